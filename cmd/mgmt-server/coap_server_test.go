@@ -2,14 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	coap_routes "github.com/chacal/thread-mgmt-server/pkg/mgmt_routes/coap"
+	"github.com/chacal/thread-mgmt-server/pkg/mocks"
+	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
+	"github.com/chacal/thread-mgmt-server/pkg/time_sync"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
+	"github.com/golang/mock/gomock"
+	"github.com/plgd-dev/go-coap/v2/message"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
 	"github.com/plgd-dev/go-coap/v2/mux"
+	"github.com/plgd-dev/go-coap/v2/udp"
+	"github.com/plgd-dev/go-coap/v2/udp/client"
+	udpMessage "github.com/plgd-dev/go-coap/v2/udp/message"
 	"github.com/plgd-dev/go-coap/v2/udp/message/pool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,13 +36,24 @@ var testState = device_registry.State{[]net.IP{ip}, 2970, "A100", -4, 1000,
 }
 
 func TestGetV1Defaults(t *testing.T) {
-	coapServerTest(t, func(t *testing.T, reg *device_registry.Registry, done chan int) {
+	coapServerTest(t, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
 		assert.JSONEq(t, `{"instance":"0000", "txPower": 0, "pollPeriod":1000, "displayType": "", "hwVersion": ""}`, getJSON(t, "/v1/defaults/ABCDE"))
 
 		_, err := reg.Create("12345")
 		assert.NoError(t, err)
 		assert.JSONEq(t, `{"instance":"0000", "txPower": 0, "pollPeriod":1000, "displayType": "", "hwVersion": ""}`, getJSON(t, "/v1/defaults/12345"))
 
+		// Devices created on their first request are sent to webhooks
+		assert.NoError(t, reg.PutWebhook(device_registry.Webhook{Id: "created", Url: "http://localhost", Events: []string{device_registry.WEBHOOK_DEVICE_CREATED}}))
+		getJSON(t, "/v1/defaults/FFFFF")
+		getJSON(t, "/v1/defaults/FFFFF")
+		queue, err := reg.GetWebhookQueue()
+		assert.NoError(t, err)
+		if assert.Len(t, queue, 1) {
+			assert.Equal(t, "FFFFF", queue[0].DeviceId)
+			assert.Equal(t, device_registry.WEBHOOK_DEVICE_CREATED, queue[0].Event)
+		}
+
 		_, err = reg.Create("AABCCEE")
 		assert.NoError(t, err)
 
@@ -44,10 +69,13 @@ func TestGetV1Defaults(t *testing.T) {
 }
 
 func TestPostV1State(t *testing.T) {
-	coapServerTest(t, func(t *testing.T, reg *device_registry.Registry, done chan int) {
+	coapServerTest(t, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
 		_, err := reg.Create("12345")
 		assert.NoError(t, err)
 
+		// Pushed state is published like a polled one
+		sender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+
 		postJSON(t, "/v1/state/12345", `{
 				"vcc": 2970,
 				"instance": "A100",
@@ -73,6 +101,224 @@ func TestPostV1State(t *testing.T) {
 	})
 }
 
+func TestBlockwiseTransfers(t *testing.T) {
+	bw := coap_utils.BlockwiseSettings{BlockSize: 16, MaxMessageSize: 128}
+
+	coapServerTestWithBlockwise(t, bw, nil, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+
+		// Block2: defaults response is larger than a single block
+		err = reg.UpdateDefaults("12345", device_registry.Defaults{"D105", 0, 500, device_registry.GOOD_DISPLAY_2_9IN_4GRAY, device_registry.MS88SF2_V1_0})
+		assert.NoError(t, err)
+		assert.JSONEq(t,
+			`{"instance":"D105", "txPower": 0, "pollPeriod":500, "displayType": "GOOD_DISPLAY_2_9IN_4GRAY", "hwVersion": "MS88SF2_V1_0"}`,
+			getJSONWithBlockwise(t, "/v1/defaults/12345", bw),
+		)
+
+		// Block1: state with many addresses doesn't fit into a single message
+		state := testState
+		state.Addresses = nil
+		for i := 0; i < 10; i++ {
+			state.Addresses = append(state.Addresses, net.ParseIP("fd11:22::"+strconv.Itoa(i+1)))
+		}
+		payload, err := json.Marshal(state)
+		require.NoError(t, err)
+		require.Greater(t, len(payload), bw.MaxMessageSize)
+
+		sender.EXPECT().PublishState(gomock.Eq(state), gomock.Any())
+		postJSONWithBlockwise(t, "/v1/state/12345", string(payload), bw)
+
+		dev, err := reg.Get("12345")
+		assert.NoError(t, err)
+		assert.Equal(t, state, *dev.State)
+		done <- 1
+	})
+}
+
+func TestPostV1State_ErrorPaths(t *testing.T) {
+	validState := `{"vcc": 2970, "instance": "A100", "addresses": ["ffff::1"], "txPower": -4, "pollPeriod": 1000,
+		"parent": {"rloc16": "0x4400", "linkQualityIn": 3, "linkQualityOut": 0, "avgRssi": -65, "latestRssi": -63}}`
+
+	coapServerTest(t, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+
+		tests := map[string]struct {
+			path       string
+			payload    string
+			code       codes.Code
+			diagnostic string
+		}{
+			"unknown device": {"/v1/state/ABCDE", validState, codes.NotFound, "device with id 'ABCDE' not found"},
+			"malformed JSON": {"/v1/state/12345", `{"vcc": 29`, codes.BadRequest, "invalid JSON: unexpected EOF"},
+			"unknown field":  {"/v1/state/12345", `{"foo": 1}`, codes.BadRequest, `invalid JSON: json: unknown field "foo"`},
+			"invalid values": {"/v1/state/12345", `{"vcc": -1, "instance": "A100", "txPower": 20,
+				"parent": {"rloc16": "0x4400", "linkQualityIn": 3, "linkQualityOut": 0, "avgRssi": -65, "latestRssi": -63}}`,
+				codes.BadRequest, "invalid state: vcc must be between 0 and 5000, txPower must be between -40 and 8"},
+			"invalid address": {"/v1/state/12345", `{"addresses": ["not-an-ip"]}`, codes.BadRequest, "invalid JSON: invalid IP address: not-an-ip"},
+			"unknown path":    {"/v1/foo/12345", validState, codes.NotFound, ""},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				code, body := postRaw(t, tc.path, tc.payload)
+				assert.Equal(t, tc.code, code)
+				assert.Equal(t, tc.diagnostic, body)
+			})
+		}
+
+		dev, err := reg.Get("12345")
+		assert.NoError(t, err)
+		assert.Nil(t, dev.State)
+
+		code, _ := getRaw(t, "/v1/state/12345")
+		assert.Equal(t, codes.MethodNotAllowed, code)
+
+		sender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+		code, _ = postRaw(t, "/v1/state/12345", validState)
+		assert.Equal(t, codes.Changed, code)
+		dev, err = reg.Get("12345")
+		assert.NoError(t, err)
+		assert.Equal(t, testState, *dev.State)
+		done <- 1
+	})
+}
+
+func TestPostV1State_Seq(t *testing.T) {
+	expectations := func(reg *device_registry.Registry, sender *mocks.MockMqttSender) {
+		sender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any()).Times(1)
+	}
+	coapServerTestWithSetup(t, expectations, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+
+		state := `{"seq": 5, "vcc": %v, "instance": "A100", "addresses": ["ffff::1"], "txPower": -4, "pollPeriod": 1000,
+			"parent": {"rloc16": "0x4400", "linkQualityIn": 3, "linkQualityOut": 0, "avgRssi": -65, "latestRssi": -63}}`
+		postJSON(t, "/v1/state/12345", fmt.Sprintf(state, 2970))
+
+		// Report with the same seq is acknowledged but ignored
+		postJSON(t, "/v1/state/12345", fmt.Sprintf(state, 2800))
+
+		dev, err := reg.Get("12345")
+		assert.NoError(t, err)
+		assert.Equal(t, testState, *dev.State)
+		done <- 1
+	})
+}
+
+func TestPostV1State_SeqZero(t *testing.T) {
+	expectations := func(reg *device_registry.Registry, sender *mocks.MockMqttSender) {
+		sender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any()).Times(1)
+	}
+	coapServerTestWithSetup(t, expectations, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+
+		state := `{"seq": 0, "vcc": %v, "instance": "A100", "addresses": ["ffff::1"], "txPower": -4, "pollPeriod": 1000,
+			"parent": {"rloc16": "0x4400", "linkQualityIn": 3, "linkQualityOut": 0, "avgRssi": -65, "latestRssi": -63}}`
+		postJSON(t, "/v1/state/12345", fmt.Sprintf(state, 2970))
+
+		// A replayed first report after a reboot is ignored like any other duplicate
+		postJSON(t, "/v1/state/12345", fmt.Sprintf(state, 2970))
+		postJSON(t, "/v1/state/12345", fmt.Sprintf(state, 2800))
+
+		dev, err := reg.Get("12345")
+		assert.NoError(t, err)
+		assert.Equal(t, testState, *dev.State)
+		history, err := reg.GetVccHistory("12345")
+		assert.NoError(t, err)
+		assert.Len(t, history, 1)
+		done <- 1
+	})
+}
+
+func TestDuplicateMessages(t *testing.T) {
+	expectations := func(reg *device_registry.Registry, sender *mocks.MockMqttSender) {
+		sender.EXPECT().PublishEvent(gomock.Any(), gomock.Any()).Times(1)
+	}
+	coapServerTestWithSetup(t, expectations, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+
+		conn, err := net.Dial("udp", TEST_COAP_URL)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		datagram := confirmablePost(t, 1234, "/v1/events/12345", `{"type": "BUTTON"}`)
+		for i := 0; i < 3; i++ {
+			_, err = conn.Write(datagram)
+			require.NoError(t, err)
+
+			resp := readResponse(t, conn)
+			assert.Equal(t, codes.Changed, resp.Code())
+			assert.Equal(t, uint16(1234), resp.MessageID())
+		}
+
+		events, err := reg.GetEvents("12345")
+		assert.NoError(t, err)
+		assert.Len(t, events, 1)
+		done <- 1
+	})
+}
+
+func TestPostV1Event(t *testing.T) {
+	expectations := func(reg *device_registry.Registry, sender *mocks.MockMqttSender) {
+		sender.EXPECT().PublishEvent(gomock.Eq("0000"), gomock.Any()).Do(func(instance string, e device_registry.Event) {
+			assert.Equal(t, device_registry.EVENT_CRASH, e.Type)
+			assert.Equal(t, "hard fault", e.Message)
+		})
+	}
+	coapServerTestWithSetup(t, expectations, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+
+		postJSON(t, "/v1/events/12345", `{"type": "CRASH", "message": "hard fault", "data": {"pc": "0x0001f2a4"}}`)
+
+		events, err := reg.GetEvents("12345")
+		assert.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, device_registry.EVENT_CRASH, events[0].Type)
+		assert.Equal(t, "hard fault", events[0].Message)
+		assert.JSONEq(t, `{"pc": "0x0001f2a4"}`, string(events[0].Data))
+		assert.WithinDuration(t, time.Now(), events[0].Timestamp, 5*time.Second)
+
+		assert.Error(t, postJSONErr("/v1/events/12345", `{"type": "UNKNOWN"}`))
+		assert.Error(t, postJSONErr("/v1/events/ABCDE", `{"type": "REBOOT"}`))
+
+		events, err = reg.GetEvents("12345")
+		assert.NoError(t, err)
+		assert.Len(t, events, 1)
+		done <- 1
+	})
+}
+
+func TestGetV1Time(t *testing.T) {
+	coapServerTest(t, func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int) {
+		var info time_sync.TimeInfo
+
+		require.NoError(t, json.Unmarshal([]byte(getJSON(t, "/v1/time")), &info))
+		assert.InDelta(t, time.Now().Unix(), info.Utc, 5)
+		assert.Equal(t, 0, info.Offset)
+		assert.Equal(t, 3600, info.SyncSec)
+
+		_, err := reg.Create("12345")
+		assert.NoError(t, err)
+		err = reg.UpdateDefaults("12345", device_registry.Defaults{PollPeriod: 5000})
+		assert.NoError(t, err)
+
+		require.NoError(t, json.Unmarshal([]byte(getJSON(t, "/v1/time/12345")), &info))
+		assert.Equal(t, 5*3600, info.SyncSec)
+
+		// Reported poll period takes precedence over the desired one
+		err = reg.UpdateState("12345", testState)
+		assert.NoError(t, err)
+		require.NoError(t, json.Unmarshal([]byte(getJSON(t, "/v1/time/12345")), &info))
+		assert.Equal(t, 3600, info.SyncSec)
+		done <- 1
+	})
+}
+
 func TestGetLastPathPart(t *testing.T) {
 	assert.Equal(t, "AABBCCDD", lastPartForPath(t, "/v1/devices/AABBCCDD"))
 	assert.Equal(t, "devices", lastPartForPath(t, "/v1/devices/"))
@@ -81,13 +327,34 @@ func TestGetLastPathPart(t *testing.T) {
 	assert.Equal(t, "v1", lastPartForPath(t, "v1"))
 }
 
-func coapServerTest(t *testing.T, testFunc func(t *testing.T, reg *device_registry.Registry, done chan int)) {
+func coapServerTest(t *testing.T, testFunc func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int)) {
+	coapServerTestWithBlockwise(t, coap_utils.DefaultBlockwiseSettings, nil, testFunc)
+}
+
+// Expectations that are refined after EXPECT() (eg. with Times or Do) must be set up in setup, which runs before
+// the server starts. gomock doesn't synchronize the refinements with the server goroutine matching the calls.
+func coapServerTestWithSetup(t *testing.T, setup func(reg *device_registry.Registry, sender *mocks.MockMqttSender),
+	testFunc func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int)) {
+	coapServerTestWithBlockwise(t, coap_utils.DefaultBlockwiseSettings, setup, testFunc)
+}
+
+func coapServerTestWithBlockwise(t *testing.T, bw coap_utils.BlockwiseSettings, setup func(reg *device_registry.Registry, sender *mocks.MockMqttSender),
+	testFunc func(t *testing.T, reg *device_registry.Registry, sender *mocks.MockMqttSender, done chan int)) {
 	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockSender := mocks.NewMockMqttSender(mockCtrl)
+	sps := state_poller_service.Create(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender)
+	defer sps.Stop()
 
-	srv, err := NewCoapServer(TEST_COAP_PORT, reg)
+	srv, err := NewCoapServer(TEST_COAP_PORT, bw, coap_routes.Deps{Reg: reg, MqttSender: mockSender, Sps: sps, Location: time.UTC,
+		Webhooks: webhooks.Create(reg, webhooks.DefaultSettings)})
 	require.NoError(t, err)
 	defer srv.Stop()
 
+	if setup != nil {
+		setup(reg, mockSender)
+	}
 	testDone := make(chan int, 2)
 
 	go func() {
@@ -96,30 +363,101 @@ func coapServerTest(t *testing.T, testFunc func(t *testing.T, reg *device_regist
 		testDone <- 1
 	}()
 
-	go testFunc(t, reg, testDone)
+	go testFunc(t, reg, mockSender, testDone)
 
 	<-testDone
 }
 
 func getJSON(t *testing.T, path string) string {
+	return getJSONWithBlockwise(t, path, coap_utils.DefaultBlockwiseSettings)
+}
+
+func getJSONWithBlockwise(t *testing.T, path string, bw coap_utils.BlockwiseSettings) string {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	res, err := coap_utils.GetJSON(ctx, TEST_COAP_URL, path)
+	res, err := coap_utils.GetJSON(ctx, TEST_COAP_URL, path, bw, coap_utils.DefaultTransmissionSettings)
 	assert.NoError(t, err)
 
 	return res
 }
 
 func postJSON(t *testing.T, path string, payload string) {
+	postJSONWithBlockwise(t, path, payload, coap_utils.DefaultBlockwiseSettings)
+}
+
+func postJSONWithBlockwise(t *testing.T, path string, payload string, bw coap_utils.BlockwiseSettings) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	res, err := coap_utils.PostJSON(ctx, TEST_COAP_URL, path, payload)
+	res, err := coap_utils.PostJSON(ctx, TEST_COAP_URL, path, payload, bw, coap_utils.DefaultTransmissionSettings)
 	assert.Equal(t, "", res)
 	assert.NoError(t, err)
 }
 
+func postJSONErr(path string, payload string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := coap_utils.PostJSON(ctx, TEST_COAP_URL, path, payload, coap_utils.DefaultBlockwiseSettings, coap_utils.DefaultTransmissionSettings)
+	return err
+}
+
+func postRaw(t *testing.T, path string, payload string) (codes.Code, string) {
+	return doRaw(t, func(ctx context.Context, conn *client.ClientConn) (*pool.Message, error) {
+		return conn.Post(ctx, path, message.AppJSON, strings.NewReader(payload))
+	})
+}
+
+func getRaw(t *testing.T, path string) (codes.Code, string) {
+	return doRaw(t, func(ctx context.Context, conn *client.ClientConn) (*pool.Message, error) {
+		return conn.Get(ctx, path)
+	})
+}
+
+func doRaw(t *testing.T, f func(ctx context.Context, conn *client.ClientConn) (*pool.Message, error)) (codes.Code, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := udp.Dial(TEST_COAP_URL, udp.WithKeepAlive(nil))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	resp, err := f(ctx, conn)
+	require.NoError(t, err)
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	return resp.Code(), string(body)
+}
+
+func confirmablePost(t *testing.T, mid uint16, path string, payload string) []byte {
+	req := pool.AcquireMessage(context.Background())
+	defer pool.ReleaseMessage(req)
+	req.SetCode(codes.POST)
+	req.SetType(udpMessage.Confirmable)
+	req.SetMessageID(mid)
+	req.SetToken([]byte{0x01, 0x02, 0x03, 0x04})
+	req.SetPath(path)
+	req.SetContentFormat(message.AppJSON)
+	req.SetBody(strings.NewReader(payload))
+
+	datagram, err := req.Marshal()
+	require.NoError(t, err)
+	return datagram
+}
+
+func readResponse(t *testing.T, conn net.Conn) *pool.Message {
+	buf := make([]byte, 1280)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	resp := pool.AcquireMessage(context.Background())
+	_, err = resp.Unmarshal(buf[:n])
+	require.NoError(t, err)
+	return resp
+}
+
 func lastPartForPath(t *testing.T, path string) string {
 	ctx := context.Background()
 	poolMsg := pool.AcquireMessage(ctx)
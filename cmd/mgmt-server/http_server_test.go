@@ -1,19 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
 	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/jobs"
 	http_routes "github.com/chacal/thread-mgmt-server/pkg/mgmt_routes/http"
 	"github.com/chacal/thread-mgmt-server/pkg/mocks"
 	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
 	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
 	T "github.com/chacal/thread-mgmt-server/pkg/test"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var ip = net.ParseIP("ffff::1")
@@ -41,7 +57,8 @@ func TestV1GetDevices(t *testing.T) {
 				"config": {
 					"mainIp": "",
 					"statePollingEnabled": false,
-					"statePollingIntervalSec": 600
+					"statePollingIntervalSec": 600,
+					"autoReconcile": false
 				}
 			}
 		}`,
@@ -66,7 +83,8 @@ func TestV1GetDevices(t *testing.T) {
 				"config": {
 					"mainIp": "",
 					"statePollingEnabled": false,
-					"statePollingIntervalSec": 600
+					"statePollingIntervalSec": 600,
+					"autoReconcile": false
 				}
 			}
 		}`,
@@ -87,11 +105,11 @@ func TestV1GetDevices(t *testing.T) {
 		`{
 			"12345": {
 				"defaults": { "instance": "D100", "txPower": -4, "pollPeriod": 5000, "displayType": "GOOD_DISPLAY_2_9IN_4GRAY", "hwVersion": "MS88SF2_V1_0" },
-				"config": { "mainIp": "", "statePollingEnabled": false, "statePollingIntervalSec": 600 }
+				"config": { "mainIp": "", "statePollingEnabled": false, "statePollingIntervalSec": 600, "autoReconcile": false }
 			},
 			"ABCDE": {
 				"defaults": { "instance": "D101", "txPower": 0, "pollPeriod": 3000, "displayType": "GOOD_DISPLAY_2_9IN", "hwVersion": "E73" },
-				"config": { "mainIp": "", "statePollingEnabled": false, "statePollingIntervalSec": 600 },
+				"config": { "mainIp": "", "statePollingEnabled": false, "statePollingIntervalSec": 600, "autoReconcile": false },
 				"state": {
 					"vcc": 2970,
 					"instance": "A100",
@@ -158,12 +176,29 @@ func TestV1PostConfig(t *testing.T) {
 		"default": {
 			"12345",
 			`{"mainIp": "ffff::1", "statePollingEnabled": false, "statePollingIntervalSec": 100}`,
-			device_registry.Config{ip, false, 100},
+			device_registry.Config{MainIp: ip, StatePollingEnabled: false, StatePollingIntervalSec: 100},
 		},
 		"replaces previous value": {
 			"12345",
 			`{"mainIp": "ffff::2", "statePollingEnabled": true, "statePollingIntervalSec": 300}`,
-			device_registry.Config{ip2, true, 300},
+			device_registry.Config{MainIp: ip2, StatePollingEnabled: true, StatePollingIntervalSec: 300},
+		},
+		"transport overrides": {
+			"12345",
+			`{"mainIp": "ffff::2", "statePollingEnabled": true, "statePollingIntervalSec": 300, "transport": {"ackTimeoutMs": 60000, "deadlineSec": 300}}`,
+			device_registry.Config{MainIp: ip2, StatePollingEnabled: true, StatePollingIntervalSec: 300,
+				Transport: &device_registry.TransportConfig{AckTimeoutMs: 60000, DeadlineSec: 300}},
+		},
+		"state mode": {
+			"12345",
+			`{"mainIp": "ffff::2", "statePollingEnabled": true, "statePollingIntervalSec": 300, "stateMode": "hybrid"}`,
+			device_registry.Config{MainIp: ip2, StatePollingEnabled: true, StatePollingIntervalSec: 300, StateMode: device_registry.STATE_MODE_HYBRID},
+		},
+		"schedule": {
+			"12345",
+			`{"mainIp": "ffff::2", "schedule": {"timezone": "Europe/Helsinki", "windows": [{"days": "mon-fri", "start": "07:00", "end": "22:00"}], "outsideWindow": "skip"}}`,
+			device_registry.Config{MainIp: ip2, Schedule: &device_registry.Schedule{Timezone: "Europe/Helsinki",
+				Windows: []device_registry.ScheduleWindow{{Days: "mon-fri", Start: "07:00", End: "22:00"}}, OutsideWindow: device_registry.OUTSIDE_WINDOW_SKIP}},
 		},
 	}
 
@@ -177,6 +212,11 @@ func TestV1PostConfig(t *testing.T) {
 			assert.Equal(t, tc.expected, device.Config)
 		})
 	}
+
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/config", `{"mainIp": "ffff::1", "transport": {"port": 70000}}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/config", `{"mainIp": "ffff::1", "transport": {"maxRetransmit": -1}}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/config", `{"mainIp": "ffff::1", "stateMode": "sometimes"}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/config", `{"mainIp": "ffff::1", "schedule": {"windows": [{"days": "*", "start": "7", "end": "22:00"}]}}`))
 }
 
 func TestV1DeleteDevice(t *testing.T) {
@@ -198,6 +238,148 @@ func TestV1DeleteDevice(t *testing.T) {
 	assert.Equal(t, false, contains)
 }
 
+func TestV1Pollers(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockSps := mocks.NewMockStatePollerService(mockCtrl)
+
+	router, reg := setupWithSps(t, mockSps)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	lastPoll := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	nextPoll := lastPoll.Add(40 * time.Minute)
+	status := device_registry.PollerStatus{IntervalSec: 600, LastPoll: &lastPoll, NextPoll: &nextPoll, Polls: 4,
+		SuccessRatio: 0.25, ConsecutiveFailures: 3, BackoffSec: 2400, LastError: "timeout"}
+	statusJson := `{"intervalSec": 600, "lastPoll": "2020-11-20T12:00:00Z", "nextPoll": "2020-11-20T12:40:00Z", "polls": 4,
+		"successRatio": 0.25, "consecutiveFailures": 3, "backoffSec": 2400, "lastError": "timeout"}`
+
+	mockSps.EXPECT().PollerStatuses().Return(map[string]device_registry.PollerStatus{"12345": status})
+	T.AssertOKJson(t, `{"12345": `+statusJson+`}`, T.RecordGet(router, "/v1/pollers"))
+
+	mockSps.EXPECT().PollerStatus(gomock.Eq("12345")).Return(status, true)
+	mockSps.EXPECT().PollerStatus(gomock.Eq("54321")).Return(device_registry.PollerStatus{}, false)
+	T.AssertOKJson(t, statusJson, T.RecordGet(router, "/v1/devices/12345/poller"))
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/devices/54321/poller"))
+
+	mockSps.EXPECT().PollNow(gomock.Eq("12345")).Return(true)
+	w := T.RecordPost(router, "/v1/devices/12345/poll_now", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	mockSps.EXPECT().PollNow(gomock.Eq("12345")).Return(false)
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/poll_now", ""))
+	T.AssertNotFound(t, T.RecordPost(router, "/v1/devices/54321/poll_now", ""))
+}
+
+func TestV1GetDeviceEvents(t *testing.T) {
+	router, reg := setup(t)
+
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/devices/12345/events"))
+
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	T.AssertOKJson(t, `[]`, T.RecordGet(router, "/v1/devices/12345/events"))
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	err = reg.AddEvent("12345", device_registry.Event{Type: device_registry.EVENT_REBOOT, Message: "power on", Timestamp: ts})
+	require.NoError(t, err)
+	err = reg.AddEvent("12345", device_registry.Event{Type: device_registry.EVENT_BUTTON, Data: []byte(`{"button":1}`), Timestamp: ts})
+	require.NoError(t, err)
+
+	T.AssertOKJson(t,
+		`[
+			{ "type": "REBOOT", "message": "power on", "ts": "2020-11-20T12:00:00Z" },
+			{ "type": "BUTTON", "data": { "button": 1 }, "ts": "2020-11-20T12:00:00Z" }
+		]`,
+		T.RecordGet(router, "/v1/devices/12345/events"),
+	)
+}
+
+func TestV1GetDeviceCommands(t *testing.T) {
+	router, reg := setup(t)
+
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/devices/12345/commands"))
+
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	T.AssertOKJson(t,
+		`[
+			{ "name": "reboot", "path": "api/cmd/reboot", "description": "Reboot the device", "destructive": false },
+			{ "name": "identify", "path": "api/cmd/identify", "description": "Blink the LED or flash the display to identify the device", "destructive": false }
+		]`,
+		T.RecordGet(router, "/v1/devices/12345/commands"),
+	)
+}
+
+func TestV1PostDeviceCommand(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	T.AssertNotFound(t, T.RecordPost(router, "/v1/devices/12345/commands/reboot", `{"address": "ffff::1"}`))
+
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+	err = reg.UpdateDefaults("12345", device_registry.Defaults{"D100", 0, 1000, "", device_registry.E73})
+	require.NoError(t, err)
+
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/commands/reboot", ""))
+	T.AssertNotFound(t, T.RecordPost(router, "/v1/devices/12345/commands/factory_reset", `{"address": "ffff::1"}`))
+
+	mockGw.EXPECT().SendCommand(gomock.Any(), gomock.Eq("api/cmd/identify"), gomock.Eq(`{"seconds":5}`), gomock.Eq(ip)).Return(`{"ok":true}`, nil)
+	w := T.RecordPost(router, "/v1/devices/12345/commands/identify", `{"address": "ffff::1", "args": {"seconds":5}}`)
+	T.AssertOK(t, w)
+	assert.Contains(t, w.Body.String(), `"success": true`)
+
+	mockGw.EXPECT().SendCommand(gomock.Any(), gomock.Eq("api/cmd/reboot"), gomock.Eq(""), gomock.Eq(ip)).Return("", errors.New("timeout"))
+	w = T.RecordPost(router, "/v1/devices/12345/commands/reboot", `{"address": "ffff::1"}`)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), `"error": "timeout"`)
+
+	history, err := reg.GetCommandHistory("12345")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "identify", history[0].Name)
+	assert.True(t, history[0].Success)
+	assert.Equal(t, `{"ok":true}`, history[0].Response)
+	assert.Equal(t, "reboot", history[1].Name)
+	assert.False(t, history[1].Success)
+	assert.Equal(t, "timeout", history[1].Error)
+
+	w = T.RecordGet(router, "/v1/devices/12345/commands/history")
+	T.AssertOK(t, w)
+	assert.Contains(t, w.Body.String(), `"name": "identify"`)
+	assert.Contains(t, w.Body.String(), `"name": "reboot"`)
+
+	// Destructive commands are sent only when confirmed
+	err = reg.UpdateDefaults("12345", device_registry.Defaults{"D100", 0, 1000, "", device_registry.MS88SF2_V1_0})
+	require.NoError(t, err)
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/commands/factory_reset", `{"address": "ffff::1"}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/commands/factory_reset", `{"address": "ffff::1", "confirm": false}`))
+
+	history, err = reg.GetCommandHistory("12345")
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	mockGw.EXPECT().SendCommand(gomock.Any(), gomock.Eq("api/cmd/factory_reset"), gomock.Eq(""), gomock.Eq(ip)).Return("", nil)
+	T.AssertOK(t, T.RecordPost(router, "/v1/devices/12345/commands/factory_reset", `{"address": "ffff::1", "confirm": true}`))
+
+	// Without an address the command is sent to the addresses known for the device
+	w = T.RecordPost(router, "/v1/devices/12345/commands/reboot", `{}`)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), `"error": "no known addresses for device '12345'"`)
+
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip}))
+	fallbackIp := net.ParseIP("fd00::2")
+	require.NoError(t, reg.UpdateState("12345", device_registry.State{Addresses: []net.IP{fallbackIp}}))
+	mockGw.EXPECT().SendCommand(gomock.Any(), gomock.Eq("api/cmd/reboot"), gomock.Eq(""), gomock.Eq(ip)).Return("", errors.New("timeout"))
+	mockGw.EXPECT().SendCommand(gomock.Any(), gomock.Eq("api/cmd/reboot"), gomock.Eq(""), gomock.Eq(fallbackIp)).Return("", nil)
+	T.AssertOK(t, T.RecordPost(router, "/v1/devices/12345/commands/reboot", `{}`))
+}
+
 func TestV1PostDevicePush(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -210,8 +392,442 @@ func TestV1PostDevicePush(t *testing.T) {
 	_, err := reg.Create("12345")
 	require.NoError(t, err)
 
-	mockGw.EXPECT().PushDefaults(gomock.Eq(device_registry.DefaultDevice.Defaults), gomock.Eq(net.ParseIP("ffff::1")))
-	T.AssertOK(t, T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1"}`))
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Eq(device_registry.DefaultDevice.Defaults), gomock.Eq(net.ParseIP("ffff::1")))
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1"}`))
+	assert.Equal(t, jobs.SUCCEEDED, job.Status)
+	assert.Equal(t, http_routes.JOB_PUSH, job.Type)
+	assert.Equal(t, "12345", job.DeviceId)
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any()).Return(errors.New("device unreachable"))
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1"}`))
+	assert.Equal(t, jobs.FAILED, job.Status)
+	assert.Equal(t, "device unreachable", job.Error)
+}
+
+func TestV1PostDevicePushWithVerify(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+	require.NoError(t, reg.UpdateDefaults("12345", device_registry.Defaults{Instance: "A100", TxPower: -4, PollPeriod: 1000}))
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Any()).Return(testState, nil)
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1", "verify": true}`))
+	assert.Equal(t, jobs.SUCCEEDED, job.Status)
+	assert.Equal(t, true, job.Result.(map[string]interface{})["verified"])
+
+	stale := testState
+	stale.TxPower = 0
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Any()).Return(stale, nil).Times(2)
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1", "verify": true}`))
+	assert.Equal(t, jobs.FAILED, job.Status)
+	assert.Equal(t, "device state doesn't match pushed defaults: txPower", job.Error)
+
+	w := T.RecordGet(router, "/v1/devices")
+	T.AssertOK(t, w)
+	var devices map[string]device_registry.Device
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &devices))
+	require.NotNil(t, devices["12345"].Drift)
+	assert.Equal(t, []string{"txPower"}, devices["12345"].Drift.Fields)
+}
+
+func TestV1PostDevicePushScheduled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	// Within the window the push is done immediately
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip,
+		Schedule: &device_registry.Schedule{Windows: []device_registry.ScheduleWindow{{Days: "*", Start: "00:00", End: "00:00"}}}}))
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Eq(ip))
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{"scheduled": true}`))
+	assert.Equal(t, jobs.SUCCEEDED, job.Status)
+
+	// Outside the window the job stays pending until the window starts, without taking a worker
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1)
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip,
+		Schedule: &device_registry.Schedule{Windows: []device_registry.ScheduleWindow{{Days: strconv.Itoa(int(tomorrow.Weekday())), Start: "00:00", End: "00:00"}}}}))
+	var scheduled []jobs.Job
+	for i := 0; i < 3; i++ {
+		w := T.RecordPost(router, "/v1/devices/12345/push", `{"scheduled": true}`)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+		assert.Equal(t, jobs.PENDING, job.Status)
+		assert.Equal(t, time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 0, 0, 0, 0, time.UTC), job.ScheduledAt.UTC())
+		scheduled = append(scheduled, job)
+	}
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Eq(ip))
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{}`))
+	assert.Equal(t, jobs.SUCCEEDED, job.Status)
+
+	// Bulk push hands the devices outside their windows to scheduled push jobs
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/bulk/push", `{"ids": ["12345"], "scheduled": true}`))
+	require.Equal(t, jobs.SUCCEEDED, job.Status)
+	var report http_routes.BulkReport
+	buf, err := json.Marshal(job.Result)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(buf, &report))
+	assert.Equal(t, 1, report.Scheduled)
+	scheduled = append(scheduled, jobs.Job{Id: report.Results["12345"].ScheduledJob})
+
+	for _, j := range scheduled {
+		require.NoError(t, json.Unmarshal(T.RecordGet(router, "/v1/jobs/"+j.Id).Body.Bytes(), &job))
+		assert.Equal(t, jobs.PENDING, job.Status)
+		assert.Equal(t, http_routes.JOB_PUSH, job.Type)
+
+		T.AssertOK(t, T.RecordDelete(router, "/v1/jobs/"+j.Id))
+		require.NoError(t, json.Unmarshal(T.RecordGet(router, "/v1/jobs/"+j.Id).Body.Bytes(), &job))
+		assert.Equal(t, jobs.CANCELLED, job.Status)
+	}
+}
+
+func TestV1PostRefreshStateWithoutAddress(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/refresh_state", `{}`))
+	assert.Equal(t, jobs.FAILED, job.Status)
+	assert.Equal(t, "no known addresses for device '12345'", job.Error)
+
+	mainIp := net.ParseIP("fd00::1")
+	meshLocalIp := net.ParseIP("fdde:ad00:beef::1")
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: mainIp}))
+	require.NoError(t, reg.UpdateState("12345", device_registry.State{Addresses: []net.IP{net.ParseIP("fe80::1"), meshLocalIp}}))
+
+	gomock.InOrder(
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(mainIp)).Return(device_registry.State{}, errors.New("timeout")),
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(meshLocalIp)).Return(testState, nil),
+	)
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/refresh_state", `{}`))
+	assert.Equal(t, jobs.SUCCEEDED, job.Status)
+
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/devices/54321/addresses"))
+	w := T.RecordGet(router, "/v1/devices/12345/addresses")
+	T.AssertOK(t, w)
+	var reachability device_registry.Reachability
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &reachability))
+	assert.Equal(t, meshLocalIp, reachability.WorkingAddress)
+
+	// Fetched state replaced the reported addresses
+	require.Len(t, reachability.Addresses, 2)
+	assert.Equal(t, meshLocalIp, reachability.Addresses[0].Address)
+	assert.True(t, reachability.Addresses[0].Reachable)
+	assert.Equal(t, mainIp, reachability.Addresses[1].Address)
+	assert.False(t, reachability.Addresses[1].Reachable)
+	assert.Equal(t, "timeout", reachability.Addresses[1].LastError)
+}
+
+func TestV1DeviceProbe(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	T.AssertNotFound(t, T.RecordPost(router, "/v1/devices/54321/probe", `{}`))
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/devices/54321/probes"))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/devices/12345/probe", `{}`))
+
+	ip := net.ParseIP("fd00::1")
+	gomock.InOrder(
+		mockGw.EXPECT().Ping(gomock.Any(), gomock.Eq(ip)).Return(10*time.Millisecond, nil),
+		mockGw.EXPECT().ProbeGet(gomock.Any(), gomock.Eq(ip)).Return(25*time.Millisecond, nil),
+		mockGw.EXPECT().Ping(gomock.Any(), gomock.Eq(ip)).Return(time.Duration(0), errors.New("timeout")),
+	)
+
+	w := T.RecordPost(router, "/v1/devices/12345/probe", `{"address": "fd00::1"}`)
+	T.AssertOK(t, w)
+	var res probe.Result
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, res.Ping.Success)
+	assert.Equal(t, 10.0, res.Ping.RttMs)
+	assert.Equal(t, 25.0, res.Get.RttMs)
+
+	w = T.RecordPost(router, "/v1/devices/12345/probe", `{"address": "fd00::1"}`)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	res = probe.Result{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.False(t, res.Ping.Success)
+	assert.Equal(t, "timeout", res.Ping.Error)
+	assert.Nil(t, res.Get)
+
+	w = T.RecordGet(router, "/v1/devices/12345/probes")
+	T.AssertOK(t, w)
+	var report http_routes.ProbeReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Samples, 3)
+	assert.Equal(t, probe.Stats{Samples: 2, Loss: 0.5, P50Ms: 10, P90Ms: 10, P99Ms: 10}, report.Stats[device_registry.PROBE_PING])
+	assert.Equal(t, probe.Stats{Samples: 1, Loss: 0, P50Ms: 25, P90Ms: 25, P99Ms: 25}, report.Stats[device_registry.PROBE_GET])
+}
+
+func TestV1PostMulticast(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	for _, id := range []string{"12345", "54321"} {
+		_, err := reg.Create(id)
+		require.NoError(t, err)
+	}
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip}))
+
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/multicast/reboot", `{}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/multicast/refresh_state", `{"group": "fd00::1"}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/multicast/refresh_state", `{"windowSec": 600}`))
+
+	payload, err := json.Marshal(testState)
+	require.NoError(t, err)
+	mockGw.EXPECT().MulticastFetchState(gomock.Any(), gomock.Eq(device_gateway.MulticastAllNodes)).Return([]coap_utils.MulticastResponse{
+		{Source: ip, Code: codes.Content, Payload: string(payload)},
+		{Source: net.ParseIP("fd00::99"), Code: codes.NotFound},
+	}, nil)
+
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/multicast/refresh_state", `{"windowSec": 1}`))
+	require.Equal(t, jobs.SUCCEEDED, job.Status)
+	assert.Equal(t, "multicast_refresh_state", job.Type)
+	report, err := json.Marshal(job.Result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"op": "refresh_state",
+		"group": "ff03::1",
+		"responses": [
+			{"deviceId": "12345", "address": "ffff::1", "code": "Content", "success": true},
+			{"address": "fd00::99", "code": "NotFound", "success": false, "error": "got response code NotFound"}
+		],
+		"missing": ["54321"]
+	}`, string(report))
+
+	device, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Equal(t, testState, *device.State)
+	assert.Equal(t, ip, device.Reachability.WorkingAddress)
+	assert.NotNil(t, device.Drift)
+	history, err := reg.GetVccHistory("12345")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	group := net.ParseIP("ff03::fc")
+	mockGw.EXPECT().MulticastCommand(gomock.Any(), gomock.Eq("api/cmd/fetch_defaults"), gomock.Eq(""), gomock.Eq(group)).
+		Return([]coap_utils.MulticastResponse{{Source: ip, Code: codes.Changed}}, nil)
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/multicast/fetch_defaults", `{"group": "ff03::fc", "windowSec": 1}`))
+	require.Equal(t, jobs.SUCCEEDED, job.Status)
+}
+
+func TestV1PostDevicesBulk(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	devices := map[string]device_registry.Config{
+		"11111": {MainIp: net.ParseIP("fd00::1"), Tags: []string{"kitchen"}},
+		"22222": {MainIp: net.ParseIP("fd00::2"), Tags: []string{"kitchen", "sleepy"}},
+		"33333": {MainIp: net.ParseIP("fd00::3")},
+	}
+	for id, config := range devices {
+		_, err := reg.Create(id)
+		require.NoError(t, err)
+		require.NoError(t, reg.UpdateConfig(id, config))
+	}
+
+	T.AssertNotFound(t, T.RecordPost(router, "/v1/bulk/reboot", `{"all": true}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/bulk/push", `{}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/bulk/push", `{"all": true, "tag": "kitchen"}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/bulk/push", `{"ids": ["11111", "99999"]}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/bulk/push", `{"all": true, "concurrency": 100}`))
+
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(devices["11111"].MainIp)).Return(testState, nil)
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(devices["22222"].MainIp)).Return(device_registry.State{}, errors.New("timeout"))
+
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/bulk/refresh_state", `{"tag": "kitchen", "concurrency": 2}`))
+	require.Equal(t, jobs.SUCCEEDED, job.Status)
+	assert.Equal(t, "bulk_refresh_state", job.Type)
+	report, err := json.Marshal(job.Result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"succeeded": 1,
+		"failed": 1,
+		"results": {
+			"11111": {"success": true},
+			"22222": {"success": false, "error": "timeout"}
+		}
+	}`, string(report))
+	refreshed, err := reg.Get("11111")
+	require.NoError(t, err)
+	assert.NotNil(t, refreshed.Drift)
+	history, err := reg.GetVccHistory("11111")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(3)
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/bulk/push", `{"all": true}`))
+	require.Equal(t, jobs.SUCCEEDED, job.Status)
+	assert.Equal(t, 3, len(job.Result.(map[string]interface{})["results"].(map[string]interface{})))
+
+	defaults := device_registry.DefaultDefaults
+	defaults.HwVersion = device_registry.E73
+	require.NoError(t, reg.UpdateDefaults("33333", defaults))
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Eq(defaults), gomock.Eq(devices["33333"].MainIp)).Return(nil)
+	job = waitForJob(t, router, T.RecordPost(router, "/v1/bulk/push", `{"hwVersion": "E73"}`))
+	require.Equal(t, jobs.SUCCEEDED, job.Status)
+}
+
+func TestV1GetDrift(t *testing.T) {
+	router, reg := setup(t)
+	T.AssertOKJson(t, `{}`, T.RecordGet(router, "/v1/drift"))
+
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+	_, err = reg.Create("54321")
+	require.NoError(t, err)
+	require.NoError(t, reg.UpdateState("12345", testState))
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, AutoReconcile: true}))
+	require.NoError(t, reg.SetDrift("12345", &device_registry.ConfigDrift{
+		Fields:     []string{"instance", "txPower"},
+		DetectedAt: time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC),
+	}))
+
+	T.AssertOKJson(t,
+		`{
+			"12345": {
+				"fields": ["instance", "txPower"],
+				"ts": "2020-11-20T12:00:00Z",
+				"desired": {
+					"instance": "0000",
+					"txPower": 0,
+					"pollPeriod": 1000,
+					"displayType": "",
+					"hwVersion": ""
+				},
+				"reported": {
+					"vcc": 2970,
+					"instance": "A100",
+					"addresses": ["ffff::1"],
+					"txPower": -4,
+					"pollPeriod": 1000,
+					"parent": {
+						"rloc16": "0x4400",
+						"linkQualityIn": 3,
+						"linkQualityOut": 0,
+						"avgRssi": -65,
+						"latestRssi": -63
+					}
+				},
+				"autoReconcile": true
+			}
+		}`,
+		T.RecordGet(router, "/v1/drift"),
+	)
+}
+
+func TestV1AlertRules(t *testing.T) {
+	router, reg := setup(t)
+	T.AssertOKJson(t, `[]`, T.RecordGet(router, "/v1/alert_rules"))
+
+	require.NoError(t, reg.PutWebhook(device_registry.Webhook{Id: "ops", Url: "https://example.com/hook"}))
+	rule := `{"id": "battery", "type": "low_vcc", "threshold": 2500, "hysteresis": 100, "webhooks": ["ops"]}`
+	T.AssertOKJson(t, rule, T.RecordPost(router, "/v1/alert_rules", rule))
+	offline := `{"id": "offline", "type": "offline", "threshold": 3, "hysteresis": 0, "tag": "hall"}`
+	T.AssertOKJson(t, offline, T.RecordPost(router, "/v1/alert_rules", offline))
+	T.AssertOKJson(t, `[`+rule+`,`+offline+`]`, T.RecordGet(router, "/v1/alert_rules"))
+
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/alert_rules", `{"id": "foo", "type": "bar"}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/alert_rules", `{"id": "roaming", "type": "parent_changes", "threshold": 3}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/alert_rules", `{"id": "battery", "type": "low_vcc", "webhooks": ["unknown"]}`))
+
+	T.AssertOK(t, T.RecordDelete(router, "/v1/alert_rules/offline"))
+	T.AssertNotFound(t, T.RecordDelete(router, "/v1/alert_rules/offline"))
+	T.AssertOKJson(t, `[`+rule+`]`, T.RecordGet(router, "/v1/alert_rules"))
+}
+
+func TestV1Alerts(t *testing.T) {
+	router, reg := setup(t)
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/devices/12345/alerts"))
+
+	_, _ = reg.Create("12345")
+	_, _ = reg.Create("54321")
+	T.AssertOKJson(t, `{}`, T.RecordGet(router, "/v1/alerts"))
+	T.AssertOKJson(t, `{"active": []}`, T.RecordGet(router, "/v1/devices/12345/alerts"))
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	alert := device_registry.Alert{RuleId: "battery", Type: device_registry.ALERT_LOW_VCC, Value: 2400, Since: ts, Message: "vcc 2400 mV, threshold 2500 mV"}
+	require.NoError(t, reg.UpdateAlertState("12345", device_registry.AlertState{Active: []device_registry.Alert{alert}, LastSeen: &ts, Parent: "0x0400"}))
+
+	alertJson := `{"ruleId": "battery", "type": "low_vcc", "value": 2400, "since": "2020-11-20T12:00:00Z", "message": "vcc 2400 mV, threshold 2500 mV"}`
+	T.AssertOKJson(t, `{"12345": [`+alertJson+`]}`, T.RecordGet(router, "/v1/alerts"))
+	T.AssertOKJson(t, `{"active": [`+alertJson+`], "lastSeen": "2020-11-20T12:00:00Z", "parent": "0x0400"}`,
+		T.RecordGet(router, "/v1/devices/12345/alerts"))
+}
+
+func TestV1Webhooks(t *testing.T) {
+	router, _ := setup(t)
+	T.AssertOKJson(t, `[]`, T.RecordGet(router, "/v1/webhooks"))
+
+	// Secrets are never returned
+	T.AssertOKJson(t, `{"id": "states", "url": "https://example.com/states", "events": ["state_updated"], "secret": "********"}`,
+		T.RecordPost(router, "/v1/webhooks", `{"id": "states", "url": "https://example.com/states", "events": ["state_updated"], "secret": "s3cret"}`))
+	all := `{"id": "all", "url": "https://example.com/all"}`
+	T.AssertOKJson(t, all, T.RecordPost(router, "/v1/webhooks", all))
+	T.AssertOKJson(t, `[`+all+`, {"id": "states", "url": "https://example.com/states", "events": ["state_updated"], "secret": "********"}]`,
+		T.RecordGet(router, "/v1/webhooks"))
+
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/webhooks", `{"id": "foo", "url": "example.com"}`))
+	T.AssertBadRequest(t, T.RecordPost(router, "/v1/webhooks", `{"id": "foo", "url": "https://example.com", "events": ["bar"]}`))
+
+	T.AssertOK(t, T.RecordDelete(router, "/v1/webhooks/states"))
+	T.AssertNotFound(t, T.RecordDelete(router, "/v1/webhooks/states"))
+	T.AssertOKJson(t, `[`+all+`]`, T.RecordGet(router, "/v1/webhooks"))
+}
+
+func TestV1WebhookDeliveries(t *testing.T) {
+	router, reg := setup(t)
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/webhooks/all/deliveries"))
+	require.NoError(t, reg.PutWebhook(device_registry.Webhook{Id: "all", Url: "https://example.com/all"}))
+	T.AssertOKJson(t, `{"pending": [], "attempts": []}`, T.RecordGet(router, "/v1/webhooks/all/deliveries"))
+
+	// Defaults changes and deletions are queued for the webhooks
+	_, _ = reg.Create("12345")
+	T.AssertOK(t, T.RecordPost(router, "/v1/devices/12345/defaults", `{"instance": "D101", "txPower": 0, "pollPeriod": 1000, "displayType": "", "hwVersion": ""}`))
+	T.AssertOK(t, T.RecordDelete(router, "/v1/devices/12345"))
+
+	queue, err := reg.GetWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	assert.Equal(t, device_registry.WEBHOOK_DEFAULTS_UPDATED, queue[0].Event)
+	assert.Contains(t, string(queue[0].Payload), `"instance":"D101"`)
+	assert.Equal(t, device_registry.WEBHOOK_DEVICE_DELETED, queue[1].Event)
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	delivered := queue[1]
+	delivered.Attempts = 1
+	require.NoError(t, reg.RecordWebhookAttempt(delivered, device_registry.WebhookAttempt{DeliveryId: delivered.Id, Event: delivered.Event,
+		DeviceId: "12345", Attempt: 1, Timestamp: ts, Status: device_registry.DELIVERY_DELIVERED, StatusCode: 200, DurationMs: 12}))
+
+	w := T.RecordGet(router, "/v1/webhooks/all/deliveries")
+	T.AssertOK(t, w)
+	var deliveries http_routes.WebhookDeliveries
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries.Pending, 1)
+	assert.Equal(t, device_registry.WEBHOOK_DEFAULTS_UPDATED, deliveries.Pending[0].Event)
+	assert.Equal(t, []device_registry.WebhookAttempt{{DeliveryId: delivered.Id, Event: device_registry.WEBHOOK_DEVICE_DELETED, DeviceId: "12345",
+		Attempt: 1, Timestamp: ts, Status: device_registry.DELIVERY_DELIVERED, StatusCode: 200, DurationMs: 12}}, deliveries.Attempts)
 }
 
 func TestV1PostRefreshState(t *testing.T) {
@@ -227,9 +843,14 @@ func TestV1PostRefreshState(t *testing.T) {
 	require.NoError(t, err)
 
 	state := testState
-	mockGw.EXPECT().FetchState(gomock.Eq(net.ParseIP("ffff::1"))).Return(state, nil)
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(net.ParseIP("ffff::1"))).Return(state, nil)
 
-	T.AssertOKJson(t,
+	job := waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/refresh_state", `{"address": "ffff::1"}`))
+	assert.Equal(t, jobs.SUCCEEDED, job.Status)
+
+	result, err := json.Marshal(job.Result)
+	require.NoError(t, err)
+	assert.JSONEq(t,
 		`{
 				"vcc": 2970,
 				"instance": "A100",
@@ -246,12 +867,106 @@ func TestV1PostRefreshState(t *testing.T) {
 					"latestRssi": -63
 				}
 			}`,
-		T.RecordPost(router, "/v1/devices/12345/refresh_state", `{"address": "ffff::1"}`),
+		string(result),
 	)
 
 	device, err := reg.Get("12345")
 	require.NoError(t, err)
 	assert.Equal(t, *device.State, state)
+
+	// The fetched state is processed like reported states
+	assert.NotNil(t, device.Drift)
+	history, err := reg.GetVccHistory("12345")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestV1Jobs(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	T.AssertNotFound(t, T.RecordGet(router, "/v1/jobs/abcd"))
+	T.AssertNotFound(t, T.RecordDelete(router, "/v1/jobs/abcd"))
+	T.AssertOKJson(t, `[]`, T.RecordGet(router, "/v1/jobs"))
+
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	// Push blocks until cancelled
+	started := make(chan struct{})
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, defaults device_registry.Defaults, dst net.IP) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+	w := T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var job jobs.Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+
+	w = T.RecordGet(router, "/v1/jobs?device_id=12345")
+	T.AssertOK(t, w)
+	assert.Contains(t, w.Body.String(), job.Id)
+	T.AssertOKJson(t, `[]`, T.RecordGet(router, "/v1/jobs?device_id=54321"))
+
+	<-started
+	T.AssertOK(t, T.RecordDelete(router, "/v1/jobs/"+job.Id))
+	require.Eventually(t, func() bool {
+		require.NoError(t, json.Unmarshal(T.RecordGet(router, "/v1/jobs/"+job.Id).Body.Bytes(), &job))
+		return job.IsFinished()
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, jobs.CANCELLED, job.Status)
+
+	// Finished jobs can't be cancelled
+	assert.Equal(t, http.StatusConflict, T.RecordDelete(router, "/v1/jobs/"+job.Id).Code)
+}
+
+func TestV1Stream(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	router, reg := setupWithGw(t, mockGw)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/stream", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any())
+	waitForJob(t, router, T.RecordPost(router, "/v1/devices/12345/push", `{"address": "ffff::1"}`))
+
+	// Progress updates are streamed as well, so the same status may repeat
+	var statuses []string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var job jobs.Job
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &job))
+		if len(statuses) == 0 || statuses[len(statuses)-1] != job.Status {
+			statuses = append(statuses, job.Status)
+		}
+		if job.IsFinished() {
+			break
+		}
+	}
+	assert.Equal(t, []string{jobs.PENDING, jobs.RUNNING, jobs.SUCCEEDED}, statuses)
 }
 
 func setup(t *testing.T) (*gin.Engine, *device_registry.Registry) {
@@ -262,18 +977,50 @@ func setup(t *testing.T) (*gin.Engine, *device_registry.Registry) {
 func setupWithGw(t *testing.T, gw device_gateway.DeviceGateway) (*gin.Engine, *device_registry.Registry) {
 	reg := device_registry.CreateTestRegistry(t)
 	mqttSender := mqtt.CreateSender("", "", "")
-	sps := state_poller_service.Create(reg, mqttSender)
-	router := gin.Default()
-	http_routes.RegisterRoutes(router, reg, gw, sps)
-
-	return router, reg
+	sps := state_poller_service.Create(reg, gw, mqttSender)
+	t.Cleanup(sps.Stop)
+	return setupWithDeps(t, reg, gw, sps)
 }
 
 func setupWithSps(t *testing.T, sps state_poller_service.StatePollerService) (*gin.Engine, *device_registry.Registry) {
 	reg := device_registry.CreateTestRegistry(t)
 	gw := device_gateway.Create()
+	return setupWithDeps(t, reg, gw, sps)
+}
+
+func setupWithDeps(t *testing.T, reg *device_registry.Registry, gw device_gateway.DeviceGateway,
+	sps state_poller_service.StatePollerService) (*gin.Engine, *device_registry.Registry) {
+	jobManager := jobs.Create(2, 10)
+	t.Cleanup(jobManager.Stop)
+
 	router := gin.Default()
-	http_routes.RegisterRoutes(router, reg, gw, sps)
+	http_routes.RegisterRoutes(router, http_routes.Deps{
+		Reg:      reg,
+		Gw:       gw,
+		Sps:      sps,
+		Jobs:     jobManager,
+		Pusher:   config_push.CreateWithBackoff(reg, gw, config_push.Backoff{Attempts: 2, Initial: time.Millisecond, Max: time.Millisecond}),
+		Fallback: address_fallback.Create(reg),
+		Prober:   probe.Create(reg, gw, address_fallback.Create(reg)),
+		// Not started, so that the sent events can be checked from the queue
+		Webhooks: webhooks.Create(reg, webhooks.DefaultSettings),
+	})
 
 	return router, reg
 }
+
+// Waits for the job created by the given 202 Accepted response to finish
+func waitForJob(t *testing.T, router *gin.Engine, w *httptest.ResponseRecorder) jobs.Job {
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var job jobs.Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, "/v1/jobs/"+job.Id, w.Header().Get("Location"))
+
+	require.Eventually(t, func() bool {
+		w := T.RecordGet(router, "/v1/jobs/"+job.Id)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+		return job.IsFinished()
+	}, 2*time.Second, 10*time.Millisecond)
+	return job
+}
@@ -3,11 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/battery"
+	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
 	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/jobs"
+	coap_routes "github.com/chacal/thread-mgmt-server/pkg/mgmt_routes/coap"
+	http_routes "github.com/chacal/thread-mgmt-server/pkg/mgmt_routes/http"
 	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
 	"github.com/chacal/thread-mgmt-server/pkg/server"
+	"github.com/chacal/thread-mgmt-server/pkg/sinks"
 	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
 	"net/http"
@@ -15,15 +25,38 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata"
 )
 
 type Options struct {
-	CoapPort      int    `short:"c" long:"coap-port" description:"CoAP port to listen" default:"5683" env:"COAP_PORT"`
-	HttpPort      int    `short:"p" long:"http-port" description:"HTTP port to listen" default:"8080" env:"HTTP_PORT"`
-	DbFile        string `short:"f" long:"file" description:"Database file for device registry" default:"devices.db" env:"DB_FILE"`
-	MqttBorkerUrl string `long:"mqtt-broker" description:"MQTT broker url (eg. 'tcp://broker.domain:1883')" env:"MQTT_BROKER" required:"true"`
-	MqttUsername  string `long:"mqtt-username" description:"MQTT username" env:"MQTT_USERNAME" required:"true"`
-	MqttPassword  string `long:"mqtt-password" description:"MQTT password" env:"MQTT_PASSWORD" required:"true"`
+	CoapPort       int            `short:"c" long:"coap-port" description:"CoAP port to listen" default:"5683" env:"COAP_PORT"`
+	BlockSize      int            `long:"coap-block-size" description:"Block size for CoAP block-wise transfers (16-1024 bytes)" default:"256" env:"COAP_BLOCK_SIZE"`
+	MaxMsgSize     int            `long:"coap-max-message-size" description:"Maximum size of a single CoAP message" default:"1280" env:"COAP_MAX_MESSAGE_SIZE"`
+	DevicePort     int            `long:"device-coap-port" description:"CoAP port of the devices" default:"5683" env:"DEVICE_COAP_PORT"`
+	AckTimeout     time.Duration  `long:"coap-ack-timeout" description:"Time to wait for an ACK before retransmitting a CoAP request" default:"20s" env:"COAP_ACK_TIMEOUT"`
+	MaxRetransmit  int            `long:"coap-max-retransmit" description:"Number of times an unacknowledged CoAP request is retransmitted" default:"5" env:"COAP_MAX_RETRANSMIT"`
+	Deadline       time.Duration  `long:"coap-request-deadline" description:"Maximum total time of a request to a device" default:"30s" env:"COAP_REQUEST_DEADLINE"`
+	PoolIdle       time.Duration  `long:"coap-idle-timeout" description:"Time after which unused connections to devices are closed" default:"2m" env:"COAP_IDLE_TIMEOUT"`
+	MaxRequests    int            `long:"coap-max-requests" description:"Maximum number of concurrent requests to devices" default:"64" env:"COAP_MAX_REQUESTS"`
+	MaxDevRequests int            `long:"coap-max-device-requests" description:"Maximum number of concurrent requests to a single device" default:"1" env:"COAP_MAX_DEVICE_REQUESTS"`
+	HttpPort       int            `short:"p" long:"http-port" description:"HTTP port to listen" default:"8080" env:"HTTP_PORT"`
+	DbFile         string         `short:"f" long:"file" description:"Database file for device registry" default:"devices.db" env:"DB_FILE"`
+	MqttBorkerUrl  string         `long:"mqtt-broker" description:"MQTT broker url (eg. 'tcp://broker.domain:1883')" env:"MQTT_BROKER" required:"true"`
+	MqttUsername   string         `long:"mqtt-username" description:"MQTT username" env:"MQTT_USERNAME" required:"true"`
+	MqttPassword   string         `long:"mqtt-password" description:"MQTT password" env:"MQTT_PASSWORD" required:"true"`
+	Timezone       string         `long:"timezone" description:"Timezone served to devices (eg. 'Europe/Helsinki')" default:"UTC" env:"TIMEZONE"`
+	JobWorkers     int            `long:"job-workers" description:"Number of device operations run concurrently" default:"4" env:"JOB_WORKERS"`
+	PollWorkers    int            `long:"poll-workers" description:"Number of devices polled concurrently" default:"4" env:"POLL_WORKERS"`
+	MaxPollRate    float64        `long:"max-poll-rate" description:"Maximum number of device polls started per second (0 for no limit)" default:"10" env:"MAX_POLL_RATE"`
+	ProbeInterval  time.Duration  `long:"probe-interval" description:"Interval of probing the round trip time of polled devices (0 disables probing)" default:"0" env:"PROBE_INTERVAL"`
+	AlertInterval  time.Duration  `long:"alert-check-interval" description:"Interval of checking time based alert rules, like devices going offline (0 disables checking)" default:"1m" env:"ALERT_CHECK_INTERVAL"`
+	BatteryCutoffs map[string]int `long:"battery-cutoff" description:"Battery cutoff voltage in mV per hw version (eg. 'E73:2000'), can be given multiple times" env:"BATTERY_CUTOFFS" env-delim:","`
+	DefaultCutoff  int            `long:"default-battery-cutoff" description:"Battery cutoff voltage in mV for other hw versions" default:"2000" env:"DEFAULT_BATTERY_CUTOFF"`
+	BatteryWindow  time.Duration  `long:"battery-window" description:"Time window of vcc history used for estimating battery life" default:"336h" env:"BATTERY_WINDOW"`
+	WebhookTries   int            `long:"webhook-max-attempts" description:"Number of attempts to deliver an event to a webhook before giving up" default:"10" env:"WEBHOOK_MAX_ATTEMPTS"`
+	WebhookBackoff time.Duration  `long:"webhook-backoff" description:"Delay before retrying a failed webhook delivery, doubled on each retry" default:"10s" env:"WEBHOOK_BACKOFF"`
+	WebhookMaxWait time.Duration  `long:"webhook-max-backoff" description:"Maximum delay between webhook delivery attempts" default:"1h" env:"WEBHOOK_MAX_BACKOFF"`
+	SinksConfig    string         `long:"sinks-config" description:"JSON file listing the destinations of device states (default: MQTT and webhooks)" env:"SINKS_CONFIG"`
 }
 
 func main() {
@@ -42,24 +75,111 @@ func main() {
 	}
 	defer reg.Close()
 
-	gw := device_gateway.Create()
+	loc, err := time.LoadLocation(opts.Timezone)
+	if err != nil {
+		log.Fatalf("Failed to load timezone '%v'. Error: %+v", opts.Timezone, err)
+	}
+
+	bw := coap_utils.BlockwiseSettings{BlockSize: opts.BlockSize, MaxMessageSize: opts.MaxMsgSize}
+	err = bw.Validate()
+	if err != nil {
+		log.Fatalf("Invalid CoAP block-wise settings. Error: %v", err)
+	}
+
+	transport := device_gateway.TransportSettings{
+		Port:         opts.DevicePort,
+		Transmission: coap_utils.TransmissionSettings{AckTimeout: opts.AckTimeout, MaxRetransmit: opts.MaxRetransmit},
+		Deadline:     opts.Deadline,
+	}
+	err = transport.Validate()
+	if err != nil {
+		log.Fatalf("Invalid CoAP transport settings. Error: %v", err)
+	}
+
+	poolSettings := coap_utils.PoolSettings{
+		IdleTimeout:               opts.PoolIdle,
+		MaxConcurrentRequests:     opts.MaxRequests,
+		MaxRequestsPerDestination: opts.MaxDevRequests,
+	}
+	err = poolSettings.Validate()
+	if err != nil {
+		log.Fatalf("Invalid CoAP connection pool settings. Error: %v", err)
+	}
+	conns := coap_utils.NewConnPool(poolSettings)
+	defer conns.Close()
+
+	gw := device_gateway.CreateWithPool(bw, transport, conns)
 	mqttSender := mqtt.CreateSender(opts.MqttBorkerUrl, opts.MqttUsername, opts.MqttPassword)
 	mqttSender.Connect()
 
-	sps := state_poller_service.Create(reg, mqttSender)
+	webhookSettings := webhooks.Settings{
+		MaxAttempts:    opts.WebhookTries,
+		InitialBackoff: opts.WebhookBackoff,
+		MaxBackoff:     opts.WebhookMaxWait,
+		Timeout:        webhooks.DefaultSettings.Timeout,
+	}
+	err = webhookSettings.Validate()
+	if err != nil {
+		log.Fatalf("Invalid webhook settings. Error: %v", err)
+	}
+	dispatcher := webhooks.Create(reg, webhookSettings)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sinkConfigs, err := loadSinkConfigs(opts)
+	if err != nil {
+		log.Fatalf("Invalid sinks config. Error: %v", err)
+	}
+	stateSinks, err := sinks.Create(sinkConfigs, mqttSender, dispatcher)
+	if err != nil {
+		log.Fatalf("Failed to create sinks. Error: %+v", err)
+	}
+	defer sinks.CloseAll(stateSinks)
+
+	spsSettings := state_poller_service.Settings{
+		Scheduler:          state_poller_service.SchedulerSettings{Workers: opts.PollWorkers, MaxRate: opts.MaxPollRate},
+		ProbeInterval:      opts.ProbeInterval,
+		AlertCheckInterval: opts.AlertInterval,
+		Battery:            batterySettings(opts),
+		Webhooks:           dispatcher,
+		Sinks:              stateSinks,
+	}
+	err = spsSettings.Scheduler.Validate()
+	if err != nil {
+		log.Fatalf("Invalid state poller settings. Error: %v", err)
+	}
+	err = spsSettings.Battery.Validate()
+	if err != nil {
+		log.Fatalf("Invalid battery estimation settings. Error: %v", err)
+	}
+	sps := state_poller_service.CreateWithSettings(reg, gw, mqttSender, spsSettings)
 	err = sps.Start()
 	if err != nil {
 		log.Fatalf("Failed create state poller service. Error: %+v", err)
 	}
 	defer sps.Stop()
 
+	jobManager := jobs.Create(opts.JobWorkers, jobs.DefaultQueueSize)
+	defer jobManager.Stop()
+
 	serverExit := make(chan int, 2)
 
 	// Start CoAP server
-	go startCoapServer(opts, reg, serverExit)
+	go startCoapServer(opts, bw, coap_routes.Deps{Reg: reg, MqttSender: mqttSender, Sps: sps, Location: loc, Webhooks: dispatcher}, serverExit)
 
 	// Start HTTP server
-	go startHttpServer(opts, reg, gw, sps, serverExit)
+	fallback := address_fallback.Create(reg)
+	httpDeps := http_routes.Deps{
+		Reg:      reg,
+		Gw:       gw,
+		Sps:      sps,
+		Jobs:     jobManager,
+		Pusher:   config_push.Create(reg, gw),
+		Fallback: fallback,
+		Prober:   probe.Create(reg, gw, fallback),
+		Webhooks: dispatcher,
+	}
+	go startHttpServer(opts, httpDeps, serverExit)
 
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
@@ -70,8 +190,8 @@ func main() {
 	log.Fatalf("%+v", err)
 }
 
-func startCoapServer(opts Options, reg *device_registry.Registry, serverExit chan int) {
-	coapServer, err := NewCoapServer(opts.CoapPort, reg)
+func startCoapServer(opts Options, bw coap_utils.BlockwiseSettings, deps coap_routes.Deps, serverExit chan int) {
+	coapServer, err := NewCoapServer(opts.CoapPort, bw, deps)
 	if err != nil {
 		log.Fatalf("failed to create CoAP server: %+v", err)
 	}
@@ -81,9 +201,8 @@ func startCoapServer(opts Options, reg *device_registry.Registry, serverExit cha
 	serverExit <- 1
 }
 
-func startHttpServer(opts Options, reg *device_registry.Registry, gw device_gateway.DeviceGateway,
-	sps state_poller_service.StatePollerService, serverExit chan int) {
-	httpServer, err := NewHttpServer(opts, reg, gw, sps)
+func startHttpServer(opts Options, deps http_routes.Deps, serverExit chan int) {
+	httpServer, err := NewHttpServer(opts, deps)
 	if err != nil {
 		log.Fatalf("failed to create HTTP server: %+v", err)
 	}
@@ -99,11 +218,31 @@ func logOptions(opts Options) {
 		value  string
 	}{
 		{"CoAP listen port", strconv.Itoa(opts.CoapPort)},
+		{"CoAP block size", strconv.Itoa(opts.BlockSize)},
+		{"CoAP max msg size", strconv.Itoa(opts.MaxMsgSize)},
+		{"Device CoAP port", strconv.Itoa(opts.DevicePort)},
+		{"CoAP ACK timeout", opts.AckTimeout.String()},
+		{"CoAP retransmits", strconv.Itoa(opts.MaxRetransmit)},
+		{"Request deadline", opts.Deadline.String()},
+		{"CoAP idle timeout", opts.PoolIdle.String()},
+		{"Max requests", strconv.Itoa(opts.MaxRequests)},
+		{"Max dev requests", strconv.Itoa(opts.MaxDevRequests)},
 		{"HTTP listen port", strconv.Itoa(opts.HttpPort)},
+		{"Job workers", strconv.Itoa(opts.JobWorkers)},
+		{"Poll workers", strconv.Itoa(opts.PollWorkers)},
+		{"Max poll rate", strconv.FormatFloat(opts.MaxPollRate, 'f', -1, 64)},
+		{"Probe interval", opts.ProbeInterval.String()},
+		{"Alert interval", opts.AlertInterval.String()},
+		{"Battery cutoffs", batterySettings(opts).String()},
+		{"Battery window", opts.BatteryWindow.String()},
+		{"Webhook attempts", strconv.Itoa(opts.WebhookTries)},
+		{"Webhook backoff", opts.WebhookBackoff.String() + " - " + opts.WebhookMaxWait.String()},
+		{"Sinks config", sinksConfig(opts)},
 		{"DB file", opts.DbFile},
 		{"MQTT broker", opts.MqttBorkerUrl},
 		{"MQTT username", opts.MqttUsername},
 		{"MQTT password", obfuscate(opts.MqttPassword)},
+		{"Timezone", opts.Timezone},
 	}
 	rowFormat := "%-20v%v\n"
 
@@ -117,6 +256,28 @@ func logOptions(opts Options) {
 	log.Info(b.String())
 }
 
+func batterySettings(opts Options) battery.Settings {
+	settings := battery.DefaultSettings
+	settings.Cutoffs = opts.BatteryCutoffs
+	settings.DefaultCutoff = opts.DefaultCutoff
+	settings.Window = opts.BatteryWindow
+	return settings
+}
+
+func loadSinkConfigs(opts Options) ([]sinks.Config, error) {
+	if opts.SinksConfig == "" {
+		return sinks.DefaultConfigs, nil
+	}
+	return sinks.LoadConfigs(opts.SinksConfig)
+}
+
+func sinksConfig(opts Options) string {
+	if opts.SinksConfig == "" {
+		return "(default)"
+	}
+	return opts.SinksConfig
+}
+
 func obfuscate(s string) string {
 	if len(s) > 4 {
 		return s[:2] + strings.Repeat("*", len(s)-2)
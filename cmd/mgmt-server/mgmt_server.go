@@ -1,11 +1,9 @@
 package main
 
 import (
-	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
-	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
 	coap_routes "github.com/chacal/thread-mgmt-server/pkg/mgmt_routes/coap"
 	http_routes "github.com/chacal/thread-mgmt-server/pkg/mgmt_routes/http"
-	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/plgd-dev/go-coap/v2/mux"
@@ -28,16 +26,18 @@ type MgmtCoapServer struct {
 	srv  *udp.Server
 }
 
-func NewCoapServer(coapPort int, reg *device_registry.Registry) (*MgmtCoapServer, error) {
+func NewCoapServer(coapPort int, bw coap_utils.BlockwiseSettings, deps coap_routes.Deps) (*MgmtCoapServer, error) {
 	conn, err := net.NewListenUDP("udp", ":"+strconv.Itoa(coapPort))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
 	router := mux.NewRouter()
-	coap_routes.RegisterRoutes(router, reg)
+	coap_routes.RegisterRoutes(router, deps)
 
-	srv := udp.NewServer(udp.WithMux(router), udp.WithKeepAlive(nil))
+	dedup := coap_utils.NewDedupCache(coap_utils.DefaultDedupCacheSize, coap_utils.ExchangeLifetime)
+	opts := append(bw.ServerOptions(), udp.WithHandlerFunc(dedup.Handler(router)), udp.WithKeepAlive(nil))
+	srv := udp.NewServer(opts...)
 
 	return &MgmtCoapServer{conn, srv}, nil
 }
@@ -51,10 +51,9 @@ func (s *MgmtCoapServer) Stop() {
 	s.conn.Close()
 }
 
-func NewHttpServer(opts Options, reg *device_registry.Registry, gw device_gateway.DeviceGateway,
-	sps state_poller_service.StatePollerService) (*http.Server, error) {
+func NewHttpServer(opts Options, deps http_routes.Deps) (*http.Server, error) {
 	router := gin.Default()
-	err := http_routes.RegisterRoutes(router, reg, gw, sps)
+	err := http_routes.RegisterRoutes(router, deps)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,172 @@
+package address_fallback
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	priorityGlobal = iota
+	priorityUniqueLocal
+	priorityOther
+	notRoutable
+)
+
+// An unreachable device holds the caller for every address tried, so only the most promising ones are tried
+const MaxAttempts = 3
+
+// Interface identifiers of Thread RLOC and ALOC addresses (0000:00ff:fe00:xxxx). These change whenever the
+// device changes its parent or role, so they are not worth trying.
+var locatorIid = []byte{0x00, 0x00, 0x00, 0xff, 0xfe, 0x00}
+
+type Fallback struct {
+	reg *device_registry.Registry
+	now func() time.Time
+}
+
+func Create(reg *device_registry.Registry) *Fallback {
+	return &Fallback{reg, time.Now}
+}
+
+// Do calls f with the device's addresses one at a time until one succeeds. At most MaxAttempts addresses are
+// tried and if ctx has a deadline, it is divided evenly between the attempts. The outcome of each attempt is
+// recorded in the registry and the successful address is returned.
+func (fb *Fallback) Do(ctx context.Context, deviceId string, preferred net.IP, f func(ctx context.Context, ip net.IP) error) (net.IP, error) {
+	var candidates []net.IP
+	if preferred != nil {
+		candidates = append(candidates, preferred)
+	}
+
+	deviceExists, err := fb.reg.Contains(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if deviceExists {
+		device, err := fb.reg.Get(deviceId)
+		if err != nil {
+			return nil, err
+		}
+		candidates = Candidates(device, preferred)
+		ctx = device_gateway.WithTransportConfig(ctx, device.Config.Transport)
+	}
+	if len(candidates) == 0 {
+		return nil, errors.Errorf("no known addresses for device '%v'", deviceId)
+	}
+
+	if len(candidates) > MaxAttempts {
+		candidates = candidates[:MaxAttempts]
+	}
+
+	var lastErr error
+	for i, ip := range candidates {
+		attemptCtx, cancel := attemptContext(ctx, len(candidates)-i)
+		lastErr = f(attemptCtx, ip)
+		cancel()
+		if deviceExists {
+			err = fb.reg.RecordReachability(deviceId, ip, lastErr, fb.now())
+			if err != nil {
+				log.Errorf("failed to record reachability for device %v: %+v", deviceId, err)
+			}
+		}
+		if lastErr == nil {
+			if preferred != nil && !ip.Equal(preferred) {
+				log.Infof("Device %v reachable using fallback address %v", deviceId, ip)
+			}
+			return ip, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.Debugf("Device %v not reachable using %v: %v", deviceId, ip, lastErr)
+	}
+	return nil, lastErr
+}
+
+// Gives the attempt an equal share of the time left before the deadline of ctx
+func attemptContext(ctx context.Context, attemptsLeft int) (context.Context, context.CancelFunc) {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline || attemptsLeft <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(attemptsLeft))
+}
+
+// Candidates lists the addresses to try for the device in order: the preferred address, the address
+// that worked last, the main IP and the rest of the routable addresses the device has reported, global ones first.
+func Candidates(device *device_registry.Device, preferred net.IP) []net.IP {
+	var candidates []net.IP
+	add := func(ip net.IP) {
+		if ip == nil || ip.IsUnspecified() || containsIP(candidates, ip) {
+			return
+		}
+		candidates = append(candidates, ip)
+	}
+
+	add(preferred)
+	if device.Reachability != nil {
+		add(device.Reachability.WorkingAddress)
+	}
+	add(device.Config.MainIp)
+
+	if device.State != nil {
+		var reported []net.IP
+		for _, ip := range device.State.Addresses {
+			if priority(ip) != notRoutable {
+				reported = append(reported, ip)
+			}
+		}
+		sort.SliceStable(reported, func(i, k int) bool {
+			return priority(reported[i]) < priority(reported[k])
+		})
+		for _, ip := range reported {
+			add(ip)
+		}
+	}
+
+	return candidates
+}
+
+func priority(ip net.IP) int {
+	switch {
+	case ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified():
+		return notRoutable
+	case ip.To4() == nil && isLocator(ip):
+		return notRoutable
+	case ip.IsGlobalUnicast() && !isUniqueLocal(ip):
+		return priorityGlobal
+	case isUniqueLocal(ip):
+		return priorityUniqueLocal
+	default:
+		return priorityOther
+	}
+}
+
+// fc00::/7
+func isUniqueLocal(ip net.IP) bool {
+	return ip.To4() == nil && len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+func isLocator(ip net.IP) bool {
+	iid := ip.To16()[8:14]
+	for i := range locatorIid {
+		if iid[i] != locatorIid[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
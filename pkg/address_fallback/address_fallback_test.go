@@ -0,0 +1,130 @@
+package address_fallback
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+var mainIp = net.ParseIP("fd00:1::1")
+var linkLocal = net.ParseIP("fe80::1")
+var rloc = net.ParseIP("fdde:ad00:beef:0:0:ff:fe00:4400")
+var mlEid = net.ParseIP("fdde:ad00:beef:0:1234:5678:9abc:def0")
+var global = net.ParseIP("2001:db8::1")
+
+func TestCandidates(t *testing.T) {
+	device := &device_registry.Device{
+		Config: device_registry.Config{MainIp: mainIp},
+		State:  &device_registry.State{Addresses: []net.IP{linkLocal, rloc, mlEid, mainIp, global}},
+	}
+	assert.Equal(t, []net.IP{mainIp, global, mlEid}, Candidates(device, mainIp))
+
+	device.Reachability = &device_registry.Reachability{WorkingAddress: mlEid}
+	assert.Equal(t, []net.IP{mlEid, mainIp, global}, Candidates(device, nil))
+	assert.Equal(t, []net.IP{global, mlEid, mainIp}, Candidates(device, global))
+
+	assert.Empty(t, Candidates(&device_registry.Device{}, nil))
+}
+
+func TestFallback_Do(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: mainIp}))
+	require.NoError(t, reg.UpdateState("12345", device_registry.State{Addresses: []net.IP{linkLocal, mlEid, global}}))
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	fb := Create(reg)
+	fb.now = func() time.Time { return ts }
+
+	var tried []net.IP
+	ip, err := fb.Do(context.Background(), "12345", mainIp, func(ctx context.Context, ip net.IP) error {
+		tried = append(tried, ip)
+		if ip.Equal(mlEid) {
+			return nil
+		}
+		return errors.New("timeout")
+	})
+	require.NoError(t, err)
+	assert.Equal(t, mlEid, ip)
+	assert.Equal(t, []net.IP{mainIp, global, mlEid}, tried)
+
+	dev, _ := reg.Get("12345")
+	require.NotNil(t, dev.Reachability)
+	assert.Equal(t, mlEid, dev.Reachability.WorkingAddress)
+	assert.Equal(t, []device_registry.AddressStatus{
+		{Address: mainIp, Reachable: false, LastFailure: &ts, LastError: "timeout"},
+		{Address: global, Reachable: false, LastFailure: &ts, LastError: "timeout"},
+		{Address: mlEid, Reachable: true, LastSuccess: &ts},
+	}, dev.Reachability.Addresses)
+
+	// Working address is tried first next time, unless an address is given explicitly
+	tried = nil
+	_, err = fb.Do(context.Background(), "12345", nil, func(ctx context.Context, ip net.IP) error {
+		tried = append(tried, ip)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{mlEid}, tried)
+
+	tried = nil
+	_, err = fb.Do(context.Background(), "12345", global, func(ctx context.Context, ip net.IP) error {
+		tried = append(tried, ip)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{global}, tried)
+}
+
+func TestFallback_DoLimitsAttempts(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: mainIp}))
+	require.NoError(t, reg.UpdateState("12345", device_registry.State{Addresses: []net.IP{mlEid, global, net.ParseIP("2001:db8::2")}}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	var tried []net.IP
+	var timeouts []time.Duration
+	_, err := Create(reg).Do(ctx, "12345", nil, func(ctx context.Context, ip net.IP) error {
+		tried = append(tried, ip)
+		deadline, _ := ctx.Deadline()
+		timeouts = append(timeouts, time.Until(deadline))
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.EqualError(t, err, "context deadline exceeded")
+
+	// The deadline is shared by the attempts
+	require.Len(t, tried, MaxAttempts)
+	assert.Equal(t, []net.IP{mainIp, global, net.ParseIP("2001:db8::2")}, tried)
+	for _, timeout := range timeouts {
+		assert.InDelta(t, 100*time.Millisecond, timeout, float64(30*time.Millisecond))
+	}
+}
+
+func TestFallback_DoFailsWhenAllAddressesFail(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.RecordReachability("12345", mainIp, nil, time.Now()))
+
+	fb := Create(reg)
+	_, err := fb.Do(context.Background(), "12345", mainIp, func(ctx context.Context, ip net.IP) error {
+		return errors.New("timeout")
+	})
+	assert.EqualError(t, err, "timeout")
+
+	dev, _ := reg.Get("12345")
+	assert.Nil(t, dev.Reachability.WorkingAddress)
+	assert.False(t, dev.Reachability.Addresses[0].Reachable)
+
+	_, err = fb.Do(context.Background(), "54321", nil, func(ctx context.Context, ip net.IP) error {
+		return nil
+	})
+	assert.EqualError(t, err, "no known addresses for device '54321'")
+}
@@ -0,0 +1,330 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Notifications waiting to be sent. When the queue is full new notifications are dropped, so that a slow
+// webhook can't block the processing of device states.
+const notificationQueueSize = 100
+
+// Notifier delivers alert notifications to one kind of destination
+type Notifier interface {
+	Notify(rule device_registry.AlertRule, n device_registry.AlertNotification)
+}
+
+type notification struct {
+	rule device_registry.AlertRule
+	n    device_registry.AlertNotification
+}
+
+// Engine evaluates the alert rules on each new state of a device and periodically for the rules that depend on
+// time passing, like a device going offline. Alert state is kept in the registry so that alerts survive restarts.
+type Engine struct {
+	reg           *device_registry.Registry
+	notifiers     []Notifier
+	checkInterval time.Duration
+	now           func() time.Time
+	mu            sync.Mutex
+	queue         chan notification
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+func Create(reg *device_registry.Registry, checkInterval time.Duration, notifiers ...Notifier) *Engine {
+	return &Engine{
+		reg:           reg,
+		notifiers:     notifiers,
+		checkInterval: checkInterval,
+		now:           time.Now,
+		queue:         make(chan notification, notificationQueueSize),
+	}
+}
+
+// Starts sending notifications and checking the time based rules every check interval, zero disables the checks
+func (e *Engine) Start() {
+	var ctx context.Context
+	ctx, e.cancel = context.WithCancel(context.Background())
+
+	e.wg.Add(1)
+	go e.dispatch(ctx)
+
+	if e.checkInterval <= 0 {
+		return
+	}
+	log.Infof("Checking alerts every %v", e.checkInterval)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(e.checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.CheckAll()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stops the checks and waits for the queued notifications to be sent
+func (e *Engine) Stop() {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.wg.Wait()
+}
+
+// Evaluates the rules of the device against a new state, which has already been stored in the registry
+func (e *Engine) StateReceived(deviceId string, state device_registry.State) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.evaluate(deviceId, &state); err != nil {
+		log.Errorf("failed to evaluate alert rules, deviceId: %v, error: %v", deviceId, err)
+	}
+}
+
+// Evaluates the time based rules of all devices
+func (e *Engine) CheckAll() {
+	devices, err := e.reg.GetDevices()
+	if err != nil {
+		log.Errorf("failed to get devices for checking alerts: %v", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for deviceId := range devices {
+		if err := e.evaluate(deviceId, nil); err != nil {
+			log.Errorf("failed to evaluate alert rules, deviceId: %v, error: %v", deviceId, err)
+		}
+	}
+}
+
+// Evaluates all rules that apply to the device. Without a state only the time based rules are evaluated and
+// the alerts of the other rules are kept as they are.
+func (e *Engine) evaluate(deviceId string, state *device_registry.State) error {
+	rules, err := e.reg.GetAlertRules()
+	if err != nil {
+		return err
+	}
+	device, err := e.reg.Get(deviceId)
+	if err != nil {
+		return err
+	}
+	alertState, err := e.reg.GetAlertState(deviceId)
+	if err != nil {
+		return err
+	}
+
+	now := e.now()
+	if state != nil {
+		device.State = state
+		track(&alertState, *state, now)
+	}
+	pruneParentChanges(&alertState, rules, now)
+
+	var notifications []notification
+	active := []device_registry.Alert{}
+	for _, rule := range rules {
+		if rule.Tag != "" && !device.Config.HasTag(rule.Tag) {
+			continue
+		}
+
+		existing := alertState.Alert(rule.Id)
+		value, ok := ruleValue(rule, device, alertState, state, now)
+		switch {
+		case !ok:
+			if existing != nil {
+				active = append(active, *existing)
+			}
+		case existing == nil && fires(rule, value):
+			alert := device_registry.Alert{RuleId: rule.Id, Type: rule.Type, Value: value, Since: now, Message: message(rule, value)}
+			log.Warnf("Alert %v fired for device %v: %v", rule.Id, deviceId, alert.Message)
+			active = append(active, alert)
+			notifications = append(notifications, e.notification(rule, device, deviceId, device_registry.ALERT_FIRING, value, now))
+		case existing != nil && resolves(rule, value):
+			log.Infof("Alert %v resolved for device %v", rule.Id, deviceId)
+			notifications = append(notifications, e.notification(rule, device, deviceId, device_registry.ALERT_RESOLVED, value, now))
+		case existing != nil:
+			existing.Value = value
+			existing.Message = message(rule, value)
+			active = append(active, *existing)
+		}
+	}
+	alertState.Active = active
+
+	err = e.reg.UpdateAlertState(deviceId, alertState)
+	if err != nil {
+		return err
+	}
+	for _, n := range notifications {
+		e.enqueue(n)
+	}
+	return nil
+}
+
+func (e *Engine) notification(rule device_registry.AlertRule, device *device_registry.Device, deviceId string, status string,
+	value float64, now time.Time) notification {
+	return notification{rule, device_registry.AlertNotification{
+		DeviceId:  deviceId,
+		Instance:  device.Instance(),
+		RuleId:    rule.Id,
+		Type:      rule.Type,
+		Status:    status,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Message:   message(rule, value),
+		Timestamp: now,
+	}}
+}
+
+func (e *Engine) enqueue(n notification) {
+	select {
+	case e.queue <- n:
+	default:
+		log.Errorf("alert notification queue is full, dropping %v notification of rule %v for device %v", n.n.Status, n.rule.Id, n.n.DeviceId)
+	}
+}
+
+// Sends the notifications in the order they were raised
+func (e *Engine) dispatch(ctx context.Context) {
+	defer e.wg.Done()
+	for {
+		select {
+		case n := <-e.queue:
+			e.send(n)
+		case <-ctx.Done():
+			for {
+				select {
+				case n := <-e.queue:
+					e.send(n)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *Engine) send(n notification) {
+	for _, notifier := range e.notifiers {
+		notifier.Notify(n.rule, n.n)
+	}
+}
+
+// Records when the device was last heard of and when it changed its parent
+func track(alertState *device_registry.AlertState, state device_registry.State, now time.Time) {
+	alertState.LastSeen = &now
+	if state.Parent.Rloc16 != alertState.Parent {
+		if alertState.Parent != "" {
+			alertState.ParentChanges = append(alertState.ParentChanges, now)
+		}
+		alertState.Parent = state.Parent.Rloc16
+	}
+}
+
+// Drops the parent changes that are older than the longest window of the parent change rules
+func pruneParentChanges(alertState *device_registry.AlertState, rules []device_registry.AlertRule, now time.Time) {
+	window := 0
+	for _, rule := range rules {
+		if rule.Type == device_registry.ALERT_PARENT_CHANGES && rule.WindowSec > window {
+			window = rule.WindowSec
+		}
+	}
+
+	since := now.Add(-time.Duration(window) * time.Second)
+	var changes []time.Time
+	for _, ts := range alertState.ParentChanges {
+		if ts.After(since) {
+			changes = append(changes, ts)
+		}
+	}
+	alertState.ParentChanges = changes
+}
+
+// Returns the value the rule is compared against, or false if the rule can't be evaluated now
+func ruleValue(rule device_registry.AlertRule, device *device_registry.Device, alertState device_registry.AlertState,
+	state *device_registry.State, now time.Time) (float64, bool) {
+	switch rule.Type {
+	case device_registry.ALERT_LOW_VCC:
+		if state != nil {
+			return float64(state.Vcc), true
+		}
+	case device_registry.ALERT_LOW_RSSI:
+		if state != nil {
+			return float64(state.Parent.AvgRssi), true
+		}
+	case device_registry.ALERT_LOW_LINK_QUALITY:
+		if state != nil {
+			return float64(min(state.Parent.LinkQualityIn, state.Parent.LinkQualityOut)), true
+		}
+	case device_registry.ALERT_OFFLINE:
+		// Devices are expected to report their state every polling interval when state polling is enabled
+		interval := time.Duration(device.Config.StatePollingIntervalSec) * time.Second
+		if device.Config.StatePollingEnabled && interval > 0 && alertState.LastSeen != nil {
+			return float64(now.Sub(*alertState.LastSeen) / interval), true
+		}
+	case device_registry.ALERT_LOW_BATTERY_DAYS:
+		// The estimate is updated before the rules are evaluated on a new state
+		if state != nil && device.Battery != nil {
+			return device.Battery.DaysRemaining, true
+		}
+	case device_registry.ALERT_PARENT_CHANGES:
+		since := now.Add(-time.Duration(rule.WindowSec) * time.Second)
+		changes := 0
+		for _, ts := range alertState.ParentChanges {
+			if ts.After(since) {
+				changes++
+			}
+		}
+		return float64(changes), true
+	}
+	return 0, false
+}
+
+func fires(rule device_registry.AlertRule, value float64) bool {
+	if rule.IsLowValueRule() {
+		return value < rule.Threshold
+	}
+	return value > rule.Threshold
+}
+
+func resolves(rule device_registry.AlertRule, value float64) bool {
+	if rule.IsLowValueRule() {
+		return value >= rule.Threshold+rule.Hysteresis
+	}
+	return value <= rule.Threshold-rule.Hysteresis
+}
+
+func message(rule device_registry.AlertRule, value float64) string {
+	switch rule.Type {
+	case device_registry.ALERT_LOW_VCC:
+		return fmt.Sprintf("vcc %v mV, threshold %v mV", value, rule.Threshold)
+	case device_registry.ALERT_LOW_RSSI:
+		return fmt.Sprintf("average RSSI %v dBm, threshold %v dBm", value, rule.Threshold)
+	case device_registry.ALERT_LOW_LINK_QUALITY:
+		return fmt.Sprintf("link quality %v, threshold %v", value, rule.Threshold)
+	case device_registry.ALERT_OFFLINE:
+		return fmt.Sprintf("%v polling intervals without state, threshold %v", value, rule.Threshold)
+	case device_registry.ALERT_LOW_BATTERY_DAYS:
+		return fmt.Sprintf("battery projected to last %v days, threshold %v days", value, rule.Threshold)
+	default:
+		return fmt.Sprintf("%v parent changes in %v, threshold %v", value, time.Duration(rule.WindowSec)*time.Second, rule.Threshold)
+	}
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
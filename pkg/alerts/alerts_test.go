@@ -0,0 +1,208 @@
+package alerts
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testState = device_registry.State{
+	Vcc:        2980,
+	Instance:   "A100",
+	PollPeriod: 1000,
+	Parent:     device_registry.ParentInfo{Rloc16: "0x0400", LinkQualityIn: 3, LinkQualityOut: 2, AvgRssi: -75, LatestRssi: -72},
+}
+
+var t0 = time.Date(2020, 11, 23, 12, 0, 0, 0, time.UTC)
+
+type fakeNotifier struct {
+	mu            sync.Mutex
+	notifications []device_registry.AlertNotification
+}
+
+func (f *fakeNotifier) Notify(rule device_registry.AlertRule, n device_registry.AlertNotification) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notifications = append(f.notifications, n)
+}
+
+func (f *fakeNotifier) statuses() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := []string{}
+	for _, n := range f.notifications {
+		statuses = append(statuses, n.RuleId+":"+n.Status)
+	}
+	return statuses
+}
+
+func TestEngine_lowVccWithHysteresis(t *testing.T) {
+	reg, e, notifier := createEngine(t, device_registry.AlertRule{Id: "battery", Type: device_registry.ALERT_LOW_VCC, Threshold: 2500, Hysteresis: 100})
+
+	for _, vcc := range []int{2600, 2450, 2400, 2550} {
+		receive(e, vcc)
+	}
+	alerts := activeAlerts(t, reg)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, device_registry.Alert{RuleId: "battery", Type: device_registry.ALERT_LOW_VCC, Value: 2550, Since: t0,
+		Message: "vcc 2550 mV, threshold 2500 mV"}, alerts[0])
+
+	// Resolves only when the voltage has recovered past the hysteresis
+	receive(e, 2600)
+	assert.Empty(t, activeAlerts(t, reg))
+
+	e.Stop()
+	assert.Equal(t, []string{"battery:firing", "battery:resolved"}, notifier.statuses())
+	assert.Equal(t, device_registry.AlertNotification{DeviceId: "12345", Instance: "A100", RuleId: "battery",
+		Type: device_registry.ALERT_LOW_VCC, Status: device_registry.ALERT_FIRING, Value: 2450, Threshold: 2500,
+		Message: "vcc 2450 mV, threshold 2500 mV", Timestamp: t0}, notifier.notifications[0])
+}
+
+func TestEngine_linkRules(t *testing.T) {
+	reg, e, notifier := createEngine(t,
+		device_registry.AlertRule{Id: "rssi", Type: device_registry.ALERT_LOW_RSSI, Threshold: -85, Hysteresis: 5},
+		device_registry.AlertRule{Id: "lqi", Type: device_registry.ALERT_LOW_LINK_QUALITY, Threshold: 2},
+	)
+
+	state := testState
+	state.Parent.AvgRssi = -90
+	state.Parent.LinkQualityOut = 1
+	e.StateReceived("12345", state)
+	assert.Len(t, activeAlerts(t, reg), 2)
+
+	state.Parent.AvgRssi = -82
+	state.Parent.LinkQualityOut = 2
+	e.StateReceived("12345", state)
+	alerts := activeAlerts(t, reg)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "rssi", alerts[0].RuleId)
+
+	e.Stop()
+	assert.Equal(t, []string{"lqi:firing", "rssi:firing", "lqi:resolved"}, notifier.statuses())
+}
+
+func TestEngine_offline(t *testing.T) {
+	reg, e, notifier := createEngine(t, device_registry.AlertRule{Id: "offline", Type: device_registry.ALERT_OFFLINE, Threshold: 2})
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{StatePollingEnabled: true, StatePollingIntervalSec: 60}))
+
+	receive(e, 2980)
+	e.now = func() time.Time { return t0.Add(179 * time.Second) }
+	e.CheckAll()
+	assert.Empty(t, activeAlerts(t, reg))
+
+	e.now = func() time.Time { return t0.Add(3 * time.Minute) }
+	e.CheckAll()
+	alerts := activeAlerts(t, reg)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, 3.0, alerts[0].Value)
+
+	// Alert state survives restarts
+	e.Stop()
+	e2 := Create(reg, 0, notifier)
+	e2.now = func() time.Time { return t0.Add(5 * time.Minute) }
+	e2.Start()
+	e2.CheckAll()
+	assert.Equal(t, 5.0, activeAlerts(t, reg)[0].Value)
+
+	receive(e2, 2980)
+	assert.Empty(t, activeAlerts(t, reg))
+
+	e2.Stop()
+	assert.Equal(t, []string{"offline:firing", "offline:resolved"}, notifier.statuses())
+}
+
+func TestEngine_parentChanges(t *testing.T) {
+	reg, e, notifier := createEngine(t, device_registry.AlertRule{Id: "roaming", Type: device_registry.ALERT_PARENT_CHANGES, Threshold: 1, WindowSec: 3600})
+
+	for i, parent := range []string{"0x0400", "0x0800", "0x0400"} {
+		e.now = func() time.Time { return t0.Add(time.Duration(i) * time.Minute) }
+		state := testState
+		state.Parent.Rloc16 = parent
+		e.StateReceived("12345", state)
+	}
+	alerts := activeAlerts(t, reg)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, 2.0, alerts[0].Value)
+
+	// Changes drop out of the window as time passes
+	e.now = func() time.Time { return t0.Add(2 * time.Hour) }
+	e.CheckAll()
+	assert.Empty(t, activeAlerts(t, reg))
+	state, err := reg.GetAlertState("12345")
+	require.NoError(t, err)
+	assert.Empty(t, state.ParentChanges)
+
+	e.Stop()
+	assert.Equal(t, []string{"roaming:firing", "roaming:resolved"}, notifier.statuses())
+}
+
+func TestEngine_batteryDays(t *testing.T) {
+	reg, e, notifier := createEngine(t, device_registry.AlertRule{Id: "battery", Type: device_registry.ALERT_LOW_BATTERY_DAYS, Threshold: 30, Hysteresis: 5})
+
+	// Nothing to compare against until there's an estimate
+	receive(e, 2300)
+	assert.Empty(t, activeAlerts(t, reg))
+
+	for _, days := range []float64{25, 33, 40} {
+		require.NoError(t, reg.SetBatteryEstimate("12345", &device_registry.BatteryEstimate{DaysRemaining: days}))
+		receive(e, 2300)
+		if days == 33 {
+			assert.Len(t, activeAlerts(t, reg), 1)
+		}
+	}
+	assert.Empty(t, activeAlerts(t, reg))
+
+	e.Stop()
+	assert.Equal(t, []string{"battery:firing", "battery:resolved"}, notifier.statuses())
+	assert.Equal(t, "battery projected to last 25 days, threshold 30 days", notifier.notifications[0].Message)
+}
+
+func TestEngine_ruleSelection(t *testing.T) {
+	reg, e, notifier := createEngine(t, device_registry.AlertRule{Id: "hall", Type: device_registry.ALERT_LOW_VCC, Threshold: 2500, Tag: "hall"})
+	require.NoError(t, reg.PutAlertRule(device_registry.AlertRule{Id: "battery", Type: device_registry.ALERT_LOW_VCC, Threshold: 2500}))
+
+	receive(e, 2400)
+	alerts := activeAlerts(t, reg)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "battery", alerts[0].RuleId)
+
+	// Alerts of deleted rules are dropped without notifications
+	_, err := reg.DeleteAlertRule("battery")
+	require.NoError(t, err)
+	e.CheckAll()
+	assert.Empty(t, activeAlerts(t, reg))
+
+	e.Stop()
+	assert.Equal(t, []string{"battery:firing"}, notifier.statuses())
+}
+
+func createEngine(t *testing.T, rules ...device_registry.AlertRule) (*device_registry.Registry, *Engine, *fakeNotifier) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+	for _, rule := range rules {
+		require.NoError(t, reg.PutAlertRule(rule))
+	}
+
+	notifier := &fakeNotifier{}
+	e := Create(reg, 0, notifier)
+	e.now = func() time.Time { return t0 }
+	e.Start()
+	t.Cleanup(e.Stop)
+	return reg, e, notifier
+}
+
+func receive(e *Engine, vcc int) {
+	state := testState
+	state.Vcc = vcc
+	e.StateReceived("12345", state)
+}
+
+func activeAlerts(t *testing.T, reg *device_registry.Registry) []device_registry.Alert {
+	state, err := reg.GetAlertState("12345")
+	require.NoError(t, err)
+	return state.Active
+}
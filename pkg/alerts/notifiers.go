@@ -0,0 +1,19 @@
+package alerts
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+)
+
+type mqttNotifier struct {
+	sender mqtt.MqttSender
+}
+
+// MqttNotifier publishes the notifications to the alert topic of the device
+func MqttNotifier(sender mqtt.MqttSender) Notifier {
+	return &mqttNotifier{sender}
+}
+
+func (m *mqttNotifier) Notify(rule device_registry.AlertRule, n device_registry.AlertNotification) {
+	m.sender.PublishAlert(n)
+}
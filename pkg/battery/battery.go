@@ -0,0 +1,150 @@
+package battery
+
+import (
+	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Projections are capped to this, also when the battery isn't discharging at all
+const MaxDaysRemaining = 3650
+
+type Settings struct {
+	// Cutoff voltage in mV by hw version, devices with other hw versions use DefaultCutoff
+	Cutoffs       map[string]int
+	DefaultCutoff int
+	// Only samples within the window are used for the estimate
+	Window time.Duration
+	// Samples must span at least this long before anything is estimated, so that a few noisy samples don't
+	// produce wild projections
+	MinSpan time.Duration
+}
+
+var DefaultSettings = Settings{Cutoffs: map[string]int{}, DefaultCutoff: 2000, Window: 14 * 24 * time.Hour, MinSpan: 24 * time.Hour}
+
+func (s Settings) Validate() error {
+	for hwVersion, cutoff := range s.Cutoffs {
+		if cutoff <= device_registry.MinVcc || cutoff > device_registry.MaxVcc {
+			return errors.Errorf("invalid cutoff voltage %v for %v, must be between %v and %v", cutoff, hwVersion, device_registry.MinVcc+1, device_registry.MaxVcc)
+		}
+	}
+	if s.DefaultCutoff <= device_registry.MinVcc || s.DefaultCutoff > device_registry.MaxVcc {
+		return errors.Errorf("invalid default cutoff voltage %v, must be between %v and %v", s.DefaultCutoff, device_registry.MinVcc+1, device_registry.MaxVcc)
+	}
+	if s.Window <= 0 || s.MinSpan < 0 || s.MinSpan > s.Window {
+		return errors.Errorf("invalid estimation window %v and minimum span %v", s.Window, s.MinSpan)
+	}
+	return nil
+}
+
+func (s Settings) CutoffFor(hwVersion string) int {
+	if cutoff, found := s.Cutoffs[hwVersion]; found {
+		return cutoff
+	}
+	return s.DefaultCutoff
+}
+
+// Formats the cutoffs as hwVersion:mV pairs, eg. for logging
+func (s Settings) String() string {
+	var cutoffs []string
+	for hwVersion, cutoff := range s.Cutoffs {
+		cutoffs = append(cutoffs, fmt.Sprintf("%v:%v", hwVersion, cutoff))
+	}
+	sort.Strings(cutoffs)
+	cutoffs = append(cutoffs, fmt.Sprintf("default:%v", s.DefaultCutoff))
+	return strings.Join(cutoffs, ", ")
+}
+
+// Estimator keeps the vcc history of the devices and their battery estimates up to date
+type Estimator struct {
+	reg      *device_registry.Registry
+	settings Settings
+	now      func() time.Time
+}
+
+func Create(reg *device_registry.Registry, settings Settings) *Estimator {
+	return &Estimator{reg, settings, time.Now}
+}
+
+// Records the vcc of a new state and stores the updated estimate of the device. Returns nil if there aren't yet
+// enough samples for an estimate.
+func (e *Estimator) StateReceived(deviceId string, state device_registry.State) (*device_registry.BatteryEstimate, error) {
+	device, err := e.reg.Get(deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := e.now()
+	err = e.reg.AddVccSample(deviceId, device_registry.VccSample{Timestamp: now, Vcc: state.Vcc})
+	if err != nil {
+		return nil, err
+	}
+	history, err := e.reg.GetVccHistory(deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := Estimate(history, e.settings.CutoffFor(device.Defaults.HwVersion), e.settings, now)
+	return estimate, e.reg.SetBatteryEstimate(deviceId, estimate)
+}
+
+// Estimate fits a line to the samples within the window using least squares and projects when it crosses the
+// cutoff voltage. Returns nil if the samples don't span long enough.
+func Estimate(samples []device_registry.VccSample, cutoff int, settings Settings, now time.Time) *device_registry.BatteryEstimate {
+	since := now.Add(-settings.Window)
+	var recent []device_registry.VccSample
+	for _, s := range samples {
+		if s.Timestamp.After(since) && s.Vcc > 0 {
+			recent = append(recent, s)
+		}
+	}
+	if len(recent) < 2 {
+		return nil
+	}
+
+	first, last := recent[0].Timestamp, recent[len(recent)-1].Timestamp
+	if last.Sub(first) < settings.MinSpan || !last.After(first) {
+		return nil
+	}
+
+	// x is days since the first sample
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(recent))
+	for _, s := range recent {
+		x := s.Timestamp.Sub(first).Hours() / 24
+		y := float64(s.Vcc)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	intercept := (sumY - slope*sumX) / n
+	vcc := intercept + slope*last.Sub(first).Hours()/24
+
+	days := float64(MaxDaysRemaining)
+	switch {
+	case vcc <= float64(cutoff):
+		days = 0
+	case slope < 0:
+		days = math.Min((vcc-float64(cutoff))/-slope, MaxDaysRemaining)
+	}
+
+	return &device_registry.BatteryEstimate{
+		SlopeMvPerDay: round(slope, 2),
+		Vcc:           int(math.Round(vcc)),
+		CutoffVcc:     cutoff,
+		DaysRemaining: round(days, 1),
+		Samples:       len(recent),
+		Timestamp:     now,
+	}
+}
+
+func round(f float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(f*p) / p
+}
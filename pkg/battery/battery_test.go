@@ -0,0 +1,99 @@
+package battery
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2020, 11, 23, 12, 0, 0, 0, time.UTC)
+
+func TestEstimate(t *testing.T) {
+	// 10 mV per day from 2900 mV, with some measurement noise
+	var samples []device_registry.VccSample
+	for day := 0; day <= 10; day++ {
+		noise := []int{0, 10, -10}[day%3]
+		samples = append(samples, device_registry.VccSample{Timestamp: now.AddDate(0, 0, day-10), Vcc: 2900 - 10*day + noise})
+	}
+
+	estimate := Estimate(samples, 2000, DefaultSettings, now)
+	require.NotNil(t, estimate)
+	assert.InDelta(t, -10, estimate.SlopeMvPerDay, 0.5)
+	assert.InDelta(t, 2800, estimate.Vcc, 5)
+	assert.Equal(t, 2000, estimate.CutoffVcc)
+	assert.InDelta(t, 80, estimate.DaysRemaining, 3)
+	assert.Equal(t, 11, estimate.Samples)
+	assert.Equal(t, now, estimate.Timestamp)
+
+	// Only samples within the window are used
+	settings := DefaultSettings
+	settings.Window = 5*24*time.Hour + time.Minute
+	assert.Equal(t, 6, Estimate(samples, 2000, settings, now).Samples)
+}
+
+func TestEstimate_notEnoughHistory(t *testing.T) {
+	assert.Nil(t, Estimate(nil, 2000, DefaultSettings, now))
+	assert.Nil(t, Estimate([]device_registry.VccSample{{Timestamp: now, Vcc: 2900}}, 2000, DefaultSettings, now))
+
+	samples := []device_registry.VccSample{{Timestamp: now.Add(-23 * time.Hour), Vcc: 2900}, {Timestamp: now, Vcc: 2800}}
+	assert.Nil(t, Estimate(samples, 2000, DefaultSettings, now))
+}
+
+func TestEstimate_notDischarging(t *testing.T) {
+	samples := []device_registry.VccSample{{Timestamp: now.AddDate(0, 0, -2), Vcc: 2900}, {Timestamp: now.AddDate(0, 0, -1), Vcc: 2950}, {Timestamp: now, Vcc: 2950}}
+	estimate := Estimate(samples, 2000, DefaultSettings, now)
+	require.NotNil(t, estimate)
+	assert.Equal(t, float64(MaxDaysRemaining), estimate.DaysRemaining)
+
+	// Already below the cutoff
+	samples = []device_registry.VccSample{{Timestamp: now.AddDate(0, 0, -2), Vcc: 2000}, {Timestamp: now, Vcc: 1900}}
+	assert.Equal(t, 0.0, Estimate(samples, 2000, DefaultSettings, now).DaysRemaining)
+
+	// Below the cutoff, even if recovering
+	samples = []device_registry.VccSample{{Timestamp: now.AddDate(0, 0, -2), Vcc: 1800}, {Timestamp: now, Vcc: 1900}}
+	estimate = Estimate(samples, 2000, DefaultSettings, now)
+	assert.Equal(t, 0.0, estimate.DaysRemaining)
+	assert.Equal(t, 50.0, estimate.SlopeMvPerDay)
+}
+
+func TestEstimator_StateReceived(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateDefaults("12345", device_registry.Defaults{Instance: "A100", HwVersion: device_registry.E73}))
+
+	settings := DefaultSettings
+	settings.Cutoffs = map[string]int{device_registry.E73: 2200}
+	e := Create(reg, settings)
+
+	e.now = func() time.Time { return now.AddDate(0, 0, -2) }
+	estimate, err := e.StateReceived("12345", device_registry.State{Vcc: 2800})
+	require.NoError(t, err)
+	assert.Nil(t, estimate)
+
+	e.now = func() time.Time { return now }
+	estimate, err = e.StateReceived("12345", device_registry.State{Vcc: 2780})
+	require.NoError(t, err)
+	require.NotNil(t, estimate)
+	assert.Equal(t, 2200, estimate.CutoffVcc)
+	assert.Equal(t, -10.0, estimate.SlopeMvPerDay)
+	assert.Equal(t, 58.0, estimate.DaysRemaining)
+
+	device, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Equal(t, estimate, device.Battery)
+}
+
+func TestSettings(t *testing.T) {
+	settings := Settings{Cutoffs: map[string]int{device_registry.E73: 1800}, DefaultCutoff: 2000, Window: 24 * time.Hour}
+	assert.NoError(t, settings.Validate())
+	assert.Equal(t, 1800, settings.CutoffFor(device_registry.E73))
+	assert.Equal(t, 2000, settings.CutoffFor(device_registry.MS88SF2_V1_0))
+	assert.Equal(t, "E73:1800, default:2000", settings.String())
+
+	settings.Cutoffs[device_registry.E73] = 6000
+	assert.EqualError(t, settings.Validate(), "invalid cutoff voltage 6000 for E73, must be between 1 and 5000")
+	assert.EqualError(t, Settings{DefaultCutoff: 2000, Window: time.Hour, MinSpan: 2 * time.Hour}.Validate(),
+		"invalid estimation window 1h0m0s and minimum span 2h0m0s")
+}
@@ -0,0 +1,67 @@
+package coap_utils
+
+import (
+	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/net/blockwise"
+	"github.com/plgd-dev/go-coap/v2/udp"
+	"time"
+)
+
+// 256 byte blocks keep each CoAP message within a few 802.15.4 frames
+const DefaultBlockSize = 256
+
+// IPv6 minimum MTU, which is also the MTU used by Thread
+const DefaultMaxMessageSize = 1280
+
+const BlockwiseTransferTimeout = 10 * time.Second
+
+// BlockwiseSettings configures block-wise transfers (RFC 7959). Payloads larger than BlockSize
+// are sent using Block1 (requests) or Block2 (responses) options.
+type BlockwiseSettings struct {
+	BlockSize      int
+	MaxMessageSize int
+}
+
+var DefaultBlockwiseSettings = BlockwiseSettings{DefaultBlockSize, DefaultMaxMessageSize}
+
+var blockSizes = map[int]blockwise.SZX{
+	16:   blockwise.SZX16,
+	32:   blockwise.SZX32,
+	64:   blockwise.SZX64,
+	128:  blockwise.SZX128,
+	256:  blockwise.SZX256,
+	512:  blockwise.SZX512,
+	1024: blockwise.SZX1024,
+}
+
+func (s BlockwiseSettings) Validate() error {
+	if _, ok := blockSizes[s.BlockSize]; !ok {
+		return errors.Errorf("invalid block size %v, must be a power of two between 16 and 1024", s.BlockSize)
+	}
+	if s.MaxMessageSize < s.BlockSize {
+		return errors.Errorf("max message size %v is smaller than block size %v", s.MaxMessageSize, s.BlockSize)
+	}
+	return nil
+}
+
+func (s BlockwiseSettings) ServerOptions() []udp.ServerOption {
+	return []udp.ServerOption{
+		udp.WithBlockwise(true, s.szx(), BlockwiseTransferTimeout),
+		udp.WithMaxMessageSize(s.MaxMessageSize),
+	}
+}
+
+func (s BlockwiseSettings) dialOptions() []udp.DialOption {
+	return []udp.DialOption{
+		udp.WithBlockwise(true, s.szx(), BlockwiseTransferTimeout),
+		udp.WithMaxMessageSize(s.MaxMessageSize),
+	}
+}
+
+func (s BlockwiseSettings) szx() blockwise.SZX {
+	szx, ok := blockSizes[s.BlockSize]
+	if !ok {
+		return blockSizes[DefaultBlockSize]
+	}
+	return szx
+}
@@ -13,10 +13,74 @@ import (
 	"time"
 )
 
-const RequestAckTimeout = 20 * time.Second
+const DefaultAckTimeout = 20 * time.Second
+const DefaultMaxRetransmit = 5
 
-func GetJSON(ctx context.Context, url string, path string) (string, error) {
-	resp, err := executeRequest(url, path, func() (*pool.Message, error) {
+// TransmissionSettings controls retransmission of confirmable requests (RFC 7252, 4.8). A request is
+// retransmitted MaxRetransmit times, AckTimeout apart, before giving up.
+type TransmissionSettings struct {
+	AckTimeout    time.Duration
+	MaxRetransmit int
+}
+
+var DefaultTransmissionSettings = TransmissionSettings{DefaultAckTimeout, DefaultMaxRetransmit}
+
+func (s TransmissionSettings) Validate() error {
+	if s.AckTimeout <= 0 {
+		return errors.Errorf("invalid ACK timeout %v, must be positive", s.AckTimeout)
+	}
+	if s.MaxRetransmit < 0 {
+		return errors.Errorf("invalid retransmit count %v, must not be negative", s.MaxRetransmit)
+	}
+	return nil
+}
+
+func (s TransmissionSettings) dialOptions() []udp.DialOption {
+	return []udp.DialOption{udp.WithTransmission(time.Second, s.AckTimeout, s.MaxRetransmit)}
+}
+
+// connSource provides a connection for a single request. The returned function is called with the
+// request's outcome when the connection is no longer needed.
+type connSource interface {
+	acquire(ctx context.Context, url string, bw BlockwiseSettings, ts TransmissionSettings) (*client.ClientConn, func(err error), error)
+}
+
+// Dials a new connection for each request
+type dialer struct{}
+
+func (dialer) acquire(ctx context.Context, url string, bw BlockwiseSettings, ts TransmissionSettings) (*client.ClientConn, func(err error), error) {
+	conn, err := dial(url, bw, ts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func(error) { _ = conn.Close() }, nil
+}
+
+func GetJSON(ctx context.Context, url string, path string, bw BlockwiseSettings, ts TransmissionSettings) (string, error) {
+	return getJSON(ctx, dialer{}, url, path, bw, ts)
+}
+
+func PostJSON(ctx context.Context, url string, path string, payload string, bw BlockwiseSettings, ts TransmissionSettings) (string, error) {
+	return postJSON(ctx, dialer{}, url, path, payload, bw, ts)
+}
+
+// Ping sends an empty confirmable message, which the destination answers with a reset (RFC 7252, 4.3)
+func Ping(ctx context.Context, url string, bw BlockwiseSettings, ts TransmissionSettings) error {
+	return ping(ctx, dialer{}, url, bw, ts)
+}
+
+func ping(ctx context.Context, conns connSource, url string, bw BlockwiseSettings, ts TransmissionSettings) error {
+	conn, done, err := conns.acquire(ctx, url, bw, ts)
+	if err != nil {
+		return err
+	}
+	err = conn.Ping(ctx)
+	done(err)
+	return errors.WithStack(err)
+}
+
+func getJSON(ctx context.Context, conns connSource, url string, path string, bw BlockwiseSettings, ts TransmissionSettings) (string, error) {
+	resp, err := executeRequest(ctx, conns, url, path, bw, ts, func() (*pool.Message, error) {
 		return client.NewGetRequest(ctx, path)
 	})
 	if err != nil {
@@ -35,8 +99,8 @@ func GetJSON(ctx context.Context, url string, path string) (string, error) {
 	return string(body), nil
 }
 
-func PostJSON(ctx context.Context, url string, path string, payload string) (string, error) {
-	resp, err := executeRequest(url, path, func() (*pool.Message, error) {
+func postJSON(ctx context.Context, conns connSource, url string, path string, payload string, bw BlockwiseSettings, ts TransmissionSettings) (string, error) {
+	resp, err := executeRequest(ctx, conns, url, path, bw, ts, func() (*pool.Message, error) {
 		return client.NewPostRequest(ctx, path, message.AppJSON, strings.NewReader(payload))
 	})
 	if err != nil {
@@ -65,21 +129,21 @@ func coapErrorHandler(err error) {
 	}
 }
 
-func executeRequest(url string, path string, reqCreator func() (*pool.Message, error)) (*pool.Message, error) {
-	conn, err := udp.Dial(url, udp.WithKeepAlive(nil), udp.WithTransmission(time.Second, RequestAckTimeout, 5), udp.WithErrors(coapErrorHandler))
-	if err != nil {
-		return nil, errors.Wrapf(err, "couldn't dial to url %v", url)
-	}
-
+func executeRequest(ctx context.Context, conns connSource, url string, path string, bw BlockwiseSettings, ts TransmissionSettings,
+	reqCreator func() (*pool.Message, error)) (*pool.Message, error) {
 	req, err := reqCreator()
 	if err != nil {
 		return nil, errors.Wrapf(err, "couldn't create request with path %v", path)
 	}
 	req.SetAccept(message.AppJSON)
-
 	defer pool.ReleaseMessage(req)
-	defer conn.Close()
+
+	conn, done, err := conns.acquire(ctx, url, bw, ts)
+	if err != nil {
+		return nil, err
+	}
 	resp, err := conn.Do(req)
+	done(err)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -43,9 +43,10 @@ func RespondWithInternalServerError(w mux.ResponseWriter, e error) {
 	setResponse(w, codes.InternalServerError, message.TextPlain, nil)
 }
 
+// RespondWithBadRequest includes the error message as a diagnostic payload (RFC 7252, 5.5.2)
 func RespondWithBadRequest(w mux.ResponseWriter, e error) {
 	log.Errorf("%+v", e)
-	setResponse(w, codes.BadRequest, message.TextPlain, nil)
+	setResponse(w, codes.BadRequest, message.TextPlain, []byte(e.Error()))
 }
 
 func RespondWithEmpty(w mux.ResponseWriter) {
@@ -60,6 +61,15 @@ func RespondWithNotFound(w mux.ResponseWriter) {
 	setResponse(w, codes.NotFound, message.TextPlain, nil)
 }
 
+func RespondWithNotFoundError(w mux.ResponseWriter, e error) {
+	log.Warnf("%v", e)
+	setResponse(w, codes.NotFound, message.TextPlain, []byte(e.Error()))
+}
+
+func RespondWithMethodNotAllowed(w mux.ResponseWriter) {
+	setResponse(w, codes.MethodNotAllowed, message.TextPlain, nil)
+}
+
 func GetLastPathPart(r *mux.Message) (string, error) {
 	path, err := r.Message.Options.Path()
 	if err != nil {
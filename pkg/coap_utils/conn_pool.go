@@ -0,0 +1,299 @@
+package coap_utils
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/udp"
+	"github.com/plgd-dev/go-coap/v2/udp/client"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const DefaultIdleTimeout = 2 * time.Minute
+const DefaultMaxConcurrentRequests = 64
+
+// Thread devices, especially sleepy ones, handle requests one at a time
+const DefaultMaxRequestsPerDestination = 1
+
+type PoolSettings struct {
+	IdleTimeout               time.Duration
+	MaxConcurrentRequests     int
+	MaxRequestsPerDestination int
+}
+
+var DefaultPoolSettings = PoolSettings{DefaultIdleTimeout, DefaultMaxConcurrentRequests, DefaultMaxRequestsPerDestination}
+
+type pooledConn struct {
+	conn     *client.ClientConn
+	inUse    int
+	lastUsed time.Time
+	broken   bool
+}
+
+// Request slots of a destination. The slots outlive the destination's connections, so that requests in flight
+// on a connection that has been replaced are still counted.
+type destination struct {
+	slots chan struct{}
+	refs  int // requests waiting for or holding a slot
+}
+
+// ConnPool keeps client connections open between requests to the same destination. Connections
+// that haven't been used for IdleTimeout are closed. The number of concurrent requests is limited
+// both in total and per destination.
+type ConnPool struct {
+	mu           sync.Mutex
+	settings     PoolSettings
+	conns        map[string]*pooledConn
+	destinations map[string]*destination
+	slots        chan struct{}
+	janitor      bool
+	closed       bool
+	now          func() time.Time
+}
+
+func NewConnPool(settings PoolSettings) *ConnPool {
+	return &ConnPool{
+		settings:     settings,
+		conns:        make(map[string]*pooledConn),
+		destinations: make(map[string]*destination),
+		slots:        make(chan struct{}, settings.MaxConcurrentRequests),
+		now:          time.Now,
+	}
+}
+
+func (s PoolSettings) Validate() error {
+	if s.IdleTimeout <= 0 {
+		return errors.Errorf("invalid idle timeout %v, must be positive", s.IdleTimeout)
+	}
+	if s.MaxConcurrentRequests < 1 || s.MaxRequestsPerDestination < 1 {
+		return errors.New("concurrent request limits must be at least 1")
+	}
+	return nil
+}
+
+func (p *ConnPool) GetJSON(ctx context.Context, url string, path string, bw BlockwiseSettings, ts TransmissionSettings) (string, error) {
+	return getJSON(ctx, p, url, path, bw, ts)
+}
+
+func (p *ConnPool) PostJSON(ctx context.Context, url string, path string, payload string, bw BlockwiseSettings, ts TransmissionSettings) (string, error) {
+	return postJSON(ctx, p, url, path, payload, bw, ts)
+}
+
+func (p *ConnPool) Ping(ctx context.Context, url string, bw BlockwiseSettings, ts TransmissionSettings) error {
+	return ping(ctx, p, url, bw, ts)
+}
+
+// Size returns the number of open connections
+func (p *ConnPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Close closes all connections. Requests in progress are cancelled.
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for key, pc := range p.conns {
+		_ = pc.conn.Close()
+		delete(p.conns, key)
+	}
+}
+
+// The destination slot is taken before the global one, so that requests queueing for a slow destination don't
+// hold global slots and starve requests to other destinations. Slots are per destination url, whatever
+// settings the connection is dialed with.
+func (p *ConnPool) acquire(ctx context.Context, url string, bw BlockwiseSettings, ts TransmissionSettings) (*client.ClientConn, func(err error), error) {
+	dst, err := p.destination(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case dst.slots <- struct{}{}:
+	case <-ctx.Done():
+		p.releaseDestination(url, dst)
+		return nil, nil, errors.WithStack(ctx.Err())
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		<-dst.slots
+		p.releaseDestination(url, dst)
+		return nil, nil, errors.WithStack(ctx.Err())
+	}
+
+	key := fmt.Sprintf("%v|%+v|%+v", url, bw, ts)
+	pc, err := p.get(key, url, bw, ts)
+	if err != nil {
+		<-p.slots
+		<-dst.slots
+		p.releaseDestination(url, dst)
+		return nil, nil, err
+	}
+
+	return pc.conn, func(err error) {
+		p.release(key, pc, err)
+		<-p.slots
+		<-dst.slots
+		p.releaseDestination(url, dst)
+	}, nil
+}
+
+func (p *ConnPool) destination(url string) (*destination, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errors.New("connection pool closed")
+	}
+
+	dst, found := p.destinations[url]
+	if !found {
+		dst = &destination{slots: make(chan struct{}, p.settings.MaxRequestsPerDestination)}
+		p.destinations[url] = dst
+	}
+	dst.refs++
+	return dst, nil
+}
+
+func (p *ConnPool) releaseDestination(url string, dst *destination) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dst.refs--
+	if dst.refs == 0 {
+		delete(p.destinations, url)
+	}
+}
+
+// Returns the open connection for key or dials a new one. Dialing may resolve names, so it is done without
+// holding the lock and if another request dialed the same connection meanwhile, that one is used instead.
+func (p *ConnPool) get(key string, url string, bw BlockwiseSettings, ts TransmissionSettings) (*pooledConn, error) {
+	if pc := p.getOpen(key); pc != nil {
+		return pc, nil
+	}
+
+	conn, err := dial(url, bw, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		_ = conn.Close()
+		return nil, errors.New("connection pool closed")
+	}
+
+	pc, found := p.conns[key]
+	if found && !pc.broken && !isClosed(pc.conn) {
+		_ = conn.Close()
+	} else {
+		pc = &pooledConn{conn: conn}
+		p.conns[key] = pc
+		p.startJanitor()
+	}
+
+	pc.inUse++
+	return pc, nil
+}
+
+func (p *ConnPool) getOpen(key string) *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc, found := p.conns[key]
+	if !found {
+		return nil
+	}
+	if pc.broken || isClosed(pc.conn) {
+		delete(p.conns, key)
+		return nil
+	}
+
+	pc.inUse++
+	return pc
+}
+
+// Connections that failed are not reused, as the socket may have been left in an error state by ICMP errors
+func (p *ConnPool) release(key string, pc *pooledConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.inUse--
+	pc.lastUsed = p.now()
+	if err != nil && !pc.broken {
+		pc.broken = true
+		if p.conns[key] == pc {
+			delete(p.conns, key)
+		}
+	}
+	if pc.broken && pc.inUse == 0 {
+		_ = pc.conn.Close()
+	}
+}
+
+// The janitor runs only while there are open connections, so idle pools don't keep goroutines around
+func (p *ConnPool) startJanitor() {
+	if p.janitor {
+		return
+	}
+	p.janitor = true
+
+	go func() {
+		ticker := time.NewTicker(p.settings.IdleTimeout / 2)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !p.evictIdle() {
+				return
+			}
+		}
+	}()
+}
+
+// evictIdle closes idle connections and returns false when there are no connections left
+func (p *ConnPool) evictIdle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pc := range p.conns {
+		if pc.inUse == 0 && p.now().Sub(pc.lastUsed) >= p.settings.IdleTimeout {
+			log.Debugf("Closing idle connection to %v", pc.conn.RemoteAddr())
+			_ = pc.conn.Close()
+			delete(p.conns, key)
+		}
+	}
+
+	if len(p.conns) == 0 {
+		p.janitor = false
+		return false
+	}
+	return true
+}
+
+func isClosed(conn *client.ClientConn) bool {
+	select {
+	case <-conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func dial(url string, bw BlockwiseSettings, ts TransmissionSettings) (*client.ClientConn, error) {
+	opts := append(bw.dialOptions(), ts.dialOptions()...)
+	opts = append(opts, udp.WithKeepAlive(nil), udp.WithErrors(coapErrorHandler))
+	conn, err := udp.Dial(url, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't dial to url %v", url)
+	}
+	return conn, nil
+}
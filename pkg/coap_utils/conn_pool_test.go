@@ -0,0 +1,232 @@
+package coap_utils
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/message"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	"github.com/plgd-dev/go-coap/v2/mux"
+	"github.com/plgd-dev/go-coap/v2/net"
+	"github.com/plgd-dev/go-coap/v2/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnPool_reusesConnections(t *testing.T) {
+	url, _ := startTestServer(t, 0)
+	p := NewConnPool(DefaultPoolSettings)
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"ok": true}`, res)
+	}
+	assert.Equal(t, 1, p.Size())
+
+	// Different settings need a connection of their own
+	_, err := p.GetJSON(context.Background(), url, "state", BlockwiseSettings{64, 128}, DefaultTransmissionSettings)
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.Size())
+}
+
+func TestConnPool_evictsIdleConnections(t *testing.T) {
+	url, _ := startTestServer(t, 0)
+	now := time.Now()
+	p := NewConnPool(PoolSettings{IdleTimeout: time.Minute, MaxConcurrentRequests: 4, MaxRequestsPerDestination: 1})
+	p.now = func() time.Time { return now }
+	defer p.Close()
+
+	_, err := p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	require.NoError(t, err)
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, p.evictIdle())
+	assert.Equal(t, 1, p.Size())
+
+	now = now.Add(30 * time.Second)
+	assert.False(t, p.evictIdle())
+	assert.Equal(t, 0, p.Size())
+
+	// A new connection is dialed after eviction
+	_, err = p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.Size())
+}
+
+func TestConnPool_dropsFailedConnections(t *testing.T) {
+	p := NewConnPool(DefaultPoolSettings)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := p.GetJSON(ctx, "127.0.0.1:1", "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	assert.Error(t, err)
+	assert.Equal(t, 0, p.Size())
+}
+
+func TestConnPool_limitsRequestsPerDestination(t *testing.T) {
+	url, maxActive := startTestServer(t, 20*time.Millisecond)
+	p := NewConnPool(PoolSettings{IdleTimeout: time.Minute, MaxConcurrentRequests: 10, MaxRequestsPerDestination: 2})
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(maxActive))
+}
+
+func TestConnPool_replacedConnectionKeepsDestinationLimit(t *testing.T) {
+	url, _ := startTestServer(t, 0)
+	p := NewConnPool(PoolSettings{IdleTimeout: time.Minute, MaxConcurrentRequests: 10, MaxRequestsPerDestination: 2})
+	defer p.Close()
+
+	_, release1, err := p.acquire(context.Background(), url, DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	require.NoError(t, err)
+	_, release2, err := p.acquire(context.Background(), url, DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	require.NoError(t, err)
+
+	// The failed connection is replaced, but the request still in flight on it holds a slot
+	release2(errors.New("timeout"))
+	_, release3, err := p.acquire(context.Background(), url, DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err = p.acquire(ctx, url, DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	release1(nil)
+	release3(nil)
+}
+
+func TestConnPool_settingsShareDestinationLimit(t *testing.T) {
+	url, maxActive := startTestServer(t, 20*time.Millisecond)
+	p := NewConnPool(PoolSettings{IdleTimeout: time.Minute, MaxConcurrentRequests: 10, MaxRequestsPerDestination: 1})
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		ts := DefaultTransmissionSettings
+		ts.AckTimeout += time.Duration(i) * time.Second
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, ts)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(maxActive))
+	assert.Equal(t, 4, p.Size())
+}
+
+func TestConnPool_slowDestinationDoesNotStarveOthers(t *testing.T) {
+	slowUrl, _ := startTestServer(t, 200*time.Millisecond)
+	fastUrl, _ := startTestServer(t, 0)
+	p := NewConnPool(PoolSettings{IdleTimeout: time.Minute, MaxConcurrentRequests: 2, MaxRequestsPerDestination: 1})
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = p.GetJSON(context.Background(), slowUrl, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Requests waiting for the slow destination leave the other global slot free
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := p.GetJSON(ctx, fastUrl, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	assert.NoError(t, err)
+	wg.Wait()
+}
+
+func TestConnPool_waitingRespectsContext(t *testing.T) {
+	url, _ := startTestServer(t, 200*time.Millisecond)
+	p := NewConnPool(PoolSettings{IdleTimeout: time.Minute, MaxConcurrentRequests: 1, MaxRequestsPerDestination: 1})
+	defer p.Close()
+
+	go p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := p.GetJSON(ctx, url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func BenchmarkGetJSON_dialPerRequest(b *testing.B) {
+	url, _ := startTestServer(b, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetJSON_pooled(b *testing.B) {
+	url, _ := startTestServer(b, 0)
+	p := NewConnPool(DefaultPoolSettings)
+	defer p.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := p.GetJSON(context.Background(), url, "state", DefaultBlockwiseSettings, DefaultTransmissionSettings)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Starts a CoAP server responding to GET /state after the given delay. Returns the server's url and
+// the maximum number of requests that were handled concurrently.
+func startTestServer(tb testing.TB, delay time.Duration) (string, *int32) {
+	var active, maxActive int32
+
+	r := mux.NewRouter()
+	_ = r.Handle("state", mux.HandlerFunc(func(w mux.ResponseWriter, msg *mux.Message) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(delay)
+		_ = w.SetResponse(codes.Content, message.AppJSON, strings.NewReader(`{"ok": true}`))
+	}))
+
+	conn, err := net.NewListenUDP("udp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	srv := udp.NewServer(udp.WithMux(r), udp.WithKeepAlive(nil), udp.WithBlockwise(true, blockSizes[64], BlockwiseTransferTimeout))
+	go func() {
+		_ = srv.Serve(conn)
+	}()
+	tb.Cleanup(func() {
+		srv.Stop()
+		_ = conn.Close()
+	})
+
+	return conn.LocalAddr().String(), &maxActive
+}
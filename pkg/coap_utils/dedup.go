@@ -0,0 +1,148 @@
+package coap_utils
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"github.com/plgd-dev/go-coap/v2/message"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	"github.com/plgd-dev/go-coap/v2/mux"
+	"github.com/plgd-dev/go-coap/v2/udp"
+	"github.com/plgd-dev/go-coap/v2/udp/client"
+	"github.com/plgd-dev/go-coap/v2/udp/message/pool"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// EXCHANGE_LIFETIME from RFC 7252, 4.8.2
+const ExchangeLifetime = 247 * time.Second
+
+const DefaultDedupCacheSize = 1024
+
+type recordedResponse struct {
+	done          chan struct{}
+	set           bool
+	code          codes.Code
+	contentFormat message.MediaType
+	payload       []byte
+	opts          message.Options
+	expires       time.Time
+}
+
+type dedupEntry struct {
+	key  string
+	resp *recordedResponse
+}
+
+// DedupCache remembers responses to recently handled requests so that retransmitted requests
+// (same remote address, message ID and token) get the original response instead of being handled twice.
+type DedupCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	lifetime   time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+	now        func() time.Time
+}
+
+func NewDedupCache(maxEntries int, lifetime time.Duration) *DedupCache {
+	return &DedupCache{
+		maxEntries: maxEntries,
+		lifetime:   lifetime,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Handler wraps the mux handler into a UDP level handler that has access to message IDs
+func (c *DedupCache) Handler(next mux.Handler) udp.HandlerFunc {
+	return func(w *client.ResponseWriter, r *pool.Message) {
+		key := fmt.Sprintf("%v|%v|%v", w.ClientConn().RemoteAddr(), r.MessageID(), r.Token())
+
+		resp, duplicate := c.getOrReserve(key)
+		if duplicate {
+			<-resp.done
+			log.Infof("Replaying response for duplicate message %v", key)
+			if resp.set {
+				_ = w.SetResponse(resp.code, resp.contentFormat, payloadReader(resp.payload), resp.opts...)
+			}
+			return
+		}
+
+		defer close(resp.done)
+		client.HandlerFuncToMux(mux.HandlerFunc(func(mw mux.ResponseWriter, mr *mux.Message) {
+			next.ServeCOAP(&recordingResponseWriter{mw, resp}, mr)
+		}))(w, r)
+	}
+}
+
+func (c *DedupCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *DedupCache) getOrReserve(key string) (*recordedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.evictExpired(now)
+
+	if e, ok := c.entries[key]; ok {
+		return e.Value.(*dedupEntry).resp, true
+	}
+
+	resp := &recordedResponse{done: make(chan struct{}), expires: now.Add(c.lifetime)}
+	c.entries[key] = c.order.PushBack(&dedupEntry{key, resp})
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	return resp, false
+}
+
+// Entries are kept in insertion order, so expired ones are always at the front
+func (c *DedupCache) evictExpired(now time.Time) {
+	for e := c.order.Front(); e != nil && now.After(e.Value.(*dedupEntry).resp.expires); e = c.order.Front() {
+		c.remove(e)
+	}
+}
+
+func (c *DedupCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*dedupEntry).key)
+}
+
+type recordingResponseWriter struct {
+	mux.ResponseWriter
+	resp *recordedResponse
+}
+
+func (w *recordingResponseWriter) SetResponse(code codes.Code, contentFormat message.MediaType, d io.ReadSeeker, opts ...message.Option) error {
+	var payload []byte
+	if d != nil {
+		var err error
+		payload, err = ioutil.ReadAll(d)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.resp.set = true
+	w.resp.code = code
+	w.resp.contentFormat = contentFormat
+	w.resp.payload = payload
+	w.resp.opts = append(message.Options{}, opts...)
+	return w.ResponseWriter.SetResponse(code, contentFormat, payloadReader(payload), opts...)
+}
+
+func payloadReader(payload []byte) io.ReadSeeker {
+	if payload == nil {
+		return nil
+	}
+	return bytes.NewReader(payload)
+}
@@ -0,0 +1,52 @@
+package coap_utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDedupCache_getOrReserve(t *testing.T) {
+	c := NewDedupCache(10, time.Minute)
+
+	resp, duplicate := c.getOrReserve("a")
+	assert.False(t, duplicate)
+
+	resp2, duplicate := c.getOrReserve("a")
+	assert.True(t, duplicate)
+	assert.Same(t, resp, resp2)
+
+	_, duplicate = c.getOrReserve("b")
+	assert.False(t, duplicate)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestDedupCache_evictsOldestWhenFull(t *testing.T) {
+	c := NewDedupCache(2, time.Minute)
+
+	c.getOrReserve("a")
+	c.getOrReserve("b")
+	c.getOrReserve("c")
+	assert.Equal(t, 2, c.Len())
+
+	_, duplicate := c.getOrReserve("a")
+	assert.False(t, duplicate)
+	_, duplicate = c.getOrReserve("c")
+	assert.True(t, duplicate)
+}
+
+func TestDedupCache_evictsExpired(t *testing.T) {
+	now := time.Now()
+	c := NewDedupCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.getOrReserve("a")
+	now = now.Add(30 * time.Second)
+	c.getOrReserve("b")
+
+	now = now.Add(31 * time.Second)
+	_, duplicate := c.getOrReserve("b")
+	assert.True(t, duplicate)
+	_, duplicate = c.getOrReserve("a")
+	assert.False(t, duplicate)
+}
@@ -0,0 +1,85 @@
+package coap_utils
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/message"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	coapNet "github.com/plgd-dev/go-coap/v2/net"
+	"github.com/plgd-dev/go-coap/v2/udp"
+	"github.com/plgd-dev/go-coap/v2/udp/client"
+	udpMessage "github.com/plgd-dev/go-coap/v2/udp/message"
+	"github.com/plgd-dev/go-coap/v2/udp/message/pool"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+)
+
+type MulticastResponse struct {
+	Source  net.IP
+	Code    codes.Code
+	Payload string
+}
+
+// Multicast sends a non-confirmable request to a multicast group (RFC 7252, 8.1) and collects the unicast
+// responses until ctx is done. Only the first response from each source is kept.
+func Multicast(ctx context.Context, groupUrl string, method codes.Code, path string, payload string, bw BlockwiseSettings) ([]MulticastResponse, error) {
+	var req *pool.Message
+	var err error
+	switch method {
+	case codes.GET:
+		req, err = client.NewGetRequest(ctx, path)
+	case codes.POST:
+		req, err = client.NewPostRequest(ctx, path, message.AppJSON, strings.NewReader(payload))
+	default:
+		return nil, errors.Errorf("unsupported multicast method %v", method)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't create request with path %v", path)
+	}
+	req.SetType(udpMessage.NonConfirmable)
+	req.SetMessageID(udpMessage.GetMID())
+	req.SetAccept(message.AppJSON)
+	defer pool.ReleaseMessage(req)
+
+	conn, err := coapNet.NewListenUDP("udp6", "")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	server := udp.NewServer(append(bw.ServerOptions(), udp.WithKeepAlive(nil), udp.WithErrors(coapErrorHandler))...)
+	defer server.Stop()
+	go func() {
+		_ = server.Serve(conn)
+	}()
+
+	var mu sync.Mutex
+	var responses []MulticastResponse
+	seen := make(map[string]bool)
+
+	err = server.DiscoveryRequest(req, groupUrl, func(cc *client.ClientConn, resp *pool.Message) {
+		source := cc.RemoteAddr().(*net.UDPAddr).IP
+		body, err := resp.ReadBody()
+		if err != nil {
+			log.Warnf("failed to read multicast response from %v: %v", source, err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if seen[source.String()] {
+			return
+		}
+		seen[source.String()] = true
+		responses = append(responses, MulticastResponse{source, resp.Code(), string(body)})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "multicast request to %v failed", groupUrl)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return responses, nil
+}
@@ -0,0 +1,145 @@
+package config_push
+
+import (
+	"context"
+	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// Backoff controls how many times the pushed defaults are read back from the device and how long to wait in between
+type Backoff struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+// Devices need a moment to apply new settings, so the first read back is delayed as well
+var DefaultBackoff = Backoff{Attempts: 5, Initial: 2 * time.Second, Max: 30 * time.Second}
+
+type Result struct {
+	Verified bool                   `json:"verified"`
+	Attempts int                    `json:"attempts,omitempty"`
+	State    *device_registry.State `json:"state,omitempty"`
+}
+
+type Pusher struct {
+	reg     *device_registry.Registry
+	gw      device_gateway.DeviceGateway
+	backoff Backoff
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+func Create(reg *device_registry.Registry, gw device_gateway.DeviceGateway) *Pusher {
+	return CreateWithBackoff(reg, gw, DefaultBackoff)
+}
+
+func CreateWithBackoff(reg *device_registry.Registry, gw device_gateway.DeviceGateway, backoff Backoff) *Pusher {
+	return &Pusher{reg, gw, backoff, sleep}
+}
+
+// Push sends the device's defaults to dst. With verify the state is read back until it matches the
+// defaults or the attempts run out, in which case the mismatching fields are recorded as config drift.
+func (p *Pusher) Push(ctx context.Context, id string, dst net.IP, verify bool, progress func(msg string)) (Result, error) {
+	device, err := p.reg.Get(id)
+	if err != nil {
+		return Result{}, err
+	}
+	ctx = device_gateway.WithTransportConfig(ctx, device.Config.Transport)
+
+	progress(fmt.Sprintf("pushing defaults to %v", dst))
+	err = p.gw.PushDefaults(ctx, device.Defaults, dst)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if !verify {
+		return Result{}, nil
+	}
+	return p.verify(ctx, id, device.Defaults, dst, progress)
+}
+
+// Verify reads back the state from dst until it matches the device's defaults
+func (p *Pusher) Verify(ctx context.Context, id string, dst net.IP, progress func(msg string)) (Result, error) {
+	device, err := p.reg.Get(id)
+	if err != nil {
+		return Result{}, err
+	}
+	ctx = device_gateway.WithTransportConfig(ctx, device.Config.Transport)
+	return p.verify(ctx, id, device.Defaults, dst, progress)
+}
+
+func (p *Pusher) verify(ctx context.Context, id string, defaults device_registry.Defaults, dst net.IP, progress func(msg string)) (Result, error) {
+	var drift []string
+	var lastErr error
+
+	delay := p.backoff.Initial
+	for attempt := 1; attempt <= p.backoff.Attempts; attempt++ {
+		err := p.sleep(ctx, delay)
+		if err != nil {
+			return Result{}, err
+		}
+		delay = nextDelay(delay, p.backoff.Max)
+
+		progress(fmt.Sprintf("verifying defaults, attempt %v/%v", attempt, p.backoff.Attempts))
+		state, err := p.gw.FetchState(ctx, dst)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Result{}, err
+			}
+			log.Warnf("failed to read back state from device %v, attempt %v: %v", id, attempt, err)
+			lastErr = err
+			continue
+		}
+
+		err = p.reg.UpdateState(id, state)
+		if err != nil {
+			return Result{}, err
+		}
+
+		drift = defaults.DriftFrom(state)
+		if len(drift) == 0 {
+			err = p.reg.SetDrift(id, nil)
+			if err != nil {
+				return Result{}, err
+			}
+			return Result{Verified: true, Attempts: attempt, State: &state}, nil
+		}
+		log.Infof("device %v hasn't applied defaults yet, differing fields: %v", id, drift)
+	}
+
+	if drift == nil {
+		return Result{}, errors.Wrap(lastErr, "failed to read back state after push")
+	}
+
+	err := p.reg.SetDrift(id, &device_registry.ConfigDrift{Fields: drift, DetectedAt: time.Now()})
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{}, errors.Errorf("device state doesn't match pushed defaults: %v", strings.Join(drift, ", "))
+}
+
+func nextDelay(d time.Duration, max time.Duration) time.Duration {
+	d *= 2
+	if d > max {
+		return max
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,111 @@
+package config_push
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+var ip = net.ParseIP("ffff::1")
+var defaults = device_registry.Defaults{Instance: "A100", TxPower: -4, PollPeriod: 1000}
+var matchingState = device_registry.State{Addresses: []net.IP{ip}, Vcc: 2970, Instance: "A100", TxPower: -4, PollPeriod: 1000}
+var staleState = device_registry.State{Addresses: []net.IP{ip}, Vcc: 2970, Instance: "0000", TxPower: -4, PollPeriod: 1000}
+
+func TestPusher_PushWithoutVerify(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+	p, _, _ := setup(t, mockGw)
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Eq(defaults), gomock.Eq(ip))
+	res, err := p.Push(context.Background(), "12345", ip, false, noProgress)
+	require.NoError(t, err)
+	assert.False(t, res.Verified)
+}
+
+func TestPusher_PushVerifiesAfterRetries(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+	p, reg, delays := setup(t, mockGw)
+
+	require.NoError(t, reg.SetDrift("12345", &device_registry.ConfigDrift{Fields: []string{"instance"}}))
+
+	gomock.InOrder(
+		mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Eq(defaults), gomock.Eq(ip)),
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(staleState, nil),
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(device_registry.State{}, errors.New("timeout")),
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(matchingState, nil),
+	)
+
+	res, err := p.Push(context.Background(), "12345", ip, true, noProgress)
+	require.NoError(t, err)
+	assert.True(t, res.Verified)
+	assert.Equal(t, 3, res.Attempts)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, *delays)
+
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Nil(t, dev.Drift)
+	assert.Equal(t, matchingState, *dev.State)
+}
+
+func TestPusher_PushRecordsDrift(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+	p, reg, _ := setup(t, mockGw)
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any())
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Any()).Return(staleState, nil).Times(4)
+
+	_, err := p.Push(context.Background(), "12345", ip, true, noProgress)
+	assert.EqualError(t, err, "device state doesn't match pushed defaults: instance")
+
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	require.NotNil(t, dev.Drift)
+	assert.Equal(t, []string{"instance"}, dev.Drift.Fields)
+}
+
+func TestPusher_PushFailsWhenDeviceUnreachable(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+	p, reg, _ := setup(t, mockGw)
+
+	mockGw.EXPECT().PushDefaults(gomock.Any(), gomock.Any(), gomock.Any())
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Any()).Return(device_registry.State{}, errors.New("timeout")).Times(4)
+
+	_, err := p.Push(context.Background(), "12345", ip, true, noProgress)
+	assert.EqualError(t, err, "failed to read back state after push: timeout")
+
+	// Unreachable device doesn't tell anything about drift
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Nil(t, dev.Drift)
+}
+
+func setup(t *testing.T, gw *mocks.MockDeviceGateway) (*Pusher, *device_registry.Registry, *[]time.Duration) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, err := reg.Create("12345")
+	require.NoError(t, err)
+	require.NoError(t, reg.UpdateDefaults("12345", defaults))
+
+	var delays []time.Duration
+	p := CreateWithBackoff(reg, gw, Backoff{Attempts: 4, Initial: time.Second, Max: 3 * time.Second})
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	return p, reg, &delays
+}
+
+func noProgress(string) {}
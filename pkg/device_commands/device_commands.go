@@ -0,0 +1,51 @@
+package device_commands
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+)
+
+const (
+	REBOOT          = "reboot"
+	IDENTIFY        = "identify"
+	REFRESH_DISPLAY = "refresh_display"
+	FACTORY_RESET   = "factory_reset"
+	CLEAR_PARENT    = "clear_parent"
+)
+
+type Command struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+	Destructive bool   `json:"destructive"`
+}
+
+var reboot = Command{REBOOT, "api/cmd/reboot", "Reboot the device", false}
+var identify = Command{IDENTIFY, "api/cmd/identify", "Blink the LED or flash the display to identify the device", false}
+var refreshDisplay = Command{REFRESH_DISPLAY, "api/cmd/refresh_display", "Redraw the display contents", false}
+var factoryReset = Command{FACTORY_RESET, "api/cmd/factory_reset", "Erase settings and Thread credentials", true}
+var clearParent = Command{CLEAR_PARENT, "api/cmd/clear_parent", "Detach from the current parent and search for a new one", false}
+
+// Commands supported by devices whose hardware version is unknown
+var defaultCatalogue = []Command{reboot, identify}
+
+var catalogues = map[string][]Command{
+	device_registry.E73:          {reboot, identify, refreshDisplay, clearParent},
+	device_registry.MS88SF2_V1_0: {reboot, identify, refreshDisplay, factoryReset, clearParent},
+}
+
+// Catalogue returns the commands supported by the given hardware version
+func Catalogue(hwVersion string) []Command {
+	if c, ok := catalogues[hwVersion]; ok {
+		return c
+	}
+	return defaultCatalogue
+}
+
+func Find(hwVersion string, name string) (Command, bool) {
+	for _, c := range Catalogue(hwVersion) {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Command{}, false
+}
@@ -0,0 +1,29 @@
+package device_commands
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCatalogue(t *testing.T) {
+	assert.Equal(t, defaultCatalogue, Catalogue(""))
+	assert.Equal(t, defaultCatalogue, Catalogue("UNKNOWN"))
+	assert.Len(t, Catalogue(device_registry.MS88SF2_V1_0), 5)
+}
+
+func TestFind(t *testing.T) {
+	c, found := Find(device_registry.MS88SF2_V1_0, FACTORY_RESET)
+	assert.True(t, found)
+	assert.Equal(t, factoryReset, c)
+
+	_, found = Find(device_registry.E73, FACTORY_RESET)
+	assert.False(t, found)
+
+	c, found = Find("", REBOOT)
+	assert.True(t, found)
+	assert.Equal(t, "api/cmd/reboot", c.Path)
+
+	_, found = Find("", "foo")
+	assert.False(t, found)
+}
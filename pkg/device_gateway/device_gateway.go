@@ -8,27 +8,106 @@ import (
 	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strconv"
 	"time"
 )
 
-var DEVICE_COAP_PORT = "5683"
+const DefaultDevicePort = 5683
+const DefaultRequestDeadline = 30 * time.Second
+
+// TransportSettings controls how requests are sent to devices. Deadline limits the total time
+// of a request including all retransmissions and block-wise transfers.
+type TransportSettings struct {
+	Port         int
+	Transmission coap_utils.TransmissionSettings
+	Deadline     time.Duration
+}
+
+var DefaultTransportSettings = TransportSettings{DefaultDevicePort, coap_utils.DefaultTransmissionSettings, DefaultRequestDeadline}
+
+// Realm-local all nodes address, which Thread forwards through the whole mesh
+var MulticastAllNodes = net.ParseIP("ff03::1")
+
+type transportConfigKey struct{}
 
 type DeviceGateway interface {
-	PushDefaults(defaults device_registry.Defaults, destination net.IP) error
-	FetchState(destination net.IP) (device_registry.State, error)
+	PushDefaults(ctx context.Context, defaults device_registry.Defaults, destination net.IP) error
+	FetchState(ctx context.Context, destination net.IP) (device_registry.State, error)
+	SendCommand(ctx context.Context, path string, payload string, destination net.IP) (string, error)
+	Ping(ctx context.Context, destination net.IP) (time.Duration, error)
+	ProbeGet(ctx context.Context, destination net.IP) (time.Duration, error)
+	MulticastFetchState(ctx context.Context, group net.IP) ([]coap_utils.MulticastResponse, error)
+	MulticastCommand(ctx context.Context, path string, payload string, group net.IP) ([]coap_utils.MulticastResponse, error)
 }
 
-type deviceGateway struct{}
+type deviceGateway struct {
+	bw        coap_utils.BlockwiseSettings
+	transport TransportSettings
+	conns     *coap_utils.ConnPool
+}
 
 func Create() *deviceGateway {
-	return &deviceGateway{}
+	return CreateWithBlockwise(coap_utils.DefaultBlockwiseSettings)
+}
+
+func CreateWithBlockwise(bw coap_utils.BlockwiseSettings) *deviceGateway {
+	return CreateWithSettings(bw, DefaultTransportSettings)
+}
+
+func CreateWithSettings(bw coap_utils.BlockwiseSettings, transport TransportSettings) *deviceGateway {
+	return CreateWithPool(bw, transport, coap_utils.NewConnPool(coap_utils.DefaultPoolSettings))
 }
 
-func (r *deviceGateway) PushDefaults(defaults device_registry.Defaults, destination net.IP) error {
+func CreateWithPool(bw coap_utils.BlockwiseSettings, transport TransportSettings, conns *coap_utils.ConnPool) *deviceGateway {
+	return &deviceGateway{bw, transport, conns}
+}
+
+func (s TransportSettings) Validate() error {
+	if s.Port <= 0 || s.Port > 65535 {
+		return errors.Errorf("invalid device port %v", s.Port)
+	}
+	if s.Deadline <= 0 {
+		return errors.Errorf("invalid request deadline %v, must be positive", s.Deadline)
+	}
+	return s.Transmission.Validate()
+}
+
+// WithOverrides returns the settings with non-zero values of the device specific config applied
+func (s TransportSettings) WithOverrides(c *device_registry.TransportConfig) TransportSettings {
+	if c == nil {
+		return s
+	}
+	if c.Port != 0 {
+		s.Port = c.Port
+	}
+	if c.AckTimeoutMs != 0 {
+		s.Transmission.AckTimeout = time.Duration(c.AckTimeoutMs) * time.Millisecond
+	}
+	if c.MaxRetransmit != 0 {
+		s.Transmission.MaxRetransmit = c.MaxRetransmit
+	}
+	if c.DeadlineSec != 0 {
+		s.Deadline = time.Duration(c.DeadlineSec) * time.Second
+	}
+	return s
+}
+
+// WithTransportConfig returns a context that makes the gateway use the device specific transport
+// settings for requests done using it
+func WithTransportConfig(ctx context.Context, c *device_registry.TransportConfig) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, transportConfigKey{}, c)
+}
+
+func (r *deviceGateway) PushDefaults(ctx context.Context, defaults device_registry.Defaults, destination net.IP) error {
 	log.Debugf("Pushing settings %+v to %+v", defaults, destination)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ts := r.settingsFor(ctx)
+	ctx, cancel := context.WithTimeout(ctx, ts.Deadline)
 	defer cancel()
 
 	payload, err := json.Marshal(defaults)
@@ -36,18 +115,87 @@ func (r *deviceGateway) PushDefaults(defaults device_registry.Defaults, destinat
 		return errors.WithStack(err)
 	}
 
-	_, err = coap_utils.PostJSON(ctx, "["+destination.String()+"]:"+DEVICE_COAP_PORT, "api/settings", string(payload))
+	_, err = r.conns.PostJSON(ctx, deviceUrl(destination, ts), "api/settings", string(payload), r.bw, ts.Transmission)
 	return err
 }
 
-func (r *deviceGateway) FetchState(destination net.IP) (device_registry.State, error) {
+func (r *deviceGateway) FetchState(ctx context.Context, destination net.IP) (device_registry.State, error) {
 	log.Debugf("Fetching state from %+v", destination)
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ts := r.settingsFor(ctx)
+	ctx, cancel := context.WithTimeout(ctx, ts.Deadline)
 	defer cancel()
 
-	res, err := coap_utils.GetJSON(ctx, "["+destination.String()+"]:"+DEVICE_COAP_PORT, "api/state")
+	res, err := r.conns.GetJSON(ctx, deviceUrl(destination, ts), "api/state", r.bw, ts.Transmission)
 	if err != nil {
 		return device_registry.State{}, err
 	}
 	return device_registry.StateFromJSON([]byte(res))
 }
+
+func (r *deviceGateway) SendCommand(ctx context.Context, path string, payload string, destination net.IP) (string, error) {
+	log.Debugf("Sending command %v with payload '%v' to %+v", path, payload, destination)
+	ts := r.settingsFor(ctx)
+	ctx, cancel := context.WithTimeout(ctx, ts.Deadline)
+	defer cancel()
+
+	return r.conns.PostJSON(ctx, deviceUrl(destination, ts), path, payload, r.bw, ts.Transmission)
+}
+
+// Ping measures the round trip time of an empty confirmable message
+func (r *deviceGateway) Ping(ctx context.Context, destination net.IP) (time.Duration, error) {
+	log.Debugf("Pinging %+v", destination)
+	ts := r.settingsFor(ctx)
+	ctx, cancel := context.WithTimeout(ctx, ts.Deadline)
+	defer cancel()
+
+	started := time.Now()
+	err := r.conns.Ping(ctx, deviceUrl(destination, ts), r.bw, ts.Transmission)
+	return time.Since(started), err
+}
+
+// ProbeGet measures the time it takes the device to respond to a state request, which unlike a ping
+// involves the application on the device
+func (r *deviceGateway) ProbeGet(ctx context.Context, destination net.IP) (time.Duration, error) {
+	log.Debugf("Probing %+v", destination)
+	ts := r.settingsFor(ctx)
+	ctx, cancel := context.WithTimeout(ctx, ts.Deadline)
+	defer cancel()
+
+	started := time.Now()
+	_, err := r.conns.GetJSON(ctx, deviceUrl(destination, ts), "api/state", r.bw, ts.Transmission)
+	return time.Since(started), err
+}
+
+// MulticastFetchState asks all devices in the group to report their state. Responses are collected
+// until ctx is done, or for the request deadline if ctx has no deadline.
+func (r *deviceGateway) MulticastFetchState(ctx context.Context, group net.IP) ([]coap_utils.MulticastResponse, error) {
+	log.Debugf("Fetching state from multicast group %+v", group)
+	ctx, cancel := r.multicastContext(ctx)
+	defer cancel()
+
+	return coap_utils.Multicast(ctx, deviceUrl(group, r.transport), codes.GET, "api/state", "", r.bw)
+}
+
+func (r *deviceGateway) MulticastCommand(ctx context.Context, path string, payload string, group net.IP) ([]coap_utils.MulticastResponse, error) {
+	log.Debugf("Sending command %v with payload '%v' to multicast group %+v", path, payload, group)
+	ctx, cancel := r.multicastContext(ctx)
+	defer cancel()
+
+	return coap_utils.Multicast(ctx, deviceUrl(group, r.transport), codes.POST, path, payload, r.bw)
+}
+
+func (r *deviceGateway) multicastContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.transport.Deadline)
+}
+
+func (r *deviceGateway) settingsFor(ctx context.Context) TransportSettings {
+	c, _ := ctx.Value(transportConfigKey{}).(*device_registry.TransportConfig)
+	return r.transport.WithOverrides(c)
+}
+
+func deviceUrl(destination net.IP, ts TransportSettings) string {
+	return net.JoinHostPort(destination.String(), strconv.Itoa(ts.Port))
+}
@@ -1,6 +1,8 @@
 package device_gateway
 
 import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	"github.com/plgd-dev/go-coap/v2/message"
 	"github.com/plgd-dev/go-coap/v2/message/codes"
@@ -10,8 +12,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	gonet "net"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var LOCAL_IP = gonet.ParseIP("127.0.0.1")
@@ -26,7 +30,7 @@ func TestGateway_PushSettings(t *testing.T) {
 
 		gw := Create()
 		dev := device_registry.Defaults{"D100", -4, 5000, device_registry.GOOD_DISPLAY_1_54IN, device_registry.E73}
-		err := gw.PushDefaults(dev, LOCAL_IP)
+		err := gw.PushDefaults(context.Background(), dev, LOCAL_IP)
 		assert.NoError(t, err)
 		done <- 1
 	})
@@ -54,20 +58,99 @@ func TestGateway_FetchState(t *testing.T) {
 		)
 
 		gw := Create()
-		state, err := gw.FetchState(LOCAL_IP)
+		state, err := gw.FetchState(context.Background(), LOCAL_IP)
 		assert.NoError(t, err)
 		assert.Equal(t, testState, state)
 		done <- 1
 	})
 }
 
+func TestGateway_SendCommand(t *testing.T) {
+	testWithCoapServer(t, func(t *testing.T, r *mux.Router, done chan int) {
+		_ = r.Handle("api/cmd/identify", mux.HandlerFunc(func(w mux.ResponseWriter, msg *mux.Message) {
+			assert.Equal(t, codes.POST, msg.Code)
+			b, _ := ioutil.ReadAll(msg.Body)
+			assert.JSONEq(t, `{"seconds": 5}`, string(b))
+			_ = w.SetResponse(codes.Content, message.AppJSON, strings.NewReader(`{"ok": true}`))
+		}))
+
+		gw := Create()
+		res, err := gw.SendCommand(context.Background(), "api/cmd/identify", `{"seconds": 5}`, LOCAL_IP)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"ok": true}`, res)
+		done <- 1
+	})
+}
+
+func TestGateway_Blockwise(t *testing.T) {
+	bw := coap_utils.BlockwiseSettings{BlockSize: 16, MaxMessageSize: 128}
+	addresses := `"fd11:22::1", "fd11:22::2", "fd11:22::3", "fd11:22::4", "fd11:22::5", "fd11:22::6", "fd11:22::7"`
+
+	testWithCoapServerOpts(t, bw.ServerOptions(), func(t *testing.T, r *mux.Router, done chan int) {
+		expectJSONPost(t, r, "api/settings", `{"instance": "D100","txPower": -4,"pollPeriod": 5000, "displayType": "GOOD_DISPLAY_2_9IN_4GRAY", "hwVersion": "MS88SF2_V1_0"}`)
+		expectJSONGet(t, r, "api/state", `{"vcc": 2970, "instance": "A100", "addresses": [`+addresses+`], "txPower": 0, "pollPeriod": 1000,
+				"parent": {"rloc16": "0x4400", "linkQualityIn": 3, "linkQualityOut": 2, "avgRssi": -65, "latestRssi": -63}}`)
+
+		gw := CreateWithBlockwise(bw)
+		err := gw.PushDefaults(context.Background(), device_registry.Defaults{"D100", -4, 5000, device_registry.GOOD_DISPLAY_2_9IN_4GRAY, device_registry.MS88SF2_V1_0}, LOCAL_IP)
+		assert.NoError(t, err)
+
+		state, err := gw.FetchState(context.Background(), LOCAL_IP)
+		assert.NoError(t, err)
+		assert.Len(t, state.Addresses, 7)
+		done <- 1
+	})
+}
+
+func TestGateway_TransportOverrides(t *testing.T) {
+	testWithCoapServerOnPort(t, 5684, nil, func(t *testing.T, r *mux.Router, done chan int) {
+		expectJSONGet(t, r, "api/state", `{"vcc": 2970, "instance": "A100", "addresses": ["ffff::1"], "txPower": 0, "pollPeriod": 1000,
+				"parent": {"rloc16": "0x4400", "linkQualityIn": 3, "linkQualityOut": 2, "avgRssi": -65, "latestRssi": -63}}`)
+
+		ts := DefaultTransportSettings
+		ts.Deadline = 200 * time.Millisecond
+		gw := CreateWithSettings(coap_utils.DefaultBlockwiseSettings, ts)
+
+		// Default port has no server listening
+		_, err := gw.FetchState(context.Background(), LOCAL_IP)
+		assert.Error(t, err)
+
+		ctx := WithTransportConfig(context.Background(), &device_registry.TransportConfig{Port: 5684, DeadlineSec: 5})
+		state, err := gw.FetchState(ctx, LOCAL_IP)
+		assert.NoError(t, err)
+		assert.Equal(t, testState, state)
+		done <- 1
+	})
+}
+
+func TestTransportSettings_WithOverrides(t *testing.T) {
+	ts := DefaultTransportSettings
+	assert.Equal(t, ts, ts.WithOverrides(nil))
+	assert.Equal(t, ts, ts.WithOverrides(&device_registry.TransportConfig{}))
+
+	overridden := ts.WithOverrides(&device_registry.TransportConfig{Port: 61631, AckTimeoutMs: 60000, MaxRetransmit: 2, DeadlineSec: 300})
+	assert.Equal(t, TransportSettings{61631, coap_utils.TransmissionSettings{AckTimeout: time.Minute, MaxRetransmit: 2}, 5 * time.Minute}, overridden)
+	assert.NoError(t, overridden.Validate())
+
+	ts.Port = 0
+	assert.Error(t, ts.Validate())
+}
+
 func testWithCoapServer(t *testing.T, testFunc func(t *testing.T, r *mux.Router, done chan int)) {
+	testWithCoapServerOpts(t, nil, testFunc)
+}
+
+func testWithCoapServerOpts(t *testing.T, opts []udp.ServerOption, testFunc func(t *testing.T, r *mux.Router, done chan int)) {
+	testWithCoapServerOnPort(t, DefaultDevicePort, opts, testFunc)
+}
+
+func testWithCoapServerOnPort(t *testing.T, port int, opts []udp.ServerOption, testFunc func(t *testing.T, r *mux.Router, done chan int)) {
 	r := mux.NewRouter()
 
-	srv := udp.NewServer(udp.WithMux(r), udp.WithKeepAlive(nil))
+	srv := udp.NewServer(append(opts, udp.WithMux(r), udp.WithKeepAlive(nil))...)
 	defer srv.Stop()
 
-	conn, err := net.NewListenUDP("udp", ":5683")
+	conn, err := net.NewListenUDP("udp", ":"+strconv.Itoa(port))
 	assert.NoError(t, err)
 	defer conn.Close()
 
@@ -0,0 +1,197 @@
+package device_registry
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+const (
+	// Fires when vcc (mV) drops below the threshold
+	ALERT_LOW_VCC = "low_vcc"
+	// Fires when the average RSSI (dBm) of the parent link drops below the threshold
+	ALERT_LOW_RSSI = "low_rssi"
+	// Fires when the worse direction of the parent link quality (0-3) drops below the threshold
+	ALERT_LOW_LINK_QUALITY = "low_link_quality"
+	// Fires when more than threshold polling intervals have passed without a state from the device
+	ALERT_OFFLINE = "offline"
+	// Fires when the device has changed its parent more than threshold times within WindowSec
+	ALERT_PARENT_CHANGES = "parent_changes"
+	// Fires when the projected battery life drops below threshold days
+	ALERT_LOW_BATTERY_DAYS = "battery_days"
+)
+
+var AlertTypes = []string{ALERT_LOW_VCC, ALERT_LOW_RSSI, ALERT_LOW_LINK_QUALITY, ALERT_OFFLINE, ALERT_PARENT_CHANGES, ALERT_LOW_BATTERY_DAYS}
+
+const (
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+)
+
+// AlertRule describes a condition on the state of the devices that raises an alert. Low value rules fire when the
+// value drops below Threshold and resolve when it rises to Threshold + Hysteresis, the others fire when the value
+// rises above Threshold and resolve when it drops to Threshold - Hysteresis.
+type AlertRule struct {
+	Id         string  `json:"id"`
+	Type       string  `json:"type"`
+	Threshold  float64 `json:"threshold"`
+	Hysteresis float64 `json:"hysteresis"`
+	// Time window for counting parent changes
+	WindowSec int `json:"windowSec,omitempty"`
+	// Only devices with the tag are checked, empty checks all devices
+	Tag string `json:"tag,omitempty"`
+	// Ids of the webhooks notified when an alert of this rule fires or resolves, in addition to the webhooks
+	// accepting all alert events
+	Webhooks []string `json:"webhooks,omitempty"`
+}
+
+// Alert is an active alert raised by a rule
+type Alert struct {
+	RuleId  string    `json:"ruleId"`
+	Type    string    `json:"type"`
+	Value   float64   `json:"value"`
+	Since   time.Time `json:"since"`
+	Message string    `json:"message"`
+}
+
+// AlertState holds the active alerts of a device together with what is needed to evaluate the rules between states
+type AlertState struct {
+	Active        []Alert     `json:"active"`
+	LastSeen      *time.Time  `json:"lastSeen,omitempty"`
+	Parent        string      `json:"parent,omitempty"`
+	ParentChanges []time.Time `json:"parentChanges,omitempty"`
+}
+
+// AlertNotification is sent when an alert fires or resolves
+type AlertNotification struct {
+	DeviceId  string    `json:"deviceId"`
+	Instance  string    `json:"instance"`
+	RuleId    string    `json:"ruleId"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"ts"`
+}
+
+const AlertRulesBucket = "AlertRules"
+const AlertsBucket = "Alerts"
+
+// Returns true if the rule fires on values below the threshold
+func (r AlertRule) IsLowValueRule() bool {
+	return r.Type == ALERT_LOW_VCC || r.Type == ALERT_LOW_RSSI || r.Type == ALERT_LOW_LINK_QUALITY || r.Type == ALERT_LOW_BATTERY_DAYS
+}
+
+func (s *AlertState) Alert(ruleId string) *Alert {
+	for i := range s.Active {
+		if s.Active[i].RuleId == ruleId {
+			return &s.Active[i]
+		}
+	}
+	return nil
+}
+
+// Creates the rule or replaces the rule with the same id
+func (r *Registry) PutAlertRule(rule AlertRule) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(AlertRulesBucket))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		buf, err := json.Marshal(rule)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal: %v", rule)
+		}
+		return errors.WithStack(b.Put([]byte(rule.Id), buf))
+	})
+}
+
+// Deletes the rule. Returns false if the rule didn't exist.
+func (r *Registry) DeleteAlertRule(id string) (bool, error) {
+	found := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(AlertRulesBucket))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return nil
+		}
+		found = true
+		return errors.WithStack(b.Delete([]byte(id)))
+	})
+	return found, err
+}
+
+// Returns all alert rules ordered by id
+func (r *Registry) GetAlertRules() ([]AlertRule, error) {
+	rules := []AlertRule{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(AlertRulesBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			rule := AlertRule{}
+			err := json.Unmarshal(v, &rule)
+			if err != nil {
+				return errors.Wrapf(err, "failed to unmarshal alert rule from db, data: %v", string(v))
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Id < rules[j].Id })
+	return rules, err
+}
+
+// Returns the alert state of the device, which is empty if no rules have been evaluated for it
+func (r *Registry) GetAlertState(id string) (AlertState, error) {
+	state := AlertState{Active: []Alert{}}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		s, err := getAlertStateInTx(tx, id)
+		if err != nil || s == nil {
+			return err
+		}
+		state = *s
+		return nil
+	})
+	return state, err
+}
+
+func (r *Registry) UpdateAlertState(id string, state AlertState) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return putToDeviceBucket(tx, AlertsBucket, id, state)
+	})
+}
+
+func getAlertStateInTx(tx *bolt.Tx, id string) (*AlertState, error) {
+	buf := getFromDeviceBucket(tx, AlertsBucket, id)
+	if buf == nil {
+		return nil, nil
+	}
+
+	state := AlertState{}
+	err := json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal alert state from db, data: %v", string(buf))
+	}
+	return &state, nil
+}
+
+func IsValidAlertType(alertType string) bool {
+	for _, t := range AlertTypes {
+		if t == alertType {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package device_registry
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
@@ -10,9 +12,13 @@ import (
 )
 
 type Device struct {
-	Defaults Defaults `json:"defaults"`
-	State    *State   `json:"state,omitempty"`
-	Config   Config   `json:"config"`
+	Defaults     Defaults         `json:"defaults"`
+	State        *State           `json:"state,omitempty"`
+	Config       Config           `json:"config"`
+	Drift        *ConfigDrift     `json:"drift,omitempty"`
+	Reachability *Reachability    `json:"reachability,omitempty"`
+	Alerts       []Alert          `json:"alerts,omitempty"`
+	Battery      *BatteryEstimate `json:"battery,omitempty"`
 }
 
 const (
@@ -52,20 +58,172 @@ type State struct {
 	Parent     ParentInfo `json:"parent"`
 }
 
+// StateSeq orders the state reports of a device. Seq is incremented for each report and Boot whenever
+// the device restarts counting Seq, eg. after a reboot.
+type StateSeq struct {
+	Boot uint32 `json:"boot"`
+	Seq  uint32 `json:"seq"`
+}
+
+// Returns true if s identifies a later report than prev
+func (s StateSeq) After(prev StateSeq) bool {
+	if s.Boot != prev.Boot {
+		return isNewerSeq(s.Boot, prev.Boot)
+	}
+	return isNewerSeq(s.Seq, prev.Seq)
+}
+
+const (
+	EVENT_REBOOT = "REBOOT"
+	EVENT_CRASH  = "CRASH"
+	EVENT_ASSERT = "ASSERT"
+	EVENT_BUTTON = "BUTTON"
+	EVENT_LOG    = "LOG"
+)
+
+var EventTypes = []string{EVENT_REBOOT, EVENT_CRASH, EVENT_ASSERT, EVENT_BUTTON, EVENT_LOG}
+
+type Event struct {
+	Type      string          `json:"type"`
+	Message   string          `json:"message,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"ts"`
+}
+
+type CommandResult struct {
+	Name       string    `json:"name"`
+	Timestamp  time.Time `json:"ts"`
+	Success    bool      `json:"success"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+const (
+	PROBE_PING = "ping"
+	PROBE_GET  = "get"
+)
+
+// ProbeSample is the outcome of a single CoAP ping or timed GET to the device
+type ProbeSample struct {
+	Kind      string    `json:"kind"`
+	Timestamp time.Time `json:"ts"`
+	Address   net.IP    `json:"address"`
+	Success   bool      `json:"success"`
+	RttMs     float64   `json:"rttMs,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// VccSample is the supply voltage reported by the device at the given time
+type VccSample struct {
+	Timestamp time.Time `json:"ts"`
+	Vcc       int       `json:"vcc"`
+}
+
+// BatteryEstimate projects the remaining battery life of the device from its recent vcc samples
+type BatteryEstimate struct {
+	// Slope of a linear fit over the samples, negative when the battery is discharging
+	SlopeMvPerDay float64 `json:"slopeMvPerDay"`
+	// Vcc of the fit at the latest sample
+	Vcc       int `json:"vcc"`
+	CutoffVcc int `json:"cutoffVcc"`
+	// Projected days until vcc reaches the cutoff, capped for batteries that are barely or not at all discharging
+	DaysRemaining float64   `json:"daysRemaining"`
+	Samples       int       `json:"samples"`
+	Timestamp     time.Time `json:"ts"`
+}
+
+// ConfigDrift lists the fields in which the state reported by a device differs from its desired defaults
+type ConfigDrift struct {
+	Fields     []string  `json:"fields"`
+	DetectedAt time.Time `json:"ts"`
+}
+
+type AddressStatus struct {
+	Address     net.IP     `json:"address"`
+	Reachable   bool       `json:"reachable"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// Reachability tracks which of the device's addresses have answered to requests
+type Reachability struct {
+	WorkingAddress net.IP          `json:"workingAddress,omitempty"`
+	Addresses      []AddressStatus `json:"addresses"`
+}
+
+// PollerStatus describes the state poller of a device
+type PollerStatus struct {
+	IntervalSec int        `json:"intervalSec"`
+	LastPoll    *time.Time `json:"lastPoll,omitempty"`
+	NextPoll    *time.Time `json:"nextPoll,omitempty"`
+	Polls       int        `json:"polls"`
+	// Share of successful polls since the poller was started
+	SuccessRatio        float64 `json:"successRatio"`
+	ConsecutiveFailures int     `json:"consecutiveFailures"`
+	// Delay before the next poll while the device is failing, zero when polling at the normal interval
+	BackoffSec int `json:"backoffSec"`
+	// Error of the latest failed poll, kept after the device recovers
+	LastError string `json:"lastError,omitempty"`
+}
+
+// How state is collected from the device. Polling is done only if StatePollingEnabled is set.
+const (
+	// The device is polled on schedule, states it pushes are processed as well
+	STATE_MODE_POLL = "poll"
+	// The device is never polled and only pushes its state
+	STATE_MODE_PUSH = "push"
+	// The device is polled only when it hasn't pushed its state within the polling interval
+	STATE_MODE_HYBRID = "hybrid"
+)
+
+var StateModes = []string{STATE_MODE_POLL, STATE_MODE_PUSH, STATE_MODE_HYBRID}
+
 type Config struct {
-	MainIp                  net.IP `json:"mainIp"`
-	StatePollingEnabled     bool   `json:"statePollingEnabled"`
-	StatePollingIntervalSec int    `json:"statePollingIntervalSec"`
+	MainIp                  net.IP   `json:"mainIp"`
+	StatePollingEnabled     bool     `json:"statePollingEnabled"`
+	StatePollingIntervalSec int      `json:"statePollingIntervalSec"`
+	AutoReconcile           bool     `json:"autoReconcile"`
+	Tags                    []string `json:"tags,omitempty"`
+	// Overrides the server wide CoAP client settings, eg. for sleepy end devices with long poll periods
+	Transport *TransportConfig `json:"transport,omitempty"`
+	// One of StateModes, empty means STATE_MODE_POLL
+	StateMode string `json:"stateMode,omitempty"`
+	// Limits polls, probes and automatic pushes to the allowed windows
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// TransportConfig holds per device CoAP client settings. Zero values use the server defaults.
+type TransportConfig struct {
+	Port          int `json:"port,omitempty"`
+	AckTimeoutMs  int `json:"ackTimeoutMs,omitempty"`
+	MaxRetransmit int `json:"maxRetransmit,omitempty"`
+	DeadlineSec   int `json:"deadlineSec,omitempty"`
 }
 
 const DevicesBucket = "Devices"
 const DefaultsBucket = "Defaults"
 const StateBucket = "State"
 const ConfigBucket = "Config"
+const EventsBucket = "Events"
+const StateSeqBucket = "StateSeq"
+const CommandsBucket = "Commands"
+const ProbesBucket = "Probes"
+const DriftBucket = "Drift"
+const ReachabilityBucket = "Reachability"
+const VccHistoryBucket = "VccHistory"
+const BatteryBucket = "Battery"
+
+const MaxEventsPerDevice = 100
+const MaxCommandsPerDevice = 50
+const MaxProbesPerDevice = 200
+const MaxAddressesPerDevice = 16
+const MaxVccSamplesPerDevice = 1000
 
 var DefaultDefaults = Defaults{Instance: "0000", TxPower: 0, PollPeriod: 1000, DisplayType: "", HwVersion: ""}
 var DefaultConfig = Config{MainIp: nil, StatePollingEnabled: false, StatePollingIntervalSec: 600}
-var DefaultDevice = Device{DefaultDefaults, nil, DefaultConfig}
+var DefaultDevice = Device{DefaultDefaults, nil, DefaultConfig, nil, nil, nil, nil}
 
 type Registry struct {
 	db *bolt.DB
@@ -168,6 +326,35 @@ func (r *Registry) UpdateState(id string, state State) error {
 	})
 }
 
+// UpdateStateWithSeq stores the state only if seq is after the sequence number of the previously
+// stored state. Returns false if the state was ignored as a duplicate or a stale report.
+func (r *Registry) UpdateStateWithSeq(id string, state State, seq StateSeq) (bool, error) {
+	applied := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+
+		prevSeq, err := getStateSeqInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if prevSeq != nil && !seq.After(*prevSeq) {
+			log.Debugf("Ignoring state for '%v' with seq %+v, previous seq %+v", id, seq, *prevSeq)
+			return nil
+		}
+
+		err = putToDeviceBucket(tx, StateBucket, id, state)
+		if err != nil {
+			return err
+		}
+		applied = true
+		return putToDeviceBucket(tx, StateSeqBucket, id, seq)
+	})
+	return applied, err
+}
+
 func (r *Registry) UpdateConfig(id string, config Config) error {
 	return r.db.Update(func(tx *bolt.Tx) error {
 		err := assertDeviceExistsInTx(tx, id)
@@ -178,6 +365,172 @@ func (r *Registry) UpdateConfig(id string, config Config) error {
 	})
 }
 
+// SetDrift records config drift for the device. A nil drift clears a previously recorded one.
+func (r *Registry) SetDrift(id string, drift *ConfigDrift) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if drift == nil {
+			return deleteFromDeviceBucket(tx, DriftBucket, id)
+		}
+		return putToDeviceBucket(tx, DriftBucket, id, drift)
+	})
+}
+
+// RecordReachability stores the outcome of a request sent to one of the device's addresses.
+// A nil reqErr marks the address as reachable and makes it the device's working address.
+func (r *Registry) RecordReachability(id string, addr net.IP, reqErr error, ts time.Time) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+
+		reachability, err := getReachabilityInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if reachability == nil {
+			reachability = &Reachability{}
+		}
+
+		reachability.record(addr, reqErr, ts)
+		return putToDeviceBucket(tx, ReachabilityBucket, id, reachability)
+	})
+}
+
+func (r *Registry) AddEvent(id string, event Event) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return appendToDeviceRingBuffer(tx, EventsBucket, id, event, MaxEventsPerDevice)
+	})
+}
+
+func (r *Registry) GetEvents(id string) ([]Event, error) {
+	events := []Event{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return forEachInDeviceRingBuffer(tx, EventsBucket, id, func(buf []byte) error {
+			e, err := eventFromJSON(buf)
+			if err != nil {
+				return err
+			}
+			events = append(events, e)
+			return nil
+		})
+	})
+	return events, err
+}
+
+func (r *Registry) AddCommandResult(id string, result CommandResult) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return appendToDeviceRingBuffer(tx, CommandsBucket, id, result, MaxCommandsPerDevice)
+	})
+}
+
+func (r *Registry) GetCommandHistory(id string) ([]CommandResult, error) {
+	results := []CommandResult{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return forEachInDeviceRingBuffer(tx, CommandsBucket, id, func(buf []byte) error {
+			res, err := commandResultFromJSON(buf)
+			if err != nil {
+				return err
+			}
+			results = append(results, res)
+			return nil
+		})
+	})
+	return results, err
+}
+
+func (r *Registry) AddProbeSample(id string, sample ProbeSample) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return appendToDeviceRingBuffer(tx, ProbesBucket, id, sample, MaxProbesPerDevice)
+	})
+}
+
+func (r *Registry) GetProbeSamples(id string) ([]ProbeSample, error) {
+	samples := []ProbeSample{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return forEachInDeviceRingBuffer(tx, ProbesBucket, id, func(buf []byte) error {
+			s, err := probeSampleFromJSON(buf)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, s)
+			return nil
+		})
+	})
+	return samples, err
+}
+
+func (r *Registry) AddVccSample(id string, sample VccSample) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return appendToDeviceRingBuffer(tx, VccHistoryBucket, id, sample, MaxVccSamplesPerDevice)
+	})
+}
+
+func (r *Registry) GetVccHistory(id string) ([]VccSample, error) {
+	samples := []VccSample{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return forEachInDeviceRingBuffer(tx, VccHistoryBucket, id, func(buf []byte) error {
+			s, err := vccSampleFromJSON(buf)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, s)
+			return nil
+		})
+	})
+	return samples, err
+}
+
+// SetBatteryEstimate stores the battery estimate of the device. A nil estimate clears a previously stored one.
+func (r *Registry) SetBatteryEstimate(id string, estimate *BatteryEstimate) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := assertDeviceExistsInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if estimate == nil {
+			return deleteFromDeviceBucket(tx, BatteryBucket, id)
+		}
+		return putToDeviceBucket(tx, BatteryBucket, id, estimate)
+	})
+}
+
 func (r *Registry) GetDevices() (map[string]Device, error) {
 	devices := make(map[string]Device)
 	err := r.db.View(func(tx *bolt.Tx) error {
@@ -214,6 +567,101 @@ func (r *Registry) DeleteDevice(id string) error {
 	})
 }
 
+// Instance returns the instance the device is currently reporting, or the desired one if no state has been received
+func (d *Device) Instance() string {
+	if d.State != nil && d.State.Instance != "" {
+		return d.State.Instance
+	}
+	return d.Defaults.Instance
+}
+
+// DriftFrom returns the names of the fields in which the reported state differs from the defaults
+func (d Defaults) DriftFrom(state State) []string {
+	var fields []string
+	if d.Instance != state.Instance {
+		fields = append(fields, "instance")
+	}
+	if d.TxPower != state.TxPower {
+		fields = append(fields, "txPower")
+	}
+	if d.PollPeriod != state.PollPeriod {
+		fields = append(fields, "pollPeriod")
+	}
+	return fields
+}
+
+func (c Config) Mode() string {
+	if c.StateMode == "" {
+		return STATE_MODE_POLL
+	}
+	return c.StateMode
+}
+
+// Returns true if the device should have a state poller
+func (c Config) IsPolled() bool {
+	return c.StatePollingEnabled && c.Mode() != STATE_MODE_PUSH
+}
+
+func (c Config) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reachability) Status(addr net.IP) *AddressStatus {
+	for i := range r.Addresses {
+		if r.Addresses[i].Address.Equal(addr) {
+			return &r.Addresses[i]
+		}
+	}
+	return nil
+}
+
+func (r *Reachability) record(addr net.IP, reqErr error, ts time.Time) {
+	status := r.Status(addr)
+	if status == nil {
+		r.Addresses = append(r.Addresses, AddressStatus{Address: addr})
+		if len(r.Addresses) > MaxAddressesPerDevice {
+			r.Addresses = r.Addresses[1:]
+		}
+		status = &r.Addresses[len(r.Addresses)-1]
+	}
+
+	status.Reachable = reqErr == nil
+	if reqErr == nil {
+		status.LastSuccess = &ts
+		status.LastError = ""
+		r.WorkingAddress = addr
+	} else {
+		status.LastFailure = &ts
+		status.LastError = reqErr.Error()
+		if r.WorkingAddress.Equal(addr) {
+			r.WorkingAddress = nil
+		}
+	}
+}
+
+func IsValidEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidStateMode(mode string) bool {
+	for _, m := range StateModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 func assertDeviceExistsInTx(tx *bolt.Tx, id string) error {
 	devices := tx.Bucket([]byte(DevicesBucket))
 	device := devices.Bucket([]byte(id))
@@ -257,6 +705,32 @@ func getDeviceInTx(tx *bolt.Tx, id string) (*Device, error) {
 		d.Config = *config
 	}
 
+	drift, err := getDriftInTx(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Drift = drift
+
+	reachability, err := getReachabilityInTx(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Reachability = reachability
+
+	alerts, err := getAlertStateInTx(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if alerts != nil && len(alerts.Active) > 0 {
+		d.Alerts = alerts.Active
+	}
+
+	battery, err := getBatteryEstimateInTx(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Battery = battery
+
 	return &d, nil
 }
 
@@ -288,6 +762,26 @@ func getStateInTx(tx *bolt.Tx, id string) (*State, error) {
 	return &state, nil
 }
 
+func getStateSeqInTx(tx *bolt.Tx, id string) (*StateSeq, error) {
+	buf := getFromDeviceBucket(tx, StateSeqBucket, id)
+	if buf == nil {
+		return nil, nil
+	}
+
+	var seq StateSeq
+	err := json.Unmarshal(buf, &seq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal state seq from db, data: %v", string(buf))
+	}
+
+	return &seq, nil
+}
+
+// Compares sequence numbers using serial number arithmetic (RFC 1982) so that wrap-around is handled
+func isNewerSeq(seq uint32, prev uint32) bool {
+	return int32(seq-prev) > 0
+}
+
 func getConfigInTx(tx *bolt.Tx, id string) (*Config, error) {
 	buf := getFromDeviceBucket(tx, ConfigBucket, id)
 	if buf == nil {
@@ -302,6 +796,49 @@ func getConfigInTx(tx *bolt.Tx, id string) (*Config, error) {
 	return &config, nil
 }
 
+func getDriftInTx(tx *bolt.Tx, id string) (*ConfigDrift, error) {
+	buf := getFromDeviceBucket(tx, DriftBucket, id)
+	if buf == nil {
+		return nil, nil
+	}
+
+	drift, err := driftFromJSON(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &drift, nil
+}
+
+func getReachabilityInTx(tx *bolt.Tx, id string) (*Reachability, error) {
+	buf := getFromDeviceBucket(tx, ReachabilityBucket, id)
+	if buf == nil {
+		return nil, nil
+	}
+
+	reachability, err := reachabilityFromJSON(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reachability, nil
+}
+
+func getBatteryEstimateInTx(tx *bolt.Tx, id string) (*BatteryEstimate, error) {
+	buf := getFromDeviceBucket(tx, BatteryBucket, id)
+	if buf == nil {
+		return nil, nil
+	}
+
+	estimate := BatteryEstimate{}
+	err := json.Unmarshal(buf, &estimate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal battery estimate from db, data: %v", string(buf))
+	}
+
+	return &estimate, nil
+}
+
 func getFromDeviceBucket(tx *bolt.Tx, bucketName string, id string) []byte {
 	devices := tx.Bucket([]byte(DevicesBucket))
 	device := devices.Bucket([]byte(id))
@@ -342,6 +879,101 @@ func putToDeviceBucket(tx *bolt.Tx, bucketName string, id string, obj interface{
 	return nil
 }
 
+func deleteFromDeviceBucket(tx *bolt.Tx, bucketName string, id string) error {
+	devices := tx.Bucket([]byte(DevicesBucket))
+	device := devices.Bucket([]byte(id))
+	if device == nil {
+		return nil
+	}
+
+	bucket := device.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return nil
+	}
+
+	log.Debugf("Deleting from bucket %v '%v'", bucketName, id)
+	return errors.WithStack(bucket.Delete([]byte(id)))
+}
+
+func appendToDeviceRingBuffer(tx *bolt.Tx, bucketName string, id string, obj interface{}, maxSize int) error {
+	devices := tx.Bucket([]byte(DevicesBucket))
+	device, err := devices.CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	b, err := device.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Debugf("Appending to bucket %v '%v': %+v", bucketName, id, obj)
+	return appendToRingBuffer(b, obj, maxSize)
+}
+
+func appendToRingBuffer(b *bolt.Bucket, obj interface{}, maxSize int) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal: %v", obj)
+	}
+
+	err = b.Put(sequenceKey(seq), buf)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put: %+v", obj)
+	}
+
+	_, err = dropOldest(b, maxSize)
+	return err
+}
+
+// Drops the entries of a bucket keyed by sequence that are more than maxSize entries older than the latest one.
+// Only the dropped entries are visited. Returns the number of dropped entries.
+func dropOldest(b *bolt.Bucket, maxSize int) (int, error) {
+	latest := b.Sequence()
+	if latest <= uint64(maxSize) {
+		return 0, nil
+	}
+
+	oldestKept := sequenceKey(latest - uint64(maxSize) + 1)
+	dropped := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, oldestKept) < 0; k, _ = c.First() {
+		err := b.Delete(k)
+		if err != nil {
+			return dropped, errors.WithStack(err)
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+func forEachInDeviceRingBuffer(tx *bolt.Tx, bucketName string, id string, f func(buf []byte) error) error {
+	devices := tx.Bucket([]byte(DevicesBucket))
+	device := devices.Bucket([]byte(id))
+	if device == nil {
+		return nil
+	}
+
+	bucket := device.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.ForEach(func(k []byte, v []byte) error {
+		return f(v)
+	})
+}
+
+func sequenceKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
 func defaultsFromJSON(buf []byte) (Defaults, error) {
 	d := Defaults{}
 	err := json.Unmarshal(buf, &d)
@@ -368,3 +1000,57 @@ func configFromJSON(buf []byte) (Config, error) {
 	}
 	return config, nil
 }
+
+func eventFromJSON(buf []byte) (Event, error) {
+	event := Event{}
+	err := json.Unmarshal(buf, &event)
+	if err != nil {
+		return event, errors.Wrapf(err, "failed to unmarshal event from db, data: %v", string(buf))
+	}
+	return event, nil
+}
+
+func commandResultFromJSON(buf []byte) (CommandResult, error) {
+	res := CommandResult{}
+	err := json.Unmarshal(buf, &res)
+	if err != nil {
+		return res, errors.Wrapf(err, "failed to unmarshal command result from db, data: %v", string(buf))
+	}
+	return res, nil
+}
+
+func probeSampleFromJSON(buf []byte) (ProbeSample, error) {
+	sample := ProbeSample{}
+	err := json.Unmarshal(buf, &sample)
+	if err != nil {
+		return sample, errors.Wrapf(err, "failed to unmarshal probe sample from db, data: %v", string(buf))
+	}
+	return sample, nil
+}
+
+func vccSampleFromJSON(buf []byte) (VccSample, error) {
+	sample := VccSample{}
+	err := json.Unmarshal(buf, &sample)
+	if err != nil {
+		return sample, errors.Wrapf(err, "failed to unmarshal vcc sample from db, data: %v", string(buf))
+	}
+	return sample, nil
+}
+
+func driftFromJSON(buf []byte) (ConfigDrift, error) {
+	drift := ConfigDrift{}
+	err := json.Unmarshal(buf, &drift)
+	if err != nil {
+		return drift, errors.Wrapf(err, "failed to unmarshal config drift from db, data: %v", string(buf))
+	}
+	return drift, nil
+}
+
+func reachabilityFromJSON(buf []byte) (Reachability, error) {
+	reachability := Reachability{}
+	err := json.Unmarshal(buf, &reachability)
+	if err != nil {
+		return reachability, errors.Wrapf(err, "failed to unmarshal reachability from db, data: %v", string(buf))
+	}
+	return reachability, nil
+}
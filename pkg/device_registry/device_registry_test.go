@@ -4,7 +4,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 var ip = net.ParseIP("ffff::1")
@@ -50,13 +52,13 @@ func TestRegistry_UpdateConfig(t *testing.T) {
 
 	dev, _ := reg.Create("12345")
 
-	expectedConfig := updateConfig(t, reg, "12345", Config{ip, true, 300})
+	expectedConfig := updateConfig(t, reg, "12345", Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 300})
 	dev, _ = reg.Get("12345")
 	assert.Equal(t, &Device{Defaults: DefaultDefaults, Config: expectedConfig}, dev)
 
 	expectedConfig = updateConfig(t, reg, "12345", Config{})
 	dev, _ = reg.Get("12345")
-	assert.Equal(t, &Device{Defaults: DefaultDefaults, Config: Config{nil, false, 0}}, dev)
+	assert.Equal(t, &Device{Defaults: DefaultDefaults, Config: Config{MainIp: nil, StatePollingEnabled: false, StatePollingIntervalSec: 0}}, dev)
 }
 
 func TestRegistry_UpdateState(t *testing.T) {
@@ -72,6 +74,356 @@ func TestRegistry_UpdateState(t *testing.T) {
 	assert.Equal(t, &Device{Defaults: DefaultDefaults, Config: DefaultConfig, State: expectedState}, dev)
 }
 
+func TestRegistry_UpdateStateWithSeq(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	_, err := reg.UpdateStateWithSeq("12345", testState, StateSeq{Seq: 1})
+	assert.Error(t, err)
+
+	_, _ = reg.Create("12345")
+
+	state2 := testState
+	state2.Vcc = 2800
+
+	tests := []struct {
+		name     string
+		seq      StateSeq
+		state    State
+		applied  bool
+		expected State
+	}{
+		{"first report", StateSeq{Seq: 10}, testState, true, testState},
+		{"duplicate", StateSeq{Seq: 10}, state2, false, testState},
+		{"stale", StateSeq{Seq: 9}, state2, false, testState},
+		{"newer", StateSeq{Seq: 11}, state2, true, state2},
+		{"large step", StateSeq{Seq: 0x7FFFFFF0}, testState, true, testState},
+		{"near wrap-around", StateSeq{Seq: 0xFFFFFF00}, state2, true, state2},
+		{"too far ahead", StateSeq{Seq: 0x7FFFFF00}, testState, false, state2},
+		{"wrapped around", StateSeq{Seq: 1}, testState, true, testState},
+		{"stale after wrap-around", StateSeq{Seq: 0xFFFFFFF0}, state2, false, testState},
+		{"zero in the same boot", StateSeq{Seq: 0}, state2, false, testState},
+		{"reboot", StateSeq{Boot: 1, Seq: 0}, state2, true, state2},
+		{"duplicate after reboot", StateSeq{Boot: 1, Seq: 0}, testState, false, state2},
+		{"counting from one after reboot", StateSeq{Boot: 2, Seq: 1}, testState, true, testState},
+		{"earlier boot", StateSeq{Boot: 1, Seq: 5}, state2, false, testState},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			applied, err := reg.UpdateStateWithSeq("12345", tc.state, tc.seq)
+			require.NoError(t, err)
+			assert.Equal(t, tc.applied, applied)
+			dev, _ := reg.Get("12345")
+			assert.Equal(t, tc.expected, *dev.State)
+		})
+	}
+}
+
+func TestRegistry_Events(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	err := reg.AddEvent("12345", Event{Type: EVENT_REBOOT})
+	assert.Error(t, err)
+	_, err = reg.GetEvents("12345")
+	assert.Error(t, err)
+
+	_, _ = reg.Create("12345")
+
+	events, err := reg.GetEvents("12345")
+	require.NoError(t, err)
+	assert.Equal(t, []Event{}, events)
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	expected := []Event{
+		{Type: EVENT_REBOOT, Message: "power on", Timestamp: ts},
+		{Type: EVENT_BUTTON, Data: []byte(`{"button":1}`), Timestamp: ts.Add(time.Second)},
+	}
+	for _, e := range expected {
+		require.NoError(t, reg.AddEvent("12345", e))
+	}
+
+	events, err = reg.GetEvents("12345")
+	require.NoError(t, err)
+	assert.Equal(t, expected, events)
+
+	// Device state is not affected by events
+	dev, _ := reg.Get("12345")
+	assert.Equal(t, &DefaultDevice, dev)
+}
+
+func TestRegistry_EventsRingBuffer(t *testing.T) {
+	reg := CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+
+	for i := 0; i < MaxEventsPerDevice+10; i++ {
+		require.NoError(t, reg.AddEvent("12345", Event{Type: EVENT_LOG, Message: strconv.Itoa(i)}))
+	}
+
+	events, err := reg.GetEvents("12345")
+	require.NoError(t, err)
+	require.Len(t, events, MaxEventsPerDevice)
+	assert.Equal(t, "10", events[0].Message)
+	assert.Equal(t, strconv.Itoa(MaxEventsPerDevice+9), events[len(events)-1].Message)
+}
+
+func TestRegistry_CommandHistory(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	err := reg.AddCommandResult("12345", CommandResult{Name: "reboot"})
+	assert.Error(t, err)
+
+	_, _ = reg.Create("12345")
+
+	history, err := reg.GetCommandHistory("12345")
+	require.NoError(t, err)
+	assert.Equal(t, []CommandResult{}, history)
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < MaxCommandsPerDevice+1; i++ {
+		require.NoError(t, reg.AddCommandResult("12345", CommandResult{Name: "identify", Timestamp: ts.Add(time.Duration(i) * time.Second), Success: true}))
+	}
+
+	history, err = reg.GetCommandHistory("12345")
+	require.NoError(t, err)
+	require.Len(t, history, MaxCommandsPerDevice)
+	assert.Equal(t, ts.Add(time.Second), history[0].Timestamp)
+
+	// Commands are not mixed with events
+	events, err := reg.GetEvents("12345")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestRegistry_ProbeSamples(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	err := reg.AddProbeSample("12345", ProbeSample{Kind: PROBE_PING})
+	assert.Error(t, err)
+
+	_, _ = reg.Create("12345")
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < MaxProbesPerDevice+1; i++ {
+		require.NoError(t, reg.AddProbeSample("12345", ProbeSample{Kind: PROBE_PING, Timestamp: ts.Add(time.Duration(i) * time.Second), Address: ip, Success: true, RttMs: 12.5}))
+	}
+
+	samples, err := reg.GetProbeSamples("12345")
+	require.NoError(t, err)
+	require.Len(t, samples, MaxProbesPerDevice)
+	assert.Equal(t, ts.Add(time.Second), samples[0].Timestamp)
+	assert.Equal(t, ProbeSample{Kind: PROBE_PING, Timestamp: ts.Add(MaxProbesPerDevice * time.Second), Address: ip, Success: true, RttMs: 12.5}, samples[len(samples)-1])
+}
+
+func TestRegistry_VccHistory(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	assert.Error(t, reg.AddVccSample("12345", VccSample{ts, 2980}))
+	_, _ = reg.Create("12345")
+
+	for i := 0; i < MaxVccSamplesPerDevice+1; i++ {
+		require.NoError(t, reg.AddVccSample("12345", VccSample{ts.Add(time.Duration(i) * time.Minute), 3000 - i}))
+	}
+
+	samples, err := reg.GetVccHistory("12345")
+	require.NoError(t, err)
+	require.Len(t, samples, MaxVccSamplesPerDevice)
+	assert.Equal(t, VccSample{ts.Add(time.Minute), 2999}, samples[0])
+	assert.Equal(t, VccSample{ts.Add(MaxVccSamplesPerDevice * time.Minute), 3000 - MaxVccSamplesPerDevice}, samples[len(samples)-1])
+}
+
+func TestRegistry_BatteryEstimate(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	estimate := &BatteryEstimate{SlopeMvPerDay: -2.5, Vcc: 2900, CutoffVcc: 2000, DaysRemaining: 360, Samples: 100,
+		Timestamp: time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)}
+	assert.Error(t, reg.SetBatteryEstimate("12345", estimate))
+	_, _ = reg.Create("12345")
+
+	require.NoError(t, reg.SetBatteryEstimate("12345", estimate))
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Equal(t, estimate, dev.Battery)
+
+	require.NoError(t, reg.SetBatteryEstimate("12345", nil))
+	dev, err = reg.Get("12345")
+	require.NoError(t, err)
+	assert.Nil(t, dev.Battery)
+}
+
+func TestRegistry_Drift(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	drift := &ConfigDrift{Fields: []string{"txPower"}, DetectedAt: time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)}
+	assert.Error(t, reg.SetDrift("12345", drift))
+
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.SetDrift("12345", nil))
+
+	require.NoError(t, reg.SetDrift("12345", drift))
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Equal(t, drift, dev.Drift)
+
+	require.NoError(t, reg.SetDrift("12345", nil))
+	dev, err = reg.Get("12345")
+	require.NoError(t, err)
+	assert.Nil(t, dev.Drift)
+}
+
+func TestRegistry_AlertRules(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	rules, err := reg.GetAlertRules()
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	vcc := AlertRule{Id: "vcc", Type: ALERT_LOW_VCC, Threshold: 2500, Hysteresis: 100}
+	offline := AlertRule{Id: "offline", Type: ALERT_OFFLINE, Threshold: 3, Tag: "hall"}
+	require.NoError(t, reg.PutAlertRule(vcc))
+	require.NoError(t, reg.PutAlertRule(offline))
+	vcc.Threshold = 2400
+	require.NoError(t, reg.PutAlertRule(vcc))
+
+	rules, err = reg.GetAlertRules()
+	require.NoError(t, err)
+	assert.Equal(t, []AlertRule{offline, vcc}, rules)
+
+	found, err := reg.DeleteAlertRule("offline")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = reg.DeleteAlertRule("offline")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	rules, err = reg.GetAlertRules()
+	require.NoError(t, err)
+	assert.Equal(t, []AlertRule{vcc}, rules)
+}
+
+func TestRegistry_AlertState(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	_, err := reg.GetAlertState("12345")
+	assert.Error(t, err)
+	_, _ = reg.Create("12345")
+
+	state, err := reg.GetAlertState("12345")
+	require.NoError(t, err)
+	assert.Equal(t, AlertState{Active: []Alert{}}, state)
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	alert := Alert{RuleId: "vcc", Type: ALERT_LOW_VCC, Value: 2400, Since: ts, Message: "low"}
+	state = AlertState{Active: []Alert{alert}, LastSeen: &ts, Parent: "0x0400"}
+	require.NoError(t, reg.UpdateAlertState("12345", state))
+
+	stored, err := reg.GetAlertState("12345")
+	require.NoError(t, err)
+	assert.Equal(t, state, stored)
+
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.Equal(t, []Alert{alert}, dev.Alerts)
+}
+
+func TestRegistry_Webhooks(t *testing.T) {
+	reg := CreateTestRegistry(t)
+
+	webhooks, err := reg.GetWebhooks()
+	require.NoError(t, err)
+	assert.Empty(t, webhooks)
+
+	states := Webhook{Id: "states", Url: "https://example.com/states", Events: []string{WEBHOOK_STATE_UPDATED}, Secret: "s3cret"}
+	all := Webhook{Id: "all", Url: "https://example.com/all"}
+	require.NoError(t, reg.PutWebhook(states))
+	require.NoError(t, reg.PutWebhook(all))
+
+	webhooks, err = reg.GetWebhooks()
+	require.NoError(t, err)
+	assert.Equal(t, []Webhook{all, states}, webhooks)
+	w, err := reg.GetWebhook("states")
+	require.NoError(t, err)
+	assert.Equal(t, &states, w)
+	w, err = reg.GetWebhook("foo")
+	require.NoError(t, err)
+	assert.Nil(t, w)
+
+	assert.True(t, states.Accepts(WEBHOOK_STATE_UPDATED))
+	assert.False(t, states.Accepts(WEBHOOK_ALERT))
+	assert.True(t, all.Accepts(WEBHOOK_ALERT))
+
+	// Deleting a webhook drops its queued deliveries and its log
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, reg.EnqueueWebhookDeliveries([]WebhookDelivery{
+		{WebhookId: "states", Event: WEBHOOK_STATE_UPDATED, DeviceId: "12345", Payload: []byte(`{}`), Created: ts, NextAttempt: ts},
+		{WebhookId: "all", Event: WEBHOOK_STATE_UPDATED, DeviceId: "12345", Payload: []byte(`{}`), Created: ts, NextAttempt: ts},
+	}))
+	queue, err := reg.GetWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	require.NoError(t, reg.RecordWebhookAttempt(queue[0], WebhookAttempt{DeliveryId: queue[0].Id, Attempt: 1, Status: DELIVERY_RETRYING}))
+
+	found, err := reg.DeleteWebhook("states")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = reg.DeleteWebhook("states")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	queue, err = reg.GetWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+	assert.Equal(t, "all", queue[0].WebhookId)
+	attempts, err := reg.GetWebhookAttempts("states")
+	require.NoError(t, err)
+	assert.Empty(t, attempts)
+}
+
+func TestRegistry_WebhookQueue(t *testing.T) {
+	reg := CreateTestRegistry(t)
+	require.NoError(t, reg.PutWebhook(Webhook{Id: "all", Url: "https://example.com/all"}))
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	delivery := WebhookDelivery{WebhookId: "all", Event: WEBHOOK_DEVICE_CREATED, DeviceId: "12345", Payload: []byte(`{"type":"device_created"}`), Created: ts, NextAttempt: ts}
+	require.NoError(t, reg.EnqueueWebhookDeliveries([]WebhookDelivery{delivery, delivery}))
+
+	queue, err := reg.GetWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	assert.Equal(t, uint64(1), queue[0].Id)
+	assert.Equal(t, uint64(2), queue[1].Id)
+	assert.JSONEq(t, `{"type":"device_created"}`, string(queue[0].Payload))
+
+	// A retried delivery stays in the queue with its new attempt time, a finished one is removed
+	retried := queue[0]
+	retried.Attempts = 1
+	retried.NextAttempt = ts.Add(time.Minute)
+	retried.LastError = "connection refused"
+	require.NoError(t, reg.RecordWebhookAttempt(retried, WebhookAttempt{DeliveryId: 1, Attempt: 1, Timestamp: ts, Status: DELIVERY_RETRYING, Error: "connection refused"}))
+	require.NoError(t, reg.RecordWebhookAttempt(queue[1], WebhookAttempt{DeliveryId: 2, Attempt: 1, Timestamp: ts, Status: DELIVERY_DELIVERED, StatusCode: 200}))
+
+	queue, err = reg.GetWebhookQueue()
+	require.NoError(t, err)
+	assert.Equal(t, []WebhookDelivery{retried}, queue)
+
+	attempts, err := reg.GetWebhookAttempts("all")
+	require.NoError(t, err)
+	assert.Equal(t, []WebhookAttempt{
+		{DeliveryId: 1, Attempt: 1, Timestamp: ts, Status: DELIVERY_RETRYING, Error: "connection refused"},
+		{DeliveryId: 2, Attempt: 1, Timestamp: ts, Status: DELIVERY_DELIVERED, StatusCode: 200},
+	}, attempts)
+}
+
+func TestDefaults_DriftFrom(t *testing.T) {
+	defaults := Defaults{Instance: "A100", TxPower: -4, PollPeriod: 1000}
+	assert.Empty(t, defaults.DriftFrom(testState))
+
+	state := testState
+	state.Instance = "A101"
+	state.PollPeriod = 5000
+	assert.Equal(t, []string{"instance", "pollPeriod"}, defaults.DriftFrom(state))
+}
+
 func TestRegistry_GetDevices(t *testing.T) {
 	reg := CreateTestRegistry(t)
 
@@ -89,7 +441,7 @@ func TestRegistry_GetDevices(t *testing.T) {
 	expected["12345"] = Device{Defaults: expectedDefaults, Config: DefaultConfig}
 	assert.Equal(t, expected, getAll(t, reg))
 
-	expectedConfig := updateConfig(t, reg, "12345", Config{ip, true, 100})
+	expectedConfig := updateConfig(t, reg, "12345", Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 100})
 	expected["12345"] = Device{Defaults: expectedDefaults, Config: expectedConfig}
 	assert.Equal(t, expected, getAll(t, reg))
 
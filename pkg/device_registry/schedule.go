@@ -0,0 +1,235 @@
+package device_registry
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What to do with a poll that is due outside the allowed windows
+const (
+	// Poll at the start of the next window
+	OUTSIDE_WINDOW_DEFER = "defer"
+	// Drop the poll and wait for the next regular poll
+	OUTSIDE_WINDOW_SKIP = "skip"
+)
+
+// Schedule limits the radio traffic initiated by the server to the given windows, eg. to keep devices quiet at
+// night. Without windows traffic is allowed at any time.
+type Schedule struct {
+	// IANA time zone of the windows, eg. 'Europe/Helsinki'. Empty means UTC.
+	Timezone string           `json:"timezone,omitempty"`
+	Windows  []ScheduleWindow `json:"windows"`
+	// One of OUTSIDE_WINDOW_DEFER or OUTSIDE_WINDOW_SKIP, empty means OUTSIDE_WINDOW_DEFER
+	OutsideWindow string `json:"outsideWindow,omitempty"`
+}
+
+// ScheduleWindow allows traffic from Start to End on the given days of week. Days use the cron day of week syntax,
+// eg. '*', '1-5' or 'mon,wed,fri'. A window ending before it starts continues past midnight, and a window ending
+// when it starts lasts the whole day.
+type ScheduleWindow struct {
+	Days  string `json:"days"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Returns true if the schedule allows traffic at t. Parses the schedule on each call, use Compile for checking
+// it repeatedly.
+func (s *Schedule) Allows(t time.Time) bool {
+	return s.compiled().Allows(t)
+}
+
+// Returns the earliest time at or after t when the schedule allows traffic
+func (s *Schedule) NextAllowed(t time.Time) time.Time {
+	return s.compiled().NextAllowed(t)
+}
+
+// Returns true if polls due outside the windows are deferred to the next window instead of being skipped
+func (s *Schedule) DefersPolls() bool {
+	return s == nil || s.OutsideWindow != OUTSIDE_WINDOW_SKIP
+}
+
+// Compile parses the windows and loads the time zone of the schedule. A schedule without windows compiles to nil,
+// which allows traffic at any time.
+func (s *Schedule) Compile() (*CompiledSchedule, error) {
+	if s == nil || len(s.Windows) == 0 {
+		return nil, nil
+	}
+	windows, loc, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledSchedule{windows: windows, loc: loc, defersPolls: s.DefersPolls()}, nil
+}
+
+// Schedules are validated before they are stored, so this fails only if eg. the time zone database has changed
+func (s *Schedule) compiled() *CompiledSchedule {
+	c, err := s.Compile()
+	if err != nil {
+		log.Errorf("invalid schedule, allowing traffic at any time: %v", err)
+	}
+	return c
+}
+
+// CompiledSchedule is a parsed Schedule. A nil CompiledSchedule allows traffic at any time.
+type CompiledSchedule struct {
+	windows     []parsedWindow
+	loc         *time.Location
+	defersPolls bool
+}
+
+// Returns true if the schedule allows traffic at t
+func (c *CompiledSchedule) Allows(t time.Time) bool {
+	if c == nil {
+		return true
+	}
+
+	t = t.In(c.loc)
+	for offset := -1; offset <= 0; offset++ {
+		for _, w := range c.windows {
+			start, end, ok := w.on(t, offset, c.loc)
+			if ok && !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the earliest time at or after t when the schedule allows traffic
+func (c *CompiledSchedule) NextAllowed(t time.Time) time.Time {
+	if c.Allows(t) {
+		return t
+	}
+
+	var next time.Time
+	t = t.In(c.loc)
+	for offset := 0; offset <= 7; offset++ {
+		for _, w := range c.windows {
+			start, _, ok := w.on(t, offset, c.loc)
+			if ok && start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	if next.IsZero() {
+		return t
+	}
+	return next
+}
+
+// Returns true if polls due outside the windows are deferred to the next window instead of being skipped
+func (c *CompiledSchedule) DefersPolls() bool {
+	return c == nil || c.defersPolls
+}
+
+type parsedWindow struct {
+	days       [7]bool
+	start, end int // Minutes from midnight
+}
+
+func (s *Schedule) parse() ([]parsedWindow, *time.Location, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var windows []parsedWindow
+	for _, w := range s.Windows {
+		var pw parsedWindow
+		pw.days, err = parseDays(w.Days)
+		if err != nil {
+			return nil, nil, err
+		}
+		pw.start, err = parseTimeOfDay(w.Start)
+		if err != nil {
+			return nil, nil, err
+		}
+		pw.end, err = parseTimeOfDay(w.End)
+		if err != nil {
+			return nil, nil, err
+		}
+		windows = append(windows, pw)
+	}
+	return windows, loc, nil
+}
+
+// Returns the window starting on the day offset days from t, or false if the window isn't active on that day
+func (w parsedWindow) on(t time.Time, offset int, loc *time.Location) (time.Time, time.Time, bool) {
+	day := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, loc)
+	if !w.days[day.Weekday()] {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, w.start, 0, 0, loc)
+	end := time.Date(day.Year(), day.Month(), day.Day(), 0, w.end, 0, 0, loc)
+	if w.end <= w.start {
+		end = time.Date(day.Year(), day.Month(), day.Day()+1, 0, w.end, 0, 0, loc)
+	}
+	return start, end, true
+}
+
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+	if strings.TrimSpace(spec) == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		first, err := parseDay(bounds[0])
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = parseDay(bounds[1])
+			if err != nil {
+				return days, err
+			}
+		}
+		if last < first {
+			return days, errors.Errorf("invalid day range '%v'", item)
+		}
+		for d := first; d <= last; d++ {
+			days[d%7] = true
+		}
+	}
+	return days, nil
+}
+
+func parseDay(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range dayNames {
+		if s == name {
+			return i, nil
+		}
+	}
+	// Both 0 and 7 are Sunday
+	d, err := strconv.Atoi(s)
+	if err != nil || d < 0 || d > 7 {
+		return 0, errors.Errorf("invalid day '%v'", s)
+	}
+	return d, nil
+}
+
+// Parses HH:MM into minutes from midnight, 24:00 is allowed as the end of day
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time '%v', must be HH:MM", s)
+	}
+	h, errH := strconv.Atoi(parts[0])
+	m, errM := strconv.Atoi(parts[1])
+	if errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("invalid time '%v', must be HH:MM", s)
+	}
+	return h*60 + m, nil
+}
@@ -0,0 +1,91 @@
+package device_registry
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSchedule_Allows(t *testing.T) {
+	// Weekdays in daytime and a late window on Friday continuing past midnight
+	s := &Schedule{Timezone: "Europe/Helsinki", Windows: []ScheduleWindow{
+		{Days: "mon-fri", Start: "07:00", End: "22:00"},
+		{Days: "5", Start: "22:00", End: "02:00"},
+	}}
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		t       time.Time
+		allowed bool
+	}{
+		"monday morning":      {time.Date(2020, 11, 23, 7, 0, 0, 0, loc), true},
+		"monday night":        {time.Date(2020, 11, 23, 22, 0, 0, 0, loc), false},
+		"tuesday early":       {time.Date(2020, 11, 24, 6, 59, 0, 0, loc), false},
+		"friday late":         {time.Date(2020, 11, 27, 23, 30, 0, 0, loc), true},
+		"saturday after mid":  {time.Date(2020, 11, 28, 1, 59, 0, 0, loc), true},
+		"saturday morning":    {time.Date(2020, 11, 28, 10, 0, 0, 0, loc), false},
+		"same instant in UTC": {time.Date(2020, 11, 23, 5, 0, 0, 0, time.UTC), true},
+		"UTC before window":   {time.Date(2020, 11, 23, 4, 59, 0, 0, time.UTC), false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.allowed, s.Allows(tc.t))
+		})
+	}
+
+	var noSchedule *Schedule
+	assert.True(t, noSchedule.Allows(time.Now()))
+	assert.True(t, (&Schedule{}).Allows(time.Now()))
+
+	allDay := &Schedule{Windows: []ScheduleWindow{{Days: "0,6", Start: "00:00", End: "00:00"}}}
+	assert.True(t, allDay.Allows(time.Date(2020, 11, 28, 23, 59, 0, 0, time.UTC)))
+	assert.False(t, allDay.Allows(time.Date(2020, 11, 30, 12, 0, 0, 0, time.UTC)))
+}
+
+func TestSchedule_NextAllowed(t *testing.T) {
+	s := &Schedule{Windows: []ScheduleWindow{
+		{Days: "mon-fri", Start: "07:00", End: "22:00"},
+		{Days: "sat", Start: "10:00", End: "12:00"},
+	}}
+
+	now := time.Date(2020, 11, 23, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, now, s.NextAllowed(now))
+	assert.Equal(t, time.Date(2020, 11, 24, 7, 0, 0, 0, time.UTC), s.NextAllowed(time.Date(2020, 11, 23, 23, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2020, 11, 28, 10, 0, 0, 0, time.UTC), s.NextAllowed(time.Date(2020, 11, 27, 22, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2020, 11, 30, 7, 0, 0, 0, time.UTC), s.NextAllowed(time.Date(2020, 11, 28, 12, 0, 0, 0, time.UTC)))
+}
+
+func TestSchedule_Compile(t *testing.T) {
+	var noSchedule *Schedule
+	compiled, err := noSchedule.Compile()
+	require.NoError(t, err)
+	assert.Nil(t, compiled)
+	assert.True(t, compiled.Allows(time.Now()))
+	assert.True(t, compiled.DefersPolls())
+
+	s := &Schedule{OutsideWindow: OUTSIDE_WINDOW_SKIP, Windows: []ScheduleWindow{{Days: "sat", Start: "10:00", End: "12:00"}}}
+	compiled, err = s.Compile()
+	require.NoError(t, err)
+	assert.False(t, compiled.Allows(time.Date(2020, 11, 23, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2020, 11, 28, 10, 0, 0, 0, time.UTC), compiled.NextAllowed(time.Date(2020, 11, 23, 12, 0, 0, 0, time.UTC)))
+	assert.False(t, compiled.DefersPolls())
+
+	// Invalid schedules fail to compile and are logged, but don't block traffic
+	s.Timezone = "Mars/Olympus_Mons"
+	_, err = s.Compile()
+	assert.Error(t, err)
+	assert.True(t, s.Allows(time.Date(2020, 11, 23, 12, 0, 0, 0, time.UTC)))
+}
+
+func TestSchedule_Validate(t *testing.T) {
+	assert.NoError(t, Schedule{}.Validate())
+	assert.NoError(t, Schedule{Timezone: "Europe/Helsinki", OutsideWindow: OUTSIDE_WINDOW_SKIP,
+		Windows: []ScheduleWindow{{Days: "*", Start: "07:00", End: "24:00"}, {Days: "1-7", Start: "0:00", End: "1:30"}}}.Validate())
+	assert.EqualError(t, Schedule{Timezone: "Mars/Olympus", OutsideWindow: "later"}.Validate(),
+		"invalid schedule: unknown timezone 'Mars/Olympus', outsideWindow must be one of defer, skip")
+	assert.EqualError(t, Schedule{Windows: []ScheduleWindow{{Days: "fri-mon", Start: "25:00", End: "7"}}}.Validate(),
+		"invalid schedule: windows[0].days: invalid day range 'fri-mon', windows[0].start: invalid time '25:00', must be HH:MM, "+
+			"windows[0].end: invalid time '7', must be HH:MM")
+}
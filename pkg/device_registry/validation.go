@@ -0,0 +1,133 @@
+package device_registry
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MinVcc         = 0
+	MaxVcc         = 5000
+	MinTxPower     = -40
+	MaxTxPower     = 8
+	MinRssi        = -128
+	MaxRssi        = 0
+	MaxLinkQuality = 3
+	MaxPort        = 65535
+)
+
+var instanceRegexp = regexp.MustCompile(`^[0-9A-Za-z]{1,16}$`)
+var rloc16Regexp = regexp.MustCompile(`^0x[0-9A-Fa-f]{4}$`)
+
+type validationErrors []string
+
+func (v *validationErrors) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*v = append(*v, fmt.Sprintf(format, args...))
+	}
+}
+
+func (v validationErrors) toError(what string) error {
+	if len(v) == 0 {
+		return nil
+	}
+	return errors.Errorf("invalid %v: %v", what, strings.Join(v, ", "))
+}
+
+func (s State) Validate() error {
+	var v validationErrors
+	v.check(instanceRegexp.MatchString(s.Instance), "instance must be 1-16 alphanumeric characters")
+	v.check(s.Vcc >= MinVcc && s.Vcc <= MaxVcc, "vcc must be between %v and %v", MinVcc, MaxVcc)
+	v.check(s.TxPower >= MinTxPower && s.TxPower <= MaxTxPower, "txPower must be between %v and %v", MinTxPower, MaxTxPower)
+	v.check(s.PollPeriod >= 0, "pollPeriod must not be negative")
+	for _, a := range s.Addresses {
+		v.check(a != nil, "addresses must not contain nulls")
+	}
+	v.check(rloc16Regexp.MatchString(s.Parent.Rloc16), "parent.rloc16 must be formatted as 0xHHHH")
+	v.check(s.Parent.LinkQualityIn >= 0 && s.Parent.LinkQualityIn <= MaxLinkQuality, "parent.linkQualityIn must be between 0 and %v", MaxLinkQuality)
+	v.check(s.Parent.LinkQualityOut >= 0 && s.Parent.LinkQualityOut <= MaxLinkQuality, "parent.linkQualityOut must be between 0 and %v", MaxLinkQuality)
+	v.check(s.Parent.AvgRssi >= MinRssi && s.Parent.AvgRssi <= MaxRssi, "parent.avgRssi must be between %v and %v", MinRssi, MaxRssi)
+	v.check(s.Parent.LatestRssi >= MinRssi && s.Parent.LatestRssi <= MaxRssi, "parent.latestRssi must be between %v and %v", MinRssi, MaxRssi)
+	return v.toError("state")
+}
+
+func (e Event) Validate() error {
+	var v validationErrors
+	v.check(IsValidEventType(e.Type), "type must be one of %v", strings.Join(EventTypes, ", "))
+	return v.toError("event")
+}
+
+func (c Config) Validate() error {
+	var v validationErrors
+	v.check(c.StateMode == "" || IsValidStateMode(c.StateMode), "stateMode must be one of %v", strings.Join(StateModes, ", "))
+	if err := v.toError("config"); err != nil {
+		return err
+	}
+	if c.Transport != nil {
+		if err := c.Transport.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Schedule != nil {
+		return c.Schedule.Validate()
+	}
+	return nil
+}
+
+func (s Schedule) Validate() error {
+	var v validationErrors
+	_, err := time.LoadLocation(s.Timezone)
+	v.check(err == nil, "unknown timezone '%v'", s.Timezone)
+	v.check(s.OutsideWindow == "" || s.OutsideWindow == OUTSIDE_WINDOW_DEFER || s.OutsideWindow == OUTSIDE_WINDOW_SKIP,
+		"outsideWindow must be one of %v, %v", OUTSIDE_WINDOW_DEFER, OUTSIDE_WINDOW_SKIP)
+	for i, w := range s.Windows {
+		_, err = parseDays(w.Days)
+		v.check(err == nil, "windows[%v].days: %v", i, err)
+		_, err = parseTimeOfDay(w.Start)
+		v.check(err == nil, "windows[%v].start: %v", i, err)
+		_, err = parseTimeOfDay(w.End)
+		v.check(err == nil, "windows[%v].end: %v", i, err)
+	}
+	return v.toError("schedule")
+}
+
+func (r AlertRule) Validate() error {
+	var v validationErrors
+	v.check(r.Id != "", "id must be given")
+	v.check(IsValidAlertType(r.Type), "type must be one of %v", strings.Join(AlertTypes, ", "))
+	v.check(r.Hysteresis >= 0, "hysteresis must not be negative")
+	v.check(r.Type != ALERT_PARENT_CHANGES || r.WindowSec > 0, "windowSec must be positive for %v", ALERT_PARENT_CHANGES)
+	v.check(r.Type != ALERT_OFFLINE || r.Threshold >= 1, "threshold must be at least 1 for %v", ALERT_OFFLINE)
+	for i, hook := range r.Webhooks {
+		v.check(hook != "", "webhooks[%v] must be a webhook id", i)
+	}
+	return v.toError("alert rule")
+}
+
+func (w Webhook) Validate() error {
+	var v validationErrors
+	v.check(w.Id != "", "id must be given")
+	v.check(isHttpUrl(w.Url), "url must be an http(s) URL")
+	for i, e := range w.Events {
+		v.check(IsValidWebhookEvent(e), "events[%v] must be one of %v", i, strings.Join(WebhookEvents, ", "))
+	}
+	return v.toError("webhook")
+}
+
+func (t TransportConfig) Validate() error {
+	var v validationErrors
+	v.check(t.Port >= 0 && t.Port <= MaxPort, "port must be 0 (default) or between 1 and %v", MaxPort)
+	v.check(t.AckTimeoutMs >= 0, "ackTimeoutMs must not be negative")
+	v.check(t.MaxRetransmit >= 0, "maxRetransmit must not be negative")
+	v.check(t.DeadlineSec >= 0, "deadlineSec must not be negative")
+	return v.toError("transport config")
+}
+
+func isHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,74 @@
+package device_registry
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestState_Validate(t *testing.T) {
+	assert.NoError(t, testState.Validate())
+
+	tests := map[string]struct {
+		modify   func(s *State)
+		expected string
+	}{
+		"empty instance":  {func(s *State) { s.Instance = "" }, "invalid state: instance must be 1-16 alphanumeric characters"},
+		"too high vcc":    {func(s *State) { s.Vcc = 6000 }, "invalid state: vcc must be between 0 and 5000"},
+		"too low txPower": {func(s *State) { s.TxPower = -41 }, "invalid state: txPower must be between -40 and 8"},
+		"negative period": {func(s *State) { s.PollPeriod = -1 }, "invalid state: pollPeriod must not be negative"},
+		"null address":    {func(s *State) { s.Addresses = []net.IP{nil} }, "invalid state: addresses must not contain nulls"},
+		"invalid rloc16":  {func(s *State) { s.Parent.Rloc16 = "4400" }, "invalid state: parent.rloc16 must be formatted as 0xHHHH"},
+		"invalid lqi":     {func(s *State) { s.Parent.LinkQualityIn = 4 }, "invalid state: parent.linkQualityIn must be between 0 and 3"},
+		"positive rssi":   {func(s *State) { s.Parent.AvgRssi = 10 }, "invalid state: parent.avgRssi must be between -128 and 0"},
+		"multiple errors": {func(s *State) { s.Vcc = -1; s.Parent.LatestRssi = -200 },
+			"invalid state: vcc must be between 0 and 5000, parent.latestRssi must be between -128 and 0"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := testState
+			tc.modify(&s)
+			assert.EqualError(t, s.Validate(), tc.expected)
+		})
+	}
+}
+
+func TestEvent_Validate(t *testing.T) {
+	assert.NoError(t, Event{Type: EVENT_REBOOT}.Validate())
+	assert.EqualError(t, Event{Type: "FOO"}.Validate(), "invalid event: type must be one of REBOOT, CRASH, ASSERT, BUTTON, LOG")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{StateMode: STATE_MODE_HYBRID}.Validate())
+	assert.EqualError(t, Config{StateMode: "foo"}.Validate(), "invalid config: stateMode must be one of poll, push, hybrid")
+	assert.EqualError(t, Config{Transport: &TransportConfig{Port: 70000}}.Validate(), "invalid transport config: port must be 0 (default) or between 1 and 65535")
+}
+
+func TestTransportConfig_Validate(t *testing.T) {
+	assert.NoError(t, TransportConfig{}.Validate())
+	assert.NoError(t, TransportConfig{Port: 5683, AckTimeoutMs: 60000, MaxRetransmit: 2, DeadlineSec: 300}.Validate())
+	assert.EqualError(t, TransportConfig{Port: 70000}.Validate(), "invalid transport config: port must be 0 (default) or between 1 and 65535")
+	assert.EqualError(t, TransportConfig{MaxRetransmit: -1, DeadlineSec: -1}.Validate(),
+		"invalid transport config: maxRetransmit must not be negative, deadlineSec must not be negative")
+}
+
+func TestAlertRule_Validate(t *testing.T) {
+	assert.NoError(t, AlertRule{Id: "vcc", Type: ALERT_LOW_VCC, Threshold: 2500, Hysteresis: 100, Webhooks: []string{"ops"}}.Validate())
+	assert.NoError(t, AlertRule{Id: "roaming", Type: ALERT_PARENT_CHANGES, Threshold: 5, WindowSec: 3600}.Validate())
+	assert.EqualError(t, AlertRule{Type: "foo", Hysteresis: -1}.Validate(),
+		"invalid alert rule: id must be given, type must be one of low_vcc, low_rssi, low_link_quality, offline, parent_changes, battery_days, hysteresis must not be negative")
+	assert.EqualError(t, AlertRule{Id: "roaming", Type: ALERT_PARENT_CHANGES, Threshold: 5}.Validate(),
+		"invalid alert rule: windowSec must be positive for parent_changes")
+	assert.EqualError(t, AlertRule{Id: "offline", Type: ALERT_OFFLINE, Webhooks: []string{""}}.Validate(),
+		"invalid alert rule: threshold must be at least 1 for offline, webhooks[0] must be a webhook id")
+}
+
+func TestWebhook_Validate(t *testing.T) {
+	assert.NoError(t, Webhook{Id: "all", Url: "https://example.com/hook"}.Validate())
+	assert.NoError(t, Webhook{Id: "states", Url: "http://localhost:8000", Events: []string{WEBHOOK_STATE_UPDATED}, Secret: "s3cret"}.Validate())
+	assert.EqualError(t, Webhook{Url: "example.com", Events: []string{WEBHOOK_ALERT, "foo"}}.Validate(),
+		"invalid webhook: id must be given, url must be an http(s) URL, "+
+			"events[1] must be one of device_created, device_deleted, state_updated, defaults_updated, alert")
+}
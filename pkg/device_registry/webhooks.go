@@ -0,0 +1,341 @@
+package device_registry
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+const (
+	WEBHOOK_DEVICE_CREATED   = "device_created"
+	WEBHOOK_DEVICE_DELETED   = "device_deleted"
+	WEBHOOK_STATE_UPDATED    = "state_updated"
+	WEBHOOK_DEFAULTS_UPDATED = "defaults_updated"
+	WEBHOOK_ALERT            = "alert"
+)
+
+var WebhookEvents = []string{WEBHOOK_DEVICE_CREATED, WEBHOOK_DEVICE_DELETED, WEBHOOK_STATE_UPDATED, WEBHOOK_DEFAULTS_UPDATED, WEBHOOK_ALERT}
+
+const (
+	// The receiver answered with a 2xx status
+	DELIVERY_DELIVERED = "delivered"
+	// The attempt failed and the delivery is retried later
+	DELIVERY_RETRYING = "retrying"
+	// The attempt failed and the delivery was given up
+	DELIVERY_FAILED = "failed"
+)
+
+// Webhook is an HTTP endpoint that device events are POSTed to
+type Webhook struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// Event types sent to the webhook, empty sends all events
+	Events []string `json:"events,omitempty"`
+	// Key for signing the request bodies with HMAC-SHA256, empty sends the requests unsigned
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookEvent is the body POSTed to the webhooks
+type WebhookEvent struct {
+	Type      string      `json:"type"`
+	DeviceId  string      `json:"deviceId"`
+	Timestamp time.Time   `json:"ts"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// WebhookDelivery is an event waiting in the queue to be delivered to a webhook
+type WebhookDelivery struct {
+	Id          uint64          `json:"id"`
+	WebhookId   string          `json:"webhookId"`
+	Event       string          `json:"event"`
+	DeviceId    string          `json:"deviceId"`
+	Payload     json.RawMessage `json:"payload"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// WebhookAttempt is the outcome of a single attempt to deliver an event
+type WebhookAttempt struct {
+	DeliveryId uint64    `json:"deliveryId"`
+	Event      string    `json:"event"`
+	DeviceId   string    `json:"deviceId"`
+	Attempt    int       `json:"attempt"`
+	Timestamp  time.Time `json:"ts"`
+	Status     string    `json:"status"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+const WebhooksBucket = "Webhooks"
+const WebhookQueueBucket = "WebhookQueue"
+const WebhookLogBucket = "WebhookLog"
+
+const MaxQueuedWebhookDeliveries = 10000
+const MaxWebhookAttemptsLogged = 200
+
+// Returns true if the event type should be sent to the webhook
+func (w Webhook) Accepts(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates the webhook or replaces the webhook with the same id
+func (r *Registry) PutWebhook(webhook Webhook) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(WebhooksBucket))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		buf, err := json.Marshal(webhook)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal: %v", webhook.Id)
+		}
+		return errors.WithStack(b.Put([]byte(webhook.Id), buf))
+	})
+}
+
+// Deletes the webhook together with its queued deliveries and delivery log. Returns false if the webhook didn't exist.
+func (r *Registry) DeleteWebhook(id string) (bool, error) {
+	found := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(WebhooksBucket))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return nil
+		}
+		found = true
+		err := b.Delete([]byte(id))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if logs := tx.Bucket([]byte(WebhookLogBucket)); logs != nil && logs.Bucket([]byte(id)) != nil {
+			err = logs.DeleteBucket([]byte(id))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		queue := tx.Bucket([]byte(WebhookQueueBucket))
+		if queue == nil {
+			return nil
+		}
+		var keys [][]byte
+		err = queue.ForEach(func(k []byte, v []byte) error {
+			d, err := webhookDeliveryFromJSON(v)
+			if err != nil {
+				return err
+			}
+			if d.WebhookId == id {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = queue.Delete(k); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Returns the webhook, or nil if it doesn't exist
+func (r *Registry) GetWebhook(id string) (*Webhook, error) {
+	var webhook *Webhook
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(WebhooksBucket))
+		if b == nil {
+			return nil
+		}
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		w, err := webhookFromJSON(buf)
+		webhook = &w
+		return err
+	})
+	return webhook, err
+}
+
+// Returns all webhooks ordered by id
+func (r *Registry) GetWebhooks() ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(WebhooksBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			w, err := webhookFromJSON(v)
+			if err != nil {
+				return err
+			}
+			webhooks = append(webhooks, w)
+			return nil
+		})
+	})
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Id < webhooks[j].Id })
+	return webhooks, err
+}
+
+// Adds the deliveries to the queue and assigns their ids. When the queue is full the oldest deliveries are dropped.
+func (r *Registry) EnqueueWebhookDeliveries(deliveries []WebhookDelivery) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(WebhookQueueBucket))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, d := range deliveries {
+			d.Id, err = b.NextSequence()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			err = putWebhookDelivery(b, d)
+			if err != nil {
+				return err
+			}
+		}
+
+		dropped, err := dropOldest(b, MaxQueuedWebhookDeliveries)
+		if dropped > 0 {
+			log.Warnf("Webhook queue is full, dropped %v oldest deliveries", dropped)
+		}
+		return err
+	})
+}
+
+// Returns the queued deliveries in the order they were queued
+func (r *Registry) GetWebhookQueue() ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(WebhookQueueBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			d, err := webhookDeliveryFromJSON(v)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+			return nil
+		})
+	})
+	return deliveries, err
+}
+
+// RecordWebhookAttempt logs an attempt to deliver the delivery. A delivered or failed delivery is removed from the
+// queue, otherwise the delivery is updated in the queue for the next attempt. Deliveries that have been dropped from
+// the queue in the meantime, eg. because their webhook was deleted, are not added back.
+func (r *Registry) RecordWebhookAttempt(delivery WebhookDelivery, attempt WebhookAttempt) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		queue, err := tx.CreateBucketIfNotExists([]byte(WebhookQueueBucket))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		key := sequenceKey(delivery.Id)
+		if attempt.Status == DELIVERY_RETRYING {
+			if queue.Get(key) != nil {
+				err = putWebhookDelivery(queue, delivery)
+			}
+		} else {
+			err = queue.Delete(key)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// The webhook may have been deleted while the attempt was in flight
+		if webhooks := tx.Bucket([]byte(WebhooksBucket)); webhooks == nil || webhooks.Get([]byte(delivery.WebhookId)) == nil {
+			return nil
+		}
+		logs, err := tx.CreateBucketIfNotExists([]byte(WebhookLogBucket))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		b, err := logs.CreateBucketIfNotExists([]byte(delivery.WebhookId))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return appendToRingBuffer(b, attempt, MaxWebhookAttemptsLogged)
+	})
+}
+
+// Returns the latest delivery attempts of the webhook, oldest first
+func (r *Registry) GetWebhookAttempts(id string) ([]WebhookAttempt, error) {
+	attempts := []WebhookAttempt{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		logs := tx.Bucket([]byte(WebhookLogBucket))
+		if logs == nil {
+			return nil
+		}
+		b := logs.Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			a := WebhookAttempt{}
+			err := json.Unmarshal(v, &a)
+			if err != nil {
+				return errors.Wrapf(err, "failed to unmarshal webhook attempt from db, data: %v", string(v))
+			}
+			attempts = append(attempts, a)
+			return nil
+		})
+	})
+	return attempts, err
+}
+
+func putWebhookDelivery(b *bolt.Bucket, d WebhookDelivery) error {
+	buf, err := json.Marshal(d)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal webhook delivery %v", d.Id)
+	}
+	return errors.WithStack(b.Put(sequenceKey(d.Id), buf))
+}
+
+func webhookFromJSON(buf []byte) (Webhook, error) {
+	w := Webhook{}
+	err := json.Unmarshal(buf, &w)
+	if err != nil {
+		return w, errors.Wrapf(err, "failed to unmarshal webhook from db, data: %v", string(buf))
+	}
+	return w, nil
+}
+
+func webhookDeliveryFromJSON(buf []byte) (WebhookDelivery, error) {
+	d := WebhookDelivery{}
+	err := json.Unmarshal(buf, &d)
+	if err != nil {
+		return d, errors.Wrapf(err, "failed to unmarshal webhook delivery from db, data: %v", string(buf))
+	}
+	return d, nil
+}
+
+func IsValidWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
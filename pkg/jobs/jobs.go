@@ -0,0 +1,334 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PENDING   = "PENDING"
+	RUNNING   = "RUNNING"
+	SUCCEEDED = "SUCCEEDED"
+	FAILED    = "FAILED"
+	CANCELLED = "CANCELLED"
+)
+
+const DefaultWorkers = 4
+const DefaultQueueSize = 100
+
+// How many finished jobs are kept around for querying
+const MaxFinishedJobs = 1000
+
+const subscriberBufferSize = 32
+
+var ErrQueueFull = errors.New("job queue is full")
+var ErrStopped = errors.New("job manager is stopped")
+
+type Job struct {
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	DeviceId  string      `json:"deviceId,omitempty"`
+	Status    string      `json:"status"`
+	Progress  string      `json:"progress,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	// Time a job submitted with SubmitAt is queued to run
+	ScheduledAt *time.Time `json:"scheduledAt,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (j Job) IsFinished() bool {
+	return j.Status == SUCCEEDED || j.Status == FAILED || j.Status == CANCELLED
+}
+
+// Func does the actual work of a job. It should return as soon as possible when ctx is cancelled.
+type Func func(ctx context.Context, progress func(msg string)) (interface{}, error)
+
+type job struct {
+	Job
+	f      Func
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Queues a job submitted with SubmitAt
+	timer *time.Timer
+}
+
+type Manager struct {
+	mu          sync.Mutex
+	jobs        map[string]*job
+	finished    []string
+	queue       chan *job
+	subscribers map[chan Job]struct{}
+	stopped     bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// Create starts a job manager running at most `workers` jobs concurrently
+func Create(workers int, queueSize int) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		jobs:        make(map[string]*job),
+		queue:       make(chan *job, queueSize),
+		subscribers: make(map[chan Job]struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	return m
+}
+
+func (m *Manager) Submit(jobType string, deviceId string, f Func) (Job, error) {
+	j := m.newJob(jobType, deviceId, f)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		j.cancel()
+		return Job{}, ErrStopped
+	}
+
+	select {
+	case m.queue <- j:
+	default:
+		j.cancel()
+		return Job{}, ErrQueueFull
+	}
+
+	m.jobs[j.Id] = j
+	m.publish(j.Job)
+	return j.Job, nil
+}
+
+// SubmitAt queues the job at the given time. Until then the job is pending without taking a worker or a place
+// in the queue. If the queue is full at that time the job fails.
+func (m *Manager) SubmitAt(jobType string, deviceId string, at time.Time, f Func) (Job, error) {
+	if !at.After(time.Now()) {
+		return m.Submit(jobType, deviceId, f)
+	}
+	j := m.newJob(jobType, deviceId, f)
+	j.ScheduledAt = &at
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		j.cancel()
+		return Job{}, ErrStopped
+	}
+
+	m.jobs[j.Id] = j
+	j.timer = time.AfterFunc(time.Until(at), func() { m.enqueueScheduled(j) })
+	m.publish(j.Job)
+	return j.Job, nil
+}
+
+func (m *Manager) enqueueScheduled(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if j.Status != PENDING {
+		return
+	}
+	if m.stopped {
+		m.finish(j, CANCELLED, nil, context.Canceled)
+		return
+	}
+	select {
+	case m.queue <- j:
+	default:
+		m.finish(j, FAILED, nil, ErrQueueFull)
+		j.cancel()
+	}
+}
+
+func (m *Manager) newJob(jobType string, deviceId string, f Func) *job {
+	ctx, cancel := context.WithCancel(m.ctx)
+	return &job{
+		Job: Job{
+			Id:        newJobId(),
+			Type:      jobType,
+			DeviceId:  deviceId,
+			Status:    PENDING,
+			CreatedAt: time.Now(),
+		},
+		f:      f,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, found := m.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+	return j.Job, true
+}
+
+// List returns all known jobs, newest first
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make([]Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		ret = append(ret, j.Job)
+	}
+	sort.Slice(ret, func(i, k int) bool {
+		return ret[i].CreatedAt.After(ret[k].CreatedAt)
+	})
+	return ret
+}
+
+// Cancel cancels a pending or running job. Running jobs end up cancelled once their Func returns.
+func (m *Manager) Cancel(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, found := m.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+
+	if j.Status == PENDING {
+		m.finish(j, CANCELLED, nil, context.Canceled)
+	}
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.cancel()
+	return j.Job, true
+}
+
+// Subscribe returns a channel receiving every job update. Updates are dropped for subscribers that
+// don't keep up. The returned function must be called to unsubscribe.
+func (m *Manager) Subscribe() (<-chan Job, func()) {
+	ch := make(chan Job, subscriberBufferSize)
+
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+
+	return ch, func() {
+		m.mu.Lock()
+		delete(m.subscribers, ch)
+		m.mu.Unlock()
+	}
+}
+
+// Stop cancels all pending and running jobs and waits for the workers to exit
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	m.stopped = true
+	m.cancel()
+	close(m.queue)
+	for _, j := range m.jobs {
+		if j.timer != nil && j.timer.Stop() {
+			m.finish(j, CANCELLED, nil, context.Canceled)
+		}
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+func (m *Manager) worker() {
+	defer m.wg.Done()
+	for j := range m.queue {
+		m.run(j)
+	}
+}
+
+func (m *Manager) run(j *job) {
+	m.mu.Lock()
+	if j.Status != PENDING {
+		m.mu.Unlock()
+		return
+	}
+	if j.ctx.Err() != nil {
+		m.finish(j, CANCELLED, nil, j.ctx.Err())
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	j.Status = RUNNING
+	j.StartedAt = &now
+	m.publish(j.Job)
+	m.mu.Unlock()
+
+	log.Debugf("Running job %v (%v) for device '%v'", j.Id, j.Type, j.DeviceId)
+	result, err := j.f(j.ctx, func(msg string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		j.Progress = msg
+		m.publish(j.Job)
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil && j.ctx.Err() == context.Canceled:
+		m.finish(j, CANCELLED, nil, err)
+	case err != nil:
+		log.Errorf("job %v (%v) for device '%v' failed: %+v", j.Id, j.Type, j.DeviceId, err)
+		m.finish(j, FAILED, nil, err)
+	default:
+		m.finish(j, SUCCEEDED, result, nil)
+	}
+	j.cancel()
+}
+
+// Must be called with mu held
+func (m *Manager) finish(j *job, status string, result interface{}, err error) {
+	now := time.Now()
+	j.Status = status
+	j.Result = result
+	j.FinishedAt = &now
+	if err != nil {
+		j.Error = err.Error()
+	}
+	m.publish(j.Job)
+
+	m.finished = append(m.finished, j.Id)
+	for len(m.finished) > MaxFinishedJobs {
+		delete(m.jobs, m.finished[0])
+		m.finished = m.finished[1:]
+	}
+}
+
+// Must be called with mu held
+func (m *Manager) publish(j Job) {
+	for ch := range m.subscribers {
+		select {
+		case ch <- j:
+		default:
+		}
+	}
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,205 @@
+package jobs
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestManager_runsJobToCompletion(t *testing.T) {
+	m := Create(2, 10)
+	defer m.Stop()
+
+	j, err := m.Submit("push", "abcd", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		progress("halfway")
+		return "done", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, PENDING, j.Status)
+	assert.Equal(t, "abcd", j.DeviceId)
+
+	j = waitFinished(t, m, j.Id)
+	assert.Equal(t, SUCCEEDED, j.Status)
+	assert.Equal(t, "done", j.Result)
+	assert.Equal(t, "halfway", j.Progress)
+	assert.NotNil(t, j.StartedAt)
+	assert.NotNil(t, j.FinishedAt)
+}
+
+func TestManager_recordsFailure(t *testing.T) {
+	m := Create(1, 10)
+	defer m.Stop()
+
+	j, err := m.Submit("push", "abcd", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		return nil, errors.New("device unreachable")
+	})
+	require.NoError(t, err)
+
+	j = waitFinished(t, m, j.Id)
+	assert.Equal(t, FAILED, j.Status)
+	assert.Equal(t, "device unreachable", j.Error)
+}
+
+func TestManager_cancelRunningJob(t *testing.T) {
+	m := Create(1, 10)
+	defer m.Stop()
+
+	started := make(chan struct{})
+	j, err := m.Submit("push", "abcd", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.NoError(t, err)
+
+	<-started
+	_, found := m.Cancel(j.Id)
+	assert.True(t, found)
+
+	j = waitFinished(t, m, j.Id)
+	assert.Equal(t, CANCELLED, j.Status)
+}
+
+func TestManager_cancelPendingJob(t *testing.T) {
+	m := Create(1, 10)
+	defer m.Stop()
+
+	release := make(chan struct{})
+	_, err := m.Submit("push", "a", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	ran := false
+	j, err := m.Submit("push", "b", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		ran = true
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	j, _ = m.Cancel(j.Id)
+	assert.Equal(t, CANCELLED, j.Status)
+	close(release)
+
+	m.Stop()
+	assert.False(t, ran)
+}
+
+func TestManager_queueFull(t *testing.T) {
+	m := Create(1, 1)
+	defer m.Stop()
+
+	release := make(chan struct{})
+	defer close(release)
+	block := func(ctx context.Context, progress func(string)) (interface{}, error) {
+		<-release
+		return nil, nil
+	}
+
+	// First job may be picked up by the worker immediately, so fill the queue until it rejects
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, err = m.Submit("push", "a", block)
+	}
+	assert.Equal(t, ErrQueueFull, err)
+}
+
+func TestManager_subscribe(t *testing.T) {
+	m := Create(1, 10)
+	defer m.Stop()
+
+	updates, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	j, err := m.Submit("push", "abcd", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	var statuses []string
+	for len(statuses) < 3 {
+		select {
+		case u := <-updates:
+			assert.Equal(t, j.Id, u.Id)
+			statuses = append(statuses, u.Status)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for job updates")
+		}
+	}
+	assert.Equal(t, []string{PENDING, RUNNING, SUCCEEDED}, statuses)
+}
+
+func TestManager_submitAt(t *testing.T) {
+	m := Create(1, 10)
+	defer m.Stop()
+
+	// The scheduled job doesn't take the only worker while it waits
+	at := time.Now().Add(100 * time.Millisecond)
+	scheduled, err := m.SubmitAt("push", "a", at, func(ctx context.Context, progress func(string)) (interface{}, error) {
+		return time.Now(), nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, PENDING, scheduled.Status)
+	assert.True(t, at.Equal(*scheduled.ScheduledAt))
+
+	j, err := m.Submit("push", "b", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		return nil, nil
+	})
+	require.NoError(t, err)
+	j = waitFinished(t, m, j.Id)
+	assert.Equal(t, SUCCEEDED, j.Status)
+
+	scheduled, _ = m.Get(scheduled.Id)
+	assert.Equal(t, PENDING, scheduled.Status)
+	scheduled = waitFinished(t, m, scheduled.Id)
+	assert.Equal(t, SUCCEEDED, scheduled.Status)
+	assert.False(t, scheduled.Result.(time.Time).Before(at))
+}
+
+func TestManager_cancelScheduledJob(t *testing.T) {
+	m := Create(1, 10)
+
+	ran := false
+	run := func(ctx context.Context, progress func(string)) (interface{}, error) {
+		ran = true
+		return nil, nil
+	}
+	j, err := m.SubmitAt("push", "a", time.Now().Add(50*time.Millisecond), run)
+	require.NoError(t, err)
+	j, _ = m.Cancel(j.Id)
+	assert.Equal(t, CANCELLED, j.Status)
+
+	// Jobs still waiting when the manager stops are cancelled
+	j, err = m.SubmitAt("push", "b", time.Now().Add(time.Hour), run)
+	require.NoError(t, err)
+	m.Stop()
+	j, _ = m.Get(j.Id)
+	assert.Equal(t, CANCELLED, j.Status)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, ran)
+}
+
+func TestManager_submitAfterStop(t *testing.T) {
+	m := Create(1, 10)
+	m.Stop()
+
+	_, err := m.Submit("push", "abcd", func(ctx context.Context, progress func(string)) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, ErrStopped, err)
+}
+
+func waitFinished(t *testing.T, m *Manager, id string) Job {
+	var j Job
+	require.Eventually(t, func() bool {
+		var found bool
+		j, found = m.Get(id)
+		return found && j.IsFinished()
+	}, time.Second, 5*time.Millisecond)
+	return j
+}
@@ -1,82 +1,138 @@
 package coap
 
 import (
-	"encoding/json"
 	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
-	"github.com/pkg/errors"
+	"github.com/chacal/thread-mgmt-server/pkg/time_sync"
 	"github.com/plgd-dev/go-coap/v2/mux"
-	"io/ioutil"
+	"strings"
+	"time"
 )
 
-func RegisterRoutes(router *mux.Router, reg *device_registry.Registry) {
+// Devices may include a sequence number in state reports to make retransmitted reports idempotent. Devices
+// that restart counting from zero must also increment the boot counter, otherwise their reports are ignored
+// until the sequence number passes the previous one.
+type stateReport struct {
+	device_registry.State
+	Seq  *uint32 `json:"seq,omitempty"`
+	Boot uint32  `json:"boot,omitempty"`
+}
+
+func RegisterRoutes(router *mux.Router, deps Deps) {
 	router.Use(coap_utils.LoggingMiddleware)
-	router.Handle("v1/defaults/", handlerWithReg(reg, getV1Defaults))
-	router.Handle("v1/state/", handlerWithReg(reg, postV1State))
+	router.Handle("v1/defaults/", get(deps, getV1Defaults))
+	router.Handle("v1/state/", post(deps, postV1State))
+	router.Handle("v1/events/", post(deps, postV1Event))
+	router.Handle("v1/time", get(deps, getV1Time))
+	router.Handle("v1/time/", get(deps, getV1Time))
 	router.DefaultHandle(mux.HandlerFunc(defaultHandler))
 }
 
-func getV1Defaults(reg *device_registry.Registry, w mux.ResponseWriter, r *mux.Message) {
-	deviceId, err := coap_utils.GetLastPathPart(r)
-	if err != nil {
-		coap_utils.RespondWithInternalServerError(w, err)
-		return
-	}
-
-	deviceExists, err := reg.Contains(deviceId)
+func getV1Defaults(deps Deps, r *Request) (interface{}, error) {
+	deviceExists, err := deps.Reg.Contains(r.DeviceId)
 	if err != nil {
-		coap_utils.RespondWithInternalServerError(w, err)
-		return
+		return nil, err
 	}
 
 	var dev *device_registry.Device
 	if !deviceExists {
-		dev, err = reg.Create(deviceId)
+		dev, err = deps.Reg.Create(r.DeviceId)
+		if err == nil {
+			deps.Webhooks.Send(device_registry.WEBHOOK_DEVICE_CREATED, r.DeviceId, dev)
+		}
 	} else {
-		dev, err = reg.Get(deviceId)
+		dev, err = deps.Reg.Get(r.DeviceId)
 	}
 
 	if err != nil {
-		coap_utils.RespondWithInternalServerError(w, err)
-		return
+		return nil, err
 	}
 
-	coap_utils.RespondWithJSON(w, dev.Defaults)
+	return dev.Defaults, nil
 }
 
-func postV1State(reg *device_registry.Registry, w mux.ResponseWriter, r *mux.Message) {
-	deviceId, err := coap_utils.GetLastPathPart(r)
+func postV1State(deps Deps, r *Request) error {
+	err := assertDeviceExists(deps, r.DeviceId)
+	if err != nil {
+		return err
+	}
+
+	var report stateReport
+	err = decodeBody(r, &report)
 	if err != nil {
-		coap_utils.RespondWithInternalServerError(w, err)
-		return
+		return err
+	}
+
+	applied := true
+	if report.Seq == nil {
+		err = deps.Reg.UpdateState(r.DeviceId, report.State)
+	} else {
+		applied, err = deps.Reg.UpdateStateWithSeq(r.DeviceId, report.State, device_registry.StateSeq{Boot: report.Boot, Seq: *report.Seq})
 	}
+	if err != nil || !applied {
+		return err
+	}
+
+	deps.Sps.StateReported(r.DeviceId, report.State)
+	return nil
+}
 
-	body, err := ioutil.ReadAll(r.Body)
+func postV1Event(deps Deps, r *Request) error {
+	err := assertDeviceExists(deps, r.DeviceId)
 	if err != nil {
-		coap_utils.RespondWithInternalServerError(w, err)
-		return
+		return err
 	}
 
-	var state device_registry.State
-	err = json.Unmarshal(body, &state)
+	var event device_registry.Event
+	err = decodeBody(r, &event)
 	if err != nil {
-		coap_utils.RespondWithBadRequest(w, errors.WithStack(err))
+		return err
 	}
+	event.Timestamp = time.Now()
 
-	err = reg.UpdateState(deviceId, state)
+	err = deps.Reg.AddEvent(r.DeviceId, event)
 	if err != nil {
-		coap_utils.RespondWithInternalServerError(w, errors.WithStack(err))
+		return err
 	}
 
-	coap_utils.RespondWithChanged(w)
+	dev, err := deps.Reg.Get(r.DeviceId)
+	if err != nil {
+		return err
+	}
+	deps.MqttSender.PublishEvent(dev.Instance(), event)
+	return nil
 }
 
-func defaultHandler(w mux.ResponseWriter, r *mux.Message) {
-	coap_utils.RespondWithNotFound(w)
+func getV1Time(deps Deps, r *Request) (interface{}, error) {
+	pollPeriod := device_registry.DefaultDefaults.PollPeriod
+	if deviceId := strings.TrimPrefix(strings.TrimPrefix(r.Path, "v1/time"), "/"); deviceId != "" {
+		var err error
+		pollPeriod, err = devicePollPeriod(deps.Reg, deviceId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return time_sync.CreateTimeInfo(time.Now(), deps.Location, pollPeriod), nil
 }
 
-func handlerWithReg(reg *device_registry.Registry, f func(reg *device_registry.Registry, w mux.ResponseWriter, r *mux.Message)) mux.Handler {
-	return mux.HandlerFunc(func(w mux.ResponseWriter, r *mux.Message) {
-		f(reg, w, r)
-	})
+// Returns the poll period the device reports, falling back to the desired one
+func devicePollPeriod(reg *device_registry.Registry, deviceId string) (int, error) {
+	deviceExists, err := reg.Contains(deviceId)
+	if err != nil || !deviceExists {
+		return device_registry.DefaultDefaults.PollPeriod, err
+	}
+
+	dev, err := reg.Get(deviceId)
+	if err != nil {
+		return 0, err
+	}
+	if dev.State != nil && dev.State.PollPeriod > 0 {
+		return dev.State.PollPeriod, nil
+	}
+	return dev.Defaults.PollPeriod, nil
+}
+
+func defaultHandler(w mux.ResponseWriter, r *mux.Message) {
+	coap_utils.RespondWithNotFound(w)
 }
@@ -0,0 +1,163 @@
+package coap
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
+	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	"github.com/plgd-dev/go-coap/v2/mux"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+type Deps struct {
+	Reg        *device_registry.Registry
+	MqttSender mqtt.MqttSender
+	Sps        state_poller_service.StatePollerService
+	Location   *time.Location
+	Webhooks   *webhooks.Dispatcher
+}
+
+type Request struct {
+	*mux.Message
+	Path     string
+	DeviceId string
+}
+
+// Handlers for GET routes return a body that is sent to the client as JSON
+type getHandlerFunc = func(deps Deps, r *Request) (interface{}, error)
+
+// Handlers for POST routes respond with 2.04 Changed on success
+type postHandlerFunc = func(deps Deps, r *Request) error
+
+type routeError struct {
+	code codes.Code
+	err  error
+}
+
+func (e *routeError) Error() string {
+	return e.err.Error()
+}
+
+type validatable interface {
+	Validate() error
+}
+
+func badRequest(err error) error {
+	return &routeError{codes.BadRequest, err}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &routeError{codes.NotFound, errors.Errorf(format, args...)}
+}
+
+func get(deps Deps, f getHandlerFunc) mux.Handler {
+	return handler(codes.GET, deps, func(w mux.ResponseWriter, r *Request) {
+		body, err := f(deps, r)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		coap_utils.RespondWithJSON(w, body)
+	})
+}
+
+func post(deps Deps, f postHandlerFunc) mux.Handler {
+	return handler(codes.POST, deps, func(w mux.ResponseWriter, r *Request) {
+		err := f(deps, r)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		coap_utils.RespondWithChanged(w)
+	})
+}
+
+func handler(method codes.Code, deps Deps, f func(w mux.ResponseWriter, r *Request)) mux.Handler {
+	return mux.HandlerFunc(func(w mux.ResponseWriter, m *mux.Message) {
+		if m.Code != method {
+			coap_utils.RespondWithMethodNotAllowed(w)
+			return
+		}
+
+		req, err := createRequest(m)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		f(w, req)
+	})
+}
+
+func createRequest(m *mux.Message) (*Request, error) {
+	path, err := m.Options.Path()
+	if err != nil {
+		return nil, badRequest(errors.Wrap(err, "couldn't get path from message"))
+	}
+
+	deviceId, err := coap_utils.GetLastPathPart(m)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	return &Request{m, strings.TrimPrefix(path, "/"), deviceId}, nil
+}
+
+// decodeBody strictly decodes a JSON request body into v and validates it
+func decodeBody(r *Request, v validatable) error {
+	if r.Body == nil {
+		return badRequest(errors.New("empty body"))
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(v)
+	if err != nil {
+		return badRequest(errors.Wrap(err, "invalid JSON"))
+	}
+
+	err = v.Validate()
+	if err != nil {
+		return badRequest(err)
+	}
+	return nil
+}
+
+func assertDeviceExists(deps Deps, deviceId string) error {
+	deviceExists, err := deps.Reg.Contains(deviceId)
+	if err != nil {
+		return err
+	}
+	if !deviceExists {
+		return notFound("device with id '%v' not found", deviceId)
+	}
+	return nil
+}
+
+func respondWithError(w mux.ResponseWriter, err error) {
+	var re *routeError
+	if !errors.As(err, &re) {
+		coap_utils.RespondWithInternalServerError(w, err)
+		return
+	}
+
+	switch re.code {
+	case codes.BadRequest:
+		coap_utils.RespondWithBadRequest(w, re.err)
+	case codes.NotFound:
+		coap_utils.RespondWithNotFoundError(w, re.err)
+	default:
+		coap_utils.RespondWithInternalServerError(w, re.err)
+	}
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+type RuleId struct {
+	Id string `uri:"rule_id" binding:"required"`
+}
+
+func getV1AlertRules(reg *device_registry.Registry, ctx *gin.Context) {
+	rules, err := reg.GetAlertRules()
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, rules)
+}
+
+// Creates an alert rule or replaces the rule with the same id
+func postV1AlertRule(reg *device_registry.Registry, ctx *gin.Context) {
+	var rule device_registry.AlertRule
+	if err := ctx.ShouldBindJSON(&rule); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	if err := rule.Validate(); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	for _, id := range rule.Webhooks {
+		webhook, err := reg.GetWebhook(id)
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+		if webhook == nil {
+			ctx.AbortWithError(http.StatusBadRequest, errors.Errorf("unknown webhook '%v'", id))
+			return
+		}
+	}
+
+	err := reg.PutAlertRule(rule)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, rule)
+}
+
+// Deletes an alert rule. Alerts it has raised are dropped on the next evaluation of each device.
+func deleteV1AlertRule(reg *device_registry.Registry, ctx *gin.Context) {
+	var id RuleId
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	found, err := reg.DeleteAlertRule(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !found {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// Lists the active alerts of all devices that have any by device id
+func getV1Alerts(reg *device_registry.Registry, ctx *gin.Context) {
+	devices, err := reg.GetDevices()
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+
+	alerts := make(map[string][]device_registry.Alert)
+	for id, device := range devices {
+		if len(device.Alerts) > 0 {
+			alerts[id] = device.Alerts
+		}
+	}
+	ctx.IndentedJSON(http.StatusOK, alerts)
+}
+
+// Returns the alert state of the device, including when it was last seen
+func getV1DeviceAlerts(reg *device_registry.Registry, ctx *gin.Context) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	deviceExists, err := reg.Contains(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !deviceExists {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	state, err := reg.GetAlertState(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, state)
+}
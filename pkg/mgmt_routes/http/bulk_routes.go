@@ -0,0 +1,212 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	JOB_BULK_PUSH          = "bulk_push"
+	JOB_BULK_REFRESH_STATE = "bulk_refresh_state"
+)
+
+const DefaultBulkConcurrency = 4
+const MaxBulkConcurrency = 32
+
+// DeviceSelector selects devices by exactly one of the criteria
+type DeviceSelector struct {
+	Ids       []string `json:"ids"`
+	Tag       string   `json:"tag"`
+	HwVersion string   `json:"hwVersion"`
+	All       bool     `json:"all"`
+}
+
+type BulkRequest struct {
+	DeviceSelector
+	Verify      bool `json:"verify"`
+	Concurrency int  `json:"concurrency"`
+	// Devices outside their schedule windows get push jobs of their own, pending until the windows start
+	Scheduled bool `json:"scheduled"`
+}
+
+type BulkResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// Id of the job doing the operation in the device's next schedule window
+	ScheduledJob string `json:"scheduledJob,omitempty"`
+}
+
+type BulkReport struct {
+	Succeeded int                   `json:"succeeded"`
+	Failed    int                   `json:"failed"`
+	Scheduled int                   `json:"scheduled,omitempty"`
+	Results   map[string]BulkResult `json:"results"`
+}
+
+// Does the operation on one device. Returns the id of the job the operation was scheduled to if it wasn't done
+// right away.
+type bulkOp func(ctx context.Context, id string, req BulkRequest) (string, error)
+
+func postV1BulkPush(deps Deps, ctx *gin.Context) {
+	postV1BulkOperation(deps, ctx, JOB_BULK_PUSH, func(jobCtx context.Context, id string, req BulkRequest) (string, error) {
+		return bulkPush(jobCtx, deps, id, req)
+	})
+}
+
+func postV1BulkRefreshState(deps Deps, ctx *gin.Context) {
+	postV1BulkOperation(deps, ctx, JOB_BULK_REFRESH_STATE, func(jobCtx context.Context, id string, req BulkRequest) (string, error) {
+		_, err := refreshState(jobCtx, deps, id, nil, func(string) {})
+		return "", err
+	})
+}
+
+// Pushes to the device now, or submits a push job waiting for the device's next schedule window
+func bulkPush(ctx context.Context, deps Deps, id string, req BulkRequest) (string, error) {
+	if req.Scheduled {
+		at, err := nextWindow(deps.Reg, id)
+		if err != nil {
+			return "", err
+		}
+		if !at.IsZero() {
+			job, err := deps.Jobs.SubmitAt(JOB_PUSH, id, at, func(jobCtx context.Context, progress func(string)) (interface{}, error) {
+				return pushDefaults(jobCtx, deps, id, nil, req.Verify, progress)
+			})
+			return job.Id, err
+		}
+	}
+
+	_, err := pushDefaults(ctx, deps, id, nil, req.Verify, func(string) {})
+	return "", err
+}
+
+func postV1BulkOperation(deps Deps, ctx *gin.Context, jobType string, op bulkOp) {
+	var req BulkRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	if req.Concurrency == 0 {
+		req.Concurrency = DefaultBulkConcurrency
+	}
+	if req.Concurrency < 1 || req.Concurrency > MaxBulkConcurrency {
+		ctx.AbortWithError(http.StatusBadRequest, errors.Errorf("concurrency must be between 1 and %v", MaxBulkConcurrency))
+		return
+	}
+
+	ids, err := selectDevices(deps.Reg, req.DeviceSelector)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	submitJob(deps, ctx, jobType, "", func(jobCtx context.Context, progress func(string)) (interface{}, error) {
+		report := BulkReport{Results: make(map[string]BulkResult)}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, req.Concurrency)
+
+		for _, id := range ids {
+			select {
+			case slots <- struct{}{}:
+			case <-jobCtx.Done():
+				wg.Wait()
+				return nil, jobCtx.Err()
+			}
+
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				scheduledJob, err := op(jobCtx, id, req)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					report.Failed++
+					report.Results[id] = BulkResult{Success: false, Error: err.Error()}
+				} else if scheduledJob != "" {
+					report.Scheduled++
+					report.Results[id] = BulkResult{Success: false, ScheduledJob: scheduledJob}
+				} else {
+					report.Succeeded++
+					report.Results[id] = BulkResult{Success: true}
+				}
+				progress(fmt.Sprintf("%v/%v devices done", len(report.Results), len(ids)))
+			}(id)
+		}
+		wg.Wait()
+
+		if jobCtx.Err() != nil {
+			return nil, jobCtx.Err()
+		}
+		return report, nil
+	})
+}
+
+func selectDevices(reg *device_registry.Registry, sel DeviceSelector) ([]string, error) {
+	criteria := 0
+	for _, set := range []bool{len(sel.Ids) > 0, sel.Tag != "", sel.HwVersion != "", sel.All} {
+		if set {
+			criteria++
+		}
+	}
+	if criteria != 1 {
+		return nil, errors.New("exactly one of ids, tag, hwVersion or all must be given")
+	}
+
+	devices, err := reg.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if len(sel.Ids) > 0 {
+		for _, id := range sel.Ids {
+			if _, found := devices[id]; !found {
+				return nil, errors.Errorf("device with id %v not found", id)
+			}
+		}
+		for _, id := range sel.Ids {
+			if !containsString(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	} else {
+		for id, d := range devices {
+			if sel.matches(d) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (sel DeviceSelector) matches(d device_registry.Device) bool {
+	switch {
+	case sel.All:
+		return true
+	case sel.Tag != "":
+		return d.Config.HasTag(sel.Tag)
+	default:
+		return d.Defaults.HwVersion == sel.HwVersion
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
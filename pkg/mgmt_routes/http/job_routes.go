@@ -0,0 +1,118 @@
+package http
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/jobs"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	JOB_PUSH          = "push"
+	JOB_REFRESH_STATE = "refresh_state"
+)
+
+// Comments are sent periodically to keep proxies from closing idle event streams
+const streamKeepAliveInterval = 15 * time.Second
+
+type JobId struct {
+	Id string `uri:"job_id" binding:"required"`
+}
+
+func getV1Jobs(deps Deps, ctx *gin.Context) {
+	deviceId := ctx.Query("device_id")
+
+	ret := make([]jobs.Job, 0)
+	for _, j := range deps.Jobs.List() {
+		if deviceId == "" || j.DeviceId == deviceId {
+			ret = append(ret, j)
+		}
+	}
+	ctx.IndentedJSON(http.StatusOK, ret)
+}
+
+func getV1Job(deps Deps, ctx *gin.Context) {
+	var id JobId
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	job, found := deps.Jobs.Get(id.Id)
+	if !found {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, job)
+}
+
+func deleteV1Job(deps Deps, ctx *gin.Context) {
+	var id JobId
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	job, found := deps.Jobs.Get(id.Id)
+	if !found {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if job.IsFinished() {
+		ctx.IndentedJSON(http.StatusConflict, job)
+		return
+	}
+
+	job, _ = deps.Jobs.Cancel(id.Id)
+	ctx.IndentedJSON(http.StatusOK, job)
+}
+
+// Streams job updates as server-sent events
+func getV1Stream(deps Deps, ctx *gin.Context) {
+	updates, unsubscribe := deps.Jobs.Subscribe()
+	defer unsubscribe()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Writer.WriteHeaderNow()
+	ctx.Writer.Flush()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case job := <-updates:
+			ctx.SSEvent("job", job)
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// submitJob runs f in the background and responds with 202 Accepted and the created job
+func submitJob(deps Deps, ctx *gin.Context, jobType string, deviceId string, f jobs.Func) {
+	submitJobAt(deps, ctx, jobType, deviceId, time.Time{}, f)
+}
+
+// Submits a job that is queued at the given time, zero time queues it immediately
+func submitJobAt(deps Deps, ctx *gin.Context, jobType string, deviceId string, at time.Time, f jobs.Func) {
+	job, err := deps.Jobs.SubmitAt(jobType, deviceId, at, f)
+	if err == jobs.ErrQueueFull || err == jobs.ErrStopped {
+		ctx.AbortWithError(http.StatusServiceUnavailable, errors.WithStack(err))
+		return
+	}
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+
+	ctx.Header("Location", "/v1/jobs/"+job.Id)
+	ctx.IndentedJSON(http.StatusAccepted, job)
+}
@@ -1,9 +1,15 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
+	"github.com/chacal/thread-mgmt-server/pkg/device_commands"
 	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
-	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
@@ -13,18 +19,46 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-func RegisterRoutes(router *gin.Engine, reg *device_registry.Registry, gw device_gateway.DeviceGateway,
-	sps state_poller_service.StatePollerService) error {
+func RegisterRoutes(router *gin.Engine, deps Deps) error {
+	reg := deps.Reg
 	router.Use(errorHandlingMiddleware)
 	router.Use(cors.Default())
 	router.GET("/v1/devices", handlerWithReg(reg, getV1Devices))
-	router.POST("/v1/devices/:device_id/defaults", handlerWithReg(reg, postV1Defaults))
-	router.POST("/v1/devices/:device_id/config", handlerWithDeps(reg, gw, sps, postV1Config))
-	router.POST("/v1/devices/:device_id/push", handlerWithDeps(reg, gw, sps, postV1DevicesPushDefaults))
-	router.POST("/v1/devices/:device_id/refresh_state", handlerWithDeps(reg, gw, sps, postV1DevicesRefreshState))
-	router.DELETE("/v1/devices/:device_id", handlerWithDeps(reg, gw, sps, deleteV1Device))
+	router.POST("/v1/devices/:device_id/defaults", handlerWithDeps(deps, postV1Defaults))
+	router.POST("/v1/devices/:device_id/config", handlerWithDeps(deps, postV1Config))
+	router.POST("/v1/devices/:device_id/push", handlerWithDeps(deps, postV1DevicesPushDefaults))
+	router.POST("/v1/devices/:device_id/refresh_state", handlerWithDeps(deps, postV1DevicesRefreshState))
+	router.DELETE("/v1/devices/:device_id", handlerWithDeps(deps, deleteV1Device))
+	router.GET("/v1/devices/:device_id/addresses", handlerWithReg(reg, getV1DeviceAddresses))
+	router.GET("/v1/devices/:device_id/poller", handlerWithDeps(deps, getV1DevicePoller))
+	router.POST("/v1/devices/:device_id/poll_now", handlerWithDeps(deps, postV1DevicePollNow))
+	router.POST("/v1/devices/:device_id/probe", handlerWithDeps(deps, postV1DeviceProbe))
+	router.GET("/v1/devices/:device_id/probes", handlerWithReg(reg, getV1DeviceProbes))
+	router.GET("/v1/devices/:device_id/events", handlerWithReg(reg, getV1DeviceEvents))
+	router.GET("/v1/devices/:device_id/commands", handlerWithReg(reg, getV1DeviceCommands))
+	router.GET("/v1/devices/:device_id/commands/history", handlerWithReg(reg, getV1DeviceCommandHistory))
+	router.POST("/v1/devices/:device_id/commands/:name", handlerWithDeps(deps, postV1DeviceCommand))
+	router.GET("/v1/devices/:device_id/alerts", handlerWithReg(reg, getV1DeviceAlerts))
+	router.POST("/v1/bulk/push", handlerWithDeps(deps, postV1BulkPush))
+	router.POST("/v1/bulk/refresh_state", handlerWithDeps(deps, postV1BulkRefreshState))
+	router.GET("/v1/drift", handlerWithReg(reg, getV1Drift))
+	router.GET("/v1/alerts", handlerWithReg(reg, getV1Alerts))
+	router.GET("/v1/alert_rules", handlerWithReg(reg, getV1AlertRules))
+	router.POST("/v1/alert_rules", handlerWithReg(reg, postV1AlertRule))
+	router.DELETE("/v1/alert_rules/:rule_id", handlerWithReg(reg, deleteV1AlertRule))
+	router.GET("/v1/webhooks", handlerWithReg(reg, getV1Webhooks))
+	router.POST("/v1/webhooks", handlerWithReg(reg, postV1Webhook))
+	router.DELETE("/v1/webhooks/:webhook_id", handlerWithReg(reg, deleteV1Webhook))
+	router.GET("/v1/webhooks/:webhook_id/deliveries", handlerWithReg(reg, getV1WebhookDeliveries))
+	router.GET("/v1/pollers", handlerWithDeps(deps, getV1Pollers))
+	router.POST("/v1/multicast/:op", handlerWithDeps(deps, postV1Multicast))
+	router.GET("/v1/jobs", handlerWithDeps(deps, getV1Jobs))
+	router.GET("/v1/jobs/:job_id", handlerWithDeps(deps, getV1Job))
+	router.DELETE("/v1/jobs/:job_id", handlerWithDeps(deps, deleteV1Job))
+	router.GET("/v1/stream", handlerWithDeps(deps, getV1Stream))
 	return serveStaticFromDir(router, "dist")
 }
 
@@ -41,7 +75,31 @@ func getV1Devices(reg *device_registry.Registry, ctx *gin.Context) {
 	ctx.IndentedJSON(http.StatusOK, devices)
 }
 
-func postV1Defaults(reg *device_registry.Registry, ctx *gin.Context) {
+type DriftReport struct {
+	device_registry.ConfigDrift
+	Desired       device_registry.Defaults `json:"desired"`
+	Reported      *device_registry.State   `json:"reported"`
+	AutoReconcile bool                     `json:"autoReconcile"`
+}
+
+// Reports devices whose latest state differs from their desired defaults
+func getV1Drift(reg *device_registry.Registry, ctx *gin.Context) {
+	devices, err := reg.GetDevices()
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+
+	report := make(map[string]DriftReport)
+	for id, device := range devices {
+		if device.Drift != nil {
+			report[id] = DriftReport{*device.Drift, device.Defaults, device.State, device.Config.AutoReconcile}
+		}
+	}
+	ctx.IndentedJSON(http.StatusOK, report)
+}
+
+func postV1Defaults(deps Deps, ctx *gin.Context) {
 	var id Id
 	if err := ctx.ShouldBindUri(&id); err != nil {
 		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
@@ -54,16 +112,17 @@ func postV1Defaults(reg *device_registry.Registry, ctx *gin.Context) {
 		return
 	}
 
-	err := reg.UpdateDefaults(id.Id, defaults)
+	err := deps.Reg.UpdateDefaults(id.Id, defaults)
 	if err != nil {
 		ctx.Error(err)
 		return
 	}
+	deps.Webhooks.Send(device_registry.WEBHOOK_DEFAULTS_UPDATED, id.Id, defaults)
 
 	ctx.Status(http.StatusOK)
 }
 
-func postV1Config(reg *device_registry.Registry, gw device_gateway.DeviceGateway, sps state_poller_service.StatePollerService, ctx *gin.Context) {
+func postV1Config(deps Deps, ctx *gin.Context) {
 	var id Id
 	if err := ctx.ShouldBindUri(&id); err != nil {
 		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
@@ -76,13 +135,18 @@ func postV1Config(reg *device_registry.Registry, gw device_gateway.DeviceGateway
 		return
 	}
 
-	err := reg.UpdateConfig(id.Id, config)
+	if err := config.Validate(); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	err := deps.Reg.UpdateConfig(id.Id, config)
 	if err != nil {
 		ctx.Error(err)
 		return
 	}
 
-	err = sps.Refresh()
+	err = deps.Sps.Refresh()
 	if err != nil {
 		ctx.Error(err)
 		return
@@ -91,20 +155,21 @@ func postV1Config(reg *device_registry.Registry, gw device_gateway.DeviceGateway
 	ctx.Status(http.StatusOK)
 }
 
-func deleteV1Device(reg *device_registry.Registry, gw device_gateway.DeviceGateway, sps state_poller_service.StatePollerService, ctx *gin.Context) {
+func deleteV1Device(deps Deps, ctx *gin.Context) {
 	var id Id
 	if err := ctx.ShouldBindUri(&id); err != nil {
 		ctx.Error(errors.WithStack(err))
 		return
 	}
 
-	err := reg.DeleteDevice(id.Id)
+	err := deps.Reg.DeleteDevice(id.Id)
 	if err != nil {
 		ctx.Error(err)
 		return
 	}
+	deps.Webhooks.Send(device_registry.WEBHOOK_DEVICE_DELETED, id.Id, nil)
 
-	err = sps.Refresh()
+	err = deps.Sps.Refresh()
 	if err != nil {
 		ctx.Error(err)
 		return
@@ -113,76 +178,376 @@ func deleteV1Device(reg *device_registry.Registry, gw device_gateway.DeviceGatew
 	ctx.Status(http.StatusOK)
 }
 
-type DeviceDestination struct {
-	Address net.IP `json:"address" binding:"required"`
+// Lists the addresses used to reach the device in the order they are tried, with their reachability
+func getV1DeviceAddresses(reg *device_registry.Registry, ctx *gin.Context) {
+	device, err := deviceFromRequest(reg, ctx)
+	if err != nil {
+		return
+	}
+
+	ret := device_registry.Reachability{Addresses: []device_registry.AddressStatus{}}
+	if device.Reachability != nil {
+		ret.WorkingAddress = device.Reachability.WorkingAddress
+	}
+	for _, ip := range address_fallback.Candidates(device, nil) {
+		status := device_registry.AddressStatus{Address: ip}
+		if device.Reachability != nil && device.Reachability.Status(ip) != nil {
+			status = *device.Reachability.Status(ip)
+		}
+		ret.Addresses = append(ret.Addresses, status)
+	}
+	ctx.IndentedJSON(http.StatusOK, ret)
+}
+
+type ProbeReport struct {
+	Stats   map[string]probe.Stats        `json:"stats"`
+	Samples []device_registry.ProbeSample `json:"samples"`
 }
 
-func postV1DevicesPushDefaults(reg *device_registry.Registry, gw device_gateway.DeviceGateway, sps state_poller_service.StatePollerService, ctx *gin.Context) {
-	id, dst, err := assertDeviceFromRequestExists(reg, ctx)
+func postV1DeviceProbe(deps Deps, ctx *gin.Context) {
+	var dst DeviceDestination
+	id, err := assertDeviceFromRequestExists(deps.Reg, ctx, &dst)
 	if err != nil {
 		return
 	}
 
-	device, err := reg.Get(id)
+	res, err := deps.Prober.Probe(ctx.Request.Context(), id, dst.Address)
+	// Without a ping sample the device had no address to probe
+	if err != nil && res.Ping == nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		ctx.IndentedJSON(http.StatusBadGateway, res)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, res)
+}
+
+func getV1DeviceProbes(reg *device_registry.Registry, ctx *gin.Context) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	deviceExists, err := reg.Contains(id.Id)
 	if err != nil {
 		ctx.Error(err)
 		return
 	}
+	if !deviceExists {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
 
-	err = gw.PushDefaults(device.Defaults, dst)
+	samples, err := reg.GetProbeSamples(id.Id)
 	if err != nil {
-		ctx.Error(errors.WithStack(err))
+		ctx.Error(err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, ProbeReport{probe.Summarize(samples), samples})
+}
+
+func getV1DeviceEvents(reg *device_registry.Registry, ctx *gin.Context) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 
-	ctx.Status(http.StatusOK)
+	deviceExists, err := reg.Contains(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !deviceExists {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	events, err := reg.GetEvents(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+
+	ctx.IndentedJSON(http.StatusOK, events)
 }
 
-func postV1DevicesRefreshState(reg *device_registry.Registry, gw device_gateway.DeviceGateway, sps state_poller_service.StatePollerService, ctx *gin.Context) {
-	id, dst, err := assertDeviceFromRequestExists(reg, ctx)
+func getV1DeviceCommands(reg *device_registry.Registry, ctx *gin.Context) {
+	device, err := deviceFromRequest(reg, ctx)
 	if err != nil {
 		return
 	}
 
-	state, err := gw.FetchState(dst)
+	ctx.IndentedJSON(http.StatusOK, device_commands.Catalogue(device.Defaults.HwVersion))
+}
+
+func getV1DeviceCommandHistory(reg *device_registry.Registry, ctx *gin.Context) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	deviceExists, err := reg.Contains(id.Id)
 	if err != nil {
 		ctx.Error(err)
 		return
 	}
+	if !deviceExists {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
 
-	err = reg.UpdateState(id, state)
+	history, err := reg.GetCommandHistory(id.Id)
 	if err != nil {
 		ctx.Error(err)
 		return
 	}
 
-	ctx.IndentedJSON(http.StatusOK, state)
+	ctx.IndentedJSON(http.StatusOK, history)
+}
+
+type CommandId struct {
+	Id   string `uri:"device_id" binding:"required"`
+	Name string `uri:"name" binding:"required"`
+}
+
+type CommandRequest struct {
+	// Sends the command to the addresses known for the device if not given
+	Address net.IP          `json:"address"`
+	Args    json.RawMessage `json:"args"`
+	Confirm bool            `json:"confirm"`
 }
 
-func assertDeviceFromRequestExists(reg *device_registry.Registry, ctx *gin.Context) (string, net.IP, error) {
+func postV1DeviceCommand(deps Deps, ctx *gin.Context) {
+	var id CommandId
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	var req CommandRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	device, err := deviceFromRequest(deps.Reg, ctx)
+	if err != nil {
+		return
+	}
+
+	cmd, found := device_commands.Find(device.Defaults.HwVersion, id.Name)
+	if !found {
+		ctx.AbortWithError(http.StatusNotFound, errors.Errorf("command '%v' not supported by hardware '%v'", id.Name, device.Defaults.HwVersion))
+		return
+	}
+
+	if cmd.Destructive && !req.Confirm {
+		ctx.AbortWithError(http.StatusBadRequest, errors.Errorf("command '%v' is destructive and must be confirmed with \"confirm\": true", cmd.Name))
+		return
+	}
+
+	started := time.Now()
+	resp, err := sendCommand(ctx.Request.Context(), deps, id.Id, device, cmd.Path, string(req.Args), req.Address)
+	result := device_registry.CommandResult{
+		Name:       cmd.Name,
+		Timestamp:  started,
+		Success:    err == nil,
+		Response:   resp,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		log.Errorf("command %v failed for device %v: %+v", cmd.Name, id.Id, err)
+		result.Error = err.Error()
+	}
+
+	err = deps.Reg.AddCommandResult(id.Id, result)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+
+	if !result.Success {
+		ctx.IndentedJSON(http.StatusBadGateway, result)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, result)
+}
+
+func sendCommand(ctx context.Context, deps Deps, id string, device *device_registry.Device, path string, args string, address net.IP) (string, error) {
+	if address != nil {
+		return deps.Gw.SendCommand(device_gateway.WithTransportConfig(ctx, device.Config.Transport), path, args, address)
+	}
+
+	var resp string
+	_, err := deps.Fallback.Do(ctx, id, nil, func(ctx context.Context, ip net.IP) error {
+		var err error
+		resp, err = deps.Gw.SendCommand(ctx, path, args, ip)
+		return err
+	})
+	return resp, err
+}
+
+func deviceFromRequest(reg *device_registry.Registry, ctx *gin.Context) (*device_registry.Device, error) {
 	var id Id
 	if err := ctx.ShouldBindUri(&id); err != nil {
 		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
-		return "", nil, err
+		return nil, err
+	}
+
+	deviceExists, err := reg.Contains(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return nil, err
+	}
+	if !deviceExists {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return nil, errors.Errorf("device with id %v not found", id.Id)
+	}
+
+	device, err := reg.Get(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return nil, err
 	}
+	return device, nil
+}
 
+// Without an address all known addresses of the device are tried
+type DeviceDestination struct {
+	Address net.IP `json:"address"`
+}
+
+type PushRequest struct {
+	Address net.IP `json:"address"`
+	Verify  bool   `json:"verify"`
+	// Pushes in the device's next allowed schedule window, the job stays pending until the window starts
+	Scheduled bool `json:"scheduled"`
+}
+
+func postV1DevicesPushDefaults(deps Deps, ctx *gin.Context) {
+	var req PushRequest
+	id, err := assertDeviceFromRequestExists(deps.Reg, ctx, &req)
+	if err != nil {
+		return
+	}
+
+	var at time.Time
+	if req.Scheduled {
+		at, err = nextWindow(deps.Reg, id)
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+	}
+
+	submitJobAt(deps, ctx, JOB_PUSH, id, at, func(jobCtx context.Context, progress func(string)) (interface{}, error) {
+		return pushDefaults(jobCtx, deps, id, req.Address, req.Verify, progress)
+	})
+}
+
+func postV1DevicesRefreshState(deps Deps, ctx *gin.Context) {
 	var dst DeviceDestination
-	if err := ctx.ShouldBindJSON(&dst); err != nil {
+	id, err := assertDeviceFromRequestExists(deps.Reg, ctx, &dst)
+	if err != nil {
+		return
+	}
+
+	submitJob(deps, ctx, JOB_REFRESH_STATE, id, func(jobCtx context.Context, progress func(string)) (interface{}, error) {
+		return refreshState(jobCtx, deps, id, dst.Address, progress)
+	})
+}
+
+func pushDefaults(ctx context.Context, deps Deps, id string, address net.IP, verify bool, progress func(string)) (config_push.Result, error) {
+	if address != nil {
+		return deps.Pusher.Push(ctx, id, address, verify, progress)
+	}
+
+	dst, err := deps.Fallback.Do(ctx, id, nil, func(ctx context.Context, ip net.IP) error {
+		_, err := deps.Pusher.Push(ctx, id, ip, false, progress)
+		return err
+	})
+	if err != nil || !verify {
+		return config_push.Result{}, err
+	}
+	return deps.Pusher.Verify(ctx, id, dst, progress)
+}
+
+// Returns the start of the device's next allowed schedule window, or zero time if the schedule allows traffic now
+func nextWindow(reg *device_registry.Registry, id string) (time.Time, error) {
+	device, err := reg.Get(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	next := device.Config.Schedule.NextAllowed(now)
+	if !next.After(now) {
+		return time.Time{}, nil
+	}
+	return next, nil
+}
+
+func refreshState(ctx context.Context, deps Deps, id string, address net.IP, progress func(string)) (device_registry.State, error) {
+	var state device_registry.State
+	fetch := func(ctx context.Context, ip net.IP) error {
+		progress(fmt.Sprintf("fetching state from %v", ip))
+		var err error
+		state, err = deps.Gw.FetchState(ctx, ip)
+		return err
+	}
+
+	var err error
+	if address != nil {
+		var device *device_registry.Device
+		device, err = deps.Reg.Get(id)
+		if err != nil {
+			return state, err
+		}
+		err = fetch(device_gateway.WithTransportConfig(ctx, device.Config.Transport), address)
+	} else {
+		_, err = deps.Fallback.Do(ctx, id, nil, fetch)
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = deps.Reg.UpdateState(id, state)
+	if err != nil {
+		return state, err
+	}
+	deps.Sps.StateReported(id, state)
+	return state, nil
+}
+
+// Binds the request body to req and checks that the device exists
+func assertDeviceFromRequestExists(reg *device_registry.Registry, ctx *gin.Context, req interface{}) (string, error) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return "", err
+	}
+
+	if err := ctx.ShouldBindJSON(req); err != nil {
 		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
-		return "", nil, err
+		return "", err
 	}
 
 	deviceExists, err := reg.Contains(id.Id)
 	if err != nil {
 		ctx.Error(err)
-		return "", nil, err
+		return "", err
 	}
 
 	if !deviceExists {
 		ctx.AbortWithStatus(http.StatusNotFound)
-		return "", nil, errors.Errorf("device with id %v not found", id.Id)
+		return "", errors.Errorf("device with id %v not found", id.Id)
 	}
-	return id.Id, dst.Address, nil
+	return id.Id, nil
 }
 
 
@@ -0,0 +1,195 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"github.com/chacal/thread-mgmt-server/pkg/coap_utils"
+	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/plgd-dev/go-coap/v2/message/codes"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	MULTICAST_REFRESH_STATE  = "refresh_state"
+	MULTICAST_FETCH_DEFAULTS = "fetch_defaults"
+)
+
+const JOB_MULTICAST_PREFIX = "multicast_"
+
+const DefaultMulticastWindowSec = 5
+const MaxMulticastWindowSec = 60
+
+// Makes devices fetch their defaults from the management server
+const fetchDefaultsPath = "api/cmd/fetch_defaults"
+
+type MulticastOp struct {
+	Op string `uri:"op" binding:"required,oneof=refresh_state fetch_defaults"`
+}
+
+type MulticastRequest struct {
+	Group     net.IP `json:"group"`
+	WindowSec int    `json:"windowSec"`
+}
+
+type MulticastDeviceResponse struct {
+	DeviceId string `json:"deviceId,omitempty"`
+	Address  net.IP `json:"address"`
+	Code     string `json:"code"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+type MulticastReport struct {
+	Op        string                    `json:"op"`
+	Group     net.IP                    `json:"group"`
+	Responses []MulticastDeviceResponse `json:"responses"`
+	// Devices in the registry that didn't respond within the window
+	Missing []string `json:"missing"`
+}
+
+func postV1Multicast(deps Deps, ctx *gin.Context) {
+	var op MulticastOp
+	if err := ctx.ShouldBindUri(&op); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	req := MulticastRequest{Group: device_gateway.MulticastAllNodes, WindowSec: DefaultMulticastWindowSec}
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+			return
+		}
+	}
+	if req.Group == nil {
+		req.Group = device_gateway.MulticastAllNodes
+	}
+	if !req.Group.IsMulticast() {
+		ctx.AbortWithError(http.StatusBadRequest, errors.Errorf("%v is not a multicast address", req.Group))
+		return
+	}
+	if req.WindowSec < 1 || req.WindowSec > MaxMulticastWindowSec {
+		ctx.AbortWithError(http.StatusBadRequest, errors.Errorf("windowSec must be between 1 and %v", MaxMulticastWindowSec))
+		return
+	}
+
+	submitJob(deps, ctx, JOB_MULTICAST_PREFIX+op.Op, "", func(jobCtx context.Context, progress func(string)) (interface{}, error) {
+		progress(fmt.Sprintf("collecting responses from %v for %vs", req.Group, req.WindowSec))
+		windowCtx, cancel := context.WithTimeout(jobCtx, time.Duration(req.WindowSec)*time.Second)
+		defer cancel()
+
+		var responses []coap_utils.MulticastResponse
+		var err error
+		if op.Op == MULTICAST_REFRESH_STATE {
+			responses, err = deps.Gw.MulticastFetchState(windowCtx, req.Group)
+		} else {
+			responses, err = deps.Gw.MulticastCommand(windowCtx, fetchDefaultsPath, "", req.Group)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if jobCtx.Err() != nil {
+			return nil, jobCtx.Err()
+		}
+
+		return handleMulticastResponses(deps, op.Op, req.Group, responses)
+	})
+}
+
+// Maps the responses back to devices using their known addresses and processes fetched states like reported ones
+func handleMulticastResponses(deps Deps, op string, group net.IP, responses []coap_utils.MulticastResponse) (MulticastReport, error) {
+	devices, err := deps.Reg.GetDevices()
+	if err != nil {
+		return MulticastReport{}, err
+	}
+	index := addressIndex(devices)
+
+	report := MulticastReport{Op: op, Group: group, Responses: make([]MulticastDeviceResponse, 0), Missing: make([]string, 0)}
+	responded := make(map[string]bool)
+	now := time.Now()
+
+	for _, r := range responses {
+		res := MulticastDeviceResponse{DeviceId: index[r.Source.String()], Address: r.Source, Code: r.Code.String()}
+		res.Success, err = handleMulticastResponse(deps, op, res.DeviceId, r)
+		if err != nil {
+			res.Error = err.Error()
+		}
+
+		if res.DeviceId != "" {
+			responded[res.DeviceId] = true
+			err = deps.Reg.RecordReachability(res.DeviceId, r.Source, nil, now)
+			if err != nil {
+				log.Errorf("failed to record reachability for device %v: %+v", res.DeviceId, err)
+			}
+		}
+		report.Responses = append(report.Responses, res)
+	}
+
+	for id := range devices {
+		if !responded[id] {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+func handleMulticastResponse(deps Deps, op string, deviceId string, r coap_utils.MulticastResponse) (bool, error) {
+	if op != MULTICAST_REFRESH_STATE {
+		switch r.Code {
+		case codes.Empty, codes.Changed, codes.Content:
+			return true, nil
+		default:
+			return false, errors.Errorf("got response code %v", r.Code)
+		}
+	}
+
+	if r.Code != codes.Content {
+		return false, errors.Errorf("got response code %v", r.Code)
+	}
+	state, err := device_registry.StateFromJSON([]byte(r.Payload))
+	if err != nil {
+		return false, err
+	}
+	if deviceId == "" {
+		return true, nil
+	}
+	err = deps.Reg.UpdateState(deviceId, state)
+	if err != nil {
+		return false, err
+	}
+	deps.Sps.StateReported(deviceId, state)
+	return true, nil
+}
+
+// Indexes device ids by every address the device is known to use
+func addressIndex(devices map[string]device_registry.Device) map[string]string {
+	index := make(map[string]string)
+	add := func(ip net.IP, id string) {
+		if ip != nil {
+			index[ip.String()] = id
+		}
+	}
+
+	for id, d := range devices {
+		if d.State != nil {
+			for _, ip := range d.State.Addresses {
+				add(ip, id)
+			}
+		}
+		if d.Reachability != nil {
+			for _, s := range d.Reachability.Addresses {
+				add(s.Address, id)
+			}
+		}
+		add(d.Config.MainIp, id)
+	}
+	return index
+}
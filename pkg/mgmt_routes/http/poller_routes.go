@@ -0,0 +1,53 @@
+package http
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// Lists the status of every running state poller by device id
+func getV1Pollers(deps Deps, ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, deps.Sps.PollerStatuses())
+}
+
+// Returns the status of the device's state poller, or 404 if the device is not polled
+func getV1DevicePoller(deps Deps, ctx *gin.Context) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	status, found := deps.Sps.PollerStatus(id.Id)
+	if !found {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, status)
+}
+
+// Polls the device immediately on the poller's worker pool. The poll result can be followed from the poller status.
+func postV1DevicePollNow(deps Deps, ctx *gin.Context) {
+	var id Id
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	deviceExists, err := deps.Reg.Contains(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !deviceExists {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if !deps.Sps.PollNow(id.Id) {
+		ctx.AbortWithError(http.StatusBadRequest, errors.Errorf("state polling is not enabled for device %v", id.Id))
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
@@ -1,18 +1,33 @@
 package http
 
 import (
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
 	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/jobs"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
 	"github.com/chacal/thread-mgmt-server/pkg/state_poller_service"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
 	"github.com/gin-gonic/gin"
 )
 
-type depHandlerFunc = func(reg *device_registry.Registry, gw device_gateway.DeviceGateway, sps state_poller_service.StatePollerService, ctx *gin.Context)
+type Deps struct {
+	Reg      *device_registry.Registry
+	Gw       device_gateway.DeviceGateway
+	Sps      state_poller_service.StatePollerService
+	Jobs     *jobs.Manager
+	Pusher   *config_push.Pusher
+	Fallback *address_fallback.Fallback
+	Prober   *probe.Prober
+	Webhooks *webhooks.Dispatcher
+}
+
+type depHandlerFunc = func(deps Deps, ctx *gin.Context)
 
-func handlerWithDeps(reg *device_registry.Registry, gw device_gateway.DeviceGateway, sps state_poller_service.StatePollerService,
-	f depHandlerFunc) gin.HandlerFunc {
+func handlerWithDeps(deps Deps, f depHandlerFunc) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		f(reg, gw, sps, ctx)
+		f(deps, ctx)
 	}
 }
 
@@ -0,0 +1,120 @@
+package http
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// Shown in place of the signing secrets, which are never returned
+const redactedSecret = "********"
+
+type WebhookId struct {
+	Id string `uri:"webhook_id" binding:"required"`
+}
+
+type WebhookDeliveries struct {
+	// Deliveries waiting for their first attempt or a retry
+	Pending []device_registry.WebhookDelivery `json:"pending"`
+	// Latest delivery attempts, oldest first
+	Attempts []device_registry.WebhookAttempt `json:"attempts"`
+}
+
+func getV1Webhooks(reg *device_registry.Registry, ctx *gin.Context) {
+	webhooks, err := reg.GetWebhooks()
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	for i := range webhooks {
+		webhooks[i] = redacted(webhooks[i])
+	}
+	ctx.IndentedJSON(http.StatusOK, webhooks)
+}
+
+// Creates a webhook or replaces the webhook with the same id
+func postV1Webhook(reg *device_registry.Registry, ctx *gin.Context) {
+	var webhook device_registry.Webhook
+	if err := ctx.ShouldBindJSON(&webhook); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	if err := webhook.Validate(); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	err := reg.PutWebhook(webhook)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, redacted(webhook))
+}
+
+// Deletes a webhook and drops its undelivered events
+func deleteV1Webhook(reg *device_registry.Registry, ctx *gin.Context) {
+	var id WebhookId
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	found, err := reg.DeleteWebhook(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if !found {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// Returns the queued deliveries and the delivery log of a webhook
+func getV1WebhookDeliveries(reg *device_registry.Registry, ctx *gin.Context) {
+	var id WebhookId
+	if err := ctx.ShouldBindUri(&id); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+
+	webhook, err := reg.GetWebhook(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	if webhook == nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	queue, err := reg.GetWebhookQueue()
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	deliveries := WebhookDeliveries{Pending: []device_registry.WebhookDelivery{}}
+	for _, d := range queue {
+		if d.WebhookId == id.Id {
+			deliveries.Pending = append(deliveries.Pending, d)
+		}
+	}
+
+	deliveries.Attempts, err = reg.GetWebhookAttempts(id.Id)
+	if err != nil {
+		ctx.Error(err)
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, deliveries)
+}
+
+func redacted(webhook device_registry.Webhook) device_registry.Webhook {
+	if webhook.Secret != "" {
+		webhook.Secret = redactedSecret
+	}
+	return webhook
+}
@@ -5,10 +5,13 @@
 package mocks
 
 import (
+	context "context"
+	coap_utils "github.com/chacal/thread-mgmt-server/pkg/coap_utils"
 	device_registry "github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	gomock "github.com/golang/mock/gomock"
 	net "net"
 	reflect "reflect"
+	time "time"
 )
 
 // MockDeviceGateway is a mock of DeviceGateway interface
@@ -35,30 +38,105 @@ func (m *MockDeviceGateway) EXPECT() *MockDeviceGatewayMockRecorder {
 }
 
 // FetchState mocks base method
-func (m *MockDeviceGateway) FetchState(arg0 net.IP) (device_registry.State, error) {
+func (m *MockDeviceGateway) FetchState(arg0 context.Context, arg1 net.IP) (device_registry.State, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FetchState", arg0)
+	ret := m.ctrl.Call(m, "FetchState", arg0, arg1)
 	ret0, _ := ret[0].(device_registry.State)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // FetchState indicates an expected call of FetchState
-func (mr *MockDeviceGatewayMockRecorder) FetchState(arg0 interface{}) *gomock.Call {
+func (mr *MockDeviceGatewayMockRecorder) FetchState(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchState", reflect.TypeOf((*MockDeviceGateway)(nil).FetchState), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchState", reflect.TypeOf((*MockDeviceGateway)(nil).FetchState), arg0, arg1)
+}
+
+// MulticastCommand mocks base method
+func (m *MockDeviceGateway) MulticastCommand(arg0 context.Context, arg1, arg2 string, arg3 net.IP) ([]coap_utils.MulticastResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MulticastCommand", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]coap_utils.MulticastResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MulticastCommand indicates an expected call of MulticastCommand
+func (mr *MockDeviceGatewayMockRecorder) MulticastCommand(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MulticastCommand", reflect.TypeOf((*MockDeviceGateway)(nil).MulticastCommand), arg0, arg1, arg2, arg3)
+}
+
+// MulticastFetchState mocks base method
+func (m *MockDeviceGateway) MulticastFetchState(arg0 context.Context, arg1 net.IP) ([]coap_utils.MulticastResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MulticastFetchState", arg0, arg1)
+	ret0, _ := ret[0].([]coap_utils.MulticastResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MulticastFetchState indicates an expected call of MulticastFetchState
+func (mr *MockDeviceGatewayMockRecorder) MulticastFetchState(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MulticastFetchState", reflect.TypeOf((*MockDeviceGateway)(nil).MulticastFetchState), arg0, arg1)
+}
+
+// Ping mocks base method
+func (m *MockDeviceGateway) Ping(arg0 context.Context, arg1 net.IP) (time.Duration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ping", arg0, arg1)
+	ret0, _ := ret[0].(time.Duration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Ping indicates an expected call of Ping
+func (mr *MockDeviceGatewayMockRecorder) Ping(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockDeviceGateway)(nil).Ping), arg0, arg1)
+}
+
+// ProbeGet mocks base method
+func (m *MockDeviceGateway) ProbeGet(arg0 context.Context, arg1 net.IP) (time.Duration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ProbeGet", arg0, arg1)
+	ret0, _ := ret[0].(time.Duration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ProbeGet indicates an expected call of ProbeGet
+func (mr *MockDeviceGatewayMockRecorder) ProbeGet(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProbeGet", reflect.TypeOf((*MockDeviceGateway)(nil).ProbeGet), arg0, arg1)
 }
 
 // PushDefaults mocks base method
-func (m *MockDeviceGateway) PushDefaults(arg0 device_registry.Defaults, arg1 net.IP) error {
+func (m *MockDeviceGateway) PushDefaults(arg0 context.Context, arg1 device_registry.Defaults, arg2 net.IP) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "PushDefaults", arg0, arg1)
+	ret := m.ctrl.Call(m, "PushDefaults", arg0, arg1, arg2)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // PushDefaults indicates an expected call of PushDefaults
-func (mr *MockDeviceGatewayMockRecorder) PushDefaults(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockDeviceGatewayMockRecorder) PushDefaults(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushDefaults", reflect.TypeOf((*MockDeviceGateway)(nil).PushDefaults), arg0, arg1, arg2)
+}
+
+// SendCommand mocks base method
+func (m *MockDeviceGateway) SendCommand(arg0 context.Context, arg1, arg2 string, arg3 net.IP) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendCommand", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SendCommand indicates an expected call of SendCommand
+func (mr *MockDeviceGatewayMockRecorder) SendCommand(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PushDefaults", reflect.TypeOf((*MockDeviceGateway)(nil).PushDefaults), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendCommand", reflect.TypeOf((*MockDeviceGateway)(nil).SendCommand), arg0, arg1, arg2, arg3)
 }
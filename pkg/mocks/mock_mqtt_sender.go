@@ -47,14 +47,38 @@ func (mr *MockMqttSenderMockRecorder) Connect() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Connect", reflect.TypeOf((*MockMqttSender)(nil).Connect))
 }
 
+// PublishAlert mocks base method
+func (m *MockMqttSender) PublishAlert(arg0 device_registry.AlertNotification) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "PublishAlert", arg0)
+}
+
+// PublishAlert indicates an expected call of PublishAlert
+func (mr *MockMqttSenderMockRecorder) PublishAlert(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishAlert", reflect.TypeOf((*MockMqttSender)(nil).PublishAlert), arg0)
+}
+
+// PublishEvent mocks base method
+func (m *MockMqttSender) PublishEvent(arg0 string, arg1 device_registry.Event) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "PublishEvent", arg0, arg1)
+}
+
+// PublishEvent indicates an expected call of PublishEvent
+func (mr *MockMqttSenderMockRecorder) PublishEvent(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishEvent", reflect.TypeOf((*MockMqttSender)(nil).PublishEvent), arg0, arg1)
+}
+
 // PublishState mocks base method
-func (m *MockMqttSender) PublishState(arg0 device_registry.State) {
+func (m *MockMqttSender) PublishState(arg0 device_registry.State, arg1 *device_registry.BatteryEstimate) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "PublishState", arg0)
+	m.ctrl.Call(m, "PublishState", arg0, arg1)
 }
 
 // PublishState indicates an expected call of PublishState
-func (mr *MockMqttSenderMockRecorder) PublishState(arg0 interface{}) *gomock.Call {
+func (mr *MockMqttSenderMockRecorder) PublishState(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishState", reflect.TypeOf((*MockMqttSender)(nil).PublishState), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublishState", reflect.TypeOf((*MockMqttSender)(nil).PublishState), arg0, arg1)
 }
@@ -5,6 +5,7 @@
 package mocks
 
 import (
+	device_registry "github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	gomock "github.com/golang/mock/gomock"
 	net "net"
 	reflect "reflect"
@@ -33,16 +34,40 @@ func (m *MockStatePoller) EXPECT() *MockStatePollerMockRecorder {
 	return m.recorder
 }
 
+// PollNow mocks base method
+func (m *MockStatePoller) PollNow() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "PollNow")
+}
+
+// PollNow indicates an expected call of PollNow
+func (mr *MockStatePollerMockRecorder) PollNow() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PollNow", reflect.TypeOf((*MockStatePoller)(nil).PollNow))
+}
+
 // Refresh mocks base method
-func (m *MockStatePoller) Refresh(arg0 int, arg1 net.IP) {
+func (m *MockStatePoller) Refresh(arg0 int, arg1 net.IP, arg2 *device_registry.Schedule) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Refresh", arg0, arg1)
+	m.ctrl.Call(m, "Refresh", arg0, arg1, arg2)
 }
 
 // Refresh indicates an expected call of Refresh
-func (mr *MockStatePollerMockRecorder) Refresh(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockStatePollerMockRecorder) Refresh(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Refresh", reflect.TypeOf((*MockStatePoller)(nil).Refresh), arg0, arg1, arg2)
+}
+
+// Reported mocks base method
+func (m *MockStatePoller) Reported() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Reported")
+}
+
+// Reported indicates an expected call of Reported
+func (mr *MockStatePollerMockRecorder) Reported() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Refresh", reflect.TypeOf((*MockStatePoller)(nil).Refresh), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reported", reflect.TypeOf((*MockStatePoller)(nil).Reported))
 }
 
 // Start mocks base method
@@ -57,6 +82,20 @@ func (mr *MockStatePollerMockRecorder) Start() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockStatePoller)(nil).Start))
 }
 
+// Status mocks base method
+func (m *MockStatePoller) Status() device_registry.PollerStatus {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Status")
+	ret0, _ := ret[0].(device_registry.PollerStatus)
+	return ret0
+}
+
+// Status indicates an expected call of Status
+func (mr *MockStatePollerMockRecorder) Status() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockStatePoller)(nil).Status))
+}
+
 // Stop mocks base method
 func (m *MockStatePoller) Stop() {
 	m.ctrl.T.Helper()
@@ -5,6 +5,7 @@
 package mocks
 
 import (
+	device_registry "github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -32,6 +33,49 @@ func (m *MockStatePollerService) EXPECT() *MockStatePollerServiceMockRecorder {
 	return m.recorder
 }
 
+// PollNow mocks base method
+func (m *MockStatePollerService) PollNow(arg0 string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PollNow", arg0)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// PollNow indicates an expected call of PollNow
+func (mr *MockStatePollerServiceMockRecorder) PollNow(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PollNow", reflect.TypeOf((*MockStatePollerService)(nil).PollNow), arg0)
+}
+
+// PollerStatus mocks base method
+func (m *MockStatePollerService) PollerStatus(arg0 string) (device_registry.PollerStatus, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PollerStatus", arg0)
+	ret0, _ := ret[0].(device_registry.PollerStatus)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// PollerStatus indicates an expected call of PollerStatus
+func (mr *MockStatePollerServiceMockRecorder) PollerStatus(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PollerStatus", reflect.TypeOf((*MockStatePollerService)(nil).PollerStatus), arg0)
+}
+
+// PollerStatuses mocks base method
+func (m *MockStatePollerService) PollerStatuses() map[string]device_registry.PollerStatus {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PollerStatuses")
+	ret0, _ := ret[0].(map[string]device_registry.PollerStatus)
+	return ret0
+}
+
+// PollerStatuses indicates an expected call of PollerStatuses
+func (mr *MockStatePollerServiceMockRecorder) PollerStatuses() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PollerStatuses", reflect.TypeOf((*MockStatePollerService)(nil).PollerStatuses))
+}
+
 // Refresh mocks base method
 func (m *MockStatePollerService) Refresh() error {
 	m.ctrl.T.Helper()
@@ -60,6 +104,18 @@ func (mr *MockStatePollerServiceMockRecorder) Start() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockStatePollerService)(nil).Start))
 }
 
+// StateReported mocks base method
+func (m *MockStatePollerService) StateReported(arg0 string, arg1 device_registry.State) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "StateReported", arg0, arg1)
+}
+
+// StateReported indicates an expected call of StateReported
+func (mr *MockStatePollerServiceMockRecorder) StateReported(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StateReported", reflect.TypeOf((*MockStatePollerService)(nil).StateReported), arg0, arg1)
+}
+
 // Stop mocks base method
 func (m *MockStatePollerService) Stop() {
 	m.ctrl.T.Helper()
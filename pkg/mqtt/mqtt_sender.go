@@ -23,11 +23,24 @@ type ThreadDisplayStatus struct {
 	TimeStamp string                     `json:"ts"`
 	Vcc       int                        `json:"vcc"`
 	Parent    device_registry.ParentInfo `json:"parent"`
+	// Estimate of the remaining battery life, missing until there's enough vcc history
+	Battery *device_registry.BatteryEstimate `json:"battery,omitempty"`
+}
+
+type ThreadDisplayEvent struct {
+	Instance  string          `json:"instance"`
+	Tag       string          `json:"tag"`
+	TimeStamp string          `json:"ts"`
+	Type      string          `json:"type"`
+	Message   string          `json:"message,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
 }
 
 type MqttSender interface {
 	Connect() chan bool
-	PublishState(state device_registry.State)
+	PublishState(state device_registry.State, battery *device_registry.BatteryEstimate)
+	PublishEvent(instance string, event device_registry.Event)
+	PublishAlert(n device_registry.AlertNotification)
 }
 
 type mqttSender struct {
@@ -65,13 +78,13 @@ func (s *mqttSender) Connect() chan bool {
 	return ret
 }
 
-func (s *mqttSender) PublishState(state device_registry.State) {
+func (s *mqttSender) PublishState(state device_registry.State, battery *device_registry.BatteryEstimate) {
 	if !s.client.IsConnectionOpen() {
 		log.Warnf("Can't publish state for device %v. MQTT not connected.", state.Instance)
 		return
 	}
 
-	topic, payload, err := publishDataForState(state, time.Now())
+	topic, payload, err := publishDataForState(state, battery, time.Now())
 	if err != nil {
 		log.Error(publishErrorMsg(state, err))
 		return
@@ -86,22 +99,88 @@ func (s *mqttSender) PublishState(state device_registry.State) {
 	}()
 }
 
-func publishDataForState(state device_registry.State, ts time.Time) (string, []byte, error) {
+func (s *mqttSender) PublishEvent(instance string, event device_registry.Event) {
+	if !s.client.IsConnectionOpen() {
+		log.Warnf("Can't publish event for device %v. MQTT not connected.", instance)
+		return
+	}
+
+	topic, payload, err := publishDataForEvent(instance, event)
+	if err != nil {
+		log.Error(publishEventErrorMsg(instance, err))
+		return
+	}
+
+	t := s.client.Publish(topic, 1, false, payload)
+	go func() {
+		_ = t.Wait()
+		if t.Error() != nil {
+			log.Error(publishEventErrorMsg(instance, t.Error()))
+		}
+	}()
+}
+
+func (s *mqttSender) PublishAlert(n device_registry.AlertNotification) {
+	if !s.client.IsConnectionOpen() {
+		log.Warnf("Can't publish alert for device %v. MQTT not connected.", n.Instance)
+		return
+	}
+
+	topic, payload, err := publishDataForAlert(n)
+	if err != nil {
+		log.Error(publishAlertErrorMsg(n.Instance, err))
+		return
+	}
+
+	t := s.client.Publish(topic, 1, false, payload)
+	go func() {
+		_ = t.Wait()
+		if t.Error() != nil {
+			log.Error(publishAlertErrorMsg(n.Instance, t.Error()))
+		}
+	}()
+}
+
+func publishDataForState(state device_registry.State, battery *device_registry.BatteryEstimate, ts time.Time) (string, []byte, error) {
 	topic := fmt.Sprintf("/sensor/%s/%s/state", state.Instance, MQTT_STATE_TAG)
-	buf, err := json.Marshal(displayStatusFromState(state, ts))
+	buf, err := json.Marshal(displayStatusFromState(state, battery, ts))
 	return topic, buf, err
 }
 
-func displayStatusFromState(s device_registry.State, ts time.Time) ThreadDisplayStatus {
+func displayStatusFromState(s device_registry.State, battery *device_registry.BatteryEstimate, ts time.Time) ThreadDisplayStatus {
 	return ThreadDisplayStatus{
 		Instance:  s.Instance,
 		Tag:       MQTT_STATE_TAG,
 		TimeStamp: ts.Format(time.RFC3339),
 		Vcc:       s.Vcc,
 		Parent:    s.Parent,
+		Battery:   battery,
 	}
 }
 
+func publishDataForEvent(instance string, event device_registry.Event) (string, []byte, error) {
+	topic := fmt.Sprintf("/sensor/%s/%s/event", instance, MQTT_STATE_TAG)
+	buf, err := json.Marshal(displayEventFromEvent(instance, event))
+	return topic, buf, err
+}
+
+func displayEventFromEvent(instance string, e device_registry.Event) ThreadDisplayEvent {
+	return ThreadDisplayEvent{
+		Instance:  instance,
+		Tag:       MQTT_STATE_TAG,
+		TimeStamp: e.Timestamp.Format(time.RFC3339),
+		Type:      e.Type,
+		Message:   e.Message,
+		Data:      e.Data,
+	}
+}
+
+func publishDataForAlert(n device_registry.AlertNotification) (string, []byte, error) {
+	topic := fmt.Sprintf("/sensor/%s/%s/alert", n.Instance, MQTT_STATE_TAG)
+	buf, err := json.Marshal(n)
+	return topic, buf, err
+}
+
 func randBetween(min int, max int) int {
 	return rand.Intn(max-min+1) + min
 }
@@ -122,3 +201,11 @@ func onMqttReconnecting(client mqtt.Client, opts *mqtt.ClientOptions) {
 func publishErrorMsg(state device_registry.State, err error) string {
 	return fmt.Sprintf("Failed to publish state for device %s. Error: %v", state.Instance, err)
 }
+
+func publishEventErrorMsg(instance string, err error) string {
+	return fmt.Sprintf("Failed to publish event for device %s. Error: %v", instance, err)
+}
+
+func publishAlertErrorMsg(instance string, err error) string {
+	return fmt.Sprintf("Failed to publish alert for device %s. Error: %v", instance, err)
+}
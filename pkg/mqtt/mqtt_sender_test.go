@@ -19,7 +19,7 @@ func TestMqttSender_publishDataForState(t *testing.T) {
 	ts := time.Now()
 	formattedTs := ts.Format(time.RFC3339)
 
-	topic, payload, err := publishDataForState(testState, ts)
+	topic, payload, err := publishDataForState(testState, nil, ts)
 	require.NoError(t, err)
 	assert.Equal(t, "/sensor/A100/d/state", topic)
 	assert.JSONEq(t,
@@ -39,3 +39,97 @@ func TestMqttSender_publishDataForState(t *testing.T) {
 		string(payload),
 	)
 }
+
+func TestMqttSender_publishDataForStateWithBattery(t *testing.T) {
+	ts := time.Now()
+	formattedTs := ts.Format(time.RFC3339)
+	estimate := &device_registry.BatteryEstimate{SlopeMvPerDay: -2.5, Vcc: 2960, CutoffVcc: 2000, DaysRemaining: 384, Samples: 120,
+		Timestamp: time.Date(2020, 11, 23, 7, 0, 0, 0, time.UTC)}
+
+	_, payload, err := publishDataForState(testState, estimate, ts)
+	require.NoError(t, err)
+	assert.JSONEq(t,
+		fmt.Sprintf(`{
+			"instance": "A100",
+			"tag": "d",
+			"ts": "%v",
+			"vcc": 2970,
+			"parent": {
+				"rloc16": "0x4400",
+				"linkQualityIn": 3,
+				"linkQualityOut": 2,
+				"avgRssi": -65,
+				"latestRssi": -63
+			},
+			"battery": {
+				"slopeMvPerDay": -2.5,
+				"vcc": 2960,
+				"cutoffVcc": 2000,
+				"daysRemaining": 384,
+				"samples": 120,
+				"ts": "2020-11-23T07:00:00Z"
+			}
+		}`, formattedTs),
+		string(payload),
+	)
+}
+
+func TestMqttSender_publishDataForEvent(t *testing.T) {
+	ts := time.Now()
+	formattedTs := ts.Format(time.RFC3339)
+	event := device_registry.Event{
+		Type:      device_registry.EVENT_CRASH,
+		Message:   "hard fault",
+		Data:      []byte(`{"pc":"0x0001f2a4"}`),
+		Timestamp: ts,
+	}
+
+	topic, payload, err := publishDataForEvent("A100", event)
+	require.NoError(t, err)
+	assert.Equal(t, "/sensor/A100/d/event", topic)
+	assert.JSONEq(t,
+		fmt.Sprintf(`{
+			"instance": "A100",
+			"tag": "d",
+			"ts": "%v",
+			"type": "CRASH",
+			"message": "hard fault",
+			"data": {
+				"pc": "0x0001f2a4"
+			}
+		}`, formattedTs),
+		string(payload),
+	)
+}
+
+func TestMqttSender_publishDataForAlert(t *testing.T) {
+	ts := time.Date(2020, 11, 23, 7, 0, 0, 0, time.UTC)
+	n := device_registry.AlertNotification{
+		DeviceId:  "12345",
+		Instance:  "A100",
+		RuleId:    "battery",
+		Type:      device_registry.ALERT_LOW_VCC,
+		Status:    device_registry.ALERT_FIRING,
+		Value:     2400,
+		Threshold: 2500,
+		Message:   "vcc 2400 mV, threshold 2500 mV",
+		Timestamp: ts,
+	}
+
+	topic, payload, err := publishDataForAlert(n)
+	require.NoError(t, err)
+	assert.Equal(t, "/sensor/A100/d/alert", topic)
+	assert.JSONEq(t, `{
+			"deviceId": "12345",
+			"instance": "A100",
+			"ruleId": "battery",
+			"type": "low_vcc",
+			"status": "firing",
+			"value": 2400,
+			"threshold": 2500,
+			"message": "vcc 2400 mV, threshold 2500 mV",
+			"ts": "2020-11-23T07:00:00Z"
+		}`,
+		string(payload),
+	)
+}
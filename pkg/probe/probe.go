@@ -0,0 +1,129 @@
+package probe
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+type Result struct {
+	Ping *device_registry.ProbeSample `json:"ping,omitempty"`
+	Get  *device_registry.ProbeSample `json:"get,omitempty"`
+}
+
+// Stats summarizes the probe samples of one kind
+type Stats struct {
+	Samples int     `json:"samples"`
+	Loss    float64 `json:"loss"`
+	P50Ms   float64 `json:"p50Ms,omitempty"`
+	P90Ms   float64 `json:"p90Ms,omitempty"`
+	P99Ms   float64 `json:"p99Ms,omitempty"`
+}
+
+type Prober struct {
+	reg      *device_registry.Registry
+	gw       device_gateway.DeviceGateway
+	fallback *address_fallback.Fallback
+	now      func() time.Time
+}
+
+func Create(reg *device_registry.Registry, gw device_gateway.DeviceGateway, fallback *address_fallback.Fallback) *Prober {
+	return &Prober{reg, gw, fallback, time.Now}
+}
+
+// Probe pings the device and then times a state request to the address that answered the ping. Without an
+// address all known addresses of the device are tried. Every sample is recorded in the registry. An error is
+// returned if either of the probes failed.
+func (p *Prober) Probe(ctx context.Context, id string, address net.IP) (Result, error) {
+	var res Result
+
+	ip, err := p.fallback.Do(ctx, id, address, func(ctx context.Context, ip net.IP) error {
+		s, err := p.sample(device_registry.PROBE_PING, ip, func() (time.Duration, error) {
+			return p.gw.Ping(ctx, ip)
+		})
+		res.Ping = &s
+		p.record(id, s)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+
+	device, err := p.reg.Get(id)
+	if err != nil {
+		return res, err
+	}
+	ctx = device_gateway.WithTransportConfig(ctx, device.Config.Transport)
+	s, err := p.sample(device_registry.PROBE_GET, ip, func() (time.Duration, error) {
+		return p.gw.ProbeGet(ctx, ip)
+	})
+	res.Get = &s
+	p.record(id, s)
+	return res, err
+}
+
+func (p *Prober) record(id string, s device_registry.ProbeSample) {
+	err := p.reg.AddProbeSample(id, s)
+	if err != nil {
+		log.Errorf("failed to record probe sample for device %v: %+v", id, err)
+	}
+}
+
+func (p *Prober) sample(kind string, ip net.IP, f func() (time.Duration, error)) (device_registry.ProbeSample, error) {
+	s := device_registry.ProbeSample{Kind: kind, Timestamp: p.now(), Address: ip}
+	rtt, err := f()
+	if err != nil {
+		log.Debugf("%v probe to %v failed: %v", kind, ip, err)
+		s.Error = err.Error()
+		return s, err
+	}
+	s.Success = true
+	s.RttMs = float64(rtt.Microseconds()) / 1000
+	return s, nil
+}
+
+// Summarize computes loss and round trip time percentiles of the samples per probe kind
+func Summarize(samples []device_registry.ProbeSample) map[string]Stats {
+	rtts := make(map[string][]float64)
+	stats := make(map[string]Stats)
+
+	for _, s := range samples {
+		st := stats[s.Kind]
+		st.Samples++
+		if s.Success {
+			rtts[s.Kind] = append(rtts[s.Kind], s.RttMs)
+		} else {
+			st.Loss++
+		}
+		stats[s.Kind] = st
+	}
+
+	for kind, st := range stats {
+		st.Loss = st.Loss / float64(st.Samples)
+		r := rtts[kind]
+		sort.Float64s(r)
+		st.P50Ms = percentile(r, 50)
+		st.P90Ms = percentile(r, 90)
+		st.P99Ms = percentile(r, 99)
+		stats[kind] = st
+	}
+	return stats
+}
+
+// Nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
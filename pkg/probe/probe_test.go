@@ -0,0 +1,87 @@
+package probe
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+var mainIp = net.ParseIP("fd00:1::1")
+var mlEid = net.ParseIP("fdde:ad00:beef:0:1234:5678:9abc:def0")
+
+func TestProber_Probe(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: mainIp}))
+	require.NoError(t, reg.UpdateState("12345", device_registry.State{Addresses: []net.IP{mlEid}}))
+
+	ts := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+	p := Create(reg, mockGw, address_fallback.Create(reg))
+	p.now = func() time.Time { return ts }
+
+	gomock.InOrder(
+		mockGw.EXPECT().Ping(gomock.Any(), gomock.Eq(mainIp)).Return(time.Duration(0), errors.New("timeout")),
+		mockGw.EXPECT().Ping(gomock.Any(), gomock.Eq(mlEid)).Return(1500*time.Microsecond, nil),
+		mockGw.EXPECT().ProbeGet(gomock.Any(), gomock.Eq(mlEid)).Return(40*time.Millisecond, nil),
+	)
+
+	res, err := p.Probe(context.Background(), "12345", nil)
+	require.NoError(t, err)
+	assert.Equal(t, &device_registry.ProbeSample{Kind: device_registry.PROBE_PING, Timestamp: ts, Address: mlEid, Success: true, RttMs: 1.5}, res.Ping)
+	assert.Equal(t, &device_registry.ProbeSample{Kind: device_registry.PROBE_GET, Timestamp: ts, Address: mlEid, Success: true, RttMs: 40}, res.Get)
+
+	// Failed pings to fallback addresses are recorded too
+	samples, err := reg.GetProbeSamples("12345")
+	require.NoError(t, err)
+	assert.Equal(t, []device_registry.ProbeSample{
+		{Kind: device_registry.PROBE_PING, Timestamp: ts, Address: mainIp, Success: false, Error: "timeout"},
+		*res.Ping,
+		*res.Get,
+	}, samples)
+}
+
+func TestProber_ProbeFailingGet(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+
+	mockGw.EXPECT().Ping(gomock.Any(), gomock.Eq(mainIp)).Return(time.Millisecond, nil)
+	mockGw.EXPECT().ProbeGet(gomock.Any(), gomock.Eq(mainIp)).Return(time.Duration(0), errors.New("4.04 Not Found"))
+
+	res, err := Create(reg, mockGw, address_fallback.Create(reg)).Probe(context.Background(), "12345", mainIp)
+	assert.EqualError(t, err, "4.04 Not Found")
+	assert.True(t, res.Ping.Success)
+	assert.False(t, res.Get.Success)
+	assert.Equal(t, "4.04 Not Found", res.Get.Error)
+}
+
+func TestSummarize(t *testing.T) {
+	var samples []device_registry.ProbeSample
+	for i := 1; i <= 10; i++ {
+		samples = append(samples, device_registry.ProbeSample{Kind: device_registry.PROBE_PING, Success: true, RttMs: float64(i)})
+	}
+	samples = append(samples,
+		device_registry.ProbeSample{Kind: device_registry.PROBE_PING, Success: false},
+		device_registry.ProbeSample{Kind: device_registry.PROBE_GET, Success: false},
+	)
+
+	stats := Summarize(samples)
+	assert.Equal(t, Stats{Samples: 11, Loss: 1.0 / 11, P50Ms: 5, P90Ms: 9, P99Ms: 10}, stats[device_registry.PROBE_PING])
+	assert.Equal(t, Stats{Samples: 1, Loss: 1}, stats[device_registry.PROBE_GET])
+	assert.Empty(t, Summarize(nil))
+}
@@ -0,0 +1,217 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Lines waiting to be written to InfluxDB. When the queue is full new lines are dropped, so that a slow
+	// database can't block the processing of device states.
+	influxQueueSize = 1000
+	// Maximum number of lines written in one request
+	influxBatchSize = 100
+	influxTimeout   = 10 * time.Second
+)
+
+type mqttSink struct {
+	sender mqtt.MqttSender
+}
+
+// Mqtt publishes the updates to the state topic of the device instance
+func Mqtt(sender mqtt.MqttSender) Sink {
+	return &mqttSink{sender}
+}
+
+func (m *mqttSink) Publish(update StateUpdate) {
+	m.sender.PublishState(update.State, update.Battery)
+}
+
+func (m *mqttSink) Close() {}
+
+type webhookSink struct {
+	dispatcher *webhooks.Dispatcher
+}
+
+// Webhook sends the updates as state_updated events to the webhooks that accept them
+func Webhook(dispatcher *webhooks.Dispatcher) Sink {
+	return &webhookSink{dispatcher}
+}
+
+func (w *webhookSink) Publish(update StateUpdate) {
+	w.dispatcher.Send(device_registry.WEBHOOK_STATE_UPDATED, update.DeviceId, update.State)
+}
+
+func (w *webhookSink) Close() {}
+
+type influxSink struct {
+	url         string
+	token       string
+	measurement string
+	client      *http.Client
+	lines       chan string
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+// Influx writes the updates in line protocol to an InfluxDB write endpoint, eg.
+// 'http://influx:8086/write?db=sensors' or 'http://influx:8086/api/v2/write?org=home&bucket=sensors'.
+// The lines are written in the background in batches.
+func Influx(url string, token string, measurement string) Sink {
+	s := &influxSink{
+		url:         url,
+		token:       token,
+		measurement: measurement,
+		client:      &http.Client{Timeout: influxTimeout},
+		lines:       make(chan string, influxQueueSize),
+		stop:        make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *influxSink) Publish(update StateUpdate) {
+	select {
+	case s.lines <- formatLine(s.measurement, update):
+	default:
+		log.Errorf("influx queue is full, dropping state of device %v", update.DeviceId)
+	}
+}
+
+// Writes the queued lines and stops the sink
+func (s *influxSink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+	})
+}
+
+func (s *influxSink) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case line := <-s.lines:
+			s.writeBatch(line)
+		case <-s.stop:
+			for {
+				select {
+				case line := <-s.lines:
+					s.writeBatch(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Writes the line together with the lines queued after it
+func (s *influxSink) writeBatch(first string) {
+	batch := []string{first}
+collect:
+	for len(batch) < influxBatchSize {
+		select {
+		case line := <-s.lines:
+			batch = append(batch, line)
+		default:
+			break collect
+		}
+	}
+
+	if err := s.write(batch); err != nil {
+		log.Errorf("failed to write %v lines to influx: %v", len(batch), err)
+	}
+}
+
+func (s *influxSink) write(lines []string) error {
+	var body bytes.Buffer
+	for _, line := range lines {
+		body.WriteString(line)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("unexpected response status %v", res.Status)
+	}
+	return nil
+}
+
+type fileSink struct {
+	format      string
+	measurement string
+	mu          sync.Mutex
+	file        *os.File
+}
+
+// File appends the updates to the file, one per line in the given format
+func File(path string, format string, measurement string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if format == "" {
+		format = FORMAT_JSON
+	}
+	return &fileSink{format: format, measurement: measurement, file: file}, nil
+}
+
+func (f *fileSink) Publish(update StateUpdate) {
+	var line []byte
+	if f.format == FORMAT_LINE {
+		line = []byte(formatLine(f.measurement, update))
+	} else {
+		var err error
+		line, err = json.Marshal(update)
+		if err != nil {
+			log.Errorf("failed to marshal state of device %v: %v", update.DeviceId, err)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("failed to write state of device %v to %v: %v", update.DeviceId, f.file.Name(), err)
+	}
+}
+
+func (f *fileSink) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return
+	}
+	if err := f.file.Close(); err != nil {
+		log.Errorf("failed to close %v: %v", f.file.Name(), err)
+	}
+	f.file = nil
+}
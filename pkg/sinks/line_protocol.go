@@ -0,0 +1,45 @@
+package sinks
+
+import (
+	"strconv"
+	"strings"
+)
+
+var measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+var stringFieldEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+
+// Formats the update in InfluxDB line protocol, with the device id and instance as tags
+func formatLine(measurement string, update StateUpdate) string {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(measurement))
+	b.WriteString(",device=")
+	b.WriteString(tagEscaper.Replace(update.DeviceId))
+	if update.State.Instance != "" {
+		b.WriteString(",instance=")
+		b.WriteString(tagEscaper.Replace(update.State.Instance))
+	}
+
+	s := update.State
+	fields := []string{
+		"vcc=" + strconv.Itoa(s.Vcc) + "i",
+		"txPower=" + strconv.Itoa(s.TxPower) + "i",
+		"pollPeriod=" + strconv.Itoa(s.PollPeriod) + "i",
+		`parent="` + stringFieldEscaper.Replace(s.Parent.Rloc16) + `"`,
+		"linkQualityIn=" + strconv.Itoa(s.Parent.LinkQualityIn) + "i",
+		"linkQualityOut=" + strconv.Itoa(s.Parent.LinkQualityOut) + "i",
+		"avgRssi=" + strconv.Itoa(s.Parent.AvgRssi) + "i",
+		"latestRssi=" + strconv.Itoa(s.Parent.LatestRssi) + "i",
+	}
+	if update.Battery != nil {
+		fields = append(fields,
+			"batteryDaysRemaining="+strconv.FormatFloat(update.Battery.DaysRemaining, 'f', -1, 64),
+			"batterySlopeMvPerDay="+strconv.FormatFloat(update.Battery.SlopeMvPerDay, 'f', -1, 64),
+		)
+	}
+	b.WriteString(" ")
+	b.WriteString(strings.Join(fields, ","))
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(update.Timestamp.UnixNano(), 10))
+	return b.String()
+}
@@ -0,0 +1,232 @@
+package sinks
+
+//go:generate mockgen -destination=../mocks/mock_sink.go -package=mocks github.com/chacal/thread-mgmt-server/pkg/sinks Sink
+
+import (
+	"encoding/json"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Publishes to the state topic of the device instance
+	SINK_MQTT = "mqtt"
+	// Sends state_updated events to the webhooks
+	SINK_WEBHOOK = "webhook"
+	// Writes InfluxDB line protocol to an HTTP write endpoint
+	SINK_INFLUX = "influx"
+	// Appends to a file, one update per line
+	SINK_FILE = "file"
+)
+
+var SinkTypes = []string{SINK_MQTT, SINK_WEBHOOK, SINK_INFLUX, SINK_FILE}
+
+const (
+	// Each update as a JSON object
+	FORMAT_JSON = "json"
+	// InfluxDB line protocol
+	FORMAT_LINE = "line"
+)
+
+const DefaultMeasurement = "thread_device"
+
+// StateUpdate is a processed state of a device, published to all sinks
+type StateUpdate struct {
+	DeviceId  string                `json:"deviceId"`
+	Timestamp time.Time             `json:"ts"`
+	State     device_registry.State `json:"state"`
+	// Missing until there's enough vcc history for an estimate
+	Battery *device_registry.BatteryEstimate `json:"battery,omitempty"`
+	Tags    []string                         `json:"tags,omitempty"`
+}
+
+// Sink is a destination for the state updates. Publish is called for every processed state and must not block
+// for long, sinks writing to slow destinations queue the updates.
+type Sink interface {
+	Publish(update StateUpdate)
+	// Flushes the queued updates and releases the resources of the sink
+	Close()
+}
+
+// Filter limits the updates published to a sink. Zero values pass everything.
+type Filter struct {
+	// Only devices having one of the tags are published
+	Tags []string `json:"tags,omitempty"`
+	// Only the listed devices are published
+	Devices []string `json:"devices,omitempty"`
+	// Updates of a device arriving sooner than this after its previous published update are dropped
+	MinIntervalSec int `json:"minIntervalSec,omitempty"`
+}
+
+// Config describes a sink in the sinks config file
+type Config struct {
+	Type   string `json:"type"`
+	Filter Filter `json:"filter"`
+	// Write endpoint of an influx sink, including the database or bucket parameters
+	Url string `json:"url,omitempty"`
+	// Measurement written by an influx sink or a file sink with line format, defaults to DefaultMeasurement
+	Measurement string `json:"measurement,omitempty"`
+	// Sent as an "Authorization: Token" header by an influx sink
+	Token string `json:"token,omitempty"`
+	// File appended to by a file sink
+	Path string `json:"path,omitempty"`
+	// Format of a file sink, FORMAT_JSON or FORMAT_LINE, defaults to FORMAT_JSON
+	Format string `json:"format,omitempty"`
+}
+
+// Publishes to MQTT and sends the updates to webhooks, like before sinks were configurable
+var DefaultConfigs = []Config{{Type: SINK_MQTT}, {Type: SINK_WEBHOOK}}
+
+func (c Config) Validate() error {
+	switch c.Type {
+	case SINK_MQTT, SINK_WEBHOOK:
+	case SINK_INFLUX:
+		u, err := url.Parse(c.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("invalid %v sink: url must be an http(s) URL", c.Type)
+		}
+	case SINK_FILE:
+		if c.Path == "" {
+			return errors.Errorf("invalid %v sink: path must be given", c.Type)
+		}
+		if c.Format != "" && c.Format != FORMAT_JSON && c.Format != FORMAT_LINE {
+			return errors.Errorf("invalid %v sink: format must be one of %v, %v", c.Type, FORMAT_JSON, FORMAT_LINE)
+		}
+	default:
+		return errors.Errorf("invalid sink type '%v', must be one of %v", c.Type, SinkTypes)
+	}
+	if c.Filter.MinIntervalSec < 0 {
+		return errors.Errorf("invalid %v sink: minIntervalSec must not be negative", c.Type)
+	}
+	return nil
+}
+
+func (c Config) measurement() string {
+	if c.Measurement == "" {
+		return DefaultMeasurement
+	}
+	return c.Measurement
+}
+
+// Reads a JSON array of sink configs from the file
+func LoadConfigs(file string) ([]Config, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var configs []Config
+	err = json.Unmarshal(buf, &configs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid sinks config in '%v'", file)
+	}
+	for i, c := range configs {
+		if err := c.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "sinks[%v]", i)
+		}
+	}
+	return configs, nil
+}
+
+// Creates the configured sinks. Sinks created before an error are closed.
+func Create(configs []Config, mqttSender mqtt.MqttSender, dispatcher *webhooks.Dispatcher) ([]Sink, error) {
+	var sinks []Sink
+	for i, c := range configs {
+		sink, err := create(c, mqttSender, dispatcher)
+		if err != nil {
+			CloseAll(sinks)
+			return nil, errors.Wrapf(err, "failed to create sinks[%v]", i)
+		}
+		sinks = append(sinks, WithFilter(sink, c.Filter))
+	}
+	return sinks, nil
+}
+
+func create(c Config, mqttSender mqtt.MqttSender, dispatcher *webhooks.Dispatcher) (Sink, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Type {
+	case SINK_MQTT:
+		return Mqtt(mqttSender), nil
+	case SINK_WEBHOOK:
+		return Webhook(dispatcher), nil
+	case SINK_INFLUX:
+		return Influx(c.Url, c.Token, c.measurement()), nil
+	default:
+		return File(c.Path, c.Format, c.measurement())
+	}
+}
+
+func CloseAll(sinks []Sink) {
+	for _, s := range sinks {
+		s.Close()
+	}
+}
+
+type filtered struct {
+	sink     Sink
+	filter   Filter
+	now      func() time.Time
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+}
+
+// WithFilter publishes only the updates passing the filter to the sink
+func WithFilter(sink Sink, filter Filter) Sink {
+	return &filtered{sink: sink, filter: filter, now: time.Now, lastSent: make(map[string]time.Time)}
+}
+
+func (f *filtered) Publish(update StateUpdate) {
+	if !f.filter.passes(update) {
+		return
+	}
+
+	if f.filter.MinIntervalSec > 0 {
+		f.mu.Lock()
+		now := f.now()
+		last, found := f.lastSent[update.DeviceId]
+		if found && now.Sub(last) < time.Duration(f.filter.MinIntervalSec)*time.Second {
+			f.mu.Unlock()
+			return
+		}
+		f.lastSent[update.DeviceId] = now
+		f.mu.Unlock()
+	}
+
+	f.sink.Publish(update)
+}
+
+func (f *filtered) Close() {
+	f.sink.Close()
+}
+
+func (f Filter) passes(update StateUpdate) bool {
+	if len(f.Devices) > 0 && !contains(f.Devices, update.DeviceId) {
+		return false
+	}
+	if len(f.Tags) == 0 {
+		return true
+	}
+	for _, tag := range update.Tags {
+		if contains(f.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
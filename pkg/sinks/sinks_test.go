@@ -0,0 +1,208 @@
+package sinks
+
+import (
+	"encoding/json"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testState = device_registry.State{
+	Vcc:        2980,
+	Instance:   "A100",
+	TxPower:    4,
+	PollPeriod: 1000,
+	Parent:     device_registry.ParentInfo{Rloc16: "0x4400", LinkQualityIn: 3, LinkQualityOut: 2, AvgRssi: -60, LatestRssi: -58},
+}
+
+var testTime = time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+
+var testUpdate = StateUpdate{DeviceId: "12345", Timestamp: testTime, State: testState, Tags: []string{"outdoor"}}
+
+// recorder is a sink that keeps the published updates
+type recorder struct {
+	mu      sync.Mutex
+	updates []StateUpdate
+	closed  bool
+}
+
+func (r *recorder) Publish(update StateUpdate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updates = append(r.updates, update)
+}
+
+func (r *recorder) Close() {
+	r.closed = true
+}
+
+func TestWithFilter(t *testing.T) {
+	r := &recorder{}
+	sink := WithFilter(r, Filter{Tags: []string{"outdoor", "sauna"}, Devices: []string{"12345", "23456"}})
+
+	sink.Publish(testUpdate)
+	sink.Publish(StateUpdate{DeviceId: "23456", Tags: []string{"indoor"}})
+	sink.Publish(StateUpdate{DeviceId: "23456"})
+	sink.Publish(StateUpdate{DeviceId: "34567", Tags: []string{"sauna"}})
+	require.Len(t, r.updates, 1)
+	assert.Equal(t, testUpdate, r.updates[0])
+
+	sink.Close()
+	assert.True(t, r.closed)
+}
+
+func TestWithFilter_minInterval(t *testing.T) {
+	r := &recorder{}
+	sink := WithFilter(r, Filter{MinIntervalSec: 60}).(*filtered)
+	now := testTime
+	sink.now = func() time.Time { return now }
+
+	sink.Publish(StateUpdate{DeviceId: "12345"})
+	sink.Publish(StateUpdate{DeviceId: "23456"})
+	now = now.Add(59 * time.Second)
+	sink.Publish(StateUpdate{DeviceId: "12345"})
+	now = now.Add(time.Second)
+	sink.Publish(StateUpdate{DeviceId: "12345"})
+
+	var devices []string
+	for _, u := range r.updates {
+		devices = append(devices, u.DeviceId)
+	}
+	assert.Equal(t, []string{"12345", "23456", "12345"}, devices)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, c := range DefaultConfigs {
+		assert.NoError(t, c.Validate())
+	}
+	assert.NoError(t, Config{Type: SINK_INFLUX, Url: "http://influx:8086/write?db=sensors"}.Validate())
+	assert.NoError(t, Config{Type: SINK_FILE, Path: "states.ndjson", Format: FORMAT_LINE}.Validate())
+
+	assert.EqualError(t, Config{Type: "kafka"}.Validate(), "invalid sink type 'kafka', must be one of [mqtt webhook influx file]")
+	assert.EqualError(t, Config{Type: SINK_INFLUX, Url: "influx:8086"}.Validate(), "invalid influx sink: url must be an http(s) URL")
+	assert.EqualError(t, Config{Type: SINK_FILE}.Validate(), "invalid file sink: path must be given")
+	assert.EqualError(t, Config{Type: SINK_FILE, Path: "states", Format: "csv"}.Validate(), "invalid file sink: format must be one of json, line")
+	assert.EqualError(t, Config{Type: SINK_MQTT, Filter: Filter{MinIntervalSec: -1}}.Validate(), "invalid mqtt sink: minIntervalSec must not be negative")
+}
+
+func TestLoadConfigs(t *testing.T) {
+	file := writeFile(t, `[
+		{"type": "mqtt"},
+		{"type": "influx", "url": "http://influx:8086/write?db=sensors", "filter": {"tags": ["outdoor"], "minIntervalSec": 300}}
+	]`)
+	configs, err := LoadConfigs(file)
+	require.NoError(t, err)
+	assert.Equal(t, []Config{
+		{Type: SINK_MQTT},
+		{Type: SINK_INFLUX, Url: "http://influx:8086/write?db=sensors", Filter: Filter{Tags: []string{"outdoor"}, MinIntervalSec: 300}},
+	}, configs)
+
+	_, err = LoadConfigs(writeFile(t, `[{"type": "mqtt"}, {"type": "file"}]`))
+	assert.EqualError(t, err, "sinks[1]: invalid file sink: path must be given")
+
+	_, err = LoadConfigs(writeFile(t, `{"type": "mqtt"}`))
+	assert.Error(t, err)
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	sinks, err := Create([]Config{{Type: SINK_MQTT}, {Type: SINK_FILE, Path: filepath.Join(dir, "states.ndjson")}}, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, sinks, 2)
+	CloseAll(sinks)
+
+	_, err = Create([]Config{{Type: SINK_MQTT}, {Type: SINK_FILE, Path: filepath.Join(dir, "missing", "states.ndjson")}}, nil, nil)
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "failed to create sinks[1]: "))
+}
+
+func TestFormatLine(t *testing.T) {
+	assert.Equal(t,
+		`thread_device,device=12345,instance=A100 vcc=2980i,txPower=4i,pollPeriod=1000i,parent="0x4400",linkQualityIn=3i,linkQualityOut=2i,avgRssi=-60i,latestRssi=-58i 1604232000000000000`,
+		formatLine(DefaultMeasurement, testUpdate))
+
+	update := StateUpdate{
+		DeviceId:  "a b,c=d",
+		Timestamp: testTime,
+		State:     device_registry.State{Vcc: 3000, Parent: device_registry.ParentInfo{Rloc16: `"x\`}},
+		Battery:   &device_registry.BatteryEstimate{DaysRemaining: 98.5, SlopeMvPerDay: -10.25},
+	}
+	assert.Equal(t,
+		`my\ measurement\,1,device=a\ b\,c\=d vcc=3000i,txPower=0i,pollPeriod=0i,parent="\"x\\",linkQualityIn=0i,linkQualityOut=0i,avgRssi=0i,latestRssi=0i,batteryDaysRemaining=98.5,batterySlopeMvPerDay=-10.25 1604232000000000000`,
+		formatLine("my measurement,1", update))
+}
+
+func TestInflux(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		auth = req.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := Influx(server.URL, "t0ken", "states")
+	sink.Publish(testUpdate)
+	sink.Publish(StateUpdate{DeviceId: "23456", Timestamp: testTime})
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "Token t0ken", auth)
+	lines := strings.Split(strings.TrimSuffix(strings.Join(bodies, ""), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, formatLine("states", testUpdate), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "states,device=23456 "))
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "states.ndjson")
+	sink, err := File(path, "", DefaultMeasurement)
+	require.NoError(t, err)
+	sink.Publish(testUpdate)
+	sink.Publish(testUpdate)
+	sink.Close()
+	sink.Publish(testUpdate)
+
+	lines := readLines(t, path)
+	require.Len(t, lines, 2)
+	var update StateUpdate
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &update))
+	assert.Equal(t, testUpdate, update)
+
+	path = filepath.Join(dir, "states.lp")
+	sink, err = File(path, FORMAT_LINE, "states")
+	require.NoError(t, err)
+	sink.Publish(testUpdate)
+	sink.Close()
+
+	assert.Equal(t, []string{formatLine("states", testUpdate)}, readLines(t, path))
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "sinks.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func readLines(t *testing.T, path string) []string {
+	buf, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+}
@@ -0,0 +1,85 @@
+package state_poller_service
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// probeLoop periodically probes the round trip time of devices that have state polling enabled. Devices are only
+// probed within their allowed windows. The probes are run by the poll scheduler, so they share its workers and
+// rate limit with the polls.
+type probeLoop struct {
+	reg       *device_registry.Registry
+	prober    *probe.Prober
+	scheduler *pollScheduler
+	interval  time.Duration
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func newProbeLoop(reg *device_registry.Registry, prober *probe.Prober, scheduler *pollScheduler, interval time.Duration) *probeLoop {
+	return &probeLoop{reg: reg, prober: prober, scheduler: scheduler, interval: interval}
+}
+
+func (pl *probeLoop) start() {
+	if pl.interval <= 0 {
+		return
+	}
+
+	var ctx context.Context
+	ctx, pl.cancel = context.WithCancel(context.Background())
+	log.Infof("Probing devices every %v", pl.interval)
+
+	pl.wg.Add(1)
+	go func() {
+		defer pl.wg.Done()
+		ticker := time.NewTicker(pl.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				pl.probeAll()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (pl *probeLoop) stop() {
+	if pl.cancel != nil {
+		pl.cancel()
+	}
+	pl.wg.Wait()
+}
+
+// Schedules a probe for each device due for one. A device whose previous probe is still waiting for a worker
+// is probed only once.
+func (pl *probeLoop) probeAll() {
+	devices, err := pl.reg.GetDevices()
+	if err != nil {
+		log.Errorf("failed to get devices for probing: %v", err)
+		return
+	}
+
+	for id, device := range devices {
+		if !device.Config.StatePollingEnabled || !device.Config.Schedule.Allows(time.Now()) {
+			continue
+		}
+
+		id, ip := id, device.Config.MainIp
+		pl.scheduler.schedule("probe:"+id, time.Now(), func(ctx context.Context) {
+			res, err := pl.prober.Probe(ctx, id, ip)
+			if err != nil {
+				log.Warnf("probing device %v failed: %v", id, err)
+				return
+			}
+			log.Debugf("Probed device %v, ping %vms, get %vms", id, res.Ping.RttMs, res.Get.RttMs)
+		})
+	}
+}
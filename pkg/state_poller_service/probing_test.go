@@ -0,0 +1,53 @@
+package state_poller_service
+
+import (
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/chacal/thread-mgmt-server/pkg/mocks"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestProbeLoop(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+
+	_, _ = reg.Create("12345")
+	_, _ = reg.Create("54321")
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600}))
+	require.NoError(t, reg.UpdateConfig("54321", device_registry.Config{MainIp: ip2, StatePollingEnabled: false}))
+
+	// Only the device with polling enabled is probed
+	mockGw.EXPECT().Ping(gomock.Any(), gomock.Eq(ip)).Return(time.Millisecond, nil).MinTimes(2)
+	mockGw.EXPECT().ProbeGet(gomock.Any(), gomock.Eq(ip)).Return(2*time.Millisecond, nil).MinTimes(2)
+
+	pl := newProbeLoop(reg, probe.Create(reg, mockGw, address_fallback.Create(reg)), createScheduler(t, DefaultSchedulerSettings), 10*time.Millisecond)
+	pl.start()
+	assert.Eventually(t, func() bool {
+		samples, err := reg.GetProbeSamples("12345")
+		require.NoError(t, err)
+		return len(samples) >= 4
+	}, time.Second, 10*time.Millisecond)
+	pl.stop()
+
+	samples, err := reg.GetProbeSamples("54321")
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+}
+
+func TestProbeLoop_disabled(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pl := newProbeLoop(reg, probe.Create(reg, mocks.NewMockDeviceGateway(mockCtrl), address_fallback.Create(reg)), createScheduler(t, DefaultSchedulerSettings), 0)
+	pl.start()
+	pl.stop()
+	assert.Nil(t, pl.cancel)
+}
@@ -0,0 +1,106 @@
+package state_poller_service
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Minimum time between automatic pushes to the same device, so that a device refusing the
+// defaults isn't flooded with pushes on every poll
+var autoReconcileInterval = 10 * time.Minute
+
+type pusher interface {
+	Push(ctx context.Context, id string, dst net.IP, verify bool, progress func(msg string)) (config_push.Result, error)
+}
+
+// reconciler compares incoming state against the desired defaults, records config drift and
+// pushes defaults to devices that have opted in to automatic reconciliation. Pushes are run by the
+// poll scheduler, so they share its workers and rate limit with the polls and are cancelled when it stops.
+type reconciler struct {
+	reg       *device_registry.Registry
+	pusher    pusher
+	fallback  *address_fallback.Fallback
+	scheduler *pollScheduler
+	mu        sync.Mutex
+	inFlight  map[string]bool
+	lastPush  map[string]time.Time
+	now       func() time.Time
+}
+
+func newReconciler(reg *device_registry.Registry, pusher pusher, fallback *address_fallback.Fallback, scheduler *pollScheduler) *reconciler {
+	return &reconciler{
+		reg:       reg,
+		pusher:    pusher,
+		fallback:  fallback,
+		scheduler: scheduler,
+		inFlight:  make(map[string]bool),
+		lastPush:  make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+func (r *reconciler) check(deviceId string, state device_registry.State) error {
+	device, err := r.reg.Get(deviceId)
+	if err != nil {
+		return err
+	}
+
+	fields := device.Defaults.DriftFrom(state)
+	if len(fields) == 0 {
+		if device.Drift != nil {
+			log.Infof("Config drift resolved for device %v", deviceId)
+			return r.reg.SetDrift(deviceId, nil)
+		}
+		return nil
+	}
+
+	if device.Drift == nil || !reflect.DeepEqual(device.Drift.Fields, fields) {
+		log.Warnf("Config drift detected for device %v, differing fields: %v", deviceId, fields)
+		err = r.reg.SetDrift(deviceId, &device_registry.ConfigDrift{Fields: fields, DetectedAt: r.now()})
+		if err != nil {
+			return err
+		}
+	}
+
+	if device.Config.AutoReconcile {
+		if !device.Config.Schedule.Allows(r.now()) {
+			log.Debugf("Not reconciling device %v outside its allowed windows", deviceId)
+			return nil
+		}
+		r.schedulePush(deviceId, device.Config.MainIp)
+	}
+	return nil
+}
+
+func (r *reconciler) schedulePush(deviceId string, dst net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.inFlight[deviceId] || r.now().Sub(r.lastPush[deviceId]) < autoReconcileInterval {
+		return
+	}
+	r.inFlight[deviceId] = true
+	r.lastPush[deviceId] = r.now()
+
+	r.scheduler.schedule("reconcile:"+deviceId, time.Now(), func(ctx context.Context) {
+		log.Infof("Pushing defaults to device %v to reconcile config drift", deviceId)
+		_, err := r.fallback.Do(ctx, deviceId, dst, func(ctx context.Context, ip net.IP) error {
+			_, err := r.pusher.Push(ctx, deviceId, ip, false, func(string) {})
+			return err
+		})
+		if err != nil {
+			log.Errorf("failed to push defaults to device %v: %v", deviceId, err)
+		}
+
+		r.mu.Lock()
+		delete(r.inFlight, deviceId)
+		r.mu.Unlock()
+	})
+}
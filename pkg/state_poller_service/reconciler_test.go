@@ -0,0 +1,154 @@
+package state_poller_service
+
+import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePusher struct {
+	mu     sync.Mutex
+	pushes []net.IP
+}
+
+func (p *fakePusher) Push(ctx context.Context, id string, dst net.IP, verify bool, progress func(msg string)) (config_push.Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pushes = append(p.pushes, dst)
+	return config_push.Result{}, nil
+}
+
+func (p *fakePusher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pushes)
+}
+
+func TestReconciler_flagsAndClearsDrift(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateDefaults("12345", device_registry.Defaults{Instance: "A100", TxPower: 0, PollPeriod: 1000}))
+
+	p := &fakePusher{}
+	r := newReconciler(reg, p, address_fallback.Create(reg), createScheduler(t, DefaultSchedulerSettings))
+
+	drifted := testState
+	drifted.PollPeriod = 5000
+	require.NoError(t, r.check("12345", drifted))
+
+	dev, _ := reg.Get("12345")
+	require.NotNil(t, dev.Drift)
+	assert.Equal(t, []string{"pollPeriod"}, dev.Drift.Fields)
+	detectedAt := dev.Drift.DetectedAt
+
+	// Same drift keeps the original detection time
+	require.NoError(t, r.check("12345", drifted))
+	dev, _ = reg.Get("12345")
+	assert.Equal(t, detectedAt.UnixNano(), dev.Drift.DetectedAt.UnixNano())
+
+	require.NoError(t, r.check("12345", testState))
+	dev, _ = reg.Get("12345")
+	assert.Nil(t, dev.Drift)
+
+	// Auto reconcile not enabled
+	waitForPushes(t, r)
+	assert.Equal(t, 0, p.count())
+}
+
+func TestReconciler_autoReconcile(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateDefaults("12345", device_registry.Defaults{Instance: "A101", TxPower: 0, PollPeriod: 1000}))
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, AutoReconcile: true}))
+
+	now := time.Now()
+	p := &fakePusher{}
+	r := newReconciler(reg, p, address_fallback.Create(reg), createScheduler(t, DefaultSchedulerSettings))
+	r.now = func() time.Time { return now }
+
+	require.NoError(t, r.check("12345", testState))
+	waitForPushes(t, r)
+	assert.Equal(t, []net.IP{ip}, p.pushes)
+
+	// No new push until the interval has passed
+	now = now.Add(autoReconcileInterval / 2)
+	require.NoError(t, r.check("12345", testState))
+	waitForPushes(t, r)
+	assert.Equal(t, 1, p.count())
+
+	now = now.Add(autoReconcileInterval)
+	require.NoError(t, r.check("12345", testState))
+	waitForPushes(t, r)
+	assert.Equal(t, 2, p.count())
+}
+
+func TestReconciler_autoReconcileOutsideWindow(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateDefaults("12345", device_registry.Defaults{Instance: "A101", TxPower: 0, PollPeriod: 1000}))
+	schedule := &device_registry.Schedule{Windows: []device_registry.ScheduleWindow{{Days: "*", Start: "07:00", End: "22:00"}}}
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, AutoReconcile: true, Schedule: schedule}))
+
+	now := time.Date(2020, 11, 23, 23, 0, 0, 0, time.UTC)
+	p := &fakePusher{}
+	r := newReconciler(reg, p, address_fallback.Create(reg), createScheduler(t, DefaultSchedulerSettings))
+	r.now = func() time.Time { return now }
+
+	// Drift is flagged but not pushed at night
+	require.NoError(t, r.check("12345", testState))
+	waitForPushes(t, r)
+	assert.Equal(t, 0, p.count())
+	device, err := reg.Get("12345")
+	require.NoError(t, err)
+	assert.NotNil(t, device.Drift)
+
+	now = time.Date(2020, 11, 24, 7, 0, 0, 0, time.UTC)
+	require.NoError(t, r.check("12345", testState))
+	waitForPushes(t, r)
+	assert.Equal(t, 1, p.count())
+}
+
+func TestReconciler_stopCancelsPush(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateDefaults("12345", device_registry.Defaults{Instance: "A101", TxPower: 0, PollPeriod: 1000}))
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, AutoReconcile: true}))
+
+	s := newPollScheduler(DefaultSchedulerSettings)
+	s.start()
+	p := &blockingPusher{started: make(chan bool)}
+	r := newReconciler(reg, p, address_fallback.Create(reg), s)
+
+	require.NoError(t, r.check("12345", testState))
+	<-p.started
+	s.stop()
+	assert.Equal(t, context.Canceled, p.err)
+}
+
+type blockingPusher struct {
+	started chan bool
+	err     error
+}
+
+func (p *blockingPusher) Push(ctx context.Context, id string, dst net.IP, verify bool, progress func(msg string)) (config_push.Result, error) {
+	p.started <- true
+	<-ctx.Done()
+	p.err = ctx.Err()
+	return config_push.Result{}, p.err
+}
+
+// Waits until the scheduled pushes have been run
+func waitForPushes(t *testing.T, r *reconciler) {
+	assert.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.inFlight) == 0
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,217 @@
+package state_poller_service
+
+import (
+	"container/heap"
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+type SchedulerSettings struct {
+	// Number of polls, probes and automatic pushes run concurrently, which bounds the number of outstanding CoAP
+	// requests made by the service
+	Workers int
+	// Maximum number of polls started per second, zero for no limit
+	MaxRate float64
+}
+
+var DefaultSchedulerSettings = SchedulerSettings{Workers: 4, MaxRate: 10}
+
+func (s SchedulerSettings) Validate() error {
+	if s.Workers < 1 {
+		return errors.Errorf("invalid number of poll workers %v, must be at least 1", s.Workers)
+	}
+	if s.MaxRate < 0 {
+		return errors.Errorf("invalid poll rate %v, must not be negative", s.MaxRate)
+	}
+	return nil
+}
+
+// pollScheduler runs scheduled polls on a bounded pool of workers. Probes and automatic pushes are run the same way,
+// keyed so that they don't replace the polls. Polls that become due while all workers are
+// busy wait in the queue in the order they were due, and successive polls are started at most MaxRate per second.
+type pollScheduler struct {
+	settings SchedulerSettings
+	mu       sync.Mutex
+	queue    pollQueue
+	polls    map[string]*scheduledPoll
+	wake     chan struct{}
+	work     chan func(ctx context.Context)
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+type scheduledPoll struct {
+	key   string
+	at    time.Time
+	f     func(ctx context.Context)
+	index int
+}
+
+func newPollScheduler(settings SchedulerSettings) *pollScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pollScheduler{
+		settings: settings,
+		polls:    make(map[string]*scheduledPoll),
+		wake:     make(chan struct{}, 1),
+		work:     make(chan func(ctx context.Context)),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (s *pollScheduler) start() {
+	s.wg.Add(s.settings.Workers + 1)
+	go s.dispatch()
+	for i := 0; i < s.settings.Workers; i++ {
+		go s.runWorker()
+	}
+}
+
+// Stops dispatching polls, cancels the context of the running polls and waits for them to finish
+func (s *pollScheduler) stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Schedules f to be run at the given time, replacing the poll previously scheduled with the same key
+func (s *pollScheduler) schedule(key string, at time.Time, f func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, found := s.polls[key]; found {
+		p.at = at
+		p.f = f
+		heap.Fix(&s.queue, p.index)
+	} else {
+		p = &scheduledPoll{key: key, at: at, f: f}
+		heap.Push(&s.queue, p)
+		s.polls[key] = p
+	}
+	s.signal()
+}
+
+// Removes the scheduled poll with the given key. A poll that is already running is not affected.
+func (s *pollScheduler) unschedule(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, found := s.polls[key]; found {
+		heap.Remove(&s.queue, p.index)
+		delete(s.polls, key)
+		s.signal()
+	}
+}
+
+func (s *pollScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *pollScheduler) dispatch() {
+	defer s.wg.Done()
+	var lastStart time.Time
+
+	for {
+		p, wait := s.next(lastStart)
+		if p != nil {
+			select {
+			case s.work <- p.f:
+				lastStart = time.Now()
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if !s.sleep(wait) {
+			return
+		}
+	}
+}
+
+// Sleeps for the given time, or until the schedule changes if wait is zero. Returns false if the scheduler was stopped.
+func (s *pollScheduler) sleep(wait time.Duration) bool {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-s.wake:
+	case <-timeout:
+	case <-s.ctx.Done():
+		return false
+	}
+	return true
+}
+
+// Returns the poll that should be started now, or the time to wait until the next one is due. Zero wait means
+// that nothing is scheduled.
+func (s *pollScheduler) next(lastStart time.Time) (*scheduledPoll, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil, 0
+	}
+
+	startAt := s.queue[0].at
+	if s.settings.MaxRate > 0 {
+		earliest := lastStart.Add(time.Duration(float64(time.Second) / s.settings.MaxRate))
+		if earliest.After(startAt) {
+			startAt = earliest
+		}
+	}
+	if wait := time.Until(startAt); wait > 0 {
+		return nil, wait
+	}
+
+	p := heap.Pop(&s.queue).(*scheduledPoll)
+	delete(s.polls, p.key)
+	return p, 0
+}
+
+func (s *pollScheduler) runWorker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case f := <-s.work:
+			f(s.ctx)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// pollQueue is a min-heap of scheduled polls ordered by their due time
+type pollQueue []*scheduledPoll
+
+func (q pollQueue) Len() int           { return len(q) }
+func (q pollQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q pollQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *pollQueue) Push(x interface{}) {
+	p := x.(*scheduledPoll)
+	p.index = len(*q)
+	*q = append(*q, p)
+}
+
+func (q *pollQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,128 @@
+package state_poller_service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollScheduler_runsPollsInDueOrder(t *testing.T) {
+	s := createScheduler(t, SchedulerSettings{Workers: 1})
+
+	var mu sync.Mutex
+	var ran []string
+	done := make(chan bool)
+	now := time.Now()
+	for i, delay := range []int{30, 10, 20} {
+		key := strconv.Itoa(i)
+		s.schedule(key, now.Add(time.Duration(delay)*time.Millisecond), func(ctx context.Context) {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, key)
+			if len(ran) == 3 {
+				done <- true
+			}
+		})
+	}
+
+	<-done
+	assert.Equal(t, []string{"1", "2", "0"}, ran)
+}
+
+func TestPollScheduler_rescheduleAndUnschedule(t *testing.T) {
+	s := createScheduler(t, SchedulerSettings{Workers: 1})
+
+	ran := make(chan string, 10)
+	poll := func(key string) func(ctx context.Context) {
+		return func(ctx context.Context) { ran <- key }
+	}
+
+	now := time.Now()
+	s.schedule("a", now.Add(time.Hour), poll("a"))
+	s.schedule("a", now.Add(10*time.Millisecond), poll("a"))
+	s.schedule("b", now.Add(20*time.Millisecond), poll("b"))
+	s.unschedule("b")
+	s.unschedule("c")
+
+	assert.Equal(t, "a", <-ran)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, ran)
+}
+
+func TestPollScheduler_boundsConcurrentPolls(t *testing.T) {
+	s := createScheduler(t, SchedulerSettings{Workers: 3})
+
+	var running, maxRunning, total int32
+	var wg sync.WaitGroup
+	wg.Add(20)
+	for i := 0; i < 20; i++ {
+		s.schedule(strconv.Itoa(i), time.Now(), func(ctx context.Context) {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&total, 1)
+		})
+	}
+
+	wg.Wait()
+	assert.Equal(t, int32(20), total)
+	assert.Equal(t, int32(3), maxRunning)
+}
+
+func TestPollScheduler_limitsRate(t *testing.T) {
+	s := createScheduler(t, SchedulerSettings{Workers: 5, MaxRate: 50})
+
+	starts := make(chan time.Time, 5)
+	for i := 0; i < 5; i++ {
+		s.schedule(strconv.Itoa(i), time.Now(), func(ctx context.Context) { starts <- time.Now() })
+	}
+
+	prev := <-starts
+	for i := 1; i < 5; i++ {
+		start := <-starts
+		assert.GreaterOrEqual(t, int64(start.Sub(prev)), int64(19*time.Millisecond))
+		prev = start
+	}
+}
+
+func TestPollScheduler_stopCancelsRunningPolls(t *testing.T) {
+	s := newPollScheduler(SchedulerSettings{Workers: 1})
+	s.start()
+
+	started := make(chan bool)
+	var cancelled bool
+	s.schedule("a", time.Now(), func(ctx context.Context) {
+		started <- true
+		<-ctx.Done()
+		cancelled = true
+	})
+
+	<-started
+	s.stop()
+	assert.True(t, cancelled)
+}
+
+func TestSchedulerSettings_Validate(t *testing.T) {
+	require.NoError(t, DefaultSchedulerSettings.Validate())
+	assert.Error(t, SchedulerSettings{Workers: 0}.Validate())
+	assert.Error(t, SchedulerSettings{Workers: 1, MaxRate: -1}.Validate())
+}
+
+func createScheduler(t *testing.T, settings SchedulerSettings) *pollScheduler {
+	s := newPollScheduler(settings)
+	s.start()
+	t.Cleanup(s.stop)
+	return s
+}
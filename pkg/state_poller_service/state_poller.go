@@ -3,36 +3,69 @@ package state_poller_service
 //go:generate mockgen -destination=../mocks/mock_state_poller.go -package=mocks github.com/chacal/thread-mgmt-server/pkg/state_poller_service StatePoller
 
 import (
+	"context"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
 	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
 	"net"
+	"reflect"
+	"sync"
 	"time"
 )
 
 var maxSleepRandomnessSeconds = 60
 
+// A device that failed to answer once is retried after fastRetryDelay, after that the polling interval is doubled
+// for each consecutive failure up to maxPollBackoff
+var fastRetryDelay = 10 * time.Second
+var maxPollBackoff = time.Hour
+
 type StatePoller interface {
 	Start()
-	Refresh(pollingIntervalSec int, ip net.IP)
+	Refresh(pollingIntervalSec int, ip net.IP, schedule *device_registry.Schedule)
 	Stop()
+	Status() device_registry.PollerStatus
+	PollNow()
+	Reported()
 }
 
-type StatePollerCreator func(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP) StatePoller
+type StatePollerCreator func(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP,
+	schedule *device_registry.Schedule) StatePoller
 
 type statePoller struct {
 	deviceId             string
 	statePollingInterval time.Duration
 	ip                   net.IP
-	timer                *time.Timer
+	schedule             *device_registry.Schedule
+	compiledSchedule     *device_registry.CompiledSchedule
+	scheduler            *pollScheduler
 	gw                   device_gateway.DeviceGateway
+	fallback             *address_fallback.Fallback
 	pollResults          chan pollResult
 	sleepRandomizer      func() time.Duration
+	mu                   sync.Mutex
+	status               device_registry.PollerStatus
+	successes            int
+	stopped              bool
 }
 
-func defaultStatePollerCreator(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP) StatePoller {
-	return &statePoller{deviceId, pollingInterval, ip, nil, device_gateway.Create(),
-		pollResults, nextSleepRandomDuration,
+func defaultStatePollerCreator(gw device_gateway.DeviceGateway, fallback *address_fallback.Fallback, scheduler *pollScheduler) StatePollerCreator {
+	return func(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP,
+		schedule *device_registry.Schedule) StatePoller {
+		return &statePoller{
+			deviceId:             deviceId,
+			statePollingInterval: pollingInterval,
+			ip:                   ip,
+			schedule:             schedule,
+			compiledSchedule:     compileSchedule(deviceId, schedule),
+			scheduler:            scheduler,
+			gw:                   gw,
+			fallback:             fallback,
+			pollResults:          pollResults,
+			sleepRandomizer:      nextSleepRandomDuration,
+		}
 	}
 }
 
@@ -41,40 +74,187 @@ func (sp *statePoller) Start() {
 	log.Infof("Starting poller for device %v with interval %v and initial sleep %v",
 		sp.deviceId, sp.statePollingInterval, initialSleep,
 	)
-	sp.timer = time.AfterFunc(initialSleep, sp.pollDeviceOnce)
+	sp.scheduleNext(initialSleep)
 }
 
-func (sp *statePoller) Refresh(pollingIntervalSec int, ip net.IP) {
+func (sp *statePoller) Refresh(pollingIntervalSec int, ip net.IP, schedule *device_registry.Schedule) {
 	duration := time.Duration(pollingIntervalSec) * time.Second
-	if sp.statePollingInterval != duration || !sp.ip.Equal(ip) {
+
+	sp.mu.Lock()
+	changed := sp.statePollingInterval != duration || !sp.ip.Equal(ip) || !reflect.DeepEqual(sp.schedule, schedule)
+	if changed {
 		log.Infof("Refreshing poller, interval: %v ip: %v", duration, ip)
-		// Stop & drain timer
-		if !sp.timer.Stop() {
-			<-sp.timer.C
-		}
 		sp.statePollingInterval = duration
-		sp.timer.Reset(sp.statePollingInterval)
 		sp.ip = ip
+		sp.schedule = schedule
+		sp.compiledSchedule = compileSchedule(sp.deviceId, schedule)
+	}
+	sp.mu.Unlock()
+
+	if changed {
+		sp.scheduleNext(duration)
 	}
 }
 
+// Schedules are validated before they are stored, so compiling fails only if eg. the time zone database has changed
+func compileSchedule(deviceId string, schedule *device_registry.Schedule) *device_registry.CompiledSchedule {
+	compiled, err := schedule.Compile()
+	if err != nil {
+		log.Errorf("invalid schedule for device %v, polling at any time: %v", deviceId, err)
+	}
+	return compiled
+}
+
 func (sp *statePoller) Stop() {
 	log.Infof("Stopping poller for device %v", sp.deviceId)
-	sp.timer.Stop()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.stopped = true
+	sp.scheduler.unschedule(sp.deviceId)
+}
+
+func (sp *statePoller) Status() device_registry.PollerStatus {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	status := sp.status
+	status.IntervalSec = int(sp.statePollingInterval.Seconds())
+	if status.Polls > 0 {
+		status.SuccessRatio = float64(sp.successes) / float64(status.Polls)
+	}
+	return status
+}
+
+// Polls the device as soon as a worker is free, even outside the allowed windows. The regular schedule continues
+// from that poll.
+func (sp *statePoller) PollNow() {
+	log.Infof("Polling device %v now", sp.deviceId)
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if !sp.stopped {
+		sp.scheduleAt(time.Now(), sp.pollDeviceNow)
+	}
+}
+
+// Counts a state pushed by the device as a successful poll and postpones the next poll by the polling interval
+func (sp *statePoller) Reported() {
+	log.Debugf("Device %v pushed its state, postponing next poll", sp.deviceId)
+	sp.scheduleNext(sp.recordPoll(nil))
+}
+
+// Schedules the next poll unless the poller has been stopped, in which case a poll that was running while
+// stopping must not schedule another one
+func (sp *statePoller) scheduleNext(sleep time.Duration) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if !sp.stopped {
+		sp.scheduleAt(time.Now().Add(sleep), sp.pollDeviceOnce)
+	}
+}
+
+func (sp *statePoller) scheduleAt(at time.Time, poll func(ctx context.Context)) {
+	sp.status.NextPoll = &at
+	sp.scheduler.schedule(sp.deviceId, at, poll)
+}
+
+// Polls the device unless the poll is due outside the allowed windows, in which case it's deferred or skipped
+func (sp *statePoller) pollDeviceOnce(ctx context.Context) {
+	sp.mu.Lock()
+	now := time.Now()
+	allowed := sp.compiledSchedule.Allows(now)
+	if !allowed && !sp.stopped {
+		if sp.compiledSchedule.DefersPolls() {
+			// Spread the deferred polls over the start of the window
+			sp.scheduleAt(sp.compiledSchedule.NextAllowed(now).Add(sp.sleepRandomizer()), sp.pollDeviceOnce)
+		} else {
+			sp.scheduleAt(now.Add(sp.statePollingInterval+sp.sleepRandomizer()), sp.pollDeviceOnce)
+		}
+		log.Debugf("Poll of device %v is outside the allowed windows, next poll at %v", sp.deviceId, *sp.status.NextPoll)
+	}
+	sp.mu.Unlock()
+
+	if allowed {
+		sp.pollDeviceNow(ctx)
+	}
 }
 
-func (sp *statePoller) pollDeviceOnce() {
-	var nextSleep = sp.statePollingInterval + sp.sleepRandomizer()
-	log.Debugf("Polling device %v, next sleep %v", sp.deviceId, nextSleep)
-	defer sp.timer.Reset(nextSleep)
+func (sp *statePoller) pollDeviceNow(ctx context.Context) {
+	sp.mu.Lock()
+	ip := sp.ip
+	sp.mu.Unlock()
+	log.Debugf("Polling device %v", sp.deviceId)
+
+	var state device_registry.State
+	_, err := sp.fallback.Do(ctx, sp.deviceId, ip, func(ctx context.Context, ip net.IP) error {
+		var err error
+		state, err = sp.gw.FetchState(ctx, ip)
+		return err
+	})
+	if ctx.Err() != nil {
+		// Scheduler was stopped
+		return
+	}
+
+	nextSleep := sp.recordPoll(err)
+	log.Debugf("Next poll of device %v in %v", sp.deviceId, nextSleep)
+	defer sp.scheduleNext(nextSleep)
 
-	state, err := sp.gw.FetchState(sp.ip)
 	if err != nil {
-		log.Errorf("failed to fetch state, deviceId: %v, ip: %v, error: %v", sp.deviceId, sp.ip, err)
+		log.Errorf("failed to fetch state, deviceId: %v, ip: %v, error: %v", sp.deviceId, ip, err)
 		return
 	}
 
-	sp.pollResults <- pollResult{sp.deviceId, state}
+	select {
+	case sp.pollResults <- pollResult{sp.deviceId, state}:
+	case <-ctx.Done():
+	}
+}
+
+// Updates the failure count with the poll result and returns the time to sleep before the next poll
+func (sp *statePoller) recordPoll(err error) time.Duration {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	now := time.Now()
+	sp.status.LastPoll = &now
+	sp.status.Polls++
+
+	if err == nil {
+		sp.successes++
+		sp.status.ConsecutiveFailures = 0
+		sp.status.BackoffSec = 0
+		return sp.statePollingInterval + sp.sleepRandomizer()
+	}
+
+	sp.status.ConsecutiveFailures++
+	sp.status.LastError = err.Error()
+	backoff := backoffDelay(sp.statePollingInterval, sp.status.ConsecutiveFailures)
+	sp.status.BackoffSec = int(backoff.Seconds())
+	if sp.status.ConsecutiveFailures == 1 {
+		log.Infof("Retrying device %v in %v", sp.deviceId, backoff)
+		return backoff
+	}
+	log.Infof("Device %v failed %v times in a row, backing off to %v", sp.deviceId, sp.status.ConsecutiveFailures, backoff)
+	return backoff + sp.sleepRandomizer()
+}
+
+// Delay before the next poll after the given number of consecutive failures. Apart from the fast retry the delay
+// is never shorter than the normal interval, even if the interval is longer than maxPollBackoff.
+func backoffDelay(interval time.Duration, failures int) time.Duration {
+	if failures <= 0 {
+		return interval
+	}
+	if failures == 1 && fastRetryDelay < interval {
+		return fastRetryDelay
+	}
+
+	delay := interval
+	for i := 1; i < failures && delay < maxPollBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPollBackoff && interval < maxPollBackoff {
+		delay = maxPollBackoff
+	}
+	return delay
 }
 
 func nextSleepRandomDuration() time.Duration {
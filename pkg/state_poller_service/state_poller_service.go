@@ -3,10 +3,19 @@ package state_poller_service
 //go:generate mockgen -destination=../mocks/mock_state_poller_service.go -package=mocks github.com/chacal/thread-mgmt-server/pkg/state_poller_service StatePollerService
 
 import (
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
+	"github.com/chacal/thread-mgmt-server/pkg/alerts"
+	"github.com/chacal/thread-mgmt-server/pkg/battery"
+	"github.com/chacal/thread-mgmt-server/pkg/config_push"
+	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	"github.com/chacal/thread-mgmt-server/pkg/mqtt"
+	"github.com/chacal/thread-mgmt-server/pkg/probe"
+	"github.com/chacal/thread-mgmt-server/pkg/sinks"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"net"
+	"sync"
 	"time"
 )
 
@@ -15,47 +24,223 @@ type pollResult struct {
 	state    device_registry.State
 }
 
+type Settings struct {
+	Scheduler SchedulerSettings
+	// Round trip times of polled devices are probed this often, zero disables probing
+	ProbeInterval time.Duration
+	// Time based alert rules are checked this often, zero disables the checks
+	AlertCheckInterval time.Duration
+	Battery            battery.Settings
+	// Receives the alert notifications, nil sends no alert events to webhooks
+	Webhooks *webhooks.Dispatcher
+	// Destinations of the processed states, nil publishes them to MQTT and to Webhooks if given
+	Sinks []sinks.Sink
+}
+
+var DefaultSettings = Settings{Scheduler: DefaultSchedulerSettings, ProbeInterval: 0, AlertCheckInterval: time.Minute,
+	Battery: battery.DefaultSettings}
+
 type StatePollerService interface {
 	Start() error
 	Stop()
 	Refresh() error
+	PollerStatus(deviceId string) (device_registry.PollerStatus, bool)
+	PollerStatuses() map[string]device_registry.PollerStatus
+	PollNow(deviceId string) bool
+	StateReported(deviceId string, state device_registry.State)
 }
 
+// All access to the pollers happens on a single owner goroutine, which also handles the poll results.
+// Other goroutines hand their work to it with exec.
 type statePollerService struct {
 	reg           *device_registry.Registry
-	mqttSender    mqtt.MqttSender
+	sinks         []sinks.Sink
 	pollers       map[string]StatePoller
 	pollerCreator StatePollerCreator
 	pollResults   chan pollResult
-	done          chan bool
+	scheduler     *pollScheduler
+	reconciler    *reconciler
+	probeLoop     *probeLoop
+	alerts        *alerts.Engine
+	battery       *battery.Estimator
+	requests      chan func()
+	stop          chan struct{}
+	stopped       chan struct{}
+	runOnce       sync.Once
+	stopOnce      sync.Once
+}
+
+func Create(reg *device_registry.Registry, gw device_gateway.DeviceGateway, mqttSender mqtt.MqttSender) *statePollerService {
+	return CreateWithSettings(reg, gw, mqttSender, DefaultSettings)
+}
+
+func CreateWithSettings(reg *device_registry.Registry, gw device_gateway.DeviceGateway, mqttSender mqtt.MqttSender, settings Settings) *statePollerService {
+	scheduler := newPollScheduler(settings.Scheduler)
+	fallback := address_fallback.Create(reg)
+	return newStatePollerService(reg, gw, mqttSender, settings, scheduler, fallback, defaultStatePollerCreator(gw, fallback, scheduler))
 }
 
-func Create(reg *device_registry.Registry, mqttSender mqtt.MqttSender) *statePollerService {
-	return CreateWithPollerCreator(reg, mqttSender, defaultStatePollerCreator)
+func CreateWithPollerCreator(reg *device_registry.Registry, gw device_gateway.DeviceGateway, mqttSender mqtt.MqttSender,
+	pollerCreator StatePollerCreator) *statePollerService {
+	return newStatePollerService(reg, gw, mqttSender, DefaultSettings, newPollScheduler(DefaultSettings.Scheduler), address_fallback.Create(reg), pollerCreator)
 }
 
-func CreateWithPollerCreator(reg *device_registry.Registry, mqttSender mqtt.MqttSender, pollerCreator StatePollerCreator) *statePollerService {
+func newStatePollerService(reg *device_registry.Registry, gw device_gateway.DeviceGateway, mqttSender mqtt.MqttSender, settings Settings,
+	scheduler *pollScheduler, fallback *address_fallback.Fallback, pollerCreator StatePollerCreator) *statePollerService {
+	notifiers := []alerts.Notifier{alerts.MqttNotifier(mqttSender)}
+	if settings.Webhooks != nil {
+		notifiers = append(notifiers, webhooks.AlertNotifier(settings.Webhooks))
+	}
+
+	stateSinks := settings.Sinks
+	if stateSinks == nil {
+		stateSinks = []sinks.Sink{sinks.Mqtt(mqttSender)}
+		if settings.Webhooks != nil {
+			stateSinks = append(stateSinks, sinks.Webhook(settings.Webhooks))
+		}
+	}
+
 	sp := statePollerService{
 		reg:           reg,
-		mqttSender:    mqttSender,
+		sinks:         stateSinks,
 		pollers:       make(map[string]StatePoller),
 		pollerCreator: pollerCreator,
 		pollResults:   make(chan pollResult),
-		done:          make(chan bool),
+		scheduler:     scheduler,
+		reconciler:    newReconciler(reg, config_push.Create(reg, gw), fallback, scheduler),
+		probeLoop:     newProbeLoop(reg, probe.Create(reg, gw, fallback), scheduler, settings.ProbeInterval),
+		alerts:        alerts.Create(reg, settings.AlertCheckInterval, notifiers...),
+		battery:       battery.Create(reg, settings.Battery),
+		requests:      make(chan func()),
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 	return &sp
 }
 
 func (sp *statePollerService) Start() error {
-	go sp.handlePollResults()
+	sp.ensureRunning()
+	sp.scheduler.start()
+	sp.probeLoop.start()
+	sp.alerts.Start()
 	return sp.Refresh()
 }
 
+// Stops all pollers and waits for the running polls, probes and pushes to finish
 func (sp *statePollerService) Stop() {
-	sp.done <- true
+	sp.stopOnce.Do(func() {
+		sp.ensureRunning()
+		close(sp.stop)
+		<-sp.stopped
+		sp.probeLoop.stop()
+		sp.scheduler.stop()
+		sp.alerts.Stop()
+	})
 }
 
 func (sp *statePollerService) Refresh() error {
+	var err error
+	if !sp.exec(func() { err = sp.refreshPollers() }) {
+		return errors.New("state poller service is stopped")
+	}
+	return err
+}
+
+// Returns the status of the device's poller, or false if the device is not polled
+func (sp *statePollerService) PollerStatus(deviceId string) (device_registry.PollerStatus, bool) {
+	var status device_registry.PollerStatus
+	found := false
+	sp.exec(func() {
+		poller, exists := sp.pollers[deviceId]
+		if exists {
+			status, found = poller.Status(), true
+		}
+	})
+	return status, found
+}
+
+// Returns the statuses of all pollers by device id
+func (sp *statePollerService) PollerStatuses() map[string]device_registry.PollerStatus {
+	statuses := make(map[string]device_registry.PollerStatus)
+	sp.exec(func() {
+		for deviceId, poller := range sp.pollers {
+			statuses[deviceId] = poller.Status()
+		}
+	})
+	return statuses
+}
+
+// Triggers an immediate poll of the device outside its schedule. Returns false if the device is not polled.
+func (sp *statePollerService) PollNow(deviceId string) bool {
+	found := false
+	sp.exec(func() {
+		poller, exists := sp.pollers[deviceId]
+		if exists {
+			poller.PollNow()
+			found = true
+		}
+	})
+	return found
+}
+
+// Handles a state the device pushed and that has already been stored in the registry. The state is processed
+// like a polled one, and in hybrid mode it replaces the next poll.
+func (sp *statePollerService) StateReported(deviceId string, state device_registry.State) {
+	ok := sp.exec(func() {
+		device, err := sp.reg.Get(deviceId)
+		if err != nil {
+			log.Errorf("failed to get device %v for reported state: %v", deviceId, err)
+			return
+		}
+		if poller, exists := sp.pollers[deviceId]; exists && device.Config.Mode() == device_registry.STATE_MODE_HYBRID {
+			poller.Reported()
+		}
+		sp.processState(deviceId, state)
+	})
+	if !ok {
+		log.Warnf("state poller service is stopped, ignoring state reported by device %v", deviceId)
+	}
+}
+
+// Runs f on the owner goroutine and waits for it to complete. Returns false if the service has been stopped.
+func (sp *statePollerService) exec(f func()) bool {
+	sp.ensureRunning()
+	executed := make(chan struct{})
+	select {
+	case sp.requests <- func() { f(); close(executed) }:
+		<-executed
+		return true
+	case <-sp.stopped:
+		return false
+	}
+}
+
+// The owner goroutine is started on first use, so that pollers can be refreshed before the service is started
+func (sp *statePollerService) ensureRunning() {
+	sp.runOnce.Do(func() {
+		go sp.run()
+	})
+}
+
+func (sp *statePollerService) run() {
+	defer close(sp.stopped)
+	for {
+		select {
+		case s := <-sp.pollResults:
+			sp.handlePollResult(s)
+		case f := <-sp.requests:
+			f()
+		case <-sp.stop:
+			log.Infof("Stopping state pollers")
+			for deviceId := range sp.pollers {
+				sp.removePoller(deviceId)
+			}
+			return
+		}
+	}
+}
+
+func (sp *statePollerService) refreshPollers() error {
 	devices, err := sp.reg.GetDevices()
 	if err != nil {
 		return err
@@ -65,11 +250,11 @@ func (sp *statePollerService) Refresh() error {
 	for deviceId, device := range devices {
 		poller, pollerExists := sp.pollers[deviceId]
 
-		if device.Config.StatePollingEnabled && !pollerExists {
-			sp.createPoller(deviceId, device.Config.StatePollingIntervalSec, device.Config.MainIp)
-		} else if device.Config.StatePollingEnabled && pollerExists {
-			poller.Refresh(device.Config.StatePollingIntervalSec, device.Config.MainIp)
-		} else if !device.Config.StatePollingEnabled && pollerExists {
+		if device.Config.IsPolled() && !pollerExists {
+			sp.createPoller(deviceId, device.Config)
+		} else if device.Config.IsPolled() && pollerExists {
+			poller.Refresh(device.Config.StatePollingIntervalSec, device.Config.MainIp, device.Config.Schedule)
+		} else if !device.Config.IsPolled() && pollerExists {
 			sp.removePoller(deviceId)
 		}
 	}
@@ -85,25 +270,44 @@ func (sp *statePollerService) Refresh() error {
 	return nil
 }
 
-func (sp *statePollerService) handlePollResults() {
-	for {
-		select {
-		case s := <-sp.pollResults:
-			err := sp.reg.UpdateState(s.deviceId, s.state)
-			if err != nil {
-				log.Errorf("failed to update state, deviceId: %v, error: %v", s.deviceId, err)
-			}
-			sp.mqttSender.PublishState(s.state)
-		case _ = <-sp.done:
-			log.Infof("Ending poll result handling")
-			return
-		}
+func (sp *statePollerService) handlePollResult(s pollResult) {
+	err := sp.reg.UpdateState(s.deviceId, s.state)
+	if err != nil {
+		log.Errorf("failed to update state, deviceId: %v, error: %v", s.deviceId, err)
+		sp.publish(s.deviceId, s.state, nil)
+		return
+	}
+	sp.processState(s.deviceId, s.state)
+}
+
+// Runs the processing shared by polled and pushed states after the state has been stored
+func (sp *statePollerService) processState(deviceId string, state device_registry.State) {
+	estimate, err := sp.battery.StateReceived(deviceId, state)
+	if err != nil {
+		log.Errorf("failed to estimate battery life, deviceId: %v, error: %v", deviceId, err)
+	}
+	err = sp.reconciler.check(deviceId, state)
+	if err != nil {
+		log.Errorf("failed to check config drift, deviceId: %v, error: %v", deviceId, err)
+	}
+	sp.alerts.StateReceived(deviceId, state)
+	sp.publish(deviceId, state, estimate)
+}
+
+func (sp *statePollerService) publish(deviceId string, state device_registry.State, estimate *device_registry.BatteryEstimate) {
+	update := sinks.StateUpdate{DeviceId: deviceId, Timestamp: time.Now(), State: state, Battery: estimate}
+	device, err := sp.reg.Get(deviceId)
+	if err == nil {
+		update.Tags = device.Config.Tags
+	}
+	for _, sink := range sp.sinks {
+		sink.Publish(update)
 	}
 }
 
-func (sp *statePollerService) createPoller(deviceId string, pollingIntervalSec int, ip net.IP) {
-	duration := time.Duration(pollingIntervalSec) * time.Second
-	poller := sp.pollerCreator(sp.pollResults, deviceId, duration, ip)
+func (sp *statePollerService) createPoller(deviceId string, config device_registry.Config) {
+	duration := time.Duration(config.StatePollingIntervalSec) * time.Second
+	poller := sp.pollerCreator(sp.pollResults, deviceId, duration, config.MainIp, config.Schedule)
 	sp.pollers[deviceId] = poller
 	poller.Start()
 }
@@ -1,12 +1,17 @@
 package state_poller_service
 
 import (
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	"github.com/chacal/thread-mgmt-server/pkg/mocks"
+	"github.com/chacal/thread-mgmt-server/pkg/sinks"
+	"github.com/chacal/thread-mgmt-server/pkg/webhooks"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -19,7 +24,7 @@ func TestCreate(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 	mockSender := mocks.NewMockMqttSender(mockCtrl)
-	sp := Create(reg, mockSender)
+	sp := Create(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender)
 
 	assert.Empty(t, sp.pollers)
 }
@@ -30,33 +35,33 @@ func TestStatePollerService_Refresh_whenConfigChanges(t *testing.T) {
 	defer mockCtrl.Finish()
 	mockPoller := mocks.NewMockStatePoller(mockCtrl)
 	mockSender := mocks.NewMockMqttSender(mockCtrl)
-	sp := CreateWithPollerCreator(reg, mockSender, mockDevicePollerCreator(mockPoller))
+	sp := CreateWithPollerCreator(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender, mockDevicePollerCreator(mockPoller))
 	_, _ = reg.Create("12345")
 
 	// Refresh with disabled polling should not start pollers
-	reg.UpdateConfig("12345", device_registry.Config{ip, false, 600})
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: false, StatePollingIntervalSec: 600})
 	err := sp.Refresh()
 	require.NoError(t, err)
 
 	// Refresh with enabled polling should start poller
-	reg.UpdateConfig("12345", device_registry.Config{ip, true, 600})
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600})
 	mockPoller.EXPECT().Start()
 	err = sp.Refresh()
 	require.NoError(t, err)
 
 	// Refresh with changed config should refresh poller with the new config
-	reg.UpdateConfig("12345", device_registry.Config{ip2, true, 500})
-	mockPoller.EXPECT().Refresh(gomock.Eq(500), gomock.Eq(ip2))
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip2, StatePollingEnabled: true, StatePollingIntervalSec: 500})
+	mockPoller.EXPECT().Refresh(gomock.Eq(500), gomock.Eq(ip2), gomock.Nil())
 	err = sp.Refresh()
 	require.NoError(t, err)
 
 	// Refresh with the same config should refresh poller with the same config
-	mockPoller.EXPECT().Refresh(gomock.Eq(500), gomock.Eq(ip2))
+	mockPoller.EXPECT().Refresh(gomock.Eq(500), gomock.Eq(ip2), gomock.Nil())
 	err = sp.Refresh()
 	require.NoError(t, err)
 
 	// Refresh with disabled polling should stop poller
-	reg.UpdateConfig("12345", device_registry.Config{ip2, false, 500})
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip2, StatePollingEnabled: false, StatePollingIntervalSec: 500})
 	mockPoller.EXPECT().Stop()
 	err = sp.Refresh()
 	require.NoError(t, err)
@@ -72,11 +77,11 @@ func TestStatePollerService_Refresh_whenDeviceDeleted(t *testing.T) {
 	defer mockCtrl.Finish()
 	mockPoller := mocks.NewMockStatePoller(mockCtrl)
 	mockSender := mocks.NewMockMqttSender(mockCtrl)
-	sp := CreateWithPollerCreator(reg, mockSender, mockDevicePollerCreator(mockPoller))
+	sp := CreateWithPollerCreator(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender, mockDevicePollerCreator(mockPoller))
 	_, _ = reg.Create("12345")
 
 	// Refresh with enabled polling should start poller
-	reg.UpdateConfig("12345", device_registry.Config{ip, true, 600})
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600})
 	mockPoller.EXPECT().Start()
 	err := sp.Refresh()
 	require.NoError(t, err)
@@ -94,7 +99,7 @@ func TestStatePollerService_PollResultHandling(t *testing.T) {
 	defer mockCtrl.Finish()
 	mockSender := mocks.NewMockMqttSender(mockCtrl)
 
-	sps := Create(reg, mockSender)
+	sps := Create(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender)
 	_, _ = reg.Create("12345")
 
 	pollResults := make(chan pollResult)
@@ -104,7 +109,7 @@ func TestStatePollerService_PollResultHandling(t *testing.T) {
 	require.NoError(t, err)
 	defer sps.Stop()
 
-	mockSender.EXPECT().PublishState(gomock.Eq(testState))
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
 	pollResults <- pollResult{"12345", testState}
 
 	assert.Eventually(t, func() bool {
@@ -113,8 +118,231 @@ func TestStatePollerService_PollResultHandling(t *testing.T) {
 	}, time.Second, 10*time.Millisecond)
 }
 
+func TestStatePollerService_alerts(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockSender := mocks.NewMockMqttSender(mockCtrl)
+
+	sps := Create(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.PutAlertRule(device_registry.AlertRule{Id: "battery", Type: device_registry.ALERT_LOW_VCC, Threshold: 3000}))
+
+	pollResults := make(chan pollResult)
+	sps.pollResults = pollResults
+	require.NoError(t, sps.Start())
+
+	alerted := make(chan device_registry.AlertNotification, 1)
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+	mockSender.EXPECT().PublishAlert(gomock.Any()).Do(func(n device_registry.AlertNotification) { alerted <- n })
+	pollResults <- pollResult{"12345", testState}
+	sps.Stop()
+
+	n := <-alerted
+	assert.Equal(t, "battery", n.RuleId)
+	assert.Equal(t, device_registry.ALERT_FIRING, n.Status)
+	assert.Equal(t, "A100", n.Instance)
+
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	require.Len(t, dev.Alerts, 1)
+	assert.Equal(t, 2980.0, dev.Alerts[0].Value)
+}
+
+func TestStatePollerService_webhooks(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockSender := mocks.NewMockMqttSender(mockCtrl)
+
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.PutAlertRule(device_registry.AlertRule{Id: "battery", Type: device_registry.ALERT_LOW_VCC, Threshold: 3000}))
+	require.NoError(t, reg.PutWebhook(device_registry.Webhook{Id: "all", Url: "http://localhost"}))
+
+	// The dispatcher isn't started, so the events stay in the queue
+	settings := DefaultSettings
+	settings.Webhooks = webhooks.Create(reg, webhooks.DefaultSettings)
+	sps := CreateWithSettings(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender, settings)
+	require.NoError(t, sps.Start())
+
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+	mockSender.EXPECT().PublishAlert(gomock.Any())
+	sps.StateReported("12345", testState)
+	sps.Stop()
+
+	queue, err := reg.GetWebhookQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 2)
+	assert.Equal(t, device_registry.WEBHOOK_STATE_UPDATED, queue[0].Event)
+	assert.Equal(t, device_registry.WEBHOOK_ALERT, queue[1].Event)
+	assert.Equal(t, "12345", queue[1].DeviceId)
+}
+
+func TestStatePollerService_sinks(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockSink1 := mocks.NewMockSink(mockCtrl)
+	mockSink2 := mocks.NewMockSink(mockCtrl)
+
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateConfig("12345", device_registry.Config{Tags: []string{"outdoor"}}))
+
+	settings := DefaultSettings
+	settings.Sinks = []sinks.Sink{mockSink1, mockSink2}
+	sps := CreateWithSettings(reg, mocks.NewMockDeviceGateway(mockCtrl), mocks.NewMockMqttSender(mockCtrl), settings)
+
+	var published []sinks.StateUpdate
+	mockSink1.EXPECT().Publish(gomock.Any()).Do(func(update sinks.StateUpdate) { published = append(published, update) })
+	mockSink2.EXPECT().Publish(gomock.Any()).Do(func(update sinks.StateUpdate) { published = append(published, update) })
+	sps.StateReported("12345", testState)
+
+	require.Len(t, published, 2)
+	assert.Equal(t, published[0], published[1])
+	assert.Equal(t, "12345", published[0].DeviceId)
+	assert.Equal(t, testState, published[0].State)
+	assert.Equal(t, []string{"outdoor"}, published[0].Tags)
+	assert.Nil(t, published[0].Battery)
+	assert.WithinDuration(t, time.Now(), published[0].Timestamp, time.Second)
+}
+
+func TestStatePollerService_batteryEstimate(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockSender := mocks.NewMockMqttSender(mockCtrl)
+
+	sps := Create(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.AddVccSample("12345", device_registry.VccSample{Timestamp: time.Now().AddDate(0, 0, -2), Vcc: 3000}))
+
+	published := make(chan *device_registry.BatteryEstimate, 1)
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any()).Do(func(state device_registry.State, estimate *device_registry.BatteryEstimate) {
+		published <- estimate
+	})
+	sps.StateReported("12345", testState)
+
+	estimate := <-published
+	require.NotNil(t, estimate)
+	assert.Equal(t, 2, estimate.Samples)
+	assert.InDelta(t, -10, estimate.SlopeMvPerDay, 0.1)
+	assert.InDelta(t, 98, estimate.DaysRemaining, 0.5)
+
+	dev, err := reg.Get("12345")
+	require.NoError(t, err)
+	require.NotNil(t, dev.Battery)
+	assert.True(t, estimate.Timestamp.Equal(dev.Battery.Timestamp))
+	assert.Equal(t, estimate.DaysRemaining, dev.Battery.DaysRemaining)
+}
+
+func TestStatePollerService_StateReported(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockPoller := mocks.NewMockStatePoller(mockCtrl)
+	mockSender := mocks.NewMockMqttSender(mockCtrl)
+	sp := CreateWithPollerCreator(reg, mocks.NewMockDeviceGateway(mockCtrl), mockSender, mockDevicePollerCreator(mockPoller))
+	defer sp.Stop()
+	_, _ = reg.Create("12345")
+
+	// Pushed state of a device in push mode is published, but the device is not polled
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600, StateMode: device_registry.STATE_MODE_PUSH})
+	require.NoError(t, sp.Refresh())
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+	sp.StateReported("12345", testState)
+
+	// In poll mode the poller keeps its schedule
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600, StateMode: device_registry.STATE_MODE_POLL})
+	mockPoller.EXPECT().Start()
+	require.NoError(t, sp.Refresh())
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+	sp.StateReported("12345", testState)
+
+	// In hybrid mode pushed state replaces the next poll
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600, StateMode: device_registry.STATE_MODE_HYBRID})
+	mockPoller.EXPECT().Refresh(gomock.Eq(600), gomock.Eq(ip), gomock.Nil())
+	require.NoError(t, sp.Refresh())
+	mockPoller.EXPECT().Reported()
+	mockSender.EXPECT().PublishState(gomock.Eq(testState), gomock.Any())
+	sp.StateReported("12345", testState)
+
+	mockPoller.EXPECT().Stop()
+}
+
+func TestStatePollerService_Stop(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockPoller := mocks.NewMockStatePoller(mockCtrl)
+	sp := CreateWithPollerCreator(reg, mocks.NewMockDeviceGateway(mockCtrl), mocks.NewMockMqttSender(mockCtrl), mockDevicePollerCreator(mockPoller))
+	_, _ = reg.Create("12345")
+	reg.UpdateConfig("12345", device_registry.Config{MainIp: ip, StatePollingEnabled: true, StatePollingIntervalSec: 600})
+
+	mockPoller.EXPECT().Start()
+	require.NoError(t, sp.Start())
+
+	// Stopping the service stops the pollers
+	mockPoller.EXPECT().Stop()
+	sp.Stop()
+	sp.Stop()
+
+	assert.Error(t, sp.Refresh())
+	_, found := sp.PollerStatus("12345")
+	assert.False(t, found)
+}
+
+// Run with -race
+func TestStatePollerService_concurrentRefresh(t *testing.T) {
+	reg := device_registry.CreateTestRegistry(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockGw := mocks.NewMockDeviceGateway(mockCtrl)
+	mockSender := mocks.NewMockMqttSender(mockCtrl)
+
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Any()).Return(testState, nil).AnyTimes()
+	mockSender.EXPECT().PublishState(gomock.Any(), gomock.Any()).AnyTimes()
+
+	sp := CreateWithSettings(reg, mockGw, mockSender, Settings{Scheduler: SchedulerSettings{Workers: 4}})
+	sp.pollerCreator = func(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP,
+		schedule *device_registry.Schedule) StatePoller {
+		poller := defaultStatePollerCreator(mockGw, address_fallback.Create(reg), sp.scheduler)(pollResults, deviceId, pollingInterval, ip, schedule)
+		poller.(*statePoller).sleepRandomizer = func() time.Duration { return 0 }
+		return poller
+	}
+
+	ids := make([]string, 20)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		_, _ = reg.Create(ids[i])
+	}
+	require.NoError(t, sp.Start())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := ids[(w+i)%len(ids)]
+				config := device_registry.Config{MainIp: ip, StatePollingEnabled: (w+i)%3 != 0, StatePollingIntervalSec: 1 + i%2}
+				if i%2 == 0 {
+					config.MainIp = ip2
+				}
+				assert.NoError(t, reg.UpdateConfig(id, config))
+				assert.NoError(t, sp.Refresh())
+				sp.PollerStatus(id)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	sp.Stop()
+	assert.Empty(t, sp.pollers)
+}
+
 func mockDevicePollerCreator(mockPoller *mocks.MockStatePoller) StatePollerCreator {
-	return func(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP) StatePoller {
+	return func(pollResults chan pollResult, deviceId string, pollingInterval time.Duration, ip net.IP,
+		schedule *device_registry.Schedule) StatePoller {
 		return mockPoller
 	}
 }
@@ -1,12 +1,17 @@
 package state_poller_service
 
 import (
+	"context"
+	"errors"
+	"github.com/chacal/thread-mgmt-server/pkg/address_fallback"
 	"github.com/chacal/thread-mgmt-server/pkg/device_gateway"
 	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
 	"github.com/chacal/thread-mgmt-server/pkg/mocks"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -23,21 +28,22 @@ var testState = device_registry.State{
 func TestStatePoller_Start(t *testing.T) {
 	pollResults, mockGw := create(t)
 
-	poller := createPoller(pollResults, mockGw, 200*time.Millisecond)
+	poller := createPoller(t, pollResults, mockGw, 200*time.Millisecond)
 	defer poller.Stop()
 
-	mockGw.EXPECT().FetchState(gomock.Eq(ip)).Return(testState, nil)
+	testState2 := testState
+	testState2.Vcc = 3000
+	gomock.InOrder(
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(testState, nil),
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(testState2, nil),
+	)
 	poller.Start()
 
 	// Wait for immediate poll
 	result := <-pollResults
 	assert.Equal(t, pollResult{"12345", testState}, result)
 
-	testState2 := testState
-	testState2.Vcc = 3000
-	mockGw.EXPECT().FetchState(gomock.Eq(ip)).Return(testState2, nil)
-
-	// Wait for the first timer poll
+	// Wait for the first scheduled poll
 	result = <-pollResults
 	assert.Equal(t, pollResult{"12345", testState2}, result)
 }
@@ -45,17 +51,17 @@ func TestStatePoller_Start(t *testing.T) {
 func TestStatePoller_Refresh(t *testing.T) {
 	pollResults, mockGw := create(t)
 
-	poller := createPoller(pollResults, mockGw, 200*time.Millisecond)
+	poller := createPoller(t, pollResults, mockGw, 200*time.Millisecond)
 	defer poller.Stop()
 
-	mockGw.EXPECT().FetchState(gomock.Eq(ip)).Return(testState, nil)
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(testState, nil)
 	poller.Start()
 
 	// Wait for immediate poll
 	<-pollResults
 
-	mockGw.EXPECT().FetchState(gomock.Eq(ip2)).Return(testState, nil)
-	poller.Refresh(1, ip2)
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip2)).Return(testState, nil)
+	poller.Refresh(1, ip2, nil)
 
 	// Wait for the next poll
 	<-pollResults
@@ -64,9 +70,9 @@ func TestStatePoller_Refresh(t *testing.T) {
 func TestStatePoller_Stop(t *testing.T) {
 	pollResults, mockGw := create(t)
 
-	poller := createPoller(pollResults, mockGw, 200*time.Millisecond)
+	poller := createPoller(t, pollResults, mockGw, 200*time.Millisecond)
 
-	mockGw.EXPECT().FetchState(gomock.Eq(ip)).Return(testState, nil)
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(testState, nil)
 	poller.Start()
 
 	// Wait for immediate poll
@@ -78,6 +84,207 @@ func TestStatePoller_Stop(t *testing.T) {
 	time.Sleep(300 * time.Millisecond)
 }
 
+func TestStatePoller_fallsBackToOtherAddresses(t *testing.T) {
+	pollResults, mockGw := create(t)
+
+	mainIp := net.ParseIP("fd00::1")
+	meshLocalIp := net.ParseIP("fdde:ad00:beef::1")
+
+	reg := device_registry.CreateTestRegistry(t)
+	_, _ = reg.Create("12345")
+	require.NoError(t, reg.UpdateState("12345", device_registry.State{Addresses: []net.IP{mainIp, meshLocalIp}}))
+
+	poller := createPoller(t, pollResults, mockGw, time.Hour)
+	poller.ip = mainIp
+	poller.fallback = address_fallback.Create(reg)
+	defer poller.Stop()
+
+	gomock.InOrder(
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(mainIp)).Return(device_registry.State{}, errors.New("timeout")),
+		mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(meshLocalIp)).Return(testState, nil),
+	)
+	poller.Start()
+
+	result := <-pollResults
+	assert.Equal(t, pollResult{"12345", testState}, result)
+
+	dev, _ := reg.Get("12345")
+	assert.Equal(t, meshLocalIp, dev.Reachability.WorkingAddress)
+}
+
+func TestStatePoller_backsOffWhenDeviceFails(t *testing.T) {
+	pollResults, mockGw := create(t)
+	withBackoff(t, 50*time.Millisecond, time.Second)
+
+	poller := createPoller(t, pollResults, mockGw, 100*time.Millisecond)
+	defer poller.Stop()
+
+	var polls []time.Time
+	failures := 0
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).DoAndReturn(func(ctx context.Context, ip net.IP) (device_registry.State, error) {
+		polls = append(polls, time.Now())
+		if failures < 3 {
+			failures++
+			return device_registry.State{}, errors.New("timeout")
+		}
+		return testState, nil
+	}).Times(4)
+	poller.Start()
+
+	<-pollResults
+	status := poller.Status()
+	assert.Equal(t, 4, status.Polls)
+	assert.Equal(t, 0.25, status.SuccessRatio)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+	assert.Equal(t, 0, status.BackoffSec)
+	assert.Equal(t, "timeout", status.LastError)
+
+	// Fast retry, then the normal interval doubled for each further failure
+	require.Len(t, polls, 4)
+	assertDelay(t, 50*time.Millisecond, polls[1].Sub(polls[0]))
+	assertDelay(t, 200*time.Millisecond, polls[2].Sub(polls[1]))
+	assertDelay(t, 400*time.Millisecond, polls[3].Sub(polls[2]))
+}
+
+func TestStatePoller_Status(t *testing.T) {
+	pollResults, mockGw := create(t)
+	withBackoff(t, time.Hour, time.Hour)
+
+	poller := createPoller(t, pollResults, mockGw, time.Hour)
+	defer poller.Stop()
+
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(device_registry.State{}, errors.New("timeout"))
+	poller.Start()
+
+	assert.Eventually(t, func() bool {
+		return poller.Status().ConsecutiveFailures == 1
+	}, time.Second, 10*time.Millisecond)
+	status := poller.Status()
+	require.NotNil(t, status.LastPoll)
+	require.NotNil(t, status.NextPoll)
+	assert.Equal(t, status.LastPoll.Add(time.Hour).Round(time.Second), status.NextPoll.Round(time.Second))
+	status.LastPoll, status.NextPoll = nil, nil
+	assert.Equal(t, device_registry.PollerStatus{IntervalSec: 3600, Polls: 1, ConsecutiveFailures: 1, BackoffSec: 3600, LastError: "timeout"}, status)
+}
+
+func TestStatePoller_PollNow(t *testing.T) {
+	pollResults, mockGw := create(t)
+
+	poller := createPoller(t, pollResults, mockGw, time.Hour)
+	poller.sleepRandomizer = func() time.Duration { return time.Hour }
+	defer poller.Stop()
+
+	poller.Start()
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(testState, nil)
+	poller.PollNow()
+
+	<-pollResults
+	assert.Eventually(t, func() bool {
+		status := poller.Status()
+		return status.Polls == 1 && status.NextPoll.After(time.Now().Add(119*time.Minute))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestStatePoller_Reported(t *testing.T) {
+	pollResults, mockGw := create(t)
+
+	poller := createPoller(t, pollResults, mockGw, time.Hour)
+	defer poller.Stop()
+
+	poller.status.ConsecutiveFailures = 2
+	poller.status.BackoffSec = 7200
+	poller.Reported()
+
+	status := poller.Status()
+	assert.Equal(t, 1, status.Polls)
+	assert.Equal(t, 1.0, status.SuccessRatio)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+	assert.Equal(t, 0, status.BackoffSec)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *status.NextPoll, time.Second)
+}
+
+func TestStatePoller_defersPollsOutsideWindow(t *testing.T) {
+	pollResults, mockGw := create(t)
+
+	poller := createPoller(t, pollResults, mockGw, time.Hour)
+	setSchedule(t, poller, tomorrowOnly())
+	defer poller.Stop()
+
+	// No polls today, the first poll is deferred to the start of tomorrow
+	poller.Start()
+	tomorrow := poller.schedule.NextAllowed(time.Now())
+	assert.Eventually(t, func() bool {
+		status := poller.Status()
+		return status.NextPoll != nil && status.NextPoll.Equal(tomorrow)
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, poller.Status().Polls)
+
+	// Polling on demand ignores the schedule
+	mockGw.EXPECT().FetchState(gomock.Any(), gomock.Eq(ip)).Return(testState, nil)
+	poller.PollNow()
+	<-pollResults
+}
+
+func TestStatePoller_skipsPollsOutsideWindow(t *testing.T) {
+	pollResults, mockGw := create(t)
+
+	poller := createPoller(t, pollResults, mockGw, time.Hour)
+	schedule := tomorrowOnly()
+	schedule.OutsideWindow = device_registry.OUTSIDE_WINDOW_SKIP
+	setSchedule(t, poller, schedule)
+	defer poller.Stop()
+
+	poller.Start()
+	assert.Eventually(t, func() bool {
+		status := poller.Status()
+		return status.NextPoll != nil && status.NextPoll.After(time.Now().Add(59*time.Minute))
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, poller.Status().Polls)
+}
+
+func TestBackoffDelay(t *testing.T) {
+	withBackoff(t, 10*time.Second, time.Hour)
+
+	assert.Equal(t, 10*time.Minute, backoffDelay(10*time.Minute, 0))
+	assert.Equal(t, 10*time.Second, backoffDelay(10*time.Minute, 1))
+	assert.Equal(t, 20*time.Minute, backoffDelay(10*time.Minute, 2))
+	assert.Equal(t, 40*time.Minute, backoffDelay(10*time.Minute, 3))
+	assert.Equal(t, time.Hour, backoffDelay(10*time.Minute, 4))
+	assert.Equal(t, time.Hour, backoffDelay(10*time.Minute, 100))
+
+	// Intervals shorter than the fast retry and longer than the cap are kept
+	assert.Equal(t, 5*time.Second, backoffDelay(5*time.Second, 1))
+	assert.Equal(t, 10*time.Second, backoffDelay(2*time.Hour, 1))
+	assert.Equal(t, 2*time.Hour, backoffDelay(2*time.Hour, 5))
+}
+
+// Returns a schedule allowing polls for the whole of tomorrow (UTC) only
+func tomorrowOnly() *device_registry.Schedule {
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Weekday()
+	return &device_registry.Schedule{Windows: []device_registry.ScheduleWindow{
+		{Days: strconv.Itoa(int(tomorrow)), Start: "00:00", End: "00:00"},
+	}}
+}
+
+func setSchedule(t *testing.T, poller *statePoller, schedule *device_registry.Schedule) {
+	compiled, err := schedule.Compile()
+	require.NoError(t, err)
+	poller.schedule, poller.compiledSchedule = schedule, compiled
+}
+
+func withBackoff(t *testing.T, fastRetry time.Duration, max time.Duration) {
+	origFastRetry, origMax := fastRetryDelay, maxPollBackoff
+	fastRetryDelay, maxPollBackoff = fastRetry, max
+	t.Cleanup(func() {
+		fastRetryDelay, maxPollBackoff = origFastRetry, origMax
+	})
+}
+
+func assertDelay(t *testing.T, expected time.Duration, actual time.Duration) {
+	assert.GreaterOrEqual(t, int64(actual), int64(expected))
+	assert.Less(t, int64(actual), int64(expected+100*time.Millisecond))
+}
+
 func create(t *testing.T) (chan pollResult, *mocks.MockDeviceGateway) {
 	pollResults := make(chan pollResult)
 	mockCtrl := gomock.NewController(t)
@@ -88,8 +295,16 @@ func create(t *testing.T) (chan pollResult, *mocks.MockDeviceGateway) {
 	return pollResults, mockGw
 }
 
-func createPoller(pollResults chan pollResult, gw device_gateway.DeviceGateway, interval time.Duration) *statePoller {
-	return &statePoller{"12345", interval, ip, nil,
-		gw, pollResults, func() time.Duration { return 0 },
+func createPoller(t *testing.T, pollResults chan pollResult, gw device_gateway.DeviceGateway, interval time.Duration) *statePoller {
+	fallback := address_fallback.Create(device_registry.CreateTestRegistry(t))
+	return &statePoller{
+		deviceId:             "12345",
+		statePollingInterval: interval,
+		ip:                   ip,
+		scheduler:            createScheduler(t, SchedulerSettings{Workers: 1}),
+		gw:                   gw,
+		fallback:             fallback,
+		pollResults:          pollResults,
+		sleepRandomizer:      func() time.Duration { return 0 },
 	}
 }
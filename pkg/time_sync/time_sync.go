@@ -0,0 +1,93 @@
+package time_sync
+
+import (
+	"time"
+)
+
+const MinSyncInterval = time.Hour
+const MaxSyncInterval = 24 * time.Hour
+
+// How many seconds of sync interval each millisecond of device poll period buys
+const syncSecondsPerPollMs = 3.6
+
+// How far ahead timezone transitions are reported to devices
+const transitionLookahead = 366 * 24 * time.Hour
+
+type Transition struct {
+	At     int64 `json:"at"`
+	Offset int   `json:"off"`
+}
+
+// TimeInfo is kept compact on purpose as it is sent over 802.15.4 to devices
+type TimeInfo struct {
+	Utc         int64        `json:"utc"`
+	Offset      int          `json:"off"`
+	Transitions []Transition `json:"tz,omitempty"`
+	SyncSec     int          `json:"sync"`
+}
+
+func CreateTimeInfo(now time.Time, loc *time.Location, pollPeriodMs int) TimeInfo {
+	_, offset := now.In(loc).Zone()
+	return TimeInfo{
+		Utc:         now.Unix(),
+		Offset:      offset,
+		Transitions: transitions(now, now.Add(transitionLookahead), loc),
+		SyncSec:     int(SyncInterval(pollPeriodMs) / time.Second),
+	}
+}
+
+// SyncInterval returns how often a device should re-sync its clock. Devices polling their parent
+// rarely are assumed to be battery constrained and are told to sync less often.
+func SyncInterval(pollPeriodMs int) time.Duration {
+	interval := time.Duration(float64(pollPeriodMs)*syncSecondsPerPollMs) * time.Second
+	if interval < MinSyncInterval {
+		return MinSyncInterval
+	}
+	if interval > MaxSyncInterval {
+		return MaxSyncInterval
+	}
+	return interval
+}
+
+func transitions(from time.Time, until time.Time, loc *time.Location) []Transition {
+	var ret []Transition
+	for {
+		t, found := nextTransition(from, until, loc)
+		if !found {
+			return ret
+		}
+		_, offset := t.In(loc).Zone()
+		ret = append(ret, Transition{t.Unix(), offset})
+		from = t
+	}
+}
+
+func nextTransition(from time.Time, until time.Time, loc *time.Location) (time.Time, bool) {
+	step := 24 * time.Hour
+	for lo := from; lo.Before(until); lo = lo.Add(step) {
+		hi := lo.Add(step)
+		if offsetAt(lo, loc) != offsetAt(hi, loc) {
+			return bisectTransition(lo, hi, loc), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Finds the first second having a different offset than lo
+func bisectTransition(lo time.Time, hi time.Time, loc *time.Location) time.Time {
+	loOffset := offsetAt(lo, loc)
+	for hi.Sub(lo) > time.Second {
+		mid := lo.Add(hi.Sub(lo) / 2).Truncate(time.Second)
+		if offsetAt(mid, loc) == loOffset {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
+
+func offsetAt(t time.Time, loc *time.Location) int {
+	_, offset := t.In(loc).Zone()
+	return offset
+}
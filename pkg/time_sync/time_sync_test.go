@@ -0,0 +1,40 @@
+package time_sync
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCreateTimeInfo_UTC(t *testing.T) {
+	now := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+
+	info := CreateTimeInfo(now, time.UTC, 1000)
+	assert.Equal(t, TimeInfo{Utc: now.Unix(), Offset: 0, Transitions: nil, SyncSec: 3600}, info)
+}
+
+func TestCreateTimeInfo_WithDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	require.NoError(t, err)
+	now := time.Date(2020, 11, 20, 12, 0, 0, 0, time.UTC)
+
+	info := CreateTimeInfo(now, loc, 5000)
+	assert.Equal(t, TimeInfo{
+		Utc:    now.Unix(),
+		Offset: 2 * 3600,
+		Transitions: []Transition{
+			{time.Date(2021, 3, 28, 1, 0, 0, 0, time.UTC).Unix(), 3 * 3600},
+			{time.Date(2021, 10, 31, 1, 0, 0, 0, time.UTC).Unix(), 2 * 3600},
+		},
+		SyncSec: 5 * 3600,
+	}, info)
+}
+
+func TestSyncInterval(t *testing.T) {
+	assert.Equal(t, MinSyncInterval, SyncInterval(0))
+	assert.Equal(t, MinSyncInterval, SyncInterval(100))
+	assert.Equal(t, time.Hour, SyncInterval(1000))
+	assert.Equal(t, 10*time.Hour, SyncInterval(10000))
+	assert.Equal(t, MaxSyncInterval, SyncInterval(60000))
+}
@@ -0,0 +1,349 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/chacal/thread-mgmt-server/pkg/alerts"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+type Settings struct {
+	// Attempts before a delivery is given up
+	MaxAttempts int
+	// Delay before the first retry, doubled on each further retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Timeout        time.Duration
+}
+
+var DefaultSettings = Settings{MaxAttempts: 10, InitialBackoff: 10 * time.Second, MaxBackoff: time.Hour, Timeout: 10 * time.Second}
+
+func (s Settings) Validate() error {
+	if s.MaxAttempts < 1 {
+		return errors.Errorf("invalid max attempts %v, must be at least 1", s.MaxAttempts)
+	}
+	if s.InitialBackoff <= 0 || s.MaxBackoff < s.InitialBackoff {
+		return errors.Errorf("invalid backoff %v - %v", s.InitialBackoff, s.MaxBackoff)
+	}
+	if s.Timeout <= 0 {
+		return errors.Errorf("invalid timeout %v", s.Timeout)
+	}
+	return nil
+}
+
+// Returns the delay before the next attempt after the given number of failed attempts
+func (s Settings) backoff(attempts int) time.Duration {
+	delay := s.InitialBackoff
+	for i := 1; i < attempts && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff {
+		return s.MaxBackoff
+	}
+	return delay
+}
+
+// Dispatcher sends device events to the webhooks that accept them. Events are queued in the registry, so that
+// deliveries that haven't succeeded yet are retried also after a restart.
+type Dispatcher struct {
+	reg      *device_registry.Registry
+	settings Settings
+	client   *http.Client
+	now      func() time.Time
+	wake     chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func Create(reg *device_registry.Registry, settings Settings) *Dispatcher {
+	return &Dispatcher{
+		reg:      reg,
+		settings: settings,
+		client:   &http.Client{Timeout: settings.Timeout},
+		now:      time.Now,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Starts delivering the queued events
+func (d *Dispatcher) Start() {
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+
+	d.wg.Add(1)
+	go d.run(ctx)
+}
+
+// Stops delivering and waits for the running attempt to be cancelled. Undelivered events stay in the queue.
+func (d *Dispatcher) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.wg.Wait()
+}
+
+// Queues the event for the webhooks that accept it. A nil dispatcher drops the events, so that callers don't
+// need to care whether webhooks are in use.
+func (d *Dispatcher) Send(eventType string, deviceId string, data interface{}) {
+	d.send(eventType, deviceId, data, nil)
+}
+
+// Queues the event for the webhooks that accept it and for the listed webhooks
+func (d *Dispatcher) send(eventType string, deviceId string, data interface{}, webhookIds []string) {
+	if d == nil {
+		return
+	}
+	if err := d.enqueue(eventType, deviceId, data, webhookIds); err != nil {
+		log.Errorf("failed to queue %v webhook event for device %v: %v", eventType, deviceId, err)
+		return
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) enqueue(eventType string, deviceId string, data interface{}, webhookIds []string) error {
+	webhooks, err := d.reg.GetWebhooks()
+	if err != nil {
+		return err
+	}
+
+	now := d.now()
+	var deliveries []device_registry.WebhookDelivery
+	var payload []byte
+	for _, w := range webhooks {
+		if !w.Accepts(eventType) && !contains(webhookIds, w.Id) {
+			continue
+		}
+		if payload == nil {
+			payload, err = json.Marshal(device_registry.WebhookEvent{Type: eventType, DeviceId: deviceId, Timestamp: now, Data: data})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		deliveries = append(deliveries, device_registry.WebhookDelivery{
+			WebhookId:   w.Id,
+			Event:       eventType,
+			DeviceId:    deviceId,
+			Payload:     payload,
+			Created:     now,
+			NextAttempt: now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.reg.EnqueueWebhookDeliveries(deliveries)
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	defer d.wg.Done()
+	for {
+		next := d.deliverDue(ctx)
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(d.now()))
+			timeout = timer.C
+		}
+
+		select {
+		case <-d.wake:
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Attempts the deliveries that are due. Each webhook gets its own goroutine and its deliveries are attempted in
+// the order they were queued, so that an unreachable webhook holds up only its own deliveries. Returns when the
+// next delivery is due, or zero time if the queue is empty.
+func (d *Dispatcher) deliverDue(ctx context.Context) time.Time {
+	queue, err := d.reg.GetWebhookQueue()
+	if err != nil {
+		log.Errorf("failed to get webhook queue: %v", err)
+		return d.now().Add(d.settings.InitialBackoff)
+	}
+
+	var webhookIds []string
+	deliveries := make(map[string][]device_registry.WebhookDelivery)
+	for _, delivery := range queue {
+		if _, found := deliveries[delivery.WebhookId]; !found {
+			webhookIds = append(webhookIds, delivery.WebhookId)
+		}
+		deliveries[delivery.WebhookId] = append(deliveries[delivery.WebhookId], delivery)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var next time.Time
+	for _, id := range webhookIds {
+		wg.Add(1)
+		go func(deliveries []device_registry.WebhookDelivery) {
+			defer wg.Done()
+			due := d.deliverInOrder(ctx, deliveries)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+				next = due
+			}
+		}(deliveries[id])
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return time.Time{}
+	}
+	return next
+}
+
+// Attempts the deliveries of one webhook in order until one isn't due yet or fails. Returns when the first
+// remaining delivery is due, or zero time if none remain.
+func (d *Dispatcher) deliverInOrder(ctx context.Context, deliveries []device_registry.WebhookDelivery) time.Time {
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return time.Time{}
+		}
+		if delivery.NextAttempt.After(d.now()) {
+			return delivery.NextAttempt
+		}
+
+		retryAt, retrying := d.attempt(ctx, delivery)
+		if retrying {
+			return retryAt
+		}
+	}
+	return time.Time{}
+}
+
+// Makes one attempt to deliver and records the outcome. Returns the time of the next attempt if the delivery
+// is retried.
+func (d *Dispatcher) attempt(ctx context.Context, delivery device_registry.WebhookDelivery) (time.Time, bool) {
+	webhook, err := d.reg.GetWebhook(delivery.WebhookId)
+	if err != nil {
+		log.Errorf("failed to get webhook %v: %v", delivery.WebhookId, err)
+		return time.Time{}, false
+	}
+	if webhook == nil {
+		// Deleted after the event was queued, its deliveries have been dropped
+		return time.Time{}, false
+	}
+
+	start := d.now()
+	statusCode, err := d.post(ctx, *webhook, delivery)
+	if ctx.Err() != nil {
+		// Stopping, the delivery is attempted again after a restart
+		return time.Time{}, false
+	}
+
+	delivery.Attempts++
+	attempt := device_registry.WebhookAttempt{
+		DeliveryId: delivery.Id,
+		Event:      delivery.Event,
+		DeviceId:   delivery.DeviceId,
+		Attempt:    delivery.Attempts,
+		Timestamp:  start,
+		Status:     device_registry.DELIVERY_DELIVERED,
+		StatusCode: statusCode,
+		DurationMs: d.now().Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		delivery.LastError = err.Error()
+		if delivery.Attempts < d.settings.MaxAttempts {
+			attempt.Status = device_registry.DELIVERY_RETRYING
+			delivery.NextAttempt = d.now().Add(d.settings.backoff(delivery.Attempts))
+			log.Warnf("failed to deliver %v to webhook %v, retrying at %v: %v", delivery.Event, webhook.Id, delivery.NextAttempt.Format(time.RFC3339), err)
+		} else {
+			attempt.Status = device_registry.DELIVERY_FAILED
+			log.Errorf("failed to deliver %v to webhook %v after %v attempts, giving up: %v", delivery.Event, webhook.Id, delivery.Attempts, err)
+		}
+	}
+
+	if err := d.reg.RecordWebhookAttempt(delivery, attempt); err != nil {
+		log.Errorf("failed to record webhook attempt for delivery %v: %v", delivery.Id, err)
+	}
+	return delivery.NextAttempt, attempt.Status == device_registry.DELIVERY_RETRYING
+}
+
+// POSTs the payload of the delivery. Returns the response status, if any, and an error unless it was a 2xx.
+func (d *Dispatcher) post(ctx context.Context, webhook device_registry.Webhook, delivery device_registry.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(delivery.Id, 10))
+	if webhook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(webhook.Secret, delivery.Payload))
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, errors.Errorf("unexpected response status %v", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Sign returns the signature header value of the body, the hex encoded HMAC-SHA256 of the body prefixed with
+// "sha256=". Receivers verify it by computing the same with the shared secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type alertNotifier struct {
+	d *Dispatcher
+}
+
+// AlertNotifier sends the alert notifications as alert events to the webhooks accepting them and to the
+// webhooks of the rule
+func AlertNotifier(d *Dispatcher) alerts.Notifier {
+	return &alertNotifier{d}
+}
+
+func (a *alertNotifier) Notify(rule device_registry.AlertRule, n device_registry.AlertNotification) {
+	a.d.send(device_registry.WEBHOOK_ALERT, n.DeviceId, n, rule.Webhooks)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"github.com/chacal/thread-mgmt-server/pkg/device_registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testState = device_registry.State{Vcc: 2980, Instance: "A100", PollPeriod: 1000}
+
+var testSettings = Settings{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Timeout: time.Second}
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is a webhook endpoint that answers with the given statuses in order and with 200 after them
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func createReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, request{req.Header, body})
+		if len(r.statuses) > 0 {
+			w.WriteHeader(r.statuses[0])
+			r.statuses = r.statuses[1:]
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request{}, r.requests...)
+}
+
+func TestDispatcher_delivers(t *testing.T) {
+	r := createReceiver(t)
+	reg, d := createDispatcher(t, device_registry.Webhook{Id: "states", Url: r.URL, Events: []string{device_registry.WEBHOOK_STATE_UPDATED}, Secret: "s3cret"})
+	d.Start()
+
+	d.Send(device_registry.WEBHOOK_DEVICE_CREATED, "12345", nil)
+	d.Send(device_registry.WEBHOOK_STATE_UPDATED, "12345", testState)
+	attempts := waitForAttempts(t, reg, "states", 1)
+	assert.Equal(t, device_registry.DELIVERY_DELIVERED, attempts[0].Status)
+	assert.Equal(t, http.StatusOK, attempts[0].StatusCode)
+	assert.Equal(t, device_registry.WEBHOOK_STATE_UPDATED, attempts[0].Event)
+	assert.Equal(t, 1, attempts[0].Attempt)
+
+	requests := r.received()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "application/json", requests[0].header.Get("Content-Type"))
+	assert.Equal(t, device_registry.WEBHOOK_STATE_UPDATED, requests[0].header.Get(EventHeader))
+	assert.Equal(t, Sign("s3cret", requests[0].body), requests[0].header.Get(SignatureHeader))
+
+	var event struct {
+		Type     string                `json:"type"`
+		DeviceId string                `json:"deviceId"`
+		Data     device_registry.State `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(requests[0].body, &event))
+	assert.Equal(t, device_registry.WEBHOOK_STATE_UPDATED, event.Type)
+	assert.Equal(t, "12345", event.DeviceId)
+	assert.Equal(t, testState, event.Data)
+
+	assert.Empty(t, queue(t, reg))
+}
+
+func TestDispatcher_retries(t *testing.T) {
+	r := createReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	reg, d := createDispatcher(t, device_registry.Webhook{Id: "all", Url: r.URL})
+	d.Start()
+
+	d.Send(device_registry.WEBHOOK_DEVICE_DELETED, "12345", nil)
+	attempts := waitForAttempts(t, reg, "all", 3)
+	assert.Equal(t, []string{device_registry.DELIVERY_RETRYING, device_registry.DELIVERY_RETRYING, device_registry.DELIVERY_DELIVERED}, statuses(attempts))
+	assert.Equal(t, "unexpected response status 500 Internal Server Error", attempts[0].Error)
+	assert.Equal(t, http.StatusServiceUnavailable, attempts[1].StatusCode)
+	assert.Equal(t, 3, attempts[2].Attempt)
+
+	// Each attempt carries the same delivery
+	requests := r.received()
+	require.Len(t, requests, 3)
+	assert.Equal(t, requests[0].body, requests[2].body)
+	assert.Equal(t, requests[0].header.Get(DeliveryHeader), requests[2].header.Get(DeliveryHeader))
+	assert.Empty(t, requests[0].header.Get(SignatureHeader))
+	assert.Empty(t, queue(t, reg))
+}
+
+func TestDispatcher_givesUp(t *testing.T) {
+	r := createReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	reg, d := createDispatcher(t, device_registry.Webhook{Id: "all", Url: r.URL})
+	d.Start()
+
+	d.Send(device_registry.WEBHOOK_DEVICE_DELETED, "12345", nil)
+	attempts := waitForAttempts(t, reg, "all", 3)
+	assert.Equal(t, []string{device_registry.DELIVERY_RETRYING, device_registry.DELIVERY_RETRYING, device_registry.DELIVERY_FAILED}, statuses(attempts))
+	assert.Empty(t, queue(t, reg))
+}
+
+func TestDispatcher_unreachableWebhook(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+	}))
+	t.Cleanup(unreachable.Close)
+	t.Cleanup(func() { close(release) })
+
+	r := createReceiver(t)
+	reg, d := createDispatcher(t, device_registry.Webhook{Id: "down", Url: unreachable.URL}, device_registry.Webhook{Id: "up", Url: r.URL})
+	d.Start()
+
+	// Deliveries to the other webhook aren't held up by the one that doesn't answer
+	for i := 0; i < 3; i++ {
+		d.Send(device_registry.WEBHOOK_DEVICE_CREATED, "12345", nil)
+	}
+	attempts := waitForAttempts(t, reg, "up", 3)
+	assert.Equal(t, []string{device_registry.DELIVERY_DELIVERED, device_registry.DELIVERY_DELIVERED, device_registry.DELIVERY_DELIVERED}, statuses(attempts))
+
+	// The deliveries of the unreachable webhook wait for its first one
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Len(t, queue(t, reg), 3)
+}
+
+func TestDispatcher_persistentQueue(t *testing.T) {
+	r := createReceiver(t)
+	reg, d := createDispatcher(t, device_registry.Webhook{Id: "all", Url: r.URL})
+
+	// Events queued while the dispatcher isn't running are delivered once a dispatcher is started
+	d.Send(device_registry.WEBHOOK_DEVICE_CREATED, "12345", nil)
+	d.Send(device_registry.WEBHOOK_DEVICE_DELETED, "12345", nil)
+	pending := queue(t, reg)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "all", pending[0].WebhookId)
+	assert.Equal(t, device_registry.WEBHOOK_DEVICE_CREATED, pending[0].Event)
+	assert.Equal(t, 0, pending[0].Attempts)
+
+	d2 := Create(reg, testSettings)
+	d2.Start()
+	t.Cleanup(d2.Stop)
+	attempts := waitForAttempts(t, reg, "all", 2)
+	assert.Equal(t, device_registry.WEBHOOK_DEVICE_CREATED, attempts[0].Event)
+	assert.Equal(t, device_registry.WEBHOOK_DEVICE_DELETED, attempts[1].Event)
+	assert.Empty(t, queue(t, reg))
+}
+
+func TestDispatcher_nil(t *testing.T) {
+	var d *Dispatcher
+	d.Send(device_registry.WEBHOOK_DEVICE_CREATED, "12345", nil)
+}
+
+func TestAlertNotifier(t *testing.T) {
+	reg, d := createDispatcher(t, device_registry.Webhook{Id: "alerts", Url: "http://localhost", Events: []string{device_registry.WEBHOOK_ALERT}})
+
+	n := device_registry.AlertNotification{DeviceId: "12345", RuleId: "battery", Status: device_registry.ALERT_FIRING}
+	AlertNotifier(d).Notify(device_registry.AlertRule{Id: "battery"}, n)
+
+	pending := queue(t, reg)
+	require.Len(t, pending, 1)
+	assert.Equal(t, device_registry.WEBHOOK_ALERT, pending[0].Event)
+	assert.Equal(t, "12345", pending[0].DeviceId)
+	assert.Contains(t, string(pending[0].Payload), `"ruleId":"battery"`)
+}
+
+func TestAlertNotifier_ruleWebhooks(t *testing.T) {
+	reg, d := createDispatcher(t,
+		device_registry.Webhook{Id: "alerts", Url: "http://localhost", Events: []string{device_registry.WEBHOOK_ALERT}},
+		device_registry.Webhook{Id: "ops", Url: "http://localhost", Events: []string{device_registry.WEBHOOK_STATE_UPDATED}},
+		device_registry.Webhook{Id: "states", Url: "http://localhost", Events: []string{device_registry.WEBHOOK_STATE_UPDATED}})
+
+	// Webhooks of the rule receive its alerts even if they don't accept alert events otherwise
+	n := device_registry.AlertNotification{DeviceId: "12345", RuleId: "battery", Status: device_registry.ALERT_FIRING}
+	AlertNotifier(d).Notify(device_registry.AlertRule{Id: "battery", Webhooks: []string{"ops", "alerts", "deleted"}}, n)
+
+	var ids []string
+	for _, delivery := range queue(t, reg) {
+		assert.Equal(t, device_registry.WEBHOOK_ALERT, delivery.Event)
+		ids = append(ids, delivery.WebhookId)
+	}
+	assert.Equal(t, []string{"alerts", "ops"}, ids)
+}
+
+func TestSettings(t *testing.T) {
+	assert.NoError(t, DefaultSettings.Validate())
+	assert.Equal(t, 10*time.Second, DefaultSettings.backoff(1))
+	assert.Equal(t, 40*time.Second, DefaultSettings.backoff(3))
+	assert.Equal(t, time.Hour, DefaultSettings.backoff(20))
+
+	assert.EqualError(t, Settings{MaxAttempts: 0, InitialBackoff: time.Second, MaxBackoff: time.Second, Timeout: time.Second}.Validate(),
+		"invalid max attempts 0, must be at least 1")
+	assert.EqualError(t, Settings{MaxAttempts: 1, InitialBackoff: time.Minute, MaxBackoff: time.Second, Timeout: time.Second}.Validate(),
+		"invalid backoff 1m0s - 1s")
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{"type":"alert"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=2a65b568e99ad5a242f0f68d3069658061b4ba112e1c818fbad8ff88ee925be4", Sign("secret", []byte(`{"type":"alert"}`)))
+}
+
+func createDispatcher(t *testing.T, webhooks ...device_registry.Webhook) (*device_registry.Registry, *Dispatcher) {
+	reg := device_registry.CreateTestRegistry(t)
+	for _, w := range webhooks {
+		require.NoError(t, reg.PutWebhook(w))
+	}
+	d := Create(reg, testSettings)
+	t.Cleanup(d.Stop)
+	return reg, d
+}
+
+func waitForAttempts(t *testing.T, reg *device_registry.Registry, webhookId string, count int) []device_registry.WebhookAttempt {
+	var attempts []device_registry.WebhookAttempt
+	require.Eventually(t, func() bool {
+		var err error
+		attempts, err = reg.GetWebhookAttempts(webhookId)
+		require.NoError(t, err)
+		return len(attempts) >= count
+	}, 5*time.Second, 5*time.Millisecond)
+	return attempts
+}
+
+func queue(t *testing.T, reg *device_registry.Registry) []device_registry.WebhookDelivery {
+	deliveries, err := reg.GetWebhookQueue()
+	require.NoError(t, err)
+	return deliveries
+}
+
+func statuses(attempts []device_registry.WebhookAttempt) []string {
+	var s []string
+	for _, a := range attempts {
+		s = append(s, a.Status)
+	}
+	return s
+}
@@ -43,6 +43,10 @@ export default function DeviceConfigPanel(props: { config: DeviceConfig, address
     setConfig({ ...config, statePollingEnabled: enabled, statePollingIntervalSec: interval })
   }
 
+  const onAutoReconcileChanged = (e: ChangeEvent<HTMLInputElement>) => {
+    setConfig({ ...config, autoReconcile: e.target.checked })
+  }
+
   const onClickSave = () => {
     setStatus(EmptyStatus)
     return props.onSaveConfig(config)
@@ -65,6 +69,20 @@ export default function DeviceConfigPanel(props: { config: DeviceConfig, address
         onPollChange={onPollConfigChanged}
       />
     </Grid>
+    <Grid item container spacing={3} className={classes.configPanelRow}>
+      <Grid item xs={12}>
+        <Typography variant={'caption'} color={'textSecondary'}>Config drift</Typography>
+      </Grid>
+      <Grid item xs={12}>
+        <FormControlLabel
+          control={
+            <Checkbox disabled={config.mainIp === ''} checked={config.autoReconcile} onChange={onAutoReconcileChanged}
+                      classes={{ root: classes.checkBoxRoot }}/>
+          }
+          label="Push defaults automatically"
+        />
+      </Grid>
+    </Grid>
     <Grid item container spacing={2} xs={12}>
       <Grid item>
         <AsyncOperationButton disabled={isSaveDisabled()} onClick={onClickSave}>Save</AsyncOperationButton>
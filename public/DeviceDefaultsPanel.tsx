@@ -13,7 +13,7 @@ import isEqual from 'lodash/isEqual'
 import StatusMessage, { EmptyStatus } from './StatusMessage'
 import { DeviceDefaults } from './DeviceList'
 import InputAdornment from '@material-ui/core/InputAdornment'
-import { postJSON } from './DeviceListItem'
+import { runJob } from './DeviceListItem'
 
 const useStyles = makeStyles((theme) => ({
   defaultsPanelInputs: {
@@ -63,7 +63,7 @@ export default function DeviceDefaultsPanel(props: { defaults: DeviceDefaults, d
 
   const onClickPush = () => {
     setStatus({ msg: 'Pushing defaults..', isError: false, showProgress: true })
-    return postJSON('/v1/devices/' + props.deviceId + '/push', { address: props.mainIp })
+    return runJob('/v1/devices/' + props.deviceId + '/push', { address: props.mainIp })
       .then(() => setStatus(EmptyStatus))
       .catch(setErrorStatus)
   }
@@ -36,13 +36,56 @@ export interface DeviceState {
 export interface DeviceConfig {
   mainIp: string,
   statePollingEnabled: boolean,
-  statePollingIntervalSec: number
+  statePollingIntervalSec: number,
+  autoReconcile: boolean,
+  tags?: string[],
+  transport?: DeviceTransport,
+  stateMode?: 'poll' | 'push' | 'hybrid',
+  schedule?: DeviceSchedule
+}
+
+export interface DeviceTransport {
+  port?: number,
+  ackTimeoutMs?: number,
+  maxRetransmit?: number,
+  deadlineSec?: number
+}
+
+export interface DeviceSchedule {
+  timezone?: string,
+  windows: ScheduleWindow[],
+  outsideWindow?: 'defer' | 'skip'
+}
+
+export interface ScheduleWindow {
+  days: string,
+  start: string,
+  end: string
+}
+
+export interface DeviceAlert {
+  ruleId: string,
+  type: 'low_vcc' | 'low_rssi' | 'low_link_quality' | 'offline' | 'parent_changes' | 'battery_days',
+  value: number,
+  since: string,
+  message: string
+}
+
+export interface BatteryEstimate {
+  slopeMvPerDay: number,
+  vcc: number,
+  cutoffVcc: number,
+  daysRemaining: number,
+  samples: number,
+  ts: string
 }
 
 export interface Device {
   defaults: DeviceDefaults
   state?: DeviceState
   config: DeviceConfig
+  alerts?: DeviceAlert[]
+  battery?: BatteryEstimate
 }
 
 export default function DeviceList() {
@@ -59,7 +59,7 @@ export default function DeviceListItem(props: DeviceListItemProps) {
 export function doFetch(input: RequestInfo, init?: RequestInit) {
   return fetch(input, init)
     .then(res => {
-      if (res.status !== 200) {
+      if (res.status !== 200 && res.status !== 202) {
         throw 'Status: ' + res.status
       }
       return res
@@ -73,3 +73,36 @@ export function postJSON(url: string, data: any) {
     headers: { 'Content-Type': 'application/json' },
   })
 }
+
+interface Job {
+  id: string
+  status: string
+  result?: any
+  error?: string
+}
+
+const JOB_POLL_INTERVAL_MS = 500
+
+// Posts to an endpoint that starts a background job and resolves with the job's result once it has finished
+export function runJob(url: string, data: any): Promise<any> {
+  return postJSON(url, data)
+    .then(res => res.json())
+    .then((job: Job) => waitForJob(job.id))
+}
+
+function waitForJob(id: string): Promise<any> {
+  return new Promise(resolve => setTimeout(resolve, JOB_POLL_INTERVAL_MS))
+    .then(() => doFetch('/v1/jobs/' + id))
+    .then(res => res.json())
+    .then((job: Job) => {
+      switch (job.status) {
+        case 'SUCCEEDED':
+          return job.result
+        case 'FAILED':
+        case 'CANCELLED':
+          throw job.error || job.status
+        default:
+          return waitForJob(id)
+      }
+    })
+}
@@ -5,7 +5,7 @@ import SubPanel from './SubPanel'
 import Grid from '@material-ui/core/Grid'
 import AsyncOperationButton from './AsyncOperationButton'
 import StatusMessage, { EmptyStatus } from './StatusMessage'
-import { postJSON } from './DeviceListItem'
+import { runJob } from './DeviceListItem'
 
 interface DeviceStatePanelProps {
   state?: DeviceState
@@ -19,8 +19,7 @@ export default function DeviceStatePanel(props: DeviceStatePanelProps) {
 
   const onClickRefresh = () => {
     setStatus({ msg: 'Refreshing state..', isError: false, showProgress: true })
-    return postJSON(`/v1/devices/${props.deviceId}/refresh_state`, { address: props.mainIp })
-      .then(res => res.json())
+    return runJob(`/v1/devices/${props.deviceId}/refresh_state`, { address: props.mainIp })
       .then(state => {
         setStatus(EmptyStatus)
         props.onStateRefresh(state)